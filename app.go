@@ -0,0 +1,432 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"golang.org/x/net/context"
+	"github.com/grpc-ecosystem/go-grpc-prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// App puts together everything described by Configurations. A typical main()
+// looks like:
+//
+//	app, err := backend_utils.NewApp("users", conf_path)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	app.WithPostgres().
+//		WithClientPools(heartbeats, 2).
+//		OnRegister(func(a *backend_utils.App) error {
+//			pb.RegisterUsersServer(a.Server, users.New(a.DB, a.Conf))
+//			return nil
+//		})
+//	log.Fatal(app.Run())
+type App struct {
+	Name		string
+	Conf		*Configurations
+	Logger		*LogUtil
+
+	// Populated by Run before the OnRegister hooks are called.
+	Server		*grpc.Server
+	Health		*health.Server
+	// Component health, mirrored to Health. Alerts per health_alerts.
+	// Postgres and the client pools report to it, see WatchDB and
+	// WatchPools.
+	HealthRegistry	*HealthRegistry
+	DB		*sql.DB
+	// Opened from fs_config with WithFileStore.
+	FileStore	FileStore
+	// Objects are moved here by archive_after retention rules, see
+	// WithArchiveStore.
+	ArchiveStore	FileStore
+
+	// Time given to in-flight calls on shutdown. Defaults to DEFAULT_HOOK_TIMEOUT.
+	DrainTimeout	time.Duration
+
+	use_db		bool
+	use_fs		bool
+	heartbeat_map	map[string] func(*grpc.ClientConn) error
+	conn_per_ep	int
+	http_handler	http.Handler
+	registrar	Registrar
+	instance	*ServiceInstance
+	register_funcs	[]func(*App) error
+	hooks		[]LifecycleHook
+}
+
+func NewApp(name, conf_path string) (*App, error) {
+
+	conf, err := ReadConfFile(conf_path)
+	if err != nil {
+		return nil, err
+	}
+	return newApp(name, conf, conf_path)
+}
+
+// ConfigChecked is the error of NewAppFromFlags with -check-config. main
+// is expected to print it and exit with ExitCode:
+//
+//	app, err := backend_utils.NewAppFromFlags("users", flags)
+//	if checked, ok := err.(*backend_utils.ConfigChecked); ok {
+//		fmt.Println(checked)
+//		os.Exit(checked.ExitCode)
+//	}
+type ConfigChecked struct {
+	Report		*ConfigReport
+	// 0 if all the checks passed.
+	ExitCode	int
+}
+
+// Error returns the report as indented JSON.
+func (c *ConfigChecked) Error() string {
+	buf, _ := json.MarshalIndent(c.Report, "", "  ")
+	return string(buf)
+}
+
+// NewAppFromFlags is NewApp with the config file, environment and
+// overrides taken from flags bound with BindConfigFlags. With -check-config
+// it runs ValidateOnly instead and returns the report as a *ConfigChecked.
+func NewAppFromFlags(name string, flags *ConfigFlags) (*App, error) {
+
+	if flags.CheckConfig {
+		checked := &ConfigChecked{Report: flags.ValidateOnly(0)}
+		if !checked.Report.OK {
+			checked.ExitCode = 1
+		}
+		return nil, checked
+	}
+
+	conf, err := flags.Load()
+	if err != nil {
+		return nil, err
+	}
+	return newApp(name, conf, flags.ConfPath)
+}
+
+func newApp(name string, conf *Configurations, conf_path string) (*App, error) {
+
+	if !conf.ServerConfig.Valid() {
+		return nil, errors.New("Invalid server config in " + conf_path)
+	}
+
+	app := &App{
+		Name: name,
+		Conf: conf,
+		Logger: InitLogger(name, conf.ServerConfig.LogLevel, true),
+	}
+	return app, nil
+}
+
+// Create the PostgresDB database if required and open it on Run.
+func (a *App) WithPostgres() *App {
+	a.use_db = true
+	return a
+}
+
+// Open the fs_config file store on Run, and apply its retention rules
+// every retention_interval till the App stops.
+func (a *App) WithFileStore() *App {
+	a.use_fs = true
+	return a
+}
+
+// Move objects to store when the fs_config retention rules archive them.
+func (a *App) WithArchiveStore(store FileStore) *App {
+	a.ArchiveStore = store
+	return a
+}
+
+// Create pools for all the client configs on Run.
+func (a *App) WithClientPools(heartbeat_map map[string] func(*grpc.ClientConn) error, conn_per_ep int) *App {
+	a.heartbeat_map = heartbeat_map
+	a.conn_per_ep = conn_per_ep
+	return a
+}
+
+// HTTP handler served next to gRPC when the server config has Multiplex set.
+func (a *App) WithHttpHandler(handler http.Handler) *App {
+	a.http_handler = handler
+	return a
+}
+
+// Announce the instance through r once the server listens, and withdraw it
+// before draining. inst defaults to LocalInstance of the server config.
+func (a *App) WithRegistrar(r Registrar, inst *ServiceInstance) *App {
+	a.registrar = r
+	a.instance = inst
+	return a
+}
+
+// Append adds a hook which is started after Postgres and the client pools
+// and before the server, e.g. to run migrations.
+func (a *App) Append(hook LifecycleHook) *App {
+	a.hooks = append(a.hooks, hook)
+	return a
+}
+
+// Hooks are called in order after the server is built and before it starts
+// listening. This is where services get registered.
+func (a *App) OnRegister(fn func(*App) error) *App {
+	a.register_funcs = append(a.register_funcs, fn)
+	return a
+}
+
+// Run starts the service and blocks till it fails or gets SIGINT/SIGTERM.
+// Error reporting is set up first, per error_reporting.
+//
+// Start order is Postgres, the file store, client pools, the hooks added
+// with Append, the OnRegister hooks, the server and then discovery
+// registration. Stopping goes the other way round: the instance is
+// deregistered, the server drains and the hooks are stopped in reverse.
+func (a *App) Run() error {
+
+	if err := a.Conf.ErrorReporting.Install(); err != nil {
+		return a.Logger.Error(err, "Failed setting up error reporting of %s", a.Name)
+	}
+	a.initHealth()
+	hooks := a.lifecycleHooks()
+
+	started, err := runStartHooks(hooks)
+	if err != nil {
+		return a.Logger.Error(err, "Failed starting %s", a.Name)
+	}
+
+	err = a.runServer()
+
+	errs := &LifecycleError{}
+	errs.add(err)
+	errs.add(runStopHooks(hooks[:started]))
+	if len(errs.Errs) > 0 {
+		return a.Logger.Error(errs, "Errors while running %s", a.Name)
+	}
+	return nil
+}
+
+func (a *App) lifecycleHooks() []LifecycleHook {
+
+	var hooks []LifecycleHook
+
+	if deps := a.Conf.Dependencies(a.Conf.WaitFor); len(deps) > 0 {
+		// WaitFor gives up at the longest dependency timeout, the hook
+		// timeout leaves room for its last check.
+		var longest time.Duration
+		for _, d := range deps {
+			if d.Timeout > longest {
+				longest = d.Timeout
+			}
+		}
+		hooks = append(hooks, LifecycleHook{
+			Name: "wait_for_dependencies",
+			OnStart: func(ctx context.Context) error {
+				return WaitFor(ctx, deps...)
+			},
+			Timeout: longest + DEPENDENCY_CHECK_TIMEOUT,
+		})
+	}
+
+	if a.use_db {
+		var unwatch func()
+		hooks = append(hooks, LifecycleHook{
+			Name: "postgres",
+			OnStart: func(ctx context.Context) (err error) {
+				a.DB, err = a.Conf.PostgresDB.CreatePQDB()
+				if err == nil {
+					unwatch = a.HealthRegistry.WatchDB(a.DB, 0)
+				}
+				return
+			},
+			OnStop: func(ctx context.Context) error {
+				unwatch()
+				return a.DB.Close()
+			},
+		})
+	}
+
+	if a.use_fs {
+		var retention *RetentionManager
+		hooks = append(hooks, LifecycleHook{
+			Name: "file_store",
+			OnStart: func(ctx context.Context) (err error) {
+				fs_conf := &a.Conf.FileStoreConfig
+				if a.FileStore, err = fs_conf.OpenFileStore(); err != nil {
+					return
+				}
+				if retention, err = fs_conf.NewRetentionManager(a.FileStore, a.ArchiveStore); err != nil {
+					return
+				}
+				if retention != nil {
+					retention.WithLogger(a.Logger).Start(fs_conf.retentionInterval())
+				}
+				return
+			},
+			OnStop: func(ctx context.Context) error {
+				if retention != nil {
+					retention.Stop()
+				}
+				return nil
+			},
+		})
+	}
+
+	if a.heartbeat_map != nil {
+		var unwatch func()
+		hooks = append(hooks, LifecycleHook{
+			Name: "client_pools",
+			OnStart: func(ctx context.Context) error {
+				err := a.Conf.CreateClientPool(a.heartbeat_map, a.conn_per_ep)
+				if err == nil {
+					unwatch = a.HealthRegistry.WatchPools(a.Conf)
+				}
+				return err
+			},
+			OnStop: func(ctx context.Context) error {
+				unwatch()
+				a.Conf.CloseClientPools()
+				return nil
+			},
+		})
+	}
+
+	return append(hooks, a.hooks...)
+}
+
+// initHealth sets up the health server and registry before the start hooks,
+// so that the components they start can report to it.
+func (a *App) initHealth() {
+	a.Health = health.NewServer()
+	a.HealthRegistry = NewHealthRegistry(a.Health)
+	if alerts := a.Conf.HealthAlerts; alerts.Enabled() {
+		var mailer MailerDaemonType
+		if len(alerts.Emails) > 0 {
+			mailer = a.Conf.Emailer.NewMailerDaemon()
+		}
+		NewHealthAlerter(a.Name, a.HealthRegistry, alerts, mailer).WithLogger(a.Logger)
+	}
+}
+
+func (a *App) runServer() error {
+
+	srv_conf := &a.Conf.ServerConfig
+	opts, err := srv_conf.GetServerOpts()
+	if err != nil {
+		return err
+	}
+
+	a.Server = grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(a.Server, a.Health)
+	RegisterInfoServer(a.Server)
+	if srv_conf.EnableChannelz {
+		RegisterChannelz(a.Server)
+	}
+
+	for _, fn := range a.register_funcs {
+		if err = fn(a); err != nil {
+			return err
+		}
+	}
+
+	errc := make(chan error, 2)
+	var metrics_srv *http.Server
+	if srv_conf.MetricsPort != 0 {
+		grpc_prometheus.Register(a.Server)
+		metrics_srv = srv_conf.MetricsServer(a.Conf.PoolDebugHandler())
+		go func() { errc <- metrics_srv.ListenAndServe() }()
+		defer func() {
+			if err := metrics_srv.Close(); err != nil {
+				a.Logger.Error(err, "Failed closing the metrics server")
+			}
+		}()
+	}
+
+	go func() { errc <- a.serve() }()
+	a.Health.Resume()
+	a.Logger.Info("%s", ReportBuildInfo(a.Name))
+	a.Logger.Info("%s listening on %s", a.Name, srv_conf.ListenAddr())
+
+	if a.registrar != nil {
+		if err = a.register(); err != nil {
+			a.Server.Stop()
+			return err
+		}
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	select {
+	case err = <-errc:
+		a.deregister()
+		a.Server.Stop()
+		return err
+	case sig := <-sigc:
+		a.Logger.Info("Received %s. Shutting down.", sig)
+	}
+
+	a.deregister()
+	a.Health.Shutdown()
+	return runHook("server", a.DrainTimeout, func(ctx context.Context) error {
+		stopped := make(chan struct{})
+		go func() {
+			a.Server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			a.Server.Stop()
+			return ctx.Err()
+		}
+	})
+}
+
+func (a *App) register() error {
+	if a.instance == nil {
+		inst, err := LocalInstance(a.Name, &a.Conf.ServerConfig)
+		if err != nil {
+			return err
+		}
+		a.instance = inst
+	}
+	return runHook("discovery register", 0, func(ctx context.Context) error {
+		return a.registrar.Register(ctx, a.instance)
+	})
+}
+
+// deregister withdraws the instance so that clients stop picking it before
+// it drains. Failing that only leaves it to the health checks.
+func (a *App) deregister() {
+	if a.registrar == nil || a.instance == nil {
+		return
+	}
+	err := runHook("discovery deregister", 0, func(ctx context.Context) error {
+		return a.registrar.Deregister(ctx, a.instance)
+	})
+	if err != nil {
+		a.Logger.Error(err, "Failed deregistering %s", a.Name)
+	}
+}
+
+func (a *App) serve() error {
+
+	srv_conf := &a.Conf.ServerConfig
+	if srv_conf.Multiplex {
+		return srv_conf.ServeMultiplexed(a.Server, a.http_handler)
+	}
+
+	lis, err := srv_conf.Listen()
+	if err != nil {
+		return err
+	}
+	return a.Server.Serve(lis)
+}
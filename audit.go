@@ -0,0 +1,342 @@
+package backend_utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Each record carries the hash of the previous one, so removing or editing
+// a record breaks the chain. See VerifyAuditChain.
+type AuditRecord struct {
+	Seq		uint64		`json:"seq"`
+	Time		time.Time	`json:"time"`
+	Subject		string		`json:"subject"`
+	Method		string		`json:"method"`
+	Resource	string		`json:"resource"`
+	Diff		string		`json:"diff"`
+	Peer		string		`json:"peer"`
+	Code		string		`json:"code"`
+	PrevHash	string		`json:"prev_hash"`
+	Hash		string		`json:"hash"`
+}
+
+// Requests implementing Auditable add the resource and change to the
+// records written by the audit interceptor.
+type Auditable interface {
+	AuditResource() string
+	AuditDiff() string
+}
+
+type AuditSink interface {
+	Append(rec *AuditRecord) error
+	// Last returns nil if there are no records yet.
+	Last() (*AuditRecord, error)
+	// Records returns up to limit records starting at sequence from.
+	Records(from uint64, limit int) ([]*AuditRecord, error)
+}
+
+func (r *AuditRecord) computeHash() string {
+	c := *r
+	c.Hash = ""
+	buf, _ := json.Marshal(&c)
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyAuditChain checks that recs are consecutive and unmodified. prev is
+// the record before recs[0], nil if recs starts at the beginning.
+func VerifyAuditChain(prev *AuditRecord, recs []*AuditRecord) error {
+	for _, r := range recs {
+		if prev != nil && (r.Seq != prev.Seq + 1 || r.PrevHash != prev.Hash) {
+			return fmt.Errorf("Audit chain broken at record %d", r.Seq)
+		}
+		if r.Hash != r.computeHash() {
+			return fmt.Errorf("Audit record %d modified", r.Seq)
+		}
+		prev = r
+	}
+	return nil
+}
+
+type AuditLogger struct {
+	mtx	sync.Mutex
+	sink	AuditSink
+	last	*AuditRecord
+	methods	map[string]bool
+}
+
+// NewAuditLogger records calls to methods, given as full method names, and
+// continues the chain already in sink.
+func NewAuditLogger(sink AuditSink, methods []string) (*AuditLogger, error) {
+	last, err := sink.Last()
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditLogger{sink: sink, last: last, methods: make(map[string]bool)}
+	for _, m := range methods {
+		a.methods[m] = true
+	}
+	return a, nil
+}
+
+// Times append retries when another writer took the sequence number.
+const AUDIT_APPEND_RETRIES = 5
+
+func (a *AuditLogger) append(rec *AuditRecord) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	// Postgres keeps microseconds, the hash has to survive the round trip.
+	rec.Time = rec.Time.Truncate(time.Microsecond)
+	var err error
+	for i := 0; i <= AUDIT_APPEND_RETRIES; i++ {
+		rec.Seq, rec.PrevHash = 0, ""
+		if a.last != nil {
+			rec.Seq = a.last.Seq + 1
+			rec.PrevHash = a.last.Hash
+		}
+		rec.Hash = rec.computeHash()
+		if err = a.sink.Append(rec); err == nil {
+			a.last = rec
+			return nil
+		}
+		// Other replicas writing to the same sink move the chain on.
+		// Continue from its end if that is why the append failed.
+		last, lerr := a.sink.Last()
+		if lerr != nil || !auditMoved(a.last, last) {
+			return err
+		}
+		a.last = last
+	}
+	return err
+}
+
+func auditMoved(cached, last *AuditRecord) bool {
+	if last == nil {
+		return false
+	}
+	return cached == nil || last.Seq != cached.Seq || last.Hash != cached.Hash
+}
+
+// Log records an action done outside of the interceptor. Subject and peer
+// are taken from ctx.
+func (a *AuditLogger) Log(ctx context.Context, method, resource, diff string) error {
+	return a.append(&AuditRecord{
+		Time: pkgClock().Now().UTC(),
+		Subject: jwtSubject(ctx),
+		Method: method,
+		Resource: resource,
+		Diff: diff,
+		Peer: peerAddr(ctx),
+	})
+}
+
+func jwtSubject(ctx context.Context) string {
+	token, ok := ctx.Value("jwt_token").(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+func peerAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
+
+// UnaryInterceptor writes a record after every call to the audited methods.
+// Calls fail with Internal if the record can't be written.
+func (a *AuditLogger) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+
+		if !a.methods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		resp, err := handler(ctx, req)
+
+		rec := &AuditRecord{
+			Time: pkgClock().Now().UTC(),
+			Subject: jwtSubject(ctx),
+			Method: info.FullMethod,
+			Peer: peerAddr(ctx),
+			Code: status.Code(err).String(),
+		}
+		if ar, ok := req.(Auditable); ok {
+			rec.Resource = ar.AuditResource()
+			rec.Diff = ar.AuditDiff()
+		}
+		if aerr := a.append(rec); aerr != nil {
+			return nil, ErrInternal("Failed writing audit record")
+		}
+		return resp, err
+	}
+}
+
+// PostgresAuditSink writes to the audit_log table. Call CreateTable once
+// before using it.
+type PostgresAuditSink struct {
+	db	*sql.DB
+}
+
+func NewPostgresAuditSink(db *sql.DB) *PostgresAuditSink {
+	return &PostgresAuditSink{db: db}
+}
+
+func (p *PostgresAuditSink) CreateTable() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS audit_log (
+		seq BIGINT PRIMARY KEY,
+		time TIMESTAMPTZ NOT NULL,
+		subject TEXT NOT NULL,
+		method TEXT NOT NULL,
+		resource TEXT NOT NULL,
+		diff TEXT NOT NULL,
+		peer TEXT NOT NULL,
+		code TEXT NOT NULL,
+		prev_hash TEXT NOT NULL,
+		hash TEXT NOT NULL)`)
+	return err
+}
+
+func (p *PostgresAuditSink) Append(r *AuditRecord) error {
+	_, err := p.db.Exec("INSERT INTO audit_log (seq, time, subject, method, resource, diff, peer, code, " +
+		"prev_hash, hash) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)", r.Seq, r.Time, r.Subject,
+		r.Method, r.Resource, r.Diff, r.Peer, r.Code, r.PrevHash, r.Hash)
+	return err
+}
+
+const auditColumns = "seq, time, subject, method, resource, diff, peer, code, prev_hash, hash"
+
+func scanAuditRecord(scan func(...interface{}) error) (*AuditRecord, error) {
+	r := new(AuditRecord)
+	err := scan(&r.Seq, &r.Time, &r.Subject, &r.Method, &r.Resource, &r.Diff, &r.Peer, &r.Code,
+		&r.PrevHash, &r.Hash)
+	if err != nil {
+		return nil, err
+	}
+	r.Time = r.Time.UTC()
+	return r, nil
+}
+
+func (p *PostgresAuditSink) Last() (*AuditRecord, error) {
+	row := p.db.QueryRow("SELECT " + auditColumns + " FROM audit_log ORDER BY seq DESC LIMIT 1")
+	r, err := scanAuditRecord(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+func (p *PostgresAuditSink) Records(from uint64, limit int) ([]*AuditRecord, error) {
+	rows, err := p.db.Query("SELECT " + auditColumns + " FROM audit_log WHERE seq >= $1 " +
+		"ORDER BY seq LIMIT $2", from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recs []*AuditRecord
+	for rows.Next() {
+		r, err := scanAuditRecord(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, r)
+	}
+	return recs, rows.Err()
+}
+
+// FileStoreAuditSink writes every record as its own object under prefix.
+// Objects are never overwritten.
+type FileStoreAuditSink struct {
+	fs	FileStore
+	prefix	string
+}
+
+func NewFileStoreAuditSink(fs FileStore, prefix string) *FileStoreAuditSink {
+	return &FileStoreAuditSink{fs: fs, prefix: prefix}
+}
+
+func (f *FileStoreAuditSink) name(seq uint64) string {
+	// Zero padded so that names sort in sequence order.
+	return fmt.Sprintf("%s%020d.json", f.prefix, seq)
+}
+
+func (f *FileStoreAuditSink) Append(r *AuditRecord) error {
+	if _, err := f.fs.Stat(f.name(r.Seq)); err == nil {
+		return fmt.Errorf("Audit record %d already exists", r.Seq)
+	}
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return f.fs.Put(f.name(r.Seq), bytes.NewReader(buf))
+}
+
+func (f *FileStoreAuditSink) read(name string) (*AuditRecord, error) {
+	rd, err := f.fs.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	r := new(AuditRecord)
+	return r, json.NewDecoder(rd).Decode(r)
+}
+
+func (f *FileStoreAuditSink) names() ([]string, error) {
+	objs, err := f.fs.List(f.prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(objs))
+	for i := range objs {
+		names[i] = objs[i].Name
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *FileStoreAuditSink) Last() (*AuditRecord, error) {
+	names, err := f.names()
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	return f.read(names[len(names)-1])
+}
+
+func (f *FileStoreAuditSink) Records(from uint64, limit int) ([]*AuditRecord, error) {
+	names, err := f.names()
+	if err != nil {
+		return nil, err
+	}
+	start := sort.SearchStrings(names, f.name(from))
+	var recs []*AuditRecord
+	for i := start; i < len(names) && len(recs) < limit; i++ {
+		r, err := f.read(names[i])
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, r)
+	}
+	return recs, nil
+}
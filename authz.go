@@ -0,0 +1,127 @@
+package backend_utils
+
+import (
+	"strings"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// AuthzConfig is a service-to-service authorization matrix: which callers
+// may call which methods. Calls not allowed by any rule are rejected with
+// PermissionDenied.
+type AuthzConfig struct {
+	Enabled		bool		`json:"enabled"`
+	// JWT claim naming the calling service. Defaults to "sub".
+	Claim		string		`json:"claim"`
+	Rules		[]AuthzRule	`json:"rules"`
+	// Methods anybody may call, e.g. the health checks. Same syntax as
+	// AuthzRule.Methods.
+	PublicMethods	[]string	`json:"public_methods"`
+	// Only log the calls which would be denied, to roll out new rules.
+	DryRun		bool		`json:"dry_run"`
+}
+
+// AuthzRule allows its callers to call its methods.
+type AuthzRule struct {
+	// Caller identities: a URI or DNS SAN of the client certificate, e.g. a
+	// SPIFFE ID, or the value of the JWT claim. A prefix ending in "/"
+	// matches all the identities under it, "*" any identified caller.
+	Callers		[]string	`json:"callers"`
+	// Full method names, a prefix of one ending in "/" or "*" for all.
+	Methods		[]string	`json:"methods"`
+}
+
+// CallerIdentities returns the identities of the caller: the URI and DNS
+// SANs of its verified client certificate, then the claim of its JWT.
+func CallerIdentities(ctx context.Context, claim string) []string {
+	var ids []string
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			cert := info.State.VerifiedChains[0][0]
+			for _, u := range cert.URIs {
+				ids = append(ids, u.String())
+			}
+			ids = append(ids, cert.DNSNames...)
+		}
+	}
+	if len(claim) == 0 {
+		claim = "sub"
+	}
+	if token, ok := ctx.Value("jwt_token").(*jwt.Token); ok {
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			if id, _ := claims[claim].(string); len(id) > 0 {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func matchesPattern(pattern, s string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "/"):
+		return strings.HasPrefix(s, pattern)
+	}
+	return pattern == s
+}
+
+func matchesAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if matchesPattern(p, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks the caller in ctx against the matrix.
+func (a *AuthzConfig) Authorize(ctx context.Context, method string) error {
+	if matchesAny(a.PublicMethods, method) {
+		return nil
+	}
+	ids := CallerIdentities(ctx, a.Claim)
+	for i := range a.Rules {
+		if !matchesAny(a.Rules[i].Methods, method) {
+			continue
+		}
+		for _, id := range ids {
+			if matchesAny(a.Rules[i].Callers, id) {
+				return nil
+			}
+		}
+	}
+
+	if a.DryRun {
+		pkgLog().Infof("Authz dry run: would deny %v calling %s", ids, method)
+		return nil
+	}
+	if len(ids) == 0 {
+		return ErrUnauthenticated("Caller not identified")
+	}
+	return ErrPermissionDenied("Caller not allowed to call %s", method)
+}
+
+func (a *AuthzConfig) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if err := a.Authorize(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (a *AuthzConfig) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		if err := a.Authorize(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,135 @@
+package backend_utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// PolicyInput is what an AuthorizationPolicy decides on.
+type PolicyInput struct {
+	Method		string			`json:"method"`
+	// Claims of the caller's JWT, if any.
+	Claims		map[string]interface{}	`json:"claims,omitempty"`
+	// Incoming metadata, without the authorization header.
+	Metadata	map[string][]string	`json:"metadata,omitempty"`
+	// See CallerIdentities.
+	Callers		[]string		`json:"callers,omitempty"`
+	Tenant		string			`json:"tenant,omitempty"`
+}
+
+// AuthorizationPolicy decides whether a call is allowed, so that complex
+// rules can live in a policy engine instead of the handlers. An error
+// fails the call with Unavailable.
+type AuthorizationPolicy interface {
+	Allow(ctx context.Context, input *PolicyInput) (bool, error)
+}
+
+type AuthorizationPolicyFunc func(ctx context.Context, input *PolicyInput) (bool, error)
+
+func (f AuthorizationPolicyFunc) Allow(ctx context.Context, input *PolicyInput) (bool, error) {
+	return f(ctx, input)
+}
+
+func policyInput(ctx context.Context, method string) *PolicyInput {
+	in := &PolicyInput{Method: method, Callers: CallerIdentities(ctx, "")}
+	if token, ok := ctx.Value("jwt_token").(*jwt.Token); ok {
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			in.Claims = claims
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		in.Metadata = make(map[string][]string, len(md))
+		for k, v := range md {
+			if k != "authorization" {
+				in.Metadata[k] = v
+			}
+		}
+	}
+	in.Tenant, _ = TenantFromContext(ctx)
+	return in
+}
+
+func authorize(ctx context.Context, p AuthorizationPolicy, method string) error {
+	allowed, err := p.Allow(ctx, policyInput(ctx, method))
+	if err != nil {
+		pkgLog().Errorf("Authorization policy failed on %s. Err:%s", method, err.Error())
+		return ErrUnavailable("Authorization policy unavailable")
+	}
+	if !allowed {
+		return ErrPermissionDenied("Denied by policy")
+	}
+	return nil
+}
+
+func PolicyUnaryInterceptor(p AuthorizationPolicy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if err := authorize(ctx, p, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func PolicyStreamInterceptor(p AuthorizationPolicy) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		if err := authorize(ss.Context(), p, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// OpaPolicy asks an OPA server for the decision, passing the PolicyInput as
+// the rego input. The decision has to be a boolean, an undefined one
+// denies.
+type OpaPolicy struct {
+	url	string
+	client	*http.Client
+}
+
+// NewOpaPolicy queries the decision at path, e.g. "authz/allow", of the OPA
+// server at addr, e.g. "http://localhost:8181".
+func NewOpaPolicy(addr, path string) *OpaPolicy {
+	return &OpaPolicy{
+		url: strings.TrimSuffix(addr, "/") + "/v1/data/" + strings.Trim(path, "/"),
+		client: &http.Client{Timeout: 2 * time.Second},
+	}
+}
+
+func (o *OpaPolicy) Allow(ctx context.Context, input *PolicyInput) (bool, error) {
+	buf, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(buf))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("OPA returned %s", resp.Status)
+	}
+	var decision struct {
+		Result	*bool	`json:"result"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, err
+	}
+	return decision.Result != nil && *decision.Result, nil
+}
@@ -0,0 +1,134 @@
+package backend_utils
+
+import (
+	"runtime"
+	"sync"
+	"github.com/golang/protobuf/ptypes/empty"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Set at link time, e.g.
+//
+//	go build -ldflags "-X github.com/aloknerurkar/backend_utils.BuildVersion=1.4.0
+//		-X github.com/aloknerurkar/backend_utils.BuildGitSHA=$(git rev-parse HEAD)
+//		-X github.com/aloknerurkar/backend_utils.BuildTime=$(date -u +%FT%TZ)"
+//
+// or with SetBuildInfo.
+var (
+	BuildVersion	string
+	BuildGitSHA	string
+	BuildTime	string
+)
+
+type BuildInfo struct {
+	Version		string	`json:"version"`
+	GitSHA		string	`json:"git_sha"`
+	BuildTime	string	`json:"build_time"`
+	GoVersion	string	`json:"go_version"`
+}
+
+var buildInfoGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backend_utils_build_info",
+	Help: "Always 1, labelled with the build of the running binary.",
+}, []string{"version", "git_sha", "build_time", "go_version"})
+
+func init() {
+	prometheus.MustRegister(buildInfoGauge)
+}
+
+var buildInfoMtx sync.Mutex
+
+// SetBuildInfo overrides the link time build variables.
+func SetBuildInfo(info BuildInfo) {
+	buildInfoMtx.Lock()
+	defer buildInfoMtx.Unlock()
+
+	BuildVersion = info.Version
+	BuildGitSHA = info.GitSHA
+	BuildTime = info.BuildTime
+}
+
+func GetBuildInfo() BuildInfo {
+	buildInfoMtx.Lock()
+	defer buildInfoMtx.Unlock()
+
+	info := BuildInfo{
+		Version: BuildVersion,
+		GitSHA: BuildGitSHA,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+	if len(info.Version) == 0 {
+		info.Version = "unknown"
+	}
+	return info
+}
+
+// ReportBuildInfo sets the build_info metric and returns a banner line for
+// the startup log.
+func ReportBuildInfo(name string) string {
+	info := GetBuildInfo()
+	buildInfoGauge.Reset()
+	buildInfoGauge.WithLabelValues(info.Version, info.GitSHA, info.BuildTime, info.GoVersion).Set(1)
+	return name + " version " + info.Version + " (git " + info.GitSHA + ", built " + info.BuildTime +
+		", " + info.GoVersion + ")"
+}
+
+// InfoServer serves backend_utils.Info/GetBuildInfo, returning the
+// BuildInfo as a google.protobuf.Struct. No generated code is needed on
+// either side, e.g. grpcurl -d '{}' host:port backend_utils.Info/GetBuildInfo.
+type InfoServer interface {
+	GetBuildInfo(context.Context, *empty.Empty) (*structpb.Struct, error)
+}
+
+type infoServer struct{}
+
+func (infoServer) GetBuildInfo(ctx context.Context, _ *empty.Empty) (*structpb.Struct, error) {
+	info := GetBuildInfo()
+	str := func(s string) *structpb.Value {
+		return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: s}}
+	}
+	return &structpb.Struct{Fields: map[string]*structpb.Value{
+		"version": str(info.Version),
+		"git_sha": str(info.GitSHA),
+		"build_time": str(info.BuildTime),
+		"go_version": str(info.GoVersion),
+	}}, nil
+}
+
+func getBuildInfoHandler(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	in := new(empty.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(InfoServer).GetBuildInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server: srv,
+		FullMethod: "/backend_utils.Info/GetBuildInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(InfoServer).GetBuildInfo(ctx, req.(*empty.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var infoServiceDesc = grpc.ServiceDesc{
+	ServiceName: "backend_utils.Info",
+	HandlerType: (*InfoServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetBuildInfo", Handler: getBuildInfoHandler},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// RegisterInfoServer adds the Info service to s.
+func RegisterInfoServer(s *grpc.Server) {
+	s.RegisterService(&infoServiceDesc, infoServer{})
+}
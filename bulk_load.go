@@ -0,0 +1,478 @@
+package backend_utils
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Format of newline separated JSON objects, for BulkLoadOptions.
+	IMPORT_JSONL = "jsonl"
+
+	DEFAULT_LOAD_BATCH = 5000
+)
+
+var ErrTooManyBadRows = errors.New("Too many bad rows.")
+
+type BulkLoadOptions struct {
+	// EXPORT_CSV or IMPORT_JSONL.
+	Format		string
+	// Columns loaded. CSV objects default to their header line, JSONL ones
+	// need them since the keys are looked up by column name.
+	Columns		[]string
+	// The CSV object has no header line.
+	NoHeader	bool
+	// CSV fields equal to this are loaded as NULL. Defaults to empty
+	// fields, as COPY does.
+	NullString	string
+	// Rows per transaction. A failed load resumes after the last batch
+	// committed. Defaults to DEFAULT_LOAD_BATCH.
+	BatchRows	int
+	// Bad rows are written to this object of the store instead of failing
+	// the load, at most MaxBadRows of them, 0 for no limit. The object is
+	// rewritten before every checkpoint, so it holds the bad rows of the
+	// batches committed, including the ones of earlier runs of the job.
+	QuarantineObject string
+	MaxBadRows	int
+	// Loads with a JobID keep a checkpoint and skip the rows loaded by an
+	// earlier run of the same job.
+	JobID		string
+	// Called after every batch.
+	Progress	func(BulkLoadProgress)
+}
+
+type BulkLoadProgress struct {
+	Object		string
+	// Records read so far, bad ones and the ones skipped on resume
+	// included.
+	Records		int64
+	Loaded		int64
+	BadRows		int64
+}
+
+// QuarantinedRow is a line of the quarantine object.
+type QuarantinedRow struct {
+	// Index of the record in the object, from 0.
+	Record	int64		`json:"record"`
+	Error	string		`json:"error"`
+	Values	[]interface{}	`json:"values,omitempty"`
+}
+
+// BulkLoader loads CSV or JSONL objects of a FileStore into Postgres
+// tables using COPY.
+type BulkLoader struct {
+	db	*sql.DB
+	store	FileStore
+}
+
+func NewBulkLoader(db *sql.DB, store FileStore) *BulkLoader {
+	return &BulkLoader{db: db, store: store}
+}
+
+func (l *BulkLoader) CreateTable() error {
+	_, err := l.db.Exec(`CREATE TABLE IF NOT EXISTS bulk_load_checkpoints (
+		job_id TEXT PRIMARY KEY,
+		object TEXT NOT NULL,
+		records BIGINT NOT NULL,
+		loaded BIGINT NOT NULL,
+		updated TIMESTAMPTZ NOT NULL DEFAULT now())`)
+	return err
+}
+
+// badRow is returned by the readers for records which can't be parsed.
+// Reading goes on after it.
+type badRow struct {
+	err	error
+	vals	[]interface{}
+}
+
+func (b *badRow) Error() string { return b.err.Error() }
+
+type rowReader interface {
+	next() ([]interface{}, error)
+}
+
+type csvRowReader struct {
+	r	*csv.Reader
+	null	string
+}
+
+func (c *csvRowReader) next() ([]interface{}, error) {
+	rec, err := c.r.Read()
+	vals := make([]interface{}, len(rec))
+	for i := range rec {
+		if rec[i] != c.null {
+			vals[i] = rec[i]
+		}
+	}
+	if _, ok := err.(*csv.ParseError); ok {
+		return nil, &badRow{err: err, vals: vals}
+	}
+	return vals, err
+}
+
+type jsonlRowReader struct {
+	r	*bufio.Reader
+	cols	[]string
+}
+
+func (j *jsonlRowReader) next() ([]interface{}, error) {
+	var line []byte
+	for len(bytes.TrimSpace(line)) == 0 {
+		var err error
+		line, err = j.r.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, &badRow{err: err, vals: []interface{}{string(line)}}
+	}
+	vals := make([]interface{}, len(j.cols))
+	for i, col := range j.cols {
+		switch v := obj[col].(type) {
+		case nil:
+		case string:
+			vals[i] = v
+		case json.Number:
+			vals[i] = v.String()
+		case bool:
+			vals[i] = v
+		default:
+			// Objects and arrays go into json columns as is.
+			buf, _ := json.Marshal(v)
+			vals[i] = string(buf)
+		}
+	}
+	return vals, nil
+}
+
+func copyStmt(table string, cols []string) (string, error) {
+	for _, col := range cols {
+		if err := ValidateIdent(col); err != nil {
+			return "", fmt.Errorf("Invalid column %q", col)
+		}
+	}
+	parts := strings.Split(table, ".")
+	for _, p := range parts {
+		if err := ValidateIdent(p); err != nil {
+			return "", fmt.Errorf("Invalid table %q", table)
+		}
+	}
+	if len(parts) == 2 {
+		return pq.CopyInSchema(parts[0], parts[1], cols...), nil
+	}
+	return pq.CopyIn(table, cols...), nil
+}
+
+func insertStmt(table string, cols []string) string {
+	quoted := make([]string, len(cols))
+	params := make([]string, len(cols))
+	for i := range cols {
+		quoted[i] = QuoteIdent(cols[i])
+		params[i] = fmt.Sprintf("$%d", i + 1)
+	}
+	return "INSERT INTO " + QuoteQualifiedIdent(table) + " (" + strings.Join(quoted, ", ") +
+		") VALUES (" + strings.Join(params, ", ") + ")"
+}
+
+type loadRow struct {
+	record	int64
+	vals	[]interface{}
+}
+
+// Load streams object into table. Rows which can't be parsed, or which
+// Postgres rejects, go to the quarantine object if one is set.
+func (l *BulkLoader) Load(ctx context.Context, object, table string, opts BulkLoadOptions) (prog BulkLoadProgress,
+	err error) {
+
+	prog = BulkLoadProgress{Object: object}
+	batch_rows := opts.BatchRows
+	if batch_rows <= 0 {
+		batch_rows = DEFAULT_LOAD_BATCH
+	}
+
+	obj, err := l.store.Get(object)
+	if err != nil {
+		return prog, err
+	}
+	defer obj.Close()
+
+	cols := opts.Columns
+	var rows rowReader
+	switch opts.Format {
+	case EXPORT_CSV:
+		r := csv.NewReader(bufio.NewReader(obj))
+		if !opts.NoHeader {
+			header, err := r.Read()
+			if err != nil {
+				return prog, err
+			}
+			if len(cols) == 0 {
+				cols = header
+			}
+		}
+		r.FieldsPerRecord = len(cols)
+		rows = &csvRowReader{r: r, null: opts.NullString}
+	case IMPORT_JSONL:
+		rows = &jsonlRowReader{r: bufio.NewReader(obj), cols: cols}
+	default:
+		return prog, fmt.Errorf("Unknown import format %s", opts.Format)
+	}
+	if len(cols) == 0 {
+		return prog, errors.New("No columns to load")
+	}
+	copy_stmt, err := copyStmt(table, cols)
+	if err != nil {
+		return prog, err
+	}
+
+	var skip int64
+	if len(opts.JobID) > 0 {
+		skip, prog.Loaded, err = l.checkpoint(opts.JobID, object)
+		if err != nil {
+			return prog, err
+		}
+	}
+
+	var quarantined []QuarantinedRow
+	if skip > 0 && len(opts.QuarantineObject) > 0 {
+		// The rows an earlier run quarantined before its checkpoint.
+		if quarantined, err = l.readQuarantine(opts.QuarantineObject, skip); err != nil {
+			return prog, err
+		}
+		prog.BadRows = int64(len(quarantined))
+	}
+	dirty := false
+	quarantine := func(record int64, err error, vals []interface{}) error {
+		prog.BadRows++
+		if len(opts.QuarantineObject) == 0 {
+			return fmt.Errorf("Bad record %d: %s", record, err.Error())
+		}
+		if opts.MaxBadRows > 0 && prog.BadRows > int64(opts.MaxBadRows) {
+			return ErrTooManyBadRows
+		}
+		quarantined = append(quarantined, QuarantinedRow{Record: record, Error: err.Error(), Values: vals})
+		dirty = true
+		return nil
+	}
+	flush := func() error {
+		if !dirty {
+			return nil
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for i := range quarantined {
+			enc.Encode(&quarantined[i])
+		}
+		if err := l.store.Put(opts.QuarantineObject, &buf); err != nil {
+			return err
+		}
+		dirty = false
+		return nil
+	}
+	// Bad rows found before failing are kept too. Those past the
+	// checkpoint are dropped on resume, as their records are read again.
+	defer func() {
+		if ferr := flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}()
+
+	batch := make([]loadRow, 0, batch_rows)
+	for done := false; !done; {
+		batch = batch[:0]
+		for len(batch) < batch_rows {
+			vals, err := rows.next()
+			if err == io.EOF {
+				done = true
+				break
+			}
+			record := prog.Records
+			prog.Records++
+			if bad, ok := err.(*badRow); ok {
+				if record < skip {
+					continue
+				}
+				if err = quarantine(record, bad.err, bad.vals); err != nil {
+					return prog, err
+				}
+				continue
+			}
+			if err != nil {
+				return prog, err
+			}
+			if record >= skip {
+				batch = append(batch, loadRow{record: record, vals: vals})
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		loaded, err := l.loadBatch(ctx, copy_stmt, table, cols, batch, opts.JobID, object, prog,
+			quarantine, flush)
+		if err != nil {
+			return prog, err
+		}
+		prog.Loaded += loaded
+		if opts.Progress != nil {
+			opts.Progress(prog)
+		}
+	}
+	return prog, nil
+}
+
+// readQuarantine returns the rows of the quarantine object from before
+// record skip. A missing object has none.
+func (l *BulkLoader) readQuarantine(name string, skip int64) ([]QuarantinedRow, error) {
+	if _, err := l.store.Stat(name); err != nil {
+		return nil, nil
+	}
+	rd, err := l.store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	var rows []QuarantinedRow
+	dec := json.NewDecoder(rd)
+	for {
+		var row QuarantinedRow
+		if err = dec.Decode(&row); err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if row.Record < skip {
+			rows = append(rows, row)
+		}
+	}
+}
+
+// loadBatch copies batch in one transaction, along with the checkpoint. If
+// Postgres rejects the batch, its rows are inserted one by one instead so
+// that only the bad ones are quarantined. flush writes the quarantine out
+// before the checkpoint is saved.
+func (l *BulkLoader) loadBatch(ctx context.Context, copy_stmt, table string, cols []string, batch []loadRow,
+	job_id, object string, prog BulkLoadProgress,
+	quarantine func(int64, error, []interface{}) error, flush func() error) (int64, error) {
+
+	err := l.inTx(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, copy_stmt)
+		if err != nil {
+			return err
+		}
+		for _, row := range batch {
+			if _, err = stmt.ExecContext(ctx, row.vals...); err != nil {
+				stmt.Close()
+				return err
+			}
+		}
+		if _, err = stmt.ExecContext(ctx); err != nil {
+			stmt.Close()
+			return err
+		}
+		if err = stmt.Close(); err != nil {
+			return err
+		}
+		if err = flush(); err != nil {
+			return err
+		}
+		return l.saveCheckpoint(ctx, tx, job_id, object, prog.Records, prog.Loaded + int64(len(batch)))
+	})
+	if err == nil {
+		return int64(len(batch)), nil
+	}
+	if _, ok := err.(*pq.Error); !ok {
+		return 0, err
+	}
+
+	var loaded int64
+	insert := insertStmt(table, cols)
+	err = l.inTx(ctx, func(tx *sql.Tx) error {
+		loaded = 0
+		for _, row := range batch {
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT bulk_row"); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, insert, row.vals...); err != nil {
+				if _, rerr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT bulk_row"); rerr != nil {
+					return rerr
+				}
+				if qerr := quarantine(row.record, err, row.vals); qerr != nil {
+					return qerr
+				}
+				continue
+			}
+			loaded++
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		return l.saveCheckpoint(ctx, tx, job_id, object, prog.Records, prog.Loaded + loaded)
+	})
+	return loaded, err
+}
+
+func (l *BulkLoader) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkpoint returns the records read and rows loaded by earlier runs of
+// the job.
+func (l *BulkLoader) checkpoint(job_id, object string) (records, loaded int64, err error) {
+	var prev_object string
+	err = l.db.QueryRow("SELECT object, records, loaded FROM bulk_load_checkpoints WHERE job_id = $1",
+		job_id).Scan(&prev_object, &records, &loaded)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	if err == nil && prev_object != object {
+		err = fmt.Errorf("Job %s was loading %s", job_id, prev_object)
+	}
+	return
+}
+
+func (l *BulkLoader) saveCheckpoint(ctx context.Context, tx *sql.Tx, job_id, object string, records, loaded int64) error {
+	if len(job_id) == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO bulk_load_checkpoints (job_id, object, records, loaded)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (job_id) DO UPDATE
+		SET records = EXCLUDED.records, loaded = EXCLUDED.loaded, updated = now()`,
+		job_id, object, records, loaded)
+	return err
+}
+
+// ClearCheckpoint forgets the progress of job_id, e.g. once the load is
+// verified, so the ID can be reused.
+func (l *BulkLoader) ClearCheckpoint(job_id string) error {
+	_, err := l.db.Exec("DELETE FROM bulk_load_checkpoints WHERE job_id = $1", job_id)
+	return err
+}
@@ -0,0 +1,117 @@
+package backend_utils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var ErrCacheMiss = errors.New("Cache miss.")
+
+type Cache interface {
+	// Get returns ErrCacheMiss if key is not present or has expired.
+	Get(key string) ([]byte, error)
+	// A ttl of 0 means the entry does not expire.
+	Set(key string, val []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+type memEntry struct {
+	val	[]byte
+	expiry	time.Time
+}
+
+// MemoryCache is a Cache local to the process. Expired entries are removed
+// when they are read.
+type MemoryCache struct {
+	mtx	sync.Mutex
+	entries	map[string] memEntry
+	clock	Clock
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string] memEntry)}
+}
+
+// WithClock expires entries by c instead of the package clock.
+func (m *MemoryCache) WithClock(c Clock) *MemoryCache {
+	m.clock = c
+	return m
+}
+
+func (m *MemoryCache) Get(key string) ([]byte, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	if !e.expiry.IsZero() && clockOr(m.clock).Now().After(e.expiry) {
+		delete(m.entries, key)
+		return nil, ErrCacheMiss
+	}
+	return e.val, nil
+}
+
+func (m *MemoryCache) Set(key string, val []byte, ttl time.Duration) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	e := memEntry{val: val}
+	if ttl > 0 {
+		e.expiry = clockOr(m.clock).Now().Add(ttl)
+	}
+	m.entries[key] = e
+	return nil
+}
+
+func (m *MemoryCache) Delete(key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+var fillCoalescer = NewCoalescer()
+
+// GetOrFill returns key from cache, calling fill on a miss and caching
+// what it returns for ttl. Concurrent misses of a key in the process share
+// one fill. Errors of the cache itself are logged and treated as misses.
+func GetOrFill(cache Cache, key string, ttl time.Duration, fill func() ([]byte, error)) ([]byte, error) {
+	return GetOrFillContext(context.Background(), cache, key, ttl, func(context.Context) ([]byte, error) {
+		return fill()
+	})
+}
+
+// GetOrFillContext is GetOrFill with fill run under the ctx of the caller
+// running it. Callers waiting for another's fill give up when their ctx is
+// done, and fill again if that one failed because its ctx was done, see
+// Coalescer.DoContext.
+func GetOrFillContext(ctx context.Context, cache Cache, key string, ttl time.Duration,
+	fill func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+
+	if val, err := cache.Get(key); err == nil {
+		return val, nil
+	} else if err != ErrCacheMiss {
+		pkgLog().Errorf("Cache lookup of %s failed. Err:%s", key, err.Error())
+	}
+	// Keyed by the cache as well, so that caches sharing key names don't
+	// share fills.
+	val, err, _ := fillCoalescer.DoContext(ctx, fmt.Sprintf("%p\x00%s", cache, key),
+		func(ctx context.Context) (interface{}, error) {
+			val, err := fill(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if err = cache.Set(key, val, ttl); err != nil {
+				pkgLog().Errorf("Failed to cache %s. Err:%s", key, err.Error())
+			}
+			return val, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]byte), nil
+}
@@ -0,0 +1,88 @@
+package backend_utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrCertNotPinned = errors.New("Server certificate matches none of the pinned hashes.")
+
+// parsePin accepts a SHA-256 hash in hex, with or without colons, or in
+// base64 as used by HPKP ("sha256/..." prefix optional).
+func parsePin(pin string) ([]byte, error) {
+	if b, err := hex.DecodeString(strings.Replace(pin, ":", "", -1)); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/")); err == nil &&
+		len(b) == sha256.Size {
+		return b, nil
+	}
+	return nil, fmt.Errorf("Invalid pinned SHA-256 %q", pin)
+}
+
+// pinVerifier checks that the hash of the server's leaf certificate, or of
+// its public key (SPKI), is one of pins.
+func pinVerifier(pins []string) (func([][]byte, [][]*x509.Certificate) error, error) {
+
+	hashes := make([][]byte, 0, len(pins))
+	for _, p := range pins {
+		h, err := parsePin(p)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+
+	return func(raw_certs [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw_certs) == 0 {
+			return ErrCertNotPinned
+		}
+		leaf, err := x509.ParseCertificate(raw_certs[0])
+		if err != nil {
+			return err
+		}
+		cert_sum := sha256.Sum256(leaf.Raw)
+		spki_sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		for _, h := range hashes {
+			if bytes.Equal(h, cert_sum[:]) || bytes.Equal(h, spki_sum[:]) {
+				return nil
+			}
+		}
+		return ErrCertNotPinned
+	}, nil
+}
+
+// applyPins adds the pin check to conf, after the VerifyPeerCertificate
+// already set, e.g. by SPIFFE. With pin_only the CA chain and the host name
+// are not verified, the pin alone is trusted. Without it InsecureSkipVerify
+// is left as it is, as SPIFFE sets it and verifies the chain itself.
+func applyPins(conf *tls.Config, pins []string, pin_only bool) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	verify, err := pinVerifier(pins)
+	if err != nil {
+		return err
+	}
+	if prev := conf.VerifyPeerCertificate; prev != nil {
+		conf.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			if err := prev(raw, chains); err != nil {
+				return err
+			}
+			return verify(raw, chains)
+		}
+	} else {
+		conf.VerifyPeerCertificate = verify
+	}
+	if pin_only {
+		conf.InsecureSkipVerify = true
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package backend_utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+	"google.golang.org/grpc"
+	channelz "google.golang.org/grpc/channelz/service"
+)
+
+// RegisterChannelz adds the channelz service to s. It reports on all the
+// connections of the process, the pools' client connections included, for
+// tools like grpcdebug or grpcurl.
+func RegisterChannelz(s *grpc.Server) {
+	channelz.RegisterChannelzServiceToServer(s)
+}
+
+// PoolConnState describes a connection of a pool.
+type PoolConnState struct {
+	Endpoint	string		`json:"endpoint"`
+	Target		string		`json:"target"`
+	// Connectivity state, e.g. READY or TRANSIENT_FAILURE.
+	State		string		`json:"state"`
+	Idle		bool		`json:"idle"`
+	Expires		time.Time	`json:"expires,omitempty"`
+	LastUsed	time.Time	`json:"last_used"`
+	LastChecked	time.Time	`json:"last_checked,omitempty"`
+}
+
+// ConnStates returns the state of all the connections of the pool, idle or
+// handed out.
+func (r *RpcClientPool) ConnStates() []PoolConnState {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	states := make([]PoolConnState, 0, len(r.conn_endpoints))
+	for conn, ep := range r.conn_endpoints {
+		s := PoolConnState{
+			Endpoint: fmt.Sprintf("%+v", r.endpoints_map[ep]),
+			Target: conn.Target(),
+			State: conn.GetState().String(),
+		}
+		if info, ok := r.conn_info[conn]; ok {
+			s.Idle = !info.in_use
+			s.Expires = info.expires
+			s.LastUsed = info.last_used
+			s.LastChecked = info.last_checked
+		}
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Target < states[j].Target })
+	return states
+}
+
+// PoolStates returns the connection states of the config's pools, keyed by
+// service name.
+func (c *Configurations) PoolStates() map[string] []PoolConnState {
+	c.pools_mtx.RLock()
+	pools := make(map[string] *RpcClientPool, len(c.client_map))
+	for svc, pool := range c.client_map {
+		pools[svc] = pool
+	}
+	c.pools_mtx.RUnlock()
+	states := make(map[string] []PoolConnState, len(pools))
+	for svc, pool := range pools {
+		states[svc] = pool.ConnStates()
+	}
+	return states
+}
+
+// PoolDebugHandler serves PoolStates as JSON, e.g. next to the metrics
+// under /debug/pools.
+func (c *Configurations) PoolDebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(c.PoolStates())
+	})
+}
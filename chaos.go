@@ -0,0 +1,117 @@
+package backend_utils
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ChaosConfig injects faults into calls to test how callers cope. Nothing
+// is injected unless Enabled is set.
+type ChaosConfig struct {
+	Enabled	bool		`json:"enabled"`
+	Rules	[]ChaosRule	`json:"rules"`
+}
+
+// ChaosRule applies to Percent of the calls to the methods it matches.
+type ChaosRule struct {
+	// Full method name, a prefix of it ending in "/" or "*" for all.
+	Method		string		`json:"method"`
+	Percent		float64		`json:"percent"`
+	// Delay added before the call.
+	Latency		Duration	`json:"latency"`
+	// Fail the call with this code, e.g. "UNAVAILABLE", after the delay.
+	Code		codes.Code	`json:"code"`
+	// Fail the call the way a reset connection does. There is no way to
+	// reset the actual connection from an interceptor, so this returns the
+	// Unavailable error callers see on one.
+	Reset		bool		`json:"reset"`
+}
+
+func (r *ChaosRule) matches(method string) bool {
+	switch {
+	case r.Method == "*":
+		return true
+	case strings.HasSuffix(r.Method, "/"):
+		return strings.HasPrefix(method, r.Method)
+	}
+	return r.Method == method
+}
+
+// inject applies the first matching rule which fires. It returns the error
+// to fail the call with, if any.
+func (c *ChaosConfig) inject(ctx context.Context, method string) error {
+
+	if c == nil || !c.Enabled {
+		return nil
+	}
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if !r.matches(method) || rand.Float64() * 100 >= r.Percent {
+			continue
+		}
+		pkgLog().Infof("Chaos: injecting fault into %s", method)
+		if r.Latency.Duration > 0 {
+			select {
+			case <-time.After(r.Latency.Duration):
+			case <-ctx.Done():
+				if ctx.Err() == context.Canceled {
+					return status.Error(codes.Canceled, ctx.Err().Error())
+				}
+				return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+			}
+		}
+		if r.Reset {
+			return status.Error(codes.Unavailable, "transport is closing")
+		}
+		if r.Code != codes.OK {
+			return status.Errorf(r.Code, "Chaos: injected %s", r.Code)
+		}
+		return nil
+	}
+	return nil
+}
+
+func (c *ChaosConfig) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if err := c.inject(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (c *ChaosConfig) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		if err := c.inject(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func (c *ChaosConfig) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if err := c.inject(ctx, method); err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func (c *ChaosConfig) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if err := c.inject(ctx, method); err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
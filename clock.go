@@ -0,0 +1,188 @@
+package backend_utils
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Clock is where the package reads time from: pool heartbeats and
+// connection ages, the background loops, JWT expiry and cache TTLs. Tests
+// install a FakeClock with SetClock, or per subsystem with their Clock
+// option, to move time without sleeping.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of *time.Ticker the package uses.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+// RealClock is the Clock of the time package.
+var RealClock Clock = realClock{}
+
+func (realClock) Now() time.Time { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t	*time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop() { r.t.Stop() }
+
+var pkgClockVal = struct {
+	sync.RWMutex
+	c	Clock
+}{c: RealClock}
+
+// SetClock sets the clock of the package, including the one JWT expiry is
+// checked against. Subsystems given their own clock keep using it.
+func SetClock(c Clock) {
+	if c == nil {
+		c = RealClock
+	}
+	pkgClockVal.Lock()
+	pkgClockVal.c = c
+	pkgClockVal.Unlock()
+	jwt.TimeFunc = c.Now
+}
+
+func pkgClock() Clock {
+	pkgClockVal.RLock()
+	defer pkgClockVal.RUnlock()
+	return pkgClockVal.c
+}
+
+// clockOr returns c if set, else the package clock.
+func clockOr(c Clock) Clock {
+	if c != nil {
+		return c
+	}
+	return pkgClock()
+}
+
+// FakeClock only moves when told to. Timers and tickers fire from Advance
+// and Set, in deadline order.
+type FakeClock struct {
+	mtx	sync.Mutex
+	now	time.Time
+	waiters	[]*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at	time.Time
+	// Ticker period, 0 for one shot timers.
+	period	time.Duration
+	ch	chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	w := &fakeWaiter{at: f.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- f.now
+		return w.ch
+	}
+	f.waiters = append(f.waiters, w)
+	return w.ch
+}
+
+func (f *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	w := &fakeWaiter{at: f.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, w)
+	return &fakeTicker{clock: f, w: w}
+}
+
+// Waiters returns the number of pending timers and tickers, so tests can
+// wait for a goroutine to block on the clock before advancing it.
+func (f *FakeClock) Waiters() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.waiters)
+}
+
+// Advance moves the clock forward by d.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the clock to t, firing what is due by then. Like *time.Ticker,
+// tickers drop ticks their reader is not keeping up with.
+func (f *FakeClock) Set(t time.Time) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for {
+		sort.Slice(f.waiters, func(i, j int) bool { return f.waiters[i].at.Before(f.waiters[j].at) })
+		if len(f.waiters) == 0 || f.waiters[0].at.After(t) {
+			break
+		}
+		w := f.waiters[0]
+		f.now = w.at
+		select {
+		case w.ch <- w.at:
+		default:
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+	}
+	if t.After(f.now) {
+		f.now = t
+	}
+}
+
+func (f *FakeClock) remove(w *fakeWaiter) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for i := range f.waiters {
+		if f.waiters[i] == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i + 1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock	*FakeClock
+	w	*fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.ch }
+func (t *fakeTicker) Stop() { t.clock.remove(t.w) }
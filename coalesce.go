@@ -0,0 +1,110 @@
+package backend_utils
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+type coalescedCall struct {
+	done	chan struct{}
+	val	interface{}
+	err	error
+	shared	bool
+	// Set if fn failed with the ctx of its caller done, in which case the
+	// error is not the waiters' to share.
+	ctx_done bool
+}
+
+// Coalescer collapses concurrent calls with the same key into one, e.g.
+// identical DB lookups or downstream RPCs missing the cache together. The
+// zero value is ready to use.
+type Coalescer struct {
+	mtx	sync.Mutex
+	calls	map[string] *coalescedCall
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{}
+}
+
+// Do calls fn unless a call with key is in flight, in which case it waits
+// for that one and returns its result. shared reports whether the result
+// went to more than one caller, in which case val must not be modified.
+// If fn panics, the waiting callers get an error and the panic goes on in
+// the caller running fn.
+func (c *Coalescer) Do(key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	return c.DoContext(context.Background(), key, func(context.Context) (interface{}, error) {
+		return fn()
+	})
+}
+
+// DoContext is Do with fn run under the ctx of the caller running it.
+// Waiters stop waiting when their own ctx is done. If fn fails after its
+// caller's ctx is done, e.g. cancelled, a waiter runs fn again under its
+// ctx instead of taking that error.
+func (c *Coalescer) DoContext(ctx context.Context, key string,
+	fn func(ctx context.Context) (interface{}, error)) (val interface{}, err error, shared bool) {
+
+	c.mtx.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string] *coalescedCall)
+	}
+	for {
+		call, ok := c.calls[key]
+		if !ok {
+			break
+		}
+		call.shared = true
+		c.mtx.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err(), true
+		}
+		if call.err == nil || !call.ctx_done || ctx.Err() != nil {
+			return call.val, call.err, true
+		}
+		c.mtx.Lock()
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mtx.Unlock()
+
+	finished := false
+	defer func() {
+		if !finished {
+			r := recover()
+			call.err = fmt.Errorf("Coalesced call panicked: %v", r)
+			c.finish(key, call)
+			if r != nil {
+				panic(r)
+			}
+		}
+	}()
+	call.val, call.err = fn(ctx)
+	call.ctx_done = call.err != nil && ctx.Err() != nil
+	finished = true
+	shared = c.finish(key, call)
+	return call.val, call.err, shared
+}
+
+// finish releases the waiters of call and reports whether there were any.
+func (c *Coalescer) finish(key string, call *coalescedCall) bool {
+	c.mtx.Lock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	shared := call.shared
+	c.mtx.Unlock()
+	close(call.done)
+	return shared
+}
+
+// Forget makes the next Do of key call fn even if a call is in flight.
+func (c *Coalescer) Forget(key string) {
+	c.mtx.Lock()
+	delete(c.calls, key)
+	c.mtx.Unlock()
+}
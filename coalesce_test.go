@@ -0,0 +1,152 @@
+package backend_utils
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// waitShared waits till a caller is waiting on the call in flight for key.
+func waitShared(t *testing.T, c *Coalescer, key string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mtx.Lock()
+		call, ok := c.calls[key]
+		shared := ok && call.shared
+		c.mtx.Unlock()
+		if shared {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No caller waiting on %s.", key)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type coalesceResult struct {
+	val	interface{}
+	err	error
+}
+
+func TestCoalescerWaiters(t *testing.T) {
+	errFailed := errors.New("Failed.")
+	tests := []struct {
+		name		string
+		// Result of the first call, returned once the waiter is waiting.
+		first		func(ctx context.Context) (interface{}, error)
+		cancel_first	bool
+		cancel_waiter	bool
+		want_val	interface{}
+		want_err	string
+		want_calls	int32
+		want_panic	bool
+	}{
+		{
+			name: "shares the result",
+			first: func(context.Context) (interface{}, error) { return "first", nil },
+			want_val: "first",
+			want_calls: 1,
+		},
+		{
+			name: "shares the error",
+			first: func(context.Context) (interface{}, error) { return nil, errFailed },
+			want_err: errFailed.Error(),
+			want_calls: 1,
+		},
+		{
+			name: "calls again if the first caller was cancelled",
+			first: func(ctx context.Context) (interface{}, error) { return nil, ctx.Err() },
+			cancel_first: true,
+			want_val: "again",
+			want_calls: 2,
+		},
+		{
+			name: "waiter gives up with its ctx",
+			first: func(context.Context) (interface{}, error) { return "first", nil },
+			cancel_waiter: true,
+			want_err: context.Canceled.Error(),
+			want_calls: 1,
+		},
+		{
+			name: "waiter gets an error if the first call panics",
+			first: func(context.Context) (interface{}, error) { panic("boom") },
+			want_err: "Coalesced call panicked: boom",
+			want_calls: 1,
+			want_panic: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewCoalescer()
+			release := make(chan struct{})
+			var calls int32
+			fn := func(ctx context.Context) (interface{}, error) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					<-release
+					return tc.first(ctx)
+				}
+				return "again", nil
+			}
+
+			first_ctx, cancel_first := context.WithCancel(context.Background())
+			defer cancel_first()
+			first_done := make(chan interface{}, 1)
+			go func() {
+				defer func() { first_done <- recover() }()
+				c.DoContext(first_ctx, "key", fn)
+			}()
+			for atomic.LoadInt32(&calls) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			waiter_ctx, cancel_waiter := context.WithCancel(context.Background())
+			defer cancel_waiter()
+			waiter_done := make(chan coalesceResult, 1)
+			go func() {
+				val, err, _ := c.DoContext(waiter_ctx, "key", fn)
+				waiter_done <- coalesceResult{val, err}
+			}()
+			waitShared(t, c, "key")
+
+			var res coalesceResult
+			if tc.cancel_waiter {
+				// The waiter returns before the first call finishes.
+				cancel_waiter()
+				res = <-waiter_done
+				close(release)
+			} else {
+				if tc.cancel_first {
+					cancel_first()
+				}
+				close(release)
+				res = <-waiter_done
+			}
+
+			if len(tc.want_err) > 0 {
+				if res.err == nil || !strings.Contains(res.err.Error(), tc.want_err) {
+					t.Fatalf("Waiter got error %v, want %s.", res.err, tc.want_err)
+				}
+			} else if res.err != nil || res.val != tc.want_val {
+				t.Fatalf("Waiter got %v, %v, want %v.", res.val, res.err, tc.want_val)
+			}
+
+			if r := <-first_done; (r != nil) != tc.want_panic {
+				t.Fatalf("First caller panicked with %v, want panic %t.", r, tc.want_panic)
+			}
+			if n := atomic.LoadInt32(&calls); n != tc.want_calls {
+				t.Fatalf("fn called %d times, want %d.", n, tc.want_calls)
+			}
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+			if len(c.calls) != 0 {
+				t.Fatalf("%d calls left in flight.", len(c.calls))
+			}
+		})
+	}
+}
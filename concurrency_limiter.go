@@ -0,0 +1,127 @@
+package backend_utils
+
+import (
+	"strconv"
+	"sync"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type ConcurrencyConfig struct {
+	// Maximum calls served at once. 0 means no limit.
+	MaxInFlight		int		`json:"max_in_flight"`
+	// Limits for single methods, keyed by full method name.
+	MethodMaxInFlight	map[string]int	`json:"method_max_in_flight"`
+	// Time clients are asked to wait before retrying rejected calls.
+	RetryPushback		Duration	`json:"retry_pushback"`
+	Adaptive		AdaptiveConfig	`json:"adaptive"`
+}
+
+// With adaptive limiting the global limit is lowered while call latency is
+// above TargetLatency and raised again once it recovers (AIMD).
+type AdaptiveConfig struct {
+	Enabled		bool		`json:"enabled"`
+	TargetLatency	Duration	`json:"target_latency"`
+	// The limit is never lowered below this. Defaults to 1.
+	MinLimit	int		`json:"min_limit"`
+}
+
+type ConcurrencyLimiter struct {
+	conf		ConcurrencyConfig
+	mtx		sync.Mutex
+	in_flight	int
+	method_flight	map[string]int
+	limit		float64
+}
+
+func NewConcurrencyLimiter(conf ConcurrencyConfig) *ConcurrencyLimiter {
+	if conf.Adaptive.MinLimit <= 0 {
+		conf.Adaptive.MinLimit = 1
+	}
+	return &ConcurrencyLimiter{
+		conf: conf,
+		method_flight: make(map[string]int),
+		limit: float64(conf.MaxInFlight),
+	}
+}
+
+func (l *ConcurrencyLimiter) acquire(method string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.conf.MaxInFlight > 0 && l.in_flight >= int(l.limit) {
+		return false
+	}
+	if max, ok := l.conf.MethodMaxInFlight[method]; ok && l.method_flight[method] >= max {
+		return false
+	}
+	l.in_flight++
+	l.method_flight[method]++
+	return true
+}
+
+func (l *ConcurrencyLimiter) release(method string, latency time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.in_flight--
+	l.method_flight[method]--
+
+	a := l.conf.Adaptive
+	if !a.Enabled || l.conf.MaxInFlight <= 0 || a.TargetLatency.Duration <= 0 {
+		return
+	}
+	if latency > a.TargetLatency.Duration {
+		l.limit *= 0.9
+		if l.limit < float64(a.MinLimit) {
+			l.limit = float64(a.MinLimit)
+		}
+	} else if l.limit < float64(l.conf.MaxInFlight) {
+		// Grow by about one per limit calls.
+		l.limit += 1 / l.limit
+		if l.limit > float64(l.conf.MaxInFlight) {
+			l.limit = float64(l.conf.MaxInFlight)
+		}
+	}
+}
+
+// CurrentLimit returns the global limit in effect, lowered by adaptive
+// limiting.
+func (l *ConcurrencyLimiter) CurrentLimit() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return int(l.limit)
+}
+
+func (l *ConcurrencyLimiter) reject(ctx context.Context) error {
+	if l.conf.RetryPushback.Duration > 0 {
+		ms := strconv.FormatInt(int64(l.conf.RetryPushback.Duration / time.Millisecond), 10)
+		grpc.SetTrailer(ctx, metadata.Pairs("grpc-retry-pushback-ms", ms))
+	}
+	return ErrResourceExhausted("Server overloaded")
+}
+
+func (l *ConcurrencyLimiter) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if !l.acquire(info.FullMethod) {
+			return nil, l.reject(ctx)
+		}
+		start := time.Now()
+		defer func() { l.release(info.FullMethod, time.Since(start)) }()
+		return handler(ctx, req)
+	}
+}
+
+// Streams count against the limits while they are open. Their duration is
+// not used for adaptive limiting.
+func (l *ConcurrencyLimiter) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		if !l.acquire(info.FullMethod) {
+			return l.reject(ss.Context())
+		}
+		defer l.release(info.FullMethod, 0)
+		return handler(srv, ss)
+	}
+}
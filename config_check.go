@@ -0,0 +1,180 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+// Status of a CheckResult.
+const (
+	CHECK_OK = "ok"
+	CHECK_FAILED = "failed"
+	CHECK_SKIPPED = "skipped"
+	// Something to look at which doesn't fail the report.
+	CHECK_WARNING = "warning"
+)
+
+// Time each dial and connection check of ValidateOnly gets.
+const DEFAULT_CHECK_TIMEOUT = 3 * time.Second
+
+type CheckResult struct {
+	Name		string	`json:"name"`
+	Status		string	`json:"status"`
+	Error		string	`json:"error,omitempty"`
+	DurationMs	int64	`json:"duration_ms"`
+}
+
+// ConfigReport is the outcome of ValidateOnly, written as JSON so that
+// deploy pipelines can gate on it.
+type ConfigReport struct {
+	Config	string		`json:"config"`
+	Env	string		`json:"env,omitempty"`
+	OK	bool		`json:"ok"`
+	Checks	[]CheckResult	`json:"checks"`
+}
+
+// checkWarning ends a check with CHECK_WARNING instead of failing it.
+type checkWarning string
+
+func (w checkWarning) Error() string { return string(w) }
+
+func (r *ConfigReport) run(name string, fn func() error) bool {
+	start := time.Now()
+	res := CheckResult{Name: name, Status: CHECK_OK}
+	if err := fn(); err != nil {
+		res.Status = CHECK_FAILED
+		res.Error = err.Error()
+		if _, ok := err.(checkWarning); ok {
+			res.Status = CHECK_WARNING
+		} else {
+			r.OK = false
+		}
+	}
+	res.DurationMs = int64(time.Since(start) / time.Millisecond)
+	r.Checks = append(r.Checks, res)
+	return res.Status == CHECK_OK
+}
+
+func (r *ConfigReport) skip(name, why string) {
+	r.Checks = append(r.Checks, CheckResult{Name: name, Status: CHECK_SKIPPED, Error: why})
+}
+
+// ValidateOnly checks the config of the flags without starting anything:
+// the file against the schema, the TLS certificates and JWT keys, a dial
+// of every client endpoint and a connection to the Postgres database.
+// Dials and connections get timeout, DEFAULT_CHECK_TIMEOUT if 0. SPIFFE
+// endpoints only get a TCP dial, as their SVIDs are fetched at startup.
+func (f *ConfigFlags) ValidateOnly(timeout time.Duration) *ConfigReport {
+	if timeout <= 0 {
+		timeout = DEFAULT_CHECK_TIMEOUT
+	}
+	r := &ConfigReport{Config: f.ConfPath, Env: f.Env, OK: true}
+	r.run("schema", func() error {
+		return ValidateConfFile(f.ConfPath, envOverlays(f.ConfPath, f.Env)...)
+	})
+	var conf *Configurations
+	if !r.run("load", func() (err error) {
+		conf, err = f.Load()
+		return
+	}) {
+		return r
+	}
+	conf.check(r, timeout)
+	return r
+}
+
+func (c *Configurations) check(r *ConfigReport, timeout time.Duration) {
+	srv := &c.ServerConfig
+	if srv.Spiffe != nil {
+		r.skip("server_tls", "SPIFFE identities are only fetched at startup.")
+	} else if srv.UseTls {
+		r.run("server_tls", func() error {
+			_, err := srv.TLSConfig()
+			return err
+		})
+	}
+	if len(srv.PubKeyFile) > 0 {
+		r.run("jwt_pub_key", func() error {
+			_, err := ParseJWTpubKeyFile(srv.PubKeyFile)
+			return err
+		})
+	}
+	if len(srv.PrivKeyFile) > 0 {
+		r.run("jwt_priv_key", func() error {
+			_, err := ParseJWTprivKeyFile(srv.PrivKeyFile)
+			return err
+		})
+	}
+
+	for i := range c.ClientConfig {
+		cli := c.ClientConfig[i]
+		name := fmt.Sprintf("client %s %s", cli.SvcName, cli.ServerAddr)
+		if cli.UseTls && cli.Spiffe == nil {
+			if !r.run(name + " tls", func() error {
+				_, err := cli.TLSConfig()
+				return err
+			}) {
+				continue
+			}
+		}
+		r.run(name, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			return clientDialable(ctx, cli)
+		})
+	}
+
+	if len(c.PostgresDB.Hostname) == 0 {
+		return
+	}
+	db_conf := &c.PostgresDB
+	if !r.run("postgres", func() error {
+		return pingPostgres(db_conf.serverConnString(), timeout)
+	}) {
+		return
+	}
+	r.run("postgres db " + db_conf.DBName, func() error {
+		err := pingPostgres(db_conf.connString(), timeout)
+		if pq_err, ok := err.(*pq.Error); ok && pq_err.Code == PQ_INVALID_CATALOG_NAME {
+			// Not an error for services which create it with CreatePQDB.
+			return checkWarning("Database does not exist.")
+		}
+		return err
+	})
+}
+
+// Postgres error code of connections to a database which doesn't exist.
+const PQ_INVALID_CATALOG_NAME = "3D000"
+
+func pingPostgres(conn_str string, timeout time.Duration) error {
+	db, err := sql.Open("postgres", conn_str)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+// RunValidateOnly writes the ValidateOnly report to w as JSON and returns
+// the exit code, 0 if all the checks passed:
+//
+//	if flags.CheckConfig {
+//		os.Exit(flags.RunValidateOnly(os.Stdout))
+//	}
+func (f *ConfigFlags) RunValidateOnly(w io.Writer) int {
+	r := f.ValidateOnly(0)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil || !r.OK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package backend_utils
+
+import (
+	"flag"
+	"os"
+)
+
+// Env var holding the environment when -env isn't given.
+const CONFIG_ENV_VAR = "APP_ENV"
+
+// ConfigFlags are command line overrides of the most commonly tweaked
+// config fields. Only flags given on the command line override the file.
+type ConfigFlags struct {
+	fs		*flag.FlagSet
+	ConfPath	string
+	Env		string
+	Port		int
+	LogLevel	int
+	MetricsPort	int
+	DBHost		string
+	DBPort		int
+	DBName		string
+	// Only check the config, see RunValidateOnly.
+	CheckConfig	bool
+}
+
+// BindConfigFlags registers the flags on fs, flag.CommandLine if nil.
+// Parse fs before calling Load or Apply.
+func BindConfigFlags(fs *flag.FlagSet, default_conf_path string) *ConfigFlags {
+	if fs == nil {
+		fs = flag.CommandLine
+	}
+	f := &ConfigFlags{fs: fs}
+	fs.StringVar(&f.ConfPath, "config", default_conf_path, "Path of the config file.")
+	fs.StringVar(&f.Env, "env", os.Getenv(CONFIG_ENV_VAR),
+		"Environment whose overlay, e.g. conf.<env>.json, is merged over the config.")
+	fs.IntVar(&f.Port, "port", 0, "Port the gRPC server listens on.")
+	fs.IntVar(&f.LogLevel, "log-level", 0, "Trace level of the service logger.")
+	fs.IntVar(&f.MetricsPort, "metrics-port", 0, "Port to serve Prometheus metrics on.")
+	fs.StringVar(&f.DBHost, "db-host", "", "Postgres host.")
+	fs.IntVar(&f.DBPort, "db-port", 0, "Postgres port.")
+	fs.StringVar(&f.DBName, "db-name", "", "Postgres database.")
+	fs.BoolVar(&f.CheckConfig, "check-config", false,
+		"Check the config, certificates, endpoints and DB, print a JSON report and exit.")
+	return f
+}
+
+// Load reads the config file for the environment and applies the flags.
+func (f *ConfigFlags) Load() (*Configurations, error) {
+	conf, err := ReadConfFileForEnv(f.ConfPath, f.Env)
+	if err != nil {
+		return nil, err
+	}
+	f.Apply(conf)
+	return conf, nil
+}
+
+// Apply overrides the fields of conf whose flags were set.
+func (f *ConfigFlags) Apply(conf *Configurations) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "port":
+			conf.ServerConfig.Port = int32(f.Port)
+		case "log-level":
+			conf.ServerConfig.LogLevel = int32(f.LogLevel)
+		case "metrics-port":
+			conf.ServerConfig.MetricsPort = int32(f.MetricsPort)
+		case "db-host":
+			conf.PostgresDB.Hostname = f.DBHost
+		case "db-port":
+			conf.PostgresDB.Port = f.DBPort
+		case "db-name":
+			conf.PostgresDB.DBName = f.DBName
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package backend_utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Top level key listing files a config file builds on, e.g.
+//	"include": ["common.json", "db.json"]
+// Paths are relative to the including file. Included files are merged in
+// order and the including file is merged over them.
+const CONFIG_INCLUDE_KEY = "include"
+
+// loadConfDoc reads file_path with its includes, then merges the overlays
+// over it in order. It returns the merged document, migrated to
+// CURRENT_CONFIG_VERSION, as JSON.
+func loadConfDoc(file_path string, overlays ...string) ([]byte, error) {
+	doc, err := readConfDoc(file_path, map[string] bool{})
+	if err != nil {
+		return nil, err
+	}
+	for _, overlay := range overlays {
+		over, err := readConfDoc(overlay, map[string] bool{})
+		if err != nil {
+			return nil, err
+		}
+		doc = mergeConfDocs(doc, over)
+	}
+	if err = migrateConfDoc(doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func readConfDoc(file_path string, seen map[string] bool) (map[string] interface{}, error) {
+
+	abs, err := filepath.Abs(file_path)
+	if err != nil {
+		return nil, err
+	}
+	if seen[abs] {
+		return nil, fmt.Errorf("Config include cycle at %s", file_path)
+	}
+	seen[abs] = true
+	defer delete(seen, abs)
+
+	buf, err := ioutil.ReadFile(file_path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string] interface{}
+	if err = json.Unmarshal(stripJSONComments(buf), &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", file_path, err.Error())
+	}
+
+	var includes []string
+	switch inc := doc[CONFIG_INCLUDE_KEY].(type) {
+	case nil:
+	case string:
+		includes = []string{inc}
+	case []interface{}:
+		for _, v := range inc {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: %s must list file paths", file_path, CONFIG_INCLUDE_KEY)
+			}
+			includes = append(includes, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s: %s must list file paths", file_path, CONFIG_INCLUDE_KEY)
+	}
+	delete(doc, CONFIG_INCLUDE_KEY)
+
+	merged := map[string] interface{}{}
+	for _, inc := range includes {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(file_path), inc)
+		}
+		base, err := readConfDoc(inc, seen)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeConfDocs(merged, base)
+	}
+	return mergeConfDocs(merged, doc), nil
+}
+
+// mergeConfDocs merges over into base. Objects are merged key by key, any
+// other value in over, arrays included, replaces the one in base.
+func mergeConfDocs(base, over map[string] interface{}) map[string] interface{} {
+	out := make(map[string] interface{}, len(base) + len(over))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range over {
+		bm, ok1 := out[k].(map[string] interface{})
+		om, ok2 := v.(map[string] interface{})
+		if ok1 && ok2 {
+			out[k] = mergeConfDocs(bm, om)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// EnvOverlayPath returns the overlay of file_path for env, e.g.
+// conf.prod.json for conf.json and env "prod".
+func EnvOverlayPath(file_path, env string) string {
+	ext := filepath.Ext(file_path)
+	return strings.TrimSuffix(file_path, ext) + "." + env + ext
+}
+
+// ReadConfFileForEnv is ReadConfFile with the overlay of env merged over
+// the config, if the overlay file exists.
+func ReadConfFileForEnv(file_path, env string) (*Configurations, error) {
+	return ReadConfFile(file_path, envOverlays(file_path, env)...)
+}
+
+// envOverlays returns the overlay of env if there is one.
+func envOverlays(file_path, env string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	overlay := EnvOverlayPath(file_path, env)
+	if _, err := os.Stat(overlay); os.IsNotExist(err) {
+		return nil
+	}
+	return []string{overlay}
+}
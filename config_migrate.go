@@ -0,0 +1,60 @@
+package backend_utils
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CURRENT_CONFIG_VERSION is the config_version of the layout Configurations
+// has. Files without config_version are taken to be version 1.
+const CURRENT_CONFIG_VERSION = 1
+
+// configMigrations[v] turns a version v document into a version v+1 one,
+// e.g. by moving renamed keys. When the layout changes incompatibly, bump
+// CURRENT_CONFIG_VERSION and add the step here, so existing files keep
+// working.
+var configMigrations = map[int] func(doc map[string] interface{}) error{}
+
+// migrateConfDoc brings doc up to CURRENT_CONFIG_VERSION, logging a
+// warning for every step so old files get updated eventually.
+func migrateConfDoc(doc map[string] interface{}) error {
+
+	version := 1
+	if v, ok := doc["config_version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) || f < 1 {
+			return fmt.Errorf("config_version must be a positive integer, got %v", v)
+		}
+		version = int(f)
+	}
+	if version > CURRENT_CONFIG_VERSION {
+		return fmt.Errorf("config_version %d is newer than the supported %d, upgrade backend_utils",
+			version, CURRENT_CONFIG_VERSION)
+	}
+
+	for ; version < CURRENT_CONFIG_VERSION; version++ {
+		migrate, ok := configMigrations[version]
+		if !ok {
+			return fmt.Errorf("No migration from config_version %d", version)
+		}
+		if err := migrate(doc); err != nil {
+			return fmt.Errorf("Migrating config from version %d: %s", version, err.Error())
+		}
+		pkgLog().Infof("WARNING: config migrated from version %d to %d, please update the file.",
+			version, version + 1)
+	}
+	doc["config_version"] = CURRENT_CONFIG_VERSION
+	return nil
+}
+
+// migrateConf is migrateConfDoc for a JSON document.
+func migrateConf(buf []byte) ([]byte, error) {
+	var doc map[string] interface{}
+	if err := json.Unmarshal(buf, &doc); err != nil {
+		return nil, err
+	}
+	if err := migrateConfDoc(doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,207 @@
+package backend_utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ConfigChange is a field which differs between two configs. Secret values
+// are redacted.
+type ConfigChange struct {
+	Path	string		`json:"path"`
+	Old	interface{}	`json:"old"`
+	New	interface{}	`json:"new"`
+}
+
+func (c ConfigChange) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Path, c.Old, c.New)
+}
+
+func redactedDoc(conf *Configurations) interface{} {
+	var doc interface{}
+	buf, err := json.Marshal(Redact(conf))
+	if err == nil {
+		err = json.Unmarshal(buf, &doc)
+	}
+	if err != nil {
+		return nil
+	}
+	return doc
+}
+
+// DiffConfigs lists the fields changed from old to new, sorted by path.
+// Arrays which changed length are reported as a whole.
+func DiffConfigs(old, new *Configurations) []ConfigChange {
+	var changes []ConfigChange
+	diffDocs("", redactedDoc(old), redactedDoc(new), &changes)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func diffDocs(path string, a, b interface{}, changes *[]ConfigChange) {
+	am, ok1 := a.(map[string] interface{})
+	bm, ok2 := b.(map[string] interface{})
+	if ok1 && ok2 {
+		for k := range am {
+			diffDocs(joinPath(path, k), am[k], bm[k], changes)
+		}
+		for k := range bm {
+			if _, ok := am[k]; !ok {
+				diffDocs(joinPath(path, k), nil, bm[k], changes)
+			}
+		}
+		return
+	}
+	as, ok1 := a.([]interface{})
+	bs, ok2 := b.([]interface{})
+	if ok1 && ok2 && len(as) == len(bs) {
+		for i := range as {
+			diffDocs(fmt.Sprintf("%s[%d]", path, i), as[i], bs[i], changes)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, ConfigChange{Path: path, Old: a, New: b})
+	}
+}
+
+// configSection returns the field of conf with the json name section.
+func configSection(conf *Configurations, section string) interface{} {
+	v := reflect.ValueOf(conf).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if jsonFieldName(v.Type().Field(i)) == section {
+			return v.Field(i).Interface()
+		}
+	}
+	return nil
+}
+
+// ConfigReloader keeps the current config and reloads it on demand or when
+// the config file changes. Every reload logs what changed, calls the
+// handlers of the changed sections and publishes the changes on
+// TopicConfigReloaded.
+type ConfigReloader struct {
+	file_path	string
+	overlays	[]string
+	mtx		sync.Mutex
+	current		*Configurations
+	handlers	map[string] []func(old, new interface{})
+	mod_times	map[string] time.Time
+	logger		Logger
+}
+
+func NewConfigReloader(conf *Configurations, file_path string, overlays ...string) *ConfigReloader {
+	r := &ConfigReloader{
+		file_path: file_path,
+		overlays: overlays,
+		current: conf,
+		handlers: make(map[string] []func(old, new interface{})),
+	}
+	r.mod_times = r.modTimes()
+	return r
+}
+
+// WithLogger logs reloads to l instead of the package logger.
+func (r *ConfigReloader) WithLogger(l Logger) *ConfigReloader {
+	r.logger = l
+	return r
+}
+
+func (r *ConfigReloader) Current() *Configurations {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.current
+}
+
+// OnChange calls fn with the old and new value of a top level section,
+// e.g. "postgres_db", whenever a reload changes it. The values have the
+// section's type, e.g. PostgresDBConfig, and are not redacted.
+func (r *ConfigReloader) OnChange(section string, fn func(old, new interface{})) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.handlers[section] = append(r.handlers[section], fn)
+}
+
+// Reload reads the config file again and applies it.
+func (r *ConfigReloader) Reload() ([]ConfigChange, error) {
+	conf, err := ReadConfFile(r.file_path, r.overlays...)
+	if err != nil {
+		return nil, err
+	}
+	return r.Apply(conf), nil
+}
+
+// Apply replaces the current config with conf, e.g. one received from
+// WatchRemoteConf, and returns the changes.
+func (r *ConfigReloader) Apply(conf *Configurations) []ConfigChange {
+	r.mtx.Lock()
+	old := r.current
+	r.current = conf
+	handlers := make(map[string] []func(old, new interface{}), len(r.handlers))
+	for k, v := range r.handlers {
+		handlers[k] = v
+	}
+	r.mtx.Unlock()
+
+	changes := DiffConfigs(old, conf)
+	if len(changes) == 0 {
+		loggerOr(r.logger).Infof("Config reloaded, no changes.")
+		return nil
+	}
+	if buf, err := json.Marshal(changes); err == nil {
+		loggerOr(r.logger).Infof("Config reloaded, changes:%s", buf)
+	}
+	DefaultEventBus.Publish(TopicConfigReloaded, changes)
+
+	sections := make(map[string] bool)
+	for _, c := range changes {
+		sections[strings.SplitN(strings.SplitN(c.Path, ".", 2)[0], "[", 2)[0]] = true
+	}
+	for section := range sections {
+		for _, fn := range handlers[section] {
+			fn(configSection(old, section), configSection(conf, section))
+		}
+	}
+	return changes
+}
+
+func (r *ConfigReloader) modTimes() map[string] time.Time {
+	times := make(map[string] time.Time)
+	for _, p := range append([]string{r.file_path}, r.overlays...) {
+		if fi, err := os.Stat(p); err == nil {
+			times[p] = fi.ModTime()
+		}
+	}
+	return times
+}
+
+// Watch reloads the config whenever the config or overlay files are
+// modified, checking every interval till ctx is done. Files included by
+// the config are not watched.
+func (r *ConfigReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		times := r.modTimes()
+		if reflect.DeepEqual(times, r.mod_times) {
+			continue
+		}
+		r.mod_times = times
+		if _, err := r.Reload(); err != nil {
+			loggerOr(r.logger).Errorf("Config reload failed, keeping the current one. Err:%s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package backend_utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// How often sources without change notifications are polled by
+// WatchRemoteConf.
+const DEFAULT_CONFIG_POLL = 30 * time.Second
+
+// ConfigSource fetches the config document from outside the container.
+type ConfigSource interface {
+	// Fetch returns the current document.
+	Fetch(ctx context.Context) ([]byte, error)
+	// Wait blocks till the document may have changed since the last Fetch
+	// or ctx is done.
+	Wait(ctx context.Context) error
+}
+
+// ReadRemoteConf reads the config from src.
+func ReadRemoteConf(ctx context.Context, src ConfigSource) (*Configurations, error) {
+	buf, err := src.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return parseRemoteConf(buf)
+}
+
+func parseRemoteConf(buf []byte) (*Configurations, error) {
+	buf, err := migrateConf(stripJSONComments(buf))
+	if err != nil {
+		return nil, err
+	}
+	return parseConf(buf)
+}
+
+// WatchRemoteConf calls fn with the current config and then with every new
+// version of it till ctx is done. Fetch and parse errors are passed to fn
+// too; the previous config stays in effect then.
+func WatchRemoteConf(ctx context.Context, src ConfigSource, fn func(*Configurations, error)) {
+	var last []byte
+	for {
+		if err := src.Wait(ctx); err != nil {
+			return
+		}
+		buf, err := src.Fetch(ctx)
+		if err != nil {
+			fn(nil, err)
+			continue
+		}
+		if bytes.Equal(buf, last) {
+			continue
+		}
+		last = buf
+		fn(parseRemoteConf(buf))
+	}
+}
+
+func pollWait(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		interval = DEFAULT_CONFIG_POLL
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(interval):
+		return nil
+	}
+}
+
+var configHttpClient = &http.Client{Timeout: 30 * time.Second}
+
+// HTTPConfigSource fetches the config from a URL. Responses are
+// revalidated with ETags, and the last good copy is kept in CacheFile, if
+// set, so the service can still boot while the endpoint is down.
+type HTTPConfigSource struct {
+	URL		string
+	// Sent as "Authorization: Bearer <token>" if set.
+	BearerToken	string
+	Header		http.Header
+	CacheFile	string
+	PollInterval	time.Duration
+
+	etag		string
+	body		[]byte
+	polled		bool
+}
+
+func (h *HTTPConfigSource) Fetch(ctx context.Context) ([]byte, error) {
+	buf, err := h.fetch(ctx)
+	if err == nil {
+		return buf, nil
+	}
+	if len(h.CacheFile) > 0 {
+		if cached, cerr := ioutil.ReadFile(h.CacheFile); cerr == nil {
+			pkgLog().Errorf("Fetching config from %s failed, using cached copy. Err:%s", h.URL, err.Error())
+			return cached, nil
+		}
+	}
+	return nil, err
+}
+
+func (h *HTTPConfigSource) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vals := range h.Header {
+		for _, v := range vals {
+			req.Header.Add(k, v)
+		}
+	}
+	if len(h.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer " + h.BearerToken)
+	}
+	if len(h.etag) > 0 {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+
+	resp, err := configHttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && h.body != nil {
+		return h.body, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Config endpoint returned %s", resp.Status)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	h.etag = resp.Header.Get("ETag")
+	h.body = buf
+	if len(h.CacheFile) > 0 {
+		if err = ioutil.WriteFile(h.CacheFile, buf, 0600); err != nil {
+			pkgLog().Errorf("Failed caching config in %s. Err:%s", h.CacheFile, err.Error())
+		}
+	}
+	return buf, nil
+}
+
+func (h *HTTPConfigSource) Wait(ctx context.Context) error {
+	if !h.polled {
+		h.polled = true
+		return nil
+	}
+	return pollWait(ctx, h.PollInterval)
+}
+
+// ConsulConfigSource reads the config from a Consul KV key. Wait uses
+// blocking queries, so changes are seen right away.
+type ConsulConfigSource struct {
+	// e.g. "http://localhost:8500"
+	Addr		string
+	Key		string
+	Token		string
+	// Used instead of blocking queries while Consul returns no index,
+	// e.g. till the first Fetch succeeds. DEFAULT_CONFIG_POLL if 0.
+	PollInterval	time.Duration
+
+	index		string
+	polled		bool
+}
+
+func (c *ConsulConfigSource) get(ctx context.Context, index string, wait bool) (*http.Response, error) {
+	q := url.Values{"raw": {"true"}}
+	if wait && len(index) > 0 {
+		q.Set("index", index)
+		q.Set("wait", "5m")
+	}
+	req, err := http.NewRequest(http.MethodGet,
+		strings.TrimSuffix(c.Addr, "/") + "/v1/kv/" + c.Key + "?" + q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Token) > 0 {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	client := configHttpClient
+	if wait {
+		// Blocking queries outlive the default client timeout.
+		client = &http.Client{Timeout: 6 * time.Minute}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Consul returned %s for key %s", resp.Status, c.Key)
+	}
+	return resp, nil
+}
+
+func (c *ConsulConfigSource) Fetch(ctx context.Context) ([]byte, error) {
+	resp, err := c.get(ctx, "", false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	c.index = resp.Header.Get("X-Consul-Index")
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *ConsulConfigSource) Wait(ctx context.Context) error {
+	if !c.polled {
+		c.polled = true
+		return nil
+	}
+	if len(c.index) == 0 {
+		// Without an index the query wouldn't block.
+		return pollWait(ctx, c.PollInterval)
+	}
+	resp, err := c.get(ctx, c.index, true)
+	if err != nil {
+		// Don't spin while Consul is down.
+		return pollWait(ctx, time.Second)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// EtcdConfigSource reads the config from an etcd v3 key through the JSON
+// gateway. Changes are picked up by polling the key's revision.
+type EtcdConfigSource struct {
+	// e.g. "http://localhost:2379"
+	Endpoint	string
+	Key		string
+	// Bearer token from the etcd auth API, if auth is enabled.
+	Token		string
+	PollInterval	time.Duration
+
+	polled		bool
+}
+
+func (e *EtcdConfigSource) Fetch(ctx context.Context) ([]byte, error) {
+	body, err := json.Marshal(map[string] string{"key": base64.StdEncoding.EncodeToString([]byte(e.Key))})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(e.Endpoint, "/") + "/v3/kv/range",
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(e.Token) > 0 {
+		req.Header.Set("Authorization", e.Token)
+	}
+	resp, err := configHttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("etcd returned %s for key %s", resp.Status, e.Key)
+	}
+
+	var out struct {
+		Kvs	[]struct {
+			Value	string	`json:"value"`
+		} `json:"kvs"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if len(out.Kvs) == 0 {
+		return nil, fmt.Errorf("etcd key %s not found", e.Key)
+	}
+	return base64.StdEncoding.DecodeString(out.Kvs[0].Value)
+}
+
+func (e *EtcdConfigSource) Wait(ctx context.Context) error {
+	if !e.polled {
+		e.polled = true
+		return nil
+	}
+	return pollWait(ctx, e.PollInterval)
+}
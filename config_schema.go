@@ -0,0 +1,636 @@
+package backend_utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"google.golang.org/grpc/codes"
+)
+
+// JSONSchema is the subset of JSON Schema (draft-07) needed to describe
+// Configurations.
+type JSONSchema struct {
+	Schema			string			`json:"$schema,omitempty"`
+	Type			interface{}		`json:"type,omitempty"`
+	Description		string			`json:"description,omitempty"`
+	Properties		map[string]*JSONSchema	`json:"properties,omitempty"`
+	// Either false or a *JSONSchema for map values.
+	AdditionalProperties	interface{}		`json:"additionalProperties,omitempty"`
+	Items			*JSONSchema		`json:"items,omitempty"`
+	Pattern			string			`json:"pattern,omitempty"`
+
+	// Property names in struct order.
+	order			[]string
+}
+
+// Durations as time.ParseDuration reads them, which includes a bare "0".
+const durationPattern = `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+
+var durationRegexp = regexp.MustCompile(durationPattern)
+
+// Descriptions of the config fields keyed by path. Array elements don't have
+// an index in the path.
+var configDocs = map[string]string{
+	"config_version": "Layout version of this file. Older layouts are migrated on load.",
+	"server_config": "Settings for the gRPC server of this service.",
+	"server_config.use_tls": "Serve over TLS using cert_file and key_file.",
+	"server_config.use_jwt": "Require a JWT signed with priv_key in the authorization header.",
+	"server_config.pub_key": "PEM file with the RSA public key used to verify JWTs.",
+	"server_config.priv_key": "PEM file with the RSA private key used to sign JWTs.",
+	"server_config.totp_pending_methods": "Full method names callable with a token still waiting for its TOTP code.",
+	"server_config.access_token_ttl": "Lifetime of access tokens from NewTokenIssuer, e.g. \"15m\".",
+	"server_config.refresh_token_ttl": "Lifetime of refresh tokens from NewTokenIssuer, e.g. \"720h\".",
+	"server_config.use_validator": "Validate requests using the generated Validate() methods.",
+	"server_config.use_recovery": "Turn panics in handlers into Internal errors.",
+	"server_config.port": "Port the server listens on.",
+	"server_config.tenancy": "Resolve the tenant of every call, see TenantFromContext.",
+	"server_config.tenancy.enabled": "Resolve the tenant from the JWT claim or the tenant metadata.",
+	"server_config.tenancy.claim": "JWT claim holding the tenant ID. Defaults to \"tenant\".",
+	"server_config.tenancy.required": "Reject calls without a tenant.",
+	"server_config.tenancy.metadata_callers": "Callers which may name the tenant in metadata when their token has none, as in authz rules.",
+	"server_config.authz": "Which caller services may call which methods.",
+	"server_config.authz.enabled": "Deny calls no rule allows.",
+	"server_config.authz.claim": "JWT claim naming the calling service. Defaults to \"sub\".",
+	"server_config.authz.rules": "Methods each set of callers may call.",
+	"server_config.authz.rules.callers": "Certificate SAN or JWT claim values. A prefix ending in \"/\" matches those under it, \"*\" any identified caller.",
+	"server_config.authz.rules.methods": "Full method names, a prefix of one ending in \"/\" or \"*\" for all.",
+	"server_config.authz.public_methods": "Methods anybody may call, e.g. the health checks.",
+	"server_config.authz.dry_run": "Only log the calls which would be denied.",
+	"server_config.idempotency_ttl": "How long results of calls with an idempotency key are kept, e.g. \"24h\".",
+	"server_config.concurrency_limits": "Overload protection. Calls over the limits get ResourceExhausted.",
+	"server_config.concurrency_limits.max_in_flight": "Calls served at once. 0 means no limit.",
+	"server_config.concurrency_limits.method_max_in_flight": "Limits of single methods, keyed by full method name.",
+	"server_config.concurrency_limits.retry_pushback": "Time rejected clients are asked to wait before retrying, e.g. \"1s\".",
+	"server_config.concurrency_limits.adaptive": "Lower max_in_flight while latency is above target_latency, raise it once it recovers.",
+	"server_config.concurrency_limits.adaptive.enabled": "Adapt the limit. Needs max_in_flight and target_latency.",
+	"server_config.concurrency_limits.adaptive.target_latency": "Call latency the limit is adapted to, e.g. \"100ms\".",
+	"server_config.concurrency_limits.adaptive.min_limit": "The limit is never lowered below this. Defaults to 1.",
+	"server_config.metrics.latency_buckets": "Buckets in seconds of the handling time histogram. Enables it.",
+	"server_config.metrics.payload_sizes": "Collect per-method request and response size histograms.",
+	"server_config.metrics.size_buckets": "Buckets in bytes of the size histograms.",
+	"server_config.transport": "Keepalive, stream and flow control settings of connections.",
+	"server_config.transport.max_concurrent_streams": "Calls served at once on a single connection.",
+	"server_config.transport.max_connection_age": "Close connections after this long so that clients rebalance, e.g. \"30m\".",
+	"server_config.transport.max_connections": "Connections accepted at once. Further ones wait to be accepted.",
+	"server_config.transport.max_connection_idle": "Close connections idle this long, e.g. \"5m\".",
+	"server_config.transport.max_connection_age_grace": "Time calls in flight get to finish when max_connection_age closes a connection.",
+	"server_config.transport.keepalive_time": "Ping clients idle this long.",
+	"server_config.transport.keepalive_timeout": "Close connections not answering the keepalive ping within this.",
+	"server_config.transport.min_ping_interval": "Disconnect clients pinging more often than this.",
+	"server_config.transport.permit_ping_without_stream": "Allow client pings on connections without calls.",
+	"server_config.transport.initial_window_size": "HTTP/2 flow control window of each stream in bytes.",
+	"server_config.transport.initial_conn_window_size": "HTTP/2 flow control window of each connection in bytes.",
+	"server_config.transport.max_recv_msg_size": "Largest request message accepted in bytes.",
+	"server_config.transport.max_send_msg_size": "Largest response message sent in bytes.",
+	"server_config.tls.min_version": "Minimum TLS version accepted, \"1.2\" or \"1.3\".",
+	"server_config.tls.cipher_suites": "Go names of the cipher suites allowed up to TLS 1.2.",
+	"server_config.tls.curve_preferences": "Key exchange curves, e.g. [\"X25519\", \"P256\"].",
+	"server_config.tls": "TLS version, cipher suite and curve restrictions. Unset fields keep the Go defaults.",
+	"server_config.priority": "Queue calls over max_in_flight and serve them by priority band (high, normal, low).",
+	"server_config.priority.max_in_flight": "Calls served at once. 0 disables queueing.",
+	"server_config.priority.max_queue": "Calls queued per band, further ones are rejected. Defaults to max_in_flight.",
+	"server_config.priority.max_wait": "Reject queued calls after waiting this long. 0 waits till the call's deadline.",
+	"server_config.priority.method_priority": "Band of calls without a priority in their metadata, keyed by full method name.",
+	"server_config.priority.default_priority": "Band of calls without one otherwise. Defaults to normal.",
+	"server_config.priority.weights": "Relative share of freed slots per band.",
+	"server_config.enable_channelz": "Register the gRPC channelz service for connection debugging.",
+	"server_config.chaos": "Latency and error injection for resilience tests. Needs enabled set.",
+	"server_config.chaos.enabled": "Apply the rules. Never enable in production.",
+	"server_config.chaos.rules": "Faults injected, each into a share of the calls of the methods it matches.",
+	"server_config.chaos.rules.method": "Full method name, a prefix of one ending in \"/\" or \"*\" for all.",
+	"server_config.chaos.rules.percent": "Share of the matching calls affected, 0-100.",
+	"server_config.chaos.rules.latency": "Delay added before the call, e.g. \"200ms\".",
+	"server_config.chaos.rules.code": "Fail the call with this code after the delay, e.g. \"UNAVAILABLE\".",
+	"server_config.chaos.rules.reset": "Fail the call with the Unavailable error of a reset connection.",
+	"server_config.spiffe": "Take the TLS identity from the SPIFFE workload API instead of cert files.",
+	"server_config.spiffe.timeout": "How long to wait for the SVID from the workload API, e.g. \"10s\".",
+	"server_config.spiffe.socket_path": "Workload API socket, e.g. \"unix:///run/spire/agent.sock\". Defaults to SPIFFE_ENDPOINT_SOCKET.",
+	"server_config.spiffe.authorized_ids": "SPIFFE IDs allowed as the peer. Empty allows any peer of trust_domain.",
+	"server_config.spiffe.trust_domain": "Trust domain of the peers if authorized_ids is empty. Empty allows any valid SVID.",
+	"server_config.address": "Listen address instead of port, e.g. \"unix:///run/svc.sock\" or \"inproc://name\".",
+	"server_config.log_level": "Trace level of the service logger. Must be greater than 0.",
+	"server_config.multiplex": "Serve gRPC and HTTP on the same port.",
+	"server_config.enable_grpc_web": "Allow browser clients to call the service using grpc-web.",
+	"server_config.grpc_web_cors.allowed_origins": "Origins allowed to call using grpc-web. Empty allows any.",
+	"server_config.metrics_port": "Port to serve Prometheus metrics on. 0 disables metrics.",
+	"server_config.metrics": "Extra RPC histograms served with the metrics on metrics_port.",
+	"client_defaults": "Defaults inherited by every entry in client_config.",
+	"client_defaults.tls.min_version": "Minimum TLS version, \"1.2\" or \"1.3\".",
+	"client_defaults.tls.cipher_suites": "Go names of the cipher suites allowed up to TLS 1.2.",
+	"client_defaults.tls.curve_preferences": "Key exchange curves, e.g. [\"X25519\", \"P256\"].",
+	"client_defaults.tls": "TLS version, cipher suite and curve restrictions, as in server_config.tls.",
+	"client_defaults.propagate_metadata": "Incoming metadata keys forwarded to the services.",
+	"client_defaults.min_deadline_budget": "Fail calls right away if the caller's deadline leaves less than this.",
+	"client_defaults.deadline_reserve": "Time taken off the incoming deadline for downstream calls, e.g. \"50ms\".",
+	"client_defaults.load_balancing": "gRPC load balancing policy, pick_first or round_robin.",
+	"client_defaults.proxy": "Proxy URL to reach the services through, socks5:// or http://.",
+	"client_config": "Services this service calls. Entries with the same svc_name are pooled together.",
+	"client_config.svc_name": "Name of the service the entry connects to.",
+	"client_config.server_addr": "host:port of the service endpoint, or a unix:// or inproc:// address.",
+	"client_config.server_addrs": "More addresses of the endpoint, dialed in order after server_addr.",
+	"client_config.fallback_delay": "Time before the next address is dialed in parallel, e.g. \"300ms\".",
+	"client_config.tls": "TLS version, cipher suite and curve restrictions, as in server_config.tls.",
+	"client_config.tls.min_version": "Minimum TLS version, \"1.2\" or \"1.3\".",
+	"client_config.tls.cipher_suites": "Go names of the cipher suites allowed up to TLS 1.2.",
+	"client_config.tls.curve_preferences": "Key exchange curves, e.g. [\"X25519\", \"P256\"].",
+	"client_config.pinned_cert_sha256": "SHA-256 of the server certificate or SPKI, hex or base64. One must match.",
+	"client_config.pin_only": "Trust the pins alone instead of the CA chain.",
+	"client_config.spiffe": "Use mTLS with SPIFFE identities. Implies use_tls.",
+	"client_config.spiffe.timeout": "How long to wait for the SVID from the workload API, e.g. \"10s\".",
+	"client_config.spiffe.socket_path": "Workload API socket, e.g. \"unix:///run/spire/agent.sock\". Defaults to SPIFFE_ENDPOINT_SOCKET.",
+	"client_config.spiffe.authorized_ids": "SPIFFE IDs allowed as the peer. Empty allows any peer of trust_domain.",
+	"client_config.spiffe.trust_domain": "Trust domain of the peers if authorized_ids is empty. Empty allows any valid SVID.",
+	"client_config.server_host_override": "Server name to verify the TLS certificate against.",
+	"client_config.dial_timeout": "Maximum time to wait for a connection, e.g. \"5s\".",
+	"client_config.call_timeout": "Deadline applied to calls without a shorter one, e.g. \"1s\".",
+	"client_config.min_deadline_budget": "Fail calls right away if the caller's deadline leaves less than this.",
+	"client_config.retry_policy": "Retries for failed unary calls. Omit to disable.",
+	"client_config.weight": "Relative share of pooled calls sent to this endpoint.",
+	"client_config.hedging": "Hedging policies keyed by full method name.",
+	"client_config.propagate_metadata": "Incoming metadata keys forwarded to this service.",
+	"client_config.proxy": "Proxy URL to reach the service through, socks5:// or http://.",
+	"client_config.load_balancing": "gRPC load balancing policy, pick_first or round_robin.",
+	"client_config.service_config": "Raw gRPC service config JSON. Overrides load_balancing.",
+	"client_config.token_exchange": "Exchange the caller's token at an RFC 8693 endpoint instead of forwarding it.",
+	"client_config.token_exchange.endpoint": "Token endpoint of the STS.",
+	"client_config.token_exchange.audience": "Audience requested for the token. Defaults to svc_name.",
+	"client_config.token_exchange.scope": "Scope requested for the token.",
+	"client_config.token_exchange.client_id": "Client ID this service authenticates to the STS with.",
+	"client_config.token_exchange.client_secret": "Client secret this service authenticates to the STS with.",
+	"client_config.token_exchange.timeout": "Timeout of the exchange request, e.g. \"5s\".",
+	"client_config.chaos": "Latency and error injection on calls to this service. Needs enabled set.",
+	"client_config.chaos.enabled": "Apply the rules. Never enable in production.",
+	"client_config.chaos.rules": "Faults injected, each into a share of the calls of the methods it matches.",
+	"client_config.chaos.rules.method": "Full method name, a prefix of one ending in \"/\" or \"*\" for all.",
+	"client_config.chaos.rules.percent": "Share of the matching calls affected, 0-100.",
+	"client_config.chaos.rules.latency": "Delay added before the call, e.g. \"200ms\".",
+	"client_config.chaos.rules.code": "Fail the call with this code after the delay, e.g. \"UNAVAILABLE\".",
+	"client_config.chaos.rules.reset": "Fail the call with the Unavailable error of a reset connection.",
+	"client_config.xds": "Take endpoints, load balancing and optionally TLS from an xDS control plane.",
+	"client_config.xds.target": "Target to dial. Defaults to \"xds:///<svc_name>\".",
+	"client_config.xds.bootstrap_file": "Bootstrap file naming the control plane. Defaults to GRPC_XDS_BOOTSTRAP. Must be the same for all clients.",
+	"client_config.xds.use_xds_creds": "Use the security config from the control plane, falling back to the client's own TLS settings.",
+	"client_config.methods": "Timeout, retry, hedging and priority overrides keyed by full method name.",
+	"client_config.methods.timeout": "Deadline of calls to the method, instead of call_timeout.",
+	"client_config.methods.retry_policy": "Retries of the method, instead of retry_policy.",
+	"client_config.methods.retry_policy.max_attempts": "Attempts including the first one.",
+	"client_config.methods.retry_policy.backoff": "Wait between attempts, e.g. \"100ms\".",
+	"client_config.methods.retry_policy.per_retry_timeout": "Deadline of each attempt, e.g. \"500ms\".",
+	"client_config.methods.retry_policy.retryable_codes": "Codes retried, e.g. [\"UNAVAILABLE\"]. Defaults to UNAVAILABLE and RESOURCE_EXHAUSTED.",
+	"client_config.methods.hedging": "Hedging of the method, instead of the hedging entry.",
+	"client_config.methods.hedging.delay": "Time to wait for the first attempt before sending the hedged one.",
+	"client_config.methods.priority": "Priority band sent to the server, e.g. low for batch calls.",
+	"client_config.methods.cache_ttl": "Cache responses this long if the client has WithResponseCache.",
+	"client_config.deadline_reserve": "Time taken off the incoming deadline for downstream calls, e.g. \"50ms\".",
+	"client_config.pool_config": "Connection pool settings, read from the first entry of the service.",
+	"client_config.pool_config.conns_per_endpoint": "Connections per endpoint. Overrides the value passed in code.",
+	"client_config.pool_config.max_idle": "Idle connections kept per endpoint. 0 keeps all.",
+	"client_config.pool_config.heartbeat_interval": "Skip the heartbeat on Get for connections checked within this, e.g. \"10s\".",
+	"client_config.pool_config.heartbeat_failures": "Heartbeats failed in a row before an endpoint is reported down. Defaults to 3.",
+	"client_config.pool_config.dial_timeout": "Dial timeout for pooled connections, e.g. \"5s\".",
+	"client_config.pool_config.mode": "eager, lazy or async dialing. Defaults to eager.",
+	"client_config.pool_config.max_conn_age": "Redial connections after about this long, e.g. \"30m\". 0 disables.",
+	"client_config.pool_config.max_conn_idle": "Close connections unused for this long. 0 disables.",
+	"client_config.pool_config.failover_endpoints": "Endpoints Invoke tries before giving up. 0 means all.",
+	"postgres_db": "Postgres connection settings.",
+	"postgres_db.field_keys": "Base64 encoded 32 byte keys by id for encrypted columns.",
+	"postgres_db.field_key_id": "Id of the field key used for new values.",
+	"postgres_db.search_path": "Schemas searched for unqualified names. Postgres default if empty.",
+	"dumb_db": "Embedded key value DB settings.",
+	"emailer": "SMTP settings used for sending email.",
+	"emailer.max_conns": "SMTP connections kept open, i.e. concurrent sends.",
+	"emailer.max_per_second": "Messages sent per second over all recipients. 0 means no limit.",
+	"emailer.domain_per_second": "Messages per second to each recipient domain, \"*\" for the ones not listed.",
+	"locker_config": "Distributed lock service settings.",
+	"fs_config.root_path": "Directory the local file store keeps objects in.",
+	"fs_config.encryption_keys": "Base64 encoded 32 byte master keys by id. Stored objects are encrypted if set.",
+	"fs_config.encryption_key_id": "Id of the master key used for new objects.",
+	"fs_config.retention": "Rules archiving or deleting objects by name prefix and age.",
+	"fs_config.retention.prefix": "Names of the objects the rule applies to start with this.",
+	"fs_config.retention.archive_after": "Move objects to the archive store this long after their last change, e.g. \"720h\". Needs an archive store.",
+	"fs_config.retention.delete_after": "Delete objects this long after their last change.",
+	"fs_config.retention.keep_versions": "Versions kept of each object in a versioned store. 0 keeps all.",
+	"fs_config.retention_interval": "How often the retention rules are applied by App.WithFileStore, e.g. \"1h\". Defaults to 1h.",
+	"proxy_config": "HTTP gateway settings.",
+	"cdn_config": "CDN used for serving static content.",
+	"payment_providers": "Credentials of the payment providers.",
+	"redis_config": "Redis connection settings.",
+	"password_hashing": "Parameters of new password hashes. Existing hashes keep theirs.",
+	"password_hashing.algorithm": "Algorithm for new password hashes, bcrypt or argon2id.",
+	"password_hashing.bcrypt_cost": "bcrypt cost of new hashes.",
+	"password_hashing.argon2_time": "argon2id passes over the memory.",
+	"password_hashing.argon2_memory": "argon2id memory in KiB.",
+	"password_hashing.argon2_threads": "argon2id parallelism.",
+	"feature_flags": "Feature flags read by FeatureFlags.Enabled.",
+	"feature_flags.name": "Name the flag is checked by.",
+	"feature_flags.enabled": "Turn the feature on.",
+	"feature_flags.percentage": "Share of users, 0-100, who get the feature.",
+	"feature_flags.users": "Users who always get the feature when it is enabled.",
+	"i18n": "Message catalogs used to localize errors and emails.",
+	"i18n.dir": "Directory of the message catalogs, one <locale>.json file each.",
+	"i18n.default_locale": "Locale of the messages missing in the caller's locales, e.g. \"en\".",
+	"ids": "How NewID generates IDs.",
+	"ids.scheme": "ID scheme, uuidv4, uuidv7, ulid or snowflake.",
+	"ids.worker_id": "Snowflake worker id, 0-1023. Claimed through the locker if not set.",
+	"ids.epoch": "Snowflake epoch. Defaults to 2020-01-01T00:00:00Z.",
+	"error_reporting": "Report errors and panics to Sentry.",
+	"error_reporting.sentry_dsn": "Sentry DSN errors and panics are reported to, see ErrorReportingConfig.Install.",
+	"error_reporting.environment": "Environment tag of reported errors, e.g. \"staging\".",
+	"error_reporting.sample_rate": "Fraction of errors reported, 0 reports all. Panics are always reported.",
+	"error_reporting.dedup_window": "Repeats of an error within this are counted, not reported, e.g. \"1m\".",
+	"health_alerts": "Alert when a component of HealthRegistry stays unhealthy.",
+	"health_alerts.after": "How long a component stays unhealthy before alerting, e.g. \"1m\".",
+	"health_alerts.slack_webhook": "Slack incoming webhook URL alerts are posted to.",
+	"health_alerts.emails": "Addresses alerts are emailed to through the emailer.",
+	"health_alerts.pagerduty_routing_key": "PagerDuty Events API v2 routing key alerts trigger incidents on.",
+	"health_alerts.notify_resolved": "Also notify when an alerted component recovers.",
+	"wait_for": "Dependencies waited for at startup before the server starts.",
+	"wait_for.postgres": "How long to wait at startup for the Postgres server to be reachable, e.g. \"2m\".",
+	"wait_for.redis": "How long to wait at startup for Redis to be reachable.",
+	"wait_for.locker": "How long to wait at startup for an address of the lock service to accept connections.",
+	"wait_for.clients": "How long to wait at startup for each client service, keyed by svc_name.",
+}
+
+// Values used in the example config instead of the zero values.
+var configExamples = map[string]interface{}{
+	"config_version": CURRENT_CONFIG_VERSION,
+	"server_config.port": 10000,
+	"server_config.log_level": 1,
+	"client_config.svc_name": "users",
+	"client_config.server_addr": "localhost:10001",
+	"client_config.dial_timeout": "5s",
+	"client_config.call_timeout": "1s",
+	"client_config.retry_policy.max_attempts": 3,
+	"client_config.retry_policy.backoff": "100ms",
+	"postgres_db.hostname": "localhost",
+	"postgres_db.port": 5432,
+	"emailer.smtp_port": 587,
+	"redis_config.hostname": "localhost",
+	"redis_config.port": 6379,
+}
+
+// ConfigSchema returns the JSON Schema of the config file.
+func ConfigSchema() *JSONSchema {
+	s := schemaFor(reflect.TypeOf(Configurations{}), "")
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	return s
+}
+
+// Only fields with a json tag are part of the config file.
+func jsonFieldName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+func joinPath(path, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+	return path + "." + name
+}
+
+func schemaFor(t reflect.Type, path string) *JSONSchema {
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	s := &JSONSchema{Description: configDocs[path]}
+
+	switch t {
+	case reflect.TypeOf(Duration{}):
+		s.Type = "string"
+		s.Pattern = durationPattern
+		return s
+	case reflect.TypeOf(codes.Code(0)):
+		s.Type = []string{"string", "integer"}
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		s.Type = "object"
+		s.AdditionalProperties = false
+		s.Properties = make(map[string]*JSONSchema)
+		for i := 0; i < t.NumField(); i++ {
+			name := jsonFieldName(t.Field(i))
+			if len(name) == 0 {
+				continue
+			}
+			s.Properties[name] = schemaFor(t.Field(i).Type, joinPath(path, name))
+			s.order = append(s.order, name)
+		}
+	case reflect.Slice, reflect.Array:
+		s.Type = "array"
+		s.Items = schemaFor(t.Elem(), path)
+		s.Items.Description = ""
+	case reflect.Map:
+		s.Type = "object"
+		s.AdditionalProperties = schemaFor(t.Elem(), path + ".*")
+	case reflect.String:
+		s.Type = "string"
+	case reflect.Bool:
+		s.Type = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s.Type = "integer"
+	case reflect.Float32, reflect.Float64:
+		s.Type = "number"
+	}
+	return s
+}
+
+// WriteConfigSchema writes the JSON Schema of the config file to w.
+func WriteConfigSchema(w io.Writer) error {
+	buf, err := json.MarshalIndent(ConfigSchema(), "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
+
+// WriteExampleConfig writes an example config file with every field and a
+// "//" comment describing it. ReadConfFile accepts such comments.
+func WriteExampleConfig(w io.Writer) error {
+	var buf bytes.Buffer
+	writeExample(&buf, ConfigSchema(), "", 0)
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeExample(buf *bytes.Buffer, s *JSONSchema, path string, depth int) {
+
+	indent := strings.Repeat("\t", depth)
+
+	if ex, ok := configExamples[path]; ok {
+		val, _ := json.Marshal(ex)
+		buf.Write(val)
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		if len(s.order) == 0 {
+			buf.WriteString("{}")
+			return
+		}
+		buf.WriteString("{\n")
+		for i, name := range s.order {
+			prop := s.Properties[name]
+			if len(prop.Description) > 0 {
+				fmt.Fprintf(buf, "%s\t// %s\n", indent, prop.Description)
+			}
+			fmt.Fprintf(buf, "%s\t%q: ", indent, name)
+			writeExample(buf, prop, joinPath(path, name), depth+1)
+			if i < len(s.order) - 1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(indent + "}")
+	case "array":
+		if s.Items.Type == "object" && len(s.Items.order) > 0 {
+			buf.WriteString("[\n" + indent + "\t")
+			writeExample(buf, s.Items, path, depth+1)
+			buf.WriteString("\n" + indent + "]")
+		} else {
+			buf.WriteString("[]")
+		}
+	case "string":
+		if len(s.Pattern) > 0 {
+			buf.WriteString(`"0s"`)
+		} else {
+			buf.WriteString(`""`)
+		}
+	case "integer", "number":
+		buf.WriteString("0")
+	case "boolean":
+		buf.WriteString("false")
+	default:
+		buf.WriteString("null")
+	}
+}
+
+type ConfigFieldError struct {
+	// Location of the field, e.g. client_config[1].dial_timeout
+	Path	string
+	Msg	string
+}
+
+func (e ConfigFieldError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+type ConfigValidationError struct {
+	Errs	[]ConfigFieldError
+}
+
+func (e *ConfigValidationError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i := range e.Errs {
+		msgs[i] = e.Errs[i].Error()
+	}
+	return "Invalid config. " + strings.Join(msgs, "; ")
+}
+
+// ValidateConfFile checks the file, merged with its includes and overlays,
+// against ConfigSchema. All the problems found are returned in a
+// *ConfigValidationError.
+func ValidateConfFile(file_path string, overlays ...string) error {
+	buf, err := loadConfDoc(file_path, overlays...)
+	if err != nil {
+		return err
+	}
+	return ValidateConfig(buf)
+}
+
+func ValidateConfig(buf []byte) error {
+
+	var doc interface{}
+	err := json.Unmarshal(stripJSONComments(buf), &doc)
+	if err != nil {
+		return err
+	}
+
+	verr := &ConfigValidationError{}
+	ConfigSchema().validate(doc, "", verr)
+	if len(verr.Errs) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func (s *JSONSchema) validate(v interface{}, path string, verr *ConfigValidationError) {
+
+	if v == nil {
+		return
+	}
+
+	fail := func(format string, args... interface{}) {
+		p := path
+		if len(p) == 0 {
+			p = "<root>"
+		}
+		verr.Errs = append(verr.Errs, ConfigFieldError{Path: p, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if s.Type != "object" {
+			fail("expected %v, got object", s.Type)
+			return
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if prop, ok := s.Properties[k]; ok {
+				prop.validate(val[k], joinPath(path, k), verr)
+			} else if extra, ok := s.AdditionalProperties.(*JSONSchema); ok {
+				extra.validate(val[k], joinPath(path, k), verr)
+			} else {
+				msg := "unknown field"
+				if guess := s.suggestField(k); len(guess) > 0 {
+					msg += fmt.Sprintf(", did you mean %q?", guess)
+				}
+				verr.Errs = append(verr.Errs, ConfigFieldError{Path: joinPath(path, k), Msg: msg})
+			}
+		}
+	case []interface{}:
+		if s.Type != "array" {
+			fail("expected %v, got array", s.Type)
+			return
+		}
+		for i := range val {
+			s.Items.validate(val[i], fmt.Sprintf("%s[%d]", path, i), verr)
+		}
+	case string:
+		if !s.allows("string") {
+			fail("expected %v, got string", s.Type)
+			return
+		}
+		if len(s.Pattern) > 0 && !durationRegexp.MatchString(val) {
+			fail("invalid duration %q", val)
+		}
+	case float64:
+		if s.allows("integer") {
+			if val != float64(int64(val)) {
+				fail("expected integer, got %v", val)
+			}
+			return
+		}
+		if !s.allows("number") {
+			fail("expected %v, got number", s.Type)
+		}
+	case bool:
+		if !s.allows("boolean") {
+			fail("expected %v, got boolean", s.Type)
+		}
+	}
+}
+
+// suggestField returns the known property closest to name, if it is close
+// enough to be a typo.
+func (s *JSONSchema) suggestField(name string) string {
+	max_dist := len(name) / 3 + 1
+	best, best_dist := "", max_dist + 1
+	for prop := range s.Properties {
+		if d := editDistance(name, prop); d < best_dist || (d == best_dist && prop < best) {
+			best, best_dist = prop, d
+		}
+	}
+	if best_dist > max_dist {
+		return ""
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b) + 1)
+	curr := make([]int, len(b) + 1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j] + 1, curr[j-1] + 1), prev[j-1] + cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (s *JSONSchema) allows(typ string) bool {
+	switch t := s.Type.(type) {
+	case string:
+		return t == typ
+	case []string:
+		for i := range t {
+			if t[i] == typ {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripJSONComments blanks out "//" comments which are not inside strings.
+// Offsets are kept so that JSON syntax errors still point to the right place.
+func stripJSONComments(buf []byte) []byte {
+
+	out := make([]byte, len(buf))
+	copy(out, buf)
+
+	in_str, escaped := false, false
+	for i := 0; i < len(out); i++ {
+		ch := out[i]
+		if in_str {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				in_str = false
+			}
+			continue
+		}
+		if ch == '"' {
+			in_str = true
+			continue
+		}
+		if ch == '/' && i + 1 < len(out) && out[i+1] == '/' {
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,162 @@
+package backend_utils
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// startFakeEndpoint serves the gRPC health service on a local port till the
+// test ends.
+func startFakeEndpoint(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed listening. Err:%s", err)
+	}
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func healthHeartbeat(ctx context.Context, conn *grpc.ClientConn) error {
+	_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func fakePoolConf(t *testing.T, svcs ...string) *Configurations {
+	conf := &Configurations{}
+	for _, svc := range svcs {
+		for i := 0; i < 2; i++ {
+			conf.ClientConfig = append(conf.ClientConfig, GrpcClientConfig{
+				SvcName: svc,
+				ServerAddr: startFakeEndpoint(t),
+			})
+		}
+	}
+	return conf
+}
+
+func heartbeats(svcs ...string) map[string] HeartbeatFunc {
+	hb := make(map[string] HeartbeatFunc)
+	for _, svc := range svcs {
+		hb[svc] = healthHeartbeat
+	}
+	return hb
+}
+
+// Connections are taken and returned while the pools are recreated, as on
+// a config reload. Run with -race.
+func TestCreateClientPoolConcurrentGetPut(t *testing.T) {
+	conf := fakePoolConf(t, "a", "b")
+	if err := conf.CreateClientPoolWithContext(heartbeats("a", "b"), 2, time.Second); err != nil {
+		t.Fatalf("Failed creating pools. Err:%s", err)
+	}
+	defer conf.CloseClientPools()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		svc := []string{"a", "b"}[i % 2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn, err := conf.PooledConn(svc)
+				if err != nil {
+					// The pool was swapped out under us.
+					continue
+				}
+				conf.PooledConnDone(svc, conn)
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := conf.CreateClientPoolWithContext(heartbeats("a", "b"), 1 + i % 3, time.Second); err != nil {
+			t.Errorf("Failed recreating pools. Err:%s", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	for _, svc := range []string{"a", "b"} {
+		conn, err := conf.PooledConn(svc)
+		if err != nil {
+			t.Fatalf("No connection to %s after the reloads. Err:%s", svc, err)
+		}
+		conf.PooledConnDone(svc, conn)
+	}
+}
+
+// Connections are taken from a pool while it is closed.
+func TestCloseClientPoolsConcurrentGet(t *testing.T) {
+	conf := fakePoolConf(t, "a")
+	if err := conf.CreateClientPoolWithContext(heartbeats("a"), 2, time.Second); err != nil {
+		t.Fatalf("Failed creating pools. Err:%s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				conn, err := conf.PooledConn("a")
+				if err != nil {
+					return
+				}
+				if pool, ok := conf.clientPool("a"); ok {
+					pool.Put(conn)
+				}
+			}
+		}()
+	}
+	conf.CloseClientPools()
+	wg.Wait()
+
+	if _, err := conf.PooledConn("a"); err == nil {
+		t.Fatal("Got a connection after CloseClientPools.")
+	}
+}
+
+// Single client pools are used concurrently once created.
+func TestClientConfigPoolConcurrentGetPut(t *testing.T) {
+	conf := fakePoolConf(t, "a")
+	cli := &conf.ClientConfig[0]
+	if err := cli.CreatePoolWithContext(2, healthHeartbeat, time.Second); err != nil {
+		t.Fatalf("Failed creating pool. Err:%s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				conn, err := cli.PooledConn()
+				if err == ErrPoolExhausted {
+					continue
+				}
+				if err != nil {
+					t.Errorf("Failed getting connection. Err:%s", err)
+					return
+				}
+				cli.GiveupPooledConn(conn)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,146 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/status"
+)
+
+// Columns the helpers below expect.
+const (
+	// TIMESTAMPTZ, NULL while the row is live.
+	DELETED_AT_COL = "deleted_at"
+	// BIGINT NOT NULL, bumped by every UpdateVersioned.
+	VERSION_COL = "version"
+)
+
+var ErrRowNotFound = errors.New("Row not found.")
+
+// Execer is satisfied by *sql.DB, *sql.Tx, *sql.Conn and StmtDB.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// ConflictError is returned when a row was changed since it was read.
+// Handlers can return it as is, it converts to an Aborted status.
+type ConflictError struct {
+	Table		string
+	Key		interface{}
+	// Version the caller read, and the one the row has now.
+	Expected	int64
+	Current		int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %v was modified, version %d is now %d", e.Table, e.Key, e.Expected, e.Current)
+}
+
+func (e *ConflictError) GRPCStatus() *status.Status {
+	return status.Convert(ErrAborted("%s", e.Error()))
+}
+
+func IsConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
+
+// NotDeletedClause is the condition selecting live rows, for the queries
+// of soft-deleted tables. alias qualifies the column if set.
+func NotDeletedClause(alias string) string {
+	if len(alias) > 0 {
+		return QuoteIdent(alias) + "." + QuoteIdent(DELETED_AT_COL) + " IS NULL"
+	}
+	return QuoteIdent(DELETED_AT_COL) + " IS NULL"
+}
+
+func affectedOne(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrRowNotFound
+	}
+	return nil
+}
+
+// SoftDelete marks the row of table whose key_col is key deleted. It
+// returns ErrRowNotFound if there is no live row.
+func SoftDelete(ctx context.Context, db Execer, table, key_col string, key interface{}) error {
+	return affectedOne(db.ExecContext(ctx, "UPDATE " + QuoteQualifiedIdent(table) + " SET " +
+		QuoteIdent(DELETED_AT_COL) + " = now() WHERE " + QuoteIdent(key_col) + " = $1 AND " +
+		NotDeletedClause(""), key))
+}
+
+// Restore undoes SoftDelete. It returns ErrRowNotFound if there is no
+// deleted row.
+func Restore(ctx context.Context, db Execer, table, key_col string, key interface{}) error {
+	return affectedOne(db.ExecContext(ctx, "UPDATE " + QuoteQualifiedIdent(table) + " SET " +
+		QuoteIdent(DELETED_AT_COL) + " = NULL WHERE " + QuoteIdent(key_col) + " = $1 AND " +
+		QuoteIdent(DELETED_AT_COL) + " IS NOT NULL", key))
+}
+
+// PurgeDeleted removes the rows soft-deleted more than older_than ago. It
+// returns the number of rows removed.
+func PurgeDeleted(ctx context.Context, db Execer, table string, older_than time.Duration) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM " + QuoteQualifiedIdent(table) + " WHERE " +
+		QuoteIdent(DELETED_AT_COL) + " < $1", pkgClock().Now().Add(-older_than))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// UpdateVersioned sets the columns in set on the live row whose key_col is
+// key, if it is still at version. It returns the new version, a
+// *ConflictError if the row moved on, or ErrRowNotFound if there is no live
+// row.
+func UpdateVersioned(ctx context.Context, db Execer, table, key_col string, key interface{},
+	version int64, set map[string] interface{}) (int64, error) {
+
+	// Sorted so that the statement is the same for StmtDB.
+	cols := make([]string, 0, len(set))
+	for col := range set {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+
+	assigns := make([]string, 0, len(cols) + 1)
+	args := make([]interface{}, 0, len(cols) + 2)
+	for _, col := range cols {
+		args = append(args, set[col])
+		assigns = append(assigns, fmt.Sprintf("%s = $%d", QuoteIdent(col), len(args)))
+	}
+	ver := QuoteIdent(VERSION_COL)
+	assigns = append(assigns, ver + " = " + ver + " + 1")
+	args = append(args, key, version)
+
+	err := affectedOne(db.ExecContext(ctx, "UPDATE " + QuoteQualifiedIdent(table) + " SET " +
+		strings.Join(assigns, ", ") + fmt.Sprintf(" WHERE %s = $%d AND %s = $%d AND ",
+		QuoteIdent(key_col), len(args) - 1, ver, len(args)) + NotDeletedClause(""), args...))
+	if err == nil {
+		return version + 1, nil
+	}
+	if err != ErrRowNotFound {
+		return 0, err
+	}
+
+	var current int64
+	err = db.QueryRowContext(ctx, "SELECT " + ver + " FROM " + QuoteQualifiedIdent(table) + " WHERE " +
+		QuoteIdent(key_col) + " = $1 AND " + NotDeletedClause(""), key).Scan(&current)
+	if err == sql.ErrNoRows {
+		return 0, ErrRowNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, &ConflictError{Table: table, Key: key, Expected: version, Current: current}
+}
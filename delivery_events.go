@@ -0,0 +1,422 @@
+package backend_utils
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of email delivery events.
+const (
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_BOUNCE = "bounce"
+	DELIVERY_COMPLAINT = "complaint"
+	DELIVERY_DROPPED = "dropped"
+
+	PROVIDER_SES = "ses"
+	PROVIDER_SENDGRID = "sendgrid"
+)
+
+// DeliveryEvent is a delivery status report from the email provider.
+// Permanent is set for failures which will not go away on retry, e.g. the
+// mailbox doesn't exist.
+type DeliveryEvent struct {
+	Provider	string
+	Type		string
+	Email		string
+	MessageID	string
+	Reason		string
+	Permanent	bool
+	Timestamp	time.Time
+}
+
+// DeliveryStore records delivery events and keeps the list of addresses
+// which should not be emailed anymore.
+type DeliveryStore interface {
+	// Record saves ev, suppressing the address on permanent bounces and
+	// complaints.
+	Record(ev *DeliveryEvent) error
+	Suppressed(email string) (bool, error)
+	Suppress(email, reason string) error
+	Unsuppress(email string) error
+}
+
+// PostgresDeliveryStore keeps events in the email_events table and the
+// suppression list in email_suppressions. Call CreateTable once before
+// using it.
+type PostgresDeliveryStore struct {
+	db	*sql.DB
+}
+
+func NewPostgresDeliveryStore(db *sql.DB) *PostgresDeliveryStore {
+	return &PostgresDeliveryStore{db: db}
+}
+
+func (p *PostgresDeliveryStore) CreateTable() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS email_events (
+		id BIGSERIAL PRIMARY KEY,
+		provider TEXT NOT NULL,
+		type TEXT NOT NULL,
+		email TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		permanent BOOLEAN NOT NULL,
+		ts TIMESTAMPTZ NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`CREATE TABLE IF NOT EXISTS email_suppressions (
+		email TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now())`)
+	return err
+}
+
+func (p *PostgresDeliveryStore) Record(ev *DeliveryEvent) error {
+	_, err := p.db.Exec("INSERT INTO email_events (provider, type, email, message_id, reason, permanent, ts) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7)", ev.Provider, ev.Type, strings.ToLower(ev.Email),
+		ev.MessageID, ev.Reason, ev.Permanent, ev.Timestamp)
+	if err != nil {
+		return err
+	}
+	if ev.Type == DELIVERY_COMPLAINT || (ev.Type == DELIVERY_BOUNCE && ev.Permanent) {
+		return p.Suppress(ev.Email, ev.Type + ": " + ev.Reason)
+	}
+	return nil
+}
+
+func (p *PostgresDeliveryStore) Suppressed(email string) (bool, error) {
+	var found bool
+	err := p.db.QueryRow("SELECT EXISTS (SELECT 1 FROM email_suppressions WHERE email = $1)",
+		strings.ToLower(email)).Scan(&found)
+	return found, err
+}
+
+func (p *PostgresDeliveryStore) Suppress(email, reason string) error {
+	_, err := p.db.Exec("INSERT INTO email_suppressions (email, reason) VALUES ($1, $2) " +
+		"ON CONFLICT (email) DO NOTHING", strings.ToLower(email), reason)
+	return err
+}
+
+func (p *PostgresDeliveryStore) Unsuppress(email string) error {
+	_, err := p.db.Exec("DELETE FROM email_suppressions WHERE email = $1", strings.ToLower(email))
+	return err
+}
+
+// DeliveryWebhookHandler receives delivery notifications from provider,
+// PROVIDER_SES (through SNS) or PROVIDER_SENDGRID, and records them in
+// store. Requests must carry token in the token query parameter, all are
+// rejected if it is empty. SNS message signatures are verified as well.
+func DeliveryWebhookHandler(store DeliveryStore, provider, token string) http.Handler {
+	if len(token) == 0 {
+		pkgLog().Errorf("No token for the %s delivery webhook, rejecting all requests.", provider)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if len(token) == 0 ||
+			subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1 << 20))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var events []*DeliveryEvent
+		switch provider {
+		case PROVIDER_SES:
+			events, err = parseSESNotification(body)
+		case PROVIDER_SENDGRID:
+			events, err = parseSendGridEvents(body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			pkgLog().Errorf("Bad %s delivery webhook. Err:%s", provider, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for _, ev := range events {
+			if err = store.Record(ev); err != nil {
+				pkgLog().Errorf("Failed recording delivery event. Err:%s", err.Error())
+				// Providers retry on errors.
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+type sesRecipient struct {
+	EmailAddress	string	`json:"emailAddress"`
+	DiagnosticCode	string	`json:"diagnosticCode"`
+}
+
+type sesMessage struct {
+	NotificationType	string	`json:"notificationType"`
+	Mail			struct {
+		MessageID	string		`json:"messageId"`
+		Timestamp	time.Time	`json:"timestamp"`
+	} `json:"mail"`
+	Bounce			struct {
+		BounceType		string		`json:"bounceType"`
+		BounceSubType		string		`json:"bounceSubType"`
+		BouncedRecipients	[]sesRecipient	`json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint		struct {
+		ComplaintFeedbackType	string		`json:"complaintFeedbackType"`
+		ComplainedRecipients	[]sesRecipient	`json:"complainedRecipients"`
+	} `json:"complaint"`
+	Delivery		struct {
+		Recipients	[]string	`json:"recipients"`
+	} `json:"delivery"`
+}
+
+type snsEnvelope struct {
+	Type			string	`json:"Type"`
+	MessageId		string	`json:"MessageId"`
+	Token			string	`json:"Token"`
+	TopicArn		string	`json:"TopicArn"`
+	Subject			string	`json:"Subject"`
+	Message			string	`json:"Message"`
+	SubscribeURL		string	`json:"SubscribeURL"`
+	Timestamp		string	`json:"Timestamp"`
+	SignatureVersion	string	`json:"SignatureVersion"`
+	Signature		string	`json:"Signature"`
+	SigningCertURL		string	`json:"SigningCertURL"`
+}
+
+var snsHostRegexp = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var snsHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Signing certificates by URL, SNS rotates them rarely.
+var snsCerts = struct {
+	sync.Mutex
+	certs	map[string] *x509.Certificate
+}{certs: make(map[string] *x509.Certificate)}
+
+// snsURL parses raw, which must be an https URL of SNS itself.
+func snsURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || !snsHostRegexp.MatchString(u.Host) {
+		return nil, errors.New("Not an SNS URL.")
+	}
+	return u, nil
+}
+
+func snsCert(raw string) (*x509.Certificate, error) {
+	snsCerts.Lock()
+	defer snsCerts.Unlock()
+	if cert, ok := snsCerts.certs[raw]; ok {
+		return cert, nil
+	}
+	u, err := snsURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := snsHttpClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Fetching SNS signing cert returned " + resp.Status)
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64 << 10))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("No certificate in SNS signing cert.")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	snsCerts.certs[raw] = cert
+	return cert, nil
+}
+
+// stringToSign is the canonical form of e that SNS signs.
+func (e *snsEnvelope) stringToSign() string {
+	var b strings.Builder
+	add := func(k, v string) {
+		b.WriteString(k + "\n" + v + "\n")
+	}
+	add("Message", e.Message)
+	add("MessageId", e.MessageId)
+	if e.Type == "Notification" {
+		if len(e.Subject) > 0 {
+			add("Subject", e.Subject)
+		}
+	} else {
+		add("SubscribeURL", e.SubscribeURL)
+	}
+	add("Timestamp", e.Timestamp)
+	if e.Type != "Notification" {
+		add("Token", e.Token)
+	}
+	add("TopicArn", e.TopicArn)
+	add("Type", e.Type)
+	return b.String()
+}
+
+// verify checks the signature of e against the SNS certificate it names.
+func (e *snsEnvelope) verify() error {
+	sig, err := base64.StdEncoding.DecodeString(e.Signature)
+	if err != nil {
+		return err
+	}
+	cert, err := snsCert(e.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("Unexpected SNS signing key.")
+	}
+	switch e.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(e.stringToSign()))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA1, sum[:], sig)
+	case "2":
+		sum := sha256.Sum256([]byte(e.stringToSign()))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig)
+	}
+	return errors.New("Unknown SNS signature version.")
+}
+
+// SES posts SNS envelopes, which are only accepted with a valid signature.
+// Subscription confirmations are accepted by visiting SubscribeURL.
+func parseSESNotification(body []byte) ([]*DeliveryEvent, error) {
+	var envelope snsEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	if err := envelope.verify(); err != nil {
+		return nil, errors.New("Bad SNS signature. " + err.Error())
+	}
+	if envelope.Type == "SubscriptionConfirmation" {
+		u, err := snsURL(envelope.SubscribeURL)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := snsHttpClient.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return nil, nil
+	}
+
+	var msg sesMessage
+	if err := json.Unmarshal([]byte(envelope.Message), &msg); err != nil {
+		return nil, err
+	}
+	newEvent := func(typ, email, reason string, permanent bool) *DeliveryEvent {
+		return &DeliveryEvent{
+			Provider: PROVIDER_SES,
+			Type: typ,
+			Email: email,
+			MessageID: msg.Mail.MessageID,
+			Reason: reason,
+			Permanent: permanent,
+			Timestamp: msg.Mail.Timestamp,
+		}
+	}
+
+	var events []*DeliveryEvent
+	switch msg.NotificationType {
+	case "Bounce":
+		for _, rcpt := range msg.Bounce.BouncedRecipients {
+			reason := msg.Bounce.BounceSubType
+			if len(rcpt.DiagnosticCode) > 0 {
+				reason = rcpt.DiagnosticCode
+			}
+			events = append(events, newEvent(DELIVERY_BOUNCE, rcpt.EmailAddress, reason,
+				msg.Bounce.BounceType == "Permanent"))
+		}
+	case "Complaint":
+		for _, rcpt := range msg.Complaint.ComplainedRecipients {
+			events = append(events, newEvent(DELIVERY_COMPLAINT, rcpt.EmailAddress,
+				msg.Complaint.ComplaintFeedbackType, true))
+		}
+	case "Delivery":
+		for _, rcpt := range msg.Delivery.Recipients {
+			events = append(events, newEvent(DELIVERY_DELIVERED, rcpt, "", false))
+		}
+	}
+	return events, nil
+}
+
+func parseSendGridEvents(body []byte) ([]*DeliveryEvent, error) {
+	var raw []struct {
+		Email		string	`json:"email"`
+		Event		string	`json:"event"`
+		Type		string	`json:"type"`
+		Reason		string	`json:"reason"`
+		MessageID	string	`json:"sg_message_id"`
+		Timestamp	int64	`json:"timestamp"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+
+	events := make([]*DeliveryEvent, 0, len(raw))
+	for _, e := range raw {
+		ev := &DeliveryEvent{
+			Provider: PROVIDER_SENDGRID,
+			Email: e.Email,
+			MessageID: e.MessageID,
+			Reason: e.Reason,
+			Timestamp: time.Unix(e.Timestamp, 0),
+		}
+		switch e.Event {
+		case "delivered":
+			ev.Type = DELIVERY_DELIVERED
+		case "bounce":
+			ev.Type = DELIVERY_BOUNCE
+			// "blocked" bounces are usually temporary.
+			ev.Permanent = e.Type != "blocked"
+		case "dropped":
+			ev.Type = DELIVERY_DROPPED
+		case "spamreport":
+			ev.Type = DELIVERY_COMPLAINT
+			ev.Permanent = true
+		default:
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
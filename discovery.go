@@ -0,0 +1,137 @@
+package backend_utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"golang.org/x/net/context"
+)
+
+// Interval of the health check ConsulRegistrar registers if CheckInterval
+// is not set.
+const DEFAULT_DISCOVERY_CHECK_INTERVAL = 10 * time.Second
+
+// ServiceInstance is one running instance of a service as announced to
+// service discovery.
+type ServiceInstance struct {
+	// Unique per instance, e.g. "users-host1-10000".
+	ID		string
+	Name		string
+	// Host or IP clients dial.
+	Address		string
+	Port		int
+	Tags		[]string
+	// The instance serves TLS.
+	TLS		bool
+}
+
+// Registrar announces instances to service discovery, e.g. Consul, so that
+// clients find them. App registers its instance once the server listens
+// and deregisters it before draining, see App.WithRegistrar.
+type Registrar interface {
+	Register(ctx context.Context, inst *ServiceInstance) error
+	Deregister(ctx context.Context, inst *ServiceInstance) error
+}
+
+// LocalInstance describes the instance of svc_name served by conf, with the
+// host name as address.
+func LocalInstance(svc_name string, conf *GrpcServerConfig) (*ServiceInstance, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceInstance{
+		ID: fmt.Sprintf("%s-%s-%d", svc_name, host, conf.Port),
+		Name: svc_name,
+		Address: host,
+		Port: int(conf.Port),
+		TLS: conf.UseTls || conf.Spiffe != nil,
+	}, nil
+}
+
+// ConsulRegistrar registers instances with the local Consul agent, with a
+// gRPC health check so that Consul stops returning instances which fail
+// it.
+type ConsulRegistrar struct {
+	// e.g. "http://localhost:8500"
+	Addr		string
+	Token		string
+	// DEFAULT_DISCOVERY_CHECK_INTERVAL if 0.
+	CheckInterval	time.Duration
+	// Consul drops instances failing their check this long. Not dropped
+	// if 0.
+	DeregisterAfter	time.Duration
+}
+
+type consulCheck struct {
+	GRPC				string	`json:"GRPC"`
+	GRPCUseTLS			bool	`json:"GRPCUseTLS,omitempty"`
+	Interval			string	`json:"Interval"`
+	DeregisterCriticalServiceAfter	string	`json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+type consulService struct {
+	ID		string		`json:"ID"`
+	Name		string		`json:"Name"`
+	Address		string		`json:"Address"`
+	Port		int		`json:"Port"`
+	Tags		[]string	`json:"Tags,omitempty"`
+	Check		consulCheck	`json:"Check"`
+}
+
+func (c *ConsulRegistrar) put(ctx context.Context, path string, body interface{}) error {
+	var buf []byte
+	if body != nil {
+		var err error
+		if buf, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(c.Addr, "/") + path, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	if len(c.Token) > 0 {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	resp, err := configHttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Consul returned %s for %s", resp.Status, path)
+	}
+	return nil
+}
+
+func (c *ConsulRegistrar) Register(ctx context.Context, inst *ServiceInstance) error {
+	interval := c.CheckInterval
+	if interval <= 0 {
+		interval = DEFAULT_DISCOVERY_CHECK_INTERVAL
+	}
+	svc := &consulService{
+		ID: inst.ID,
+		Name: inst.Name,
+		Address: inst.Address,
+		Port: inst.Port,
+		Tags: inst.Tags,
+		Check: consulCheck{
+			GRPC: fmt.Sprintf("%s:%d", inst.Address, inst.Port),
+			GRPCUseTLS: inst.TLS,
+			Interval: interval.String(),
+		},
+	}
+	if c.DeregisterAfter > 0 {
+		svc.Check.DeregisterCriticalServiceAfter = c.DeregisterAfter.String()
+	}
+	return c.put(ctx, "/v1/agent/service/register", svc)
+}
+
+func (c *ConsulRegistrar) Deregister(ctx context.Context, inst *ServiceInstance) error {
+	return c.put(ctx, "/v1/agent/service/deregister/" + inst.ID, nil)
+}
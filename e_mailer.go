@@ -7,10 +7,30 @@ import (
 	"os"
 	"fmt"
 	"bytes"
-	"time"
 	tpl "html/template"
+	"crypto/tls"
+	"io"
+	"strings"
+	"sync"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 )
 
+const (
+	DEFAULT_SMTP_CONNS = 2
+)
+
+type MailerOptions struct {
+	// Number of SMTP connections kept open, which is also the number of
+	// concurrent sends. Defaults to DEFAULT_SMTP_CONNS.
+	MaxConns int
+	// Messages per second over all recipients. 0 means no limit.
+	MaxPerSecond float64
+	// Messages per second to each recipient domain, e.g. "gmail.com". The
+	// "*" entry applies to domains not listed. 0 means no limit.
+	DomainPerSecond map[string] float64
+}
+
 type EmailConf struct {
 	Host     string
 	Port     int
@@ -27,6 +47,14 @@ type MailerDaemonType interface {
 type MailerDaemon struct {
 	conf *EmailConf
 	runner *task_runner.TaskRunner
+	conns chan *smtp.Client
+	limiter *rate.Limiter
+	domain_rates map[string] float64
+	domain_mtx sync.Mutex
+	domain_limiters map[string] *rate.Limiter
+	suppressions DeliveryStore
+	templates *EmailTemplates
+	logger Logger
 }
 
 var emailScript = `From: {{.From}}
@@ -37,7 +65,14 @@ Content-Type: text/html; charset="UTF-8"
 <html><body>{{.Message}}</body></html>`
 
 func NewMailerDaemon(host, username, password string, port int) *MailerDaemon {
+	return NewMailerDaemonWithOptions(host, username, password, port, MailerOptions{})
+}
+
+func NewMailerDaemonWithOptions(host, username, password string, port int, opts MailerOptions) *MailerDaemon {
 
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = DEFAULT_SMTP_CONNS
+	}
 	daemon := new(MailerDaemon)
 	daemon.conf = &EmailConf{
 		Host: 	  host,
@@ -47,16 +82,199 @@ func NewMailerDaemon(host, username, password string, port int) *MailerDaemon {
 		Auth:     smtp.PlainAuth("", username, password, host),
 		Template: template.Must(template.New("emailTpl").Parse(emailScript)),
 	}
-	daemon.runner = task_runner.StartTaskRunner(2, os.Stdout)
+	daemon.conns = make(chan *smtp.Client, opts.MaxConns)
+	if opts.MaxPerSecond > 0 {
+		daemon.limiter = rate.NewLimiter(rate.Limit(opts.MaxPerSecond), 1)
+	}
+	daemon.domain_rates = opts.DomainPerSecond
+	daemon.domain_limiters = make(map[string] *rate.Limiter)
+	daemon.runner = task_runner.StartTaskRunner(opts.MaxConns, os.Stdout)
 	return daemon
 }
 
+func (c *EmailerConfig) NewMailerDaemon() *MailerDaemon {
+	return NewMailerDaemonWithOptions(c.SmtpAddr, c.Username, c.Password, c.SmtpPort, MailerOptions{
+		MaxConns: c.MaxConns,
+		MaxPerSecond: c.MaxPerSecond,
+		DomainPerSecond: c.DomainPerSecond,
+	})
+}
+
+// wait blocks till both the global and the domain rate allow sending to
+// the address.
+func (s *MailerDaemon) wait(to string) {
+	if s.limiter != nil {
+		s.limiter.Wait(context.Background())
+	}
+	if l := s.domainLimiter(to); l != nil {
+		l.Wait(context.Background())
+	}
+}
+
+func (s *MailerDaemon) domainLimiter(to string) *rate.Limiter {
+	if len(s.domain_rates) == 0 {
+		return nil
+	}
+	domain := strings.ToLower(to[strings.LastIndex(to, "@") + 1:])
+	per_sec, ok := s.domain_rates[domain]
+	if !ok {
+		per_sec, ok = s.domain_rates["*"]
+	}
+	if !ok || per_sec <= 0 {
+		return nil
+	}
+
+	s.domain_mtx.Lock()
+	defer s.domain_mtx.Unlock()
+	l, ok := s.domain_limiters[domain]
+	if !ok {
+		l = rate.NewLimiter(rate.Limit(per_sec), 1)
+		s.domain_limiters[domain] = l
+	}
+	return l
+}
+
+// conn returns an open SMTP connection, reusing an idle one if it still
+// responds.
+func (s *MailerDaemon) conn() (*smtp.Client, error) {
+	for {
+		select {
+		case c := <-s.conns:
+			if c.Noop() == nil {
+				return c, nil
+			}
+			c.Close()
+			continue
+		default:
+		}
+		break
+	}
+
+	c, err := smtp.Dial(fmt.Sprintf("%s:%d", s.conf.Host, s.conf.Port))
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: s.conf.Host}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok && s.conf.Auth != nil {
+		if err = c.Auth(s.conf.Auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *MailerDaemon) release(c *smtp.Client) {
+	select {
+	case s.conns <- c:
+	default:
+		c.Quit()
+	}
+}
+
+func (s *MailerDaemon) send(from, to string, msg []byte) error {
+	c, err := s.conn()
+	if err != nil {
+		return err
+	}
+	err = c.Mail(from)
+	if err == nil {
+		err = c.Rcpt(to)
+	}
+	var w io.WriteCloser
+	if err == nil {
+		w, err = c.Data()
+	}
+	if err == nil {
+		if _, err = w.Write(msg); err == nil {
+			err = w.Close()
+		}
+	}
+	if err != nil {
+		// The connection may be in the middle of a transaction.
+		c.Close()
+		return err
+	}
+	if err = c.Reset(); err != nil {
+		c.Close()
+		return nil
+	}
+	s.release(c)
+	return nil
+}
+
+// WithSuppressionList makes SendEmail skip addresses suppressed in store.
+func (s *MailerDaemon) WithSuppressionList(store DeliveryStore) *MailerDaemon {
+	s.suppressions = store
+	return s
+}
+
+// WithLogger logs the daemon's errors to l instead of the package logger.
+func (s *MailerDaemon) WithLogger(l Logger) *MailerDaemon {
+	s.logger = l
+	return s
+}
+
+// WithTemplates sets the templates SendTemplate renders.
+func (s *MailerDaemon) WithTemplates(t *EmailTemplates) *MailerDaemon {
+	s.templates = t
+	return s
+}
+
+// SendTemplate renders template name in the variant for locale and sends
+// it to to.
+func (s *MailerDaemon) SendTemplate(to, name, locale string, data interface{}) error {
+	if s.templates == nil {
+		return ErrTemplateNotFound
+	}
+	r, err := s.templates.Render(name, locale, data)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(r.Subject, "\r\n") {
+		return ErrInvalidSubject
+	}
+	s.enqueue(to, r.Subject, tpl.HTML(r.Body))
+	return nil
+}
+
+// SendEmail queues the email. Line breaks in subject are replaced by spaces.
 func (s *MailerDaemon) SendEmail(to, subject, message string, args... interface{}) {
+	s.enqueue(to, subject, tpl.HTML(fmt.Sprintf(message, args...)))
+}
+
+// headerSafe drops line breaks, which would end the header they are in and
+// let the value add headers of its own.
+func headerSafe(val string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(val)
+}
+
+func (s *MailerDaemon) enqueue(to, subject string, message tpl.HTML) {
+	if strings.ContainsAny(to, "\r\n") {
+		loggerOr(s.logger).Errorf("Not emailing invalid address %q", to)
+		return
+	}
+	subject = headerSafe(subject)
+	if s.suppressions != nil {
+		suppressed, err := s.suppressions.Suppressed(to)
+		if err != nil {
+			// Better to send than to drop mail because the list is down.
+			loggerOr(s.logger).Errorf("Failed checking suppression list. Err:%s", err.Error())
+		} else if suppressed {
+			loggerOr(s.logger).Errorf("Not emailing suppressed address %s", to)
+			return
+		}
+	}
 	task := NewEmailSendTask(taskParams{
 		From: "no-reply@kuber.com",
 		To: to,
 		Subject: subject,
-		Message: tpl.HTML(fmt.Sprintf(message, args...)),
+		Message: message,
 	}, s)
 
 	s.runner.EnqueueTask(task)
@@ -85,15 +303,18 @@ func NewEmailSendTask(parms taskParams, sender *MailerDaemon) *emailTask {
 
 func (t *emailTask) Execute() {
 	var emailMessage bytes.Buffer
-	t.sndr.conf.Template.Execute(&emailMessage, &t.params)
-
-	err := smtp.SendMail(fmt.Sprintf("%s:%d", t.sndr.conf.Host, t.sndr.conf.Port), t.sndr.conf.Auth,
-		t.params.From, []string{t.params.To}, emailMessage.Bytes())
+	if err := t.sndr.conf.Template.Execute(&emailMessage, &t.params); err != nil {
+		loggerOr(t.sndr.logger).Errorf("Failed rendering email to %s. Err:%s", t.params.To, err.Error())
+		return
+	}
 
-	if err != nil && t.tries > 0 {
-		t.tries--
-		time.Sleep(100 * time.Millisecond)
-		t.Execute()
+	err := Retry(context.Background(), BackoffPolicy{MaxAttempts: t.tries + 1, Multiplier: 1},
+		func(ctx context.Context) error {
+			t.sndr.wait(t.params.To)
+			return t.sndr.send(t.params.From, t.params.To, emailMessage.Bytes())
+		})
+	if err != nil {
+		loggerOr(t.sndr.logger).Errorf("Failed sending email to %s. Err:%s", t.params.To, err.Error())
 	}
 }
 
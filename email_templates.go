@@ -0,0 +1,201 @@
+package backend_utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	tpl "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+var (
+	ErrTemplateNotFound = errors.New("Template not found.")
+	// Line breaks in a subject would let template data add headers.
+	ErrInvalidSubject = errors.New("Rendered subject contains line breaks.")
+)
+
+type emailTemplate struct {
+	subject	*template.Template
+	body	*tpl.Template
+}
+
+// RenderedEmail is an email rendered from EmailTemplates.
+type RenderedEmail struct {
+	// Locale of the variant used.
+	Locale	string
+	Subject	string
+	Body	string
+}
+
+// EmailTemplates holds named email templates in per-locale variants.
+// Rendering in a locale falls back along LocaleChain, e.g. "pt-BR", "pt"
+// and then the default locale.
+//
+// Templates get a "plural" function picking the form for a count in the
+// variant's language: {{plural .Count "one" "%d item" "other" "%d items"}}.
+type EmailTemplates struct {
+	def_locale	string
+	mtx		sync.RWMutex
+	// By name, then by locale.
+	templates	map[string] map[string] *emailTemplate
+}
+
+func NewEmailTemplates(def_locale string) *EmailTemplates {
+	return &EmailTemplates{
+		def_locale: NormalizeLocale(def_locale),
+		templates: make(map[string] map[string] *emailTemplate),
+	}
+}
+
+func templateFuncs(locale string) map[string] interface{} {
+	return map[string] interface{}{
+		"plural": func(count interface{}, forms ...string) string {
+			n := toInt(count)
+			text := pluralPick(locale, n, forms)
+			if strings.Contains(text, "%d") {
+				return fmt.Sprintf(text, n)
+			}
+			return text
+		},
+	}
+}
+
+func toInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case uint:
+		return int(n)
+	case uint32:
+		return int(n)
+	case uint64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// Add registers the locale variant of template name. subject is a
+// text/template, body an html/template.
+func (t *EmailTemplates) Add(name, locale, subject, body string) error {
+	locale = NormalizeLocale(locale)
+	funcs := templateFuncs(locale)
+	s, err := template.New(name).Funcs(funcs).Parse(subject)
+	if err != nil {
+		return err
+	}
+	b, err := tpl.New(name).Funcs(funcs).Parse(body)
+	if err != nil {
+		return err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.templates[name] == nil {
+		t.templates[name] = make(map[string] *emailTemplate)
+	}
+	t.templates[name][locale] = &emailTemplate{subject: s, body: b}
+	return nil
+}
+
+// LoadDir adds the templates laid out as <dir>/<locale>/<name>.html, with
+// the subject in <name>.subject next to it.
+func (t *EmailTemplates) LoadDir(dir string) error {
+	bodies, err := filepath.Glob(filepath.Join(dir, "*", "*.html"))
+	if err != nil {
+		return err
+	}
+	for _, path := range bodies {
+		locale := filepath.Base(filepath.Dir(path))
+		name := strings.TrimSuffix(filepath.Base(path), ".html")
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		subject, err := ioutil.ReadFile(strings.TrimSuffix(path, ".html") + ".subject")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err = t.Add(name, locale, strings.TrimSpace(string(subject)), string(body)); err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+	return nil
+}
+
+func (t *EmailTemplates) lookup(name, locale string) (*emailTemplate, string) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	variants := t.templates[name]
+	for _, l := range LocaleChain(locale, t.def_locale) {
+		if v, ok := variants[l]; ok {
+			return v, l
+		}
+	}
+	return nil, ""
+}
+
+func (v *emailTemplate) render(locale string, data interface{}) (*RenderedEmail, error) {
+	var subject, body bytes.Buffer
+	if err := v.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := v.body.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	return &RenderedEmail{Locale: locale, Subject: subject.String(), Body: body.String()}, nil
+}
+
+// Render renders template name in the best variant for locale.
+func (t *EmailTemplates) Render(name, locale string, data interface{}) (*RenderedEmail, error) {
+	v, used := t.lookup(name, locale)
+	if v == nil {
+		return nil, ErrTemplateNotFound
+	}
+	return v.render(used, data)
+}
+
+// Locales lists the locales template name has variants in.
+func (t *EmailTemplates) Locales(name string) []string {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	locales := make([]string, 0, len(t.templates[name]))
+	for l := range t.templates[name] {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Preview renders every variant of template name with data, e.g. for
+// reviewing translations. Variants failing to render carry the error as
+// their body.
+func (t *EmailTemplates) Preview(name string, data interface{}) ([]RenderedEmail, error) {
+	locales := t.Locales(name)
+	if len(locales) == 0 {
+		return nil, ErrTemplateNotFound
+	}
+	previews := make([]RenderedEmail, 0, len(locales))
+	for _, l := range locales {
+		t.mtx.RLock()
+		v := t.templates[name][l]
+		t.mtx.RUnlock()
+		r, err := v.render(l, data)
+		if err != nil {
+			r = &RenderedEmail{Locale: l, Body: "Render failed: " + err.Error()}
+		}
+		previews = append(previews, *r)
+	}
+	return previews, nil
+}
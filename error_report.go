@@ -0,0 +1,171 @@
+package backend_utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Levels of ErrorEvent.
+const (
+	ERROR_LEVEL_ERROR = "error"
+	ERROR_LEVEL_FATAL = "fatal"
+)
+
+const DEFAULT_ERROR_DEDUP_WINDOW = time.Minute
+
+// ErrorEvent is an error or panic reported to the ErrorReporter.
+type ErrorEvent struct {
+	Level		string
+	Message		string
+	// Type of the error or panic value, e.g. "*errors.errorString".
+	Type		string
+	Stack		[]byte
+	// Events with the same fingerprint are the same issue.
+	Fingerprint	string
+	// Release, git_sha and environment are always set. Reporters of
+	// deduplicated events also get "repeats", the events suppressed since
+	// the last one reported.
+	Tags		map[string] string
+	Time		time.Time
+}
+
+// ErrorReporter sends events to an issue tracker, e.g. NewSentryReporter.
+// Report is called inline by the recovery interceptor and LogUtil.Error,
+// so it must not block.
+type ErrorReporter interface {
+	Report(ev *ErrorEvent)
+}
+
+type ErrorReportingConfig struct {
+	// Sentry DSN, e.g. https://<key>@sentry.example.com/<project>.
+	SentryDSN	string		`json:"sentry_dsn" secret:"true"`
+	Environment	string		`json:"environment"`
+	// Fraction of errors reported, 0 means 1. Panics are always reported.
+	SampleRate	float64		`json:"sample_rate"`
+	// Repeats of an issue within this are counted, not reported.
+	// Defaults to DEFAULT_ERROR_DEDUP_WINDOW.
+	DedupWindow	Duration	`json:"dedup_window"`
+}
+
+// Install sets up error reporting to Sentry if a DSN is configured.
+func (c *ErrorReportingConfig) Install() error {
+	if len(c.SentryDSN) == 0 {
+		return nil
+	}
+	r, err := NewSentryReporter(c.SentryDSN)
+	if err != nil {
+		return err
+	}
+	SetErrorReporter(r, *c)
+	return nil
+}
+
+type dedupEntry struct {
+	reported	time.Time
+	repeats		int
+}
+
+var errReporting = struct {
+	sync.Mutex
+	r	ErrorReporter
+	conf	ErrorReportingConfig
+	seen	map[string] *dedupEntry
+}{}
+
+// SetErrorReporter routes errors and panics to r with the sampling and
+// deduplication of conf. nil stops reporting.
+func SetErrorReporter(r ErrorReporter, conf ErrorReportingConfig) {
+	if conf.DedupWindow.Duration <= 0 {
+		conf.DedupWindow.Duration = DEFAULT_ERROR_DEDUP_WINDOW
+	}
+	errReporting.Lock()
+	defer errReporting.Unlock()
+	errReporting.r = r
+	errReporting.conf = conf
+	errReporting.seen = make(map[string] *dedupEntry)
+}
+
+// Numbers, e.g. ids and durations, don't make messages different issues.
+var fingerprintNumbers = regexp.MustCompile(`[0-9]+`)
+
+func errorFingerprint(typ, msg string) string {
+	sum := sha256.Sum256([]byte(typ + "\x00" + fingerprintNumbers.ReplaceAllString(msg, "N")))
+	return hex.EncodeToString(sum[:8])
+}
+
+func report(level, typ, msg string, stack []byte, tags map[string] string) {
+	errReporting.Lock()
+	r, conf := errReporting.r, errReporting.conf
+	if r == nil {
+		errReporting.Unlock()
+		return
+	}
+	if level != ERROR_LEVEL_FATAL && conf.SampleRate > 0 && conf.SampleRate < 1 &&
+		rand.Float64() >= conf.SampleRate {
+		errReporting.Unlock()
+		return
+	}
+	now := pkgClock().Now()
+	fp := errorFingerprint(typ, msg)
+	e, ok := errReporting.seen[fp]
+	if ok && now.Sub(e.reported) < conf.DedupWindow.Duration {
+		e.repeats++
+		errReporting.Unlock()
+		return
+	}
+	repeats := 0
+	if ok {
+		repeats = e.repeats
+	}
+	errReporting.seen[fp] = &dedupEntry{reported: now}
+	// Forget issues quiet for a while so the map doesn't grow forever.
+	for k, v := range errReporting.seen {
+		if now.Sub(v.reported) > 10 * conf.DedupWindow.Duration {
+			delete(errReporting.seen, k)
+		}
+	}
+	errReporting.Unlock()
+
+	info := GetBuildInfo()
+	ev := &ErrorEvent{
+		Level: level,
+		Message: msg,
+		Type: typ,
+		Stack: stack,
+		Fingerprint: fp,
+		Tags: map[string] string{
+			"release": info.Version,
+			"git_sha": info.GitSHA,
+			"environment": conf.Environment,
+		},
+		Time: now,
+	}
+	if repeats > 0 {
+		ev.Tags["repeats"] = fmt.Sprint(repeats)
+	}
+	for k, v := range tags {
+		ev.Tags[k] = v
+	}
+	r.Report(ev)
+}
+
+// ReportError reports err, e.g. an unexpected error a handler turns into
+// Internal. tags are added to the event.
+func ReportError(err error, tags map[string] string) {
+	if err == nil {
+		return
+	}
+	report(ERROR_LEVEL_ERROR, fmt.Sprintf("%T", err), err.Error(), debug.Stack(), tags)
+}
+
+// reportPanic reports a recovered panic. Called from the recovery handler,
+// which still runs on the panicking stack.
+func reportPanic(p interface{}) {
+	report(ERROR_LEVEL_FATAL, fmt.Sprintf("%T", p), fmt.Sprint(p), debug.Stack(), nil)
+}
@@ -0,0 +1,220 @@
+package backend_utils
+
+import (
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+var eventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backend_utils_events_total",
+	Help: "Events handed to subscribers, by topic and result.",
+}, []string{"topic", "result"})
+
+func init() {
+	prometheus.MustRegister(eventCounter)
+}
+
+// Topic names a kind of event. Events published on it must have the type
+// of the example it was created with.
+type Topic struct {
+	Name	string
+	typ	reflect.Type
+}
+
+func NewTopic(name string, example interface{}) Topic {
+	return Topic{Name: name, typ: reflect.TypeOf(example)}
+}
+
+// Topics published by the package itself on DefaultEventBus.
+var (
+	// Events are []ConfigChange, published by ConfigReloader.
+	TopicConfigReloaded = NewTopic("config_reloaded", []ConfigChange{})
+	// Events are PoolEvent, published by pools using PoolEventHooks.
+	TopicPoolEvent = NewTopic("pool_event", PoolEvent{})
+)
+
+// Bus used by the package's own subsystems.
+var DefaultEventBus = NewEventBus()
+
+type subscription struct {
+	id	int
+	fn	func(event interface{})
+	// nil for synchronous subscribers.
+	queue	chan interface{}
+	done	chan struct{}
+}
+
+// EventBus delivers events to the subscribers of their topic within the
+// process. Synchronous subscribers run in Publish, asynchronous ones in a
+// goroutine of their own. A panicking subscriber is logged and skipped,
+// the others still get the event.
+type EventBus struct {
+	mtx	sync.Mutex
+	subs	map[string] []*subscription
+	next_id	int
+	closed	bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[string] []*subscription)}
+}
+
+func (b *EventBus) add(topic Topic, s *subscription) func() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.next_id++
+	s.id = b.next_id
+	b.subs[topic.Name] = append(b.subs[topic.Name], s)
+	return func() { b.remove(topic, s.id) }
+}
+
+func (b *EventBus) remove(topic Topic, id int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	subs := b.subs[topic.Name]
+	for i := range subs {
+		if subs[i].id == id {
+			if subs[i].queue != nil {
+				close(subs[i].queue)
+			}
+			b.subs[topic.Name] = append(subs[:i:i], subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Subscribe calls fn with every event published on topic, before Publish
+// returns. Call the returned func to unsubscribe.
+func (b *EventBus) Subscribe(topic Topic, fn func(event interface{})) func() {
+	return b.add(topic, &subscription{fn: fn})
+}
+
+// SubscribeAsync calls fn with the events of topic from a goroutine, in
+// the order published. Up to buffer events are queued, more are dropped
+// till fn catches up.
+func (b *EventBus) SubscribeAsync(topic Topic, buffer int, fn func(event interface{})) func() {
+	s := &subscription{
+		fn: fn,
+		queue: make(chan interface{}, buffer),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		for event := range s.queue {
+			deliverEvent(topic, s.fn, event)
+		}
+	}()
+	return b.add(topic, s)
+}
+
+func deliverEvent(topic Topic, fn func(event interface{}), event interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			pkgLog().Errorf("Subscriber of %s panicked: %v\n%s", topic.Name, r, debug.Stack())
+			eventCounter.WithLabelValues(topic.Name, "panicked").Inc()
+		}
+	}()
+	fn(event)
+	eventCounter.WithLabelValues(topic.Name, "delivered").Inc()
+}
+
+// Publish hands event to the subscribers of topic. It fails if event
+// doesn't have the topic's type or the bus is closed.
+func (b *EventBus) Publish(topic Topic, event interface{}) error {
+
+	if topic.typ != nil && reflect.TypeOf(event) != topic.typ {
+		return fmt.Errorf("Event of type %T published on %s, which takes %s", event, topic.Name, topic.typ)
+	}
+
+	b.mtx.Lock()
+	if b.closed {
+		b.mtx.Unlock()
+		return fmt.Errorf("Event bus closed")
+	}
+	subs := make([]*subscription, len(b.subs[topic.Name]))
+	copy(subs, b.subs[topic.Name])
+
+	// Queued under the lock so that remove can't close the queue meanwhile.
+	var sync_subs []*subscription
+	for _, s := range subs {
+		if s.queue == nil {
+			sync_subs = append(sync_subs, s)
+			continue
+		}
+		select {
+		case s.queue <- event:
+		default:
+			eventCounter.WithLabelValues(topic.Name, "dropped").Inc()
+		}
+	}
+	b.mtx.Unlock()
+
+	for _, s := range sync_subs {
+		deliverEvent(topic, s.fn, event)
+	}
+	return nil
+}
+
+// Close unsubscribes everyone and waits for the asynchronous subscribers to
+// handle the events already queued.
+func (b *EventBus) Close() {
+	b.mtx.Lock()
+	b.closed = true
+	var pending []*subscription
+	for _, subs := range b.subs {
+		for _, s := range subs {
+			if s.queue != nil {
+				close(s.queue)
+				pending = append(pending, s)
+			}
+		}
+	}
+	b.subs = make(map[string] []*subscription)
+	b.mtx.Unlock()
+
+	for _, s := range pending {
+		<-s.done
+	}
+}
+
+// Kinds of PoolEvent.
+const (
+	POOL_EVENT_DIAL_FAIL = "dial_fail"
+	POOL_EVENT_HEARTBEAT_FAIL = "heartbeat_fail"
+	POOL_EVENT_ENDPOINT_UP = "endpoint_up"
+	POOL_EVENT_ENDPOINT_DOWN = "endpoint_down"
+)
+
+type PoolEvent struct {
+	Kind		string
+	// Endpoint as passed to the pool.
+	Endpoint	interface{}
+	Err		error
+}
+
+// PoolEventHooks returns pool hooks publishing failures and endpoint
+// up/down transitions on TopicPoolEvent of bus. Gets and puts are too
+// frequent to be worth an event each.
+func PoolEventHooks(bus *EventBus) PoolHooks {
+	return PoolHooks{
+		OnDialFail: func(ep interface{}, err error) {
+			bus.Publish(TopicPoolEvent, PoolEvent{Kind: POOL_EVENT_DIAL_FAIL, Endpoint: ep, Err: err})
+		},
+		OnHeartbeatFail: func(ep interface{}, conn *grpc.ClientConn, err error) {
+			bus.Publish(TopicPoolEvent, PoolEvent{Kind: POOL_EVENT_HEARTBEAT_FAIL, Endpoint: ep, Err: err})
+		},
+		OnEndpointState: func(ep interface{}, up bool, err error) {
+			kind := POOL_EVENT_ENDPOINT_DOWN
+			if up {
+				kind = POOL_EVENT_ENDPOINT_UP
+			}
+			bus.Publish(TopicPoolEvent, PoolEvent{Kind: kind, Endpoint: ep, Err: err})
+		},
+	}
+}
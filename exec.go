@@ -0,0 +1,125 @@
+package backend_utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+	"golang.org/x/net/context"
+)
+
+type CmdOptions struct {
+	// Kill the command if it runs longer. 0 means no timeout.
+	Timeout		time.Duration
+	// Extra "KEY=value" entries added to the current environment.
+	Env		[]string
+	// Working directory. Defaults to the current one.
+	Dir		string
+	// Called with every line of output as the command produces it.
+	OnStdout	func(line string)
+	OnStderr	func(line string)
+}
+
+// lineWriter calls fn for every complete line written to it.
+type lineWriter struct {
+	mtx	sync.Mutex
+	fn	func(string)
+	buf	[]byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.fn(string(bytes.TrimRight(l.buf[:i], "\r")))
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (l *lineWriter) flush() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if len(l.buf) > 0 {
+		l.fn(string(l.buf))
+		l.buf = nil
+	}
+}
+
+func outputWriter(buf *bytes.Buffer, fn func(string)) (io.Writer, *lineWriter) {
+	if fn == nil {
+		return buf, nil
+	}
+	lw := &lineWriter{fn: fn}
+	return io.MultiWriter(buf, lw), lw
+}
+
+// ExecCommandContext runs the command in its own process group. If ctx is
+// done or the timeout expires the whole group is killed, so children started
+// by the command don't keep running. Output collected so far is returned
+// along with the error. The command is subject to the ExecPolicy, if set.
+func ExecCommandContext(ctx context.Context, opts *CmdOptions, name string, args... string) (result *CmdResult) {
+
+	result = new(CmdResult)
+
+	done_fn, err := checkExecPolicy(name, args)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	defer func() { done_fn(result) }()
+
+	if opts == nil {
+		opts = &CmdOptions{}
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Dir = opts.Dir
+	if len(opts.Env) > 0 {
+		cmd.Env = append(os.Environ(), opts.Env...)
+	}
+	setProcessGroup(cmd)
+
+	var stdOut, stdErr bytes.Buffer
+	var out_lw, err_lw *lineWriter
+	cmd.Stdout, out_lw = outputWriter(&stdOut, opts.OnStdout)
+	cmd.Stderr, err_lw = outputWriter(&stdErr, opts.OnStderr)
+
+	result.Err = cmd.Start()
+	if result.Err != nil {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case result.Err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		result.Err = ctx.Err()
+	}
+
+	if out_lw != nil {
+		out_lw.flush()
+	}
+	if err_lw != nil {
+		err_lw.flush()
+	}
+	result.StdOut = stdOut.String()
+	result.StdErr = stdErr.String()
+	return
+}
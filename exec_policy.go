@@ -0,0 +1,132 @@
+package backend_utils
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ErrExecNotAllowed = errors.New("Command not allowed by exec policy.")
+
+// Matches things like password=..., --token xyz is not caught.
+var DefaultRedactPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(password|passwd|pwd|secret|token|api_?key)=\S*`),
+	regexp.MustCompile(`://[^/\s:@]+:[^@\s]+@`),
+}
+
+// ExecPolicy is applied to every ExecCommand and ExecCommandContext call.
+type ExecPolicy struct {
+	// Commands allowed to run. Bare names are matched against the name
+	// as given, absolute paths against the resolved binary. Empty allows all.
+	Allowed		[]string
+	// Parts of args matching any of these are logged as REDACTED.
+	// DefaultRedactPatterns if nil, an empty list logs args as they are.
+	RedactPatterns	[]*regexp.Regexp
+	// Every invocation is logged here if set.
+	Logger		*LogUtil
+}
+
+var (
+	exec_policy_mtx	sync.RWMutex
+	exec_policy	*ExecPolicy
+
+	execCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_utils_exec_total",
+		Help: "Commands run by ExecCommand, by command and result.",
+	}, []string{"command", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(execCounter)
+}
+
+// SetExecPolicy replaces the current policy. nil removes it.
+func SetExecPolicy(p *ExecPolicy) {
+	exec_policy_mtx.Lock()
+	defer exec_policy_mtx.Unlock()
+	exec_policy = p
+}
+
+func currentExecPolicy() *ExecPolicy {
+	exec_policy_mtx.RLock()
+	defer exec_policy_mtx.RUnlock()
+	return exec_policy
+}
+
+func (p *ExecPolicy) allowed(name string) bool {
+
+	if len(p.Allowed) == 0 {
+		return true
+	}
+
+	resolved, err := exec.LookPath(name)
+	if err == nil {
+		resolved, _ = filepath.Abs(resolved)
+	}
+	is_path := strings.ContainsRune(name, filepath.Separator)
+
+	for _, a := range p.Allowed {
+		if filepath.IsAbs(a) {
+			if err == nil && resolved == filepath.Clean(a) {
+				return true
+			}
+		} else if !is_path && a == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ExecPolicy) redact(args []string) string {
+	patterns := p.RedactPatterns
+	if patterns == nil {
+		patterns = DefaultRedactPatterns
+	}
+	out := make([]string, len(args))
+	for i := range args {
+		out[i] = args[i]
+		for _, re := range patterns {
+			out[i] = re.ReplaceAllString(out[i], REDACTED)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// checkExecPolicy is called before starting a command. The returned func
+// is called with the result once the command is done.
+func checkExecPolicy(name string, args []string) (func(*CmdResult), error) {
+
+	p := currentExecPolicy()
+	start := time.Now()
+
+	if p != nil && !p.allowed(name) {
+		execCounter.WithLabelValues(filepath.Base(name), "denied").Inc()
+		if p.Logger != nil {
+			p.Logger.Error(ErrExecNotAllowed, "Exec denied. Cmd:%s Args:%s", name, p.redact(args))
+		}
+		return nil, ErrExecNotAllowed
+	}
+
+	return func(result *CmdResult) {
+		status := "success"
+		if result.Err != nil {
+			status = "failure"
+		}
+		execCounter.WithLabelValues(filepath.Base(name), status).Inc()
+
+		if p == nil || p.Logger == nil {
+			return
+		}
+		if result.Err != nil {
+			p.Logger.Error(result.Err, "Exec failed. Cmd:%s Args:%s Took:%s", name,
+				p.redact(args), time.Since(start))
+		} else {
+			p.Logger.Info("Exec done. Cmd:%s Args:%s Took:%s", name, p.redact(args), time.Since(start))
+		}
+	}, nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package backend_utils
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	// Negative pid signals the whole group.
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package backend_utils
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// There are no process groups to signal, only the command itself is killed.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
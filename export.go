@@ -0,0 +1,351 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/parquet-go"
+	"golang.org/x/net/context"
+)
+
+// Export formats.
+const (
+	EXPORT_CSV = "csv"
+	EXPORT_PARQUET = "parquet"
+
+	// Rows buffered before being flushed, which is also the size of the
+	// Parquet row groups.
+	DEFAULT_EXPORT_CHUNK = 10000
+)
+
+// Queryer is satisfied by *sql.DB, *sql.Tx, *sql.Conn and StmtDB.
+type Queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type ExportOptions struct {
+	// Defaults to DEFAULT_EXPORT_CHUNK.
+	ChunkRows	int
+	// Layout of time values in CSV. Defaults to time.RFC3339Nano.
+	TimeFormat	string
+	// Leave out the CSV header line.
+	NoHeader	bool
+}
+
+func (o *ExportOptions) chunkRows() int {
+	if o.ChunkRows <= 0 {
+		return DEFAULT_EXPORT_CHUNK
+	}
+	return o.ChunkRows
+}
+
+func (o *ExportOptions) timeFormat() string {
+	if len(o.TimeFormat) == 0 {
+		return time.RFC3339Nano
+	}
+	return o.TimeFormat
+}
+
+// Column kinds the database types are mapped to.
+const (
+	colString = iota
+	colInt
+	colFloat
+	colBool
+	colTime
+)
+
+// NUMERIC stays a string so that no precision is lost.
+func columnKind(ct *sql.ColumnType) int {
+	switch strings.ToUpper(ct.DatabaseTypeName()) {
+	case "INT2", "INT4", "INT8":
+		return colInt
+	case "FLOAT4", "FLOAT8":
+		return colFloat
+	case "BOOL":
+		return colBool
+	case "DATE", "TIMESTAMP", "TIMESTAMPTZ":
+		return colTime
+	}
+	return colString
+}
+
+// exportRows scans the rows of query one by one, calling fn with the
+// scanned values, which are reused between calls.
+func exportRows(ctx context.Context, db Queryer, query string, args []interface{},
+	start func(cols []*sql.ColumnType) error, fn func(vals []interface{}) error) (int64, error) {
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+	if err = start(cols); err != nil {
+		return 0, err
+	}
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	var n int64
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		if err = fn(vals); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func csvValue(v interface{}, time_format string) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(t)
+	case string:
+		return t
+	case time.Time:
+		return t.Format(time_format)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// ExportCSV writes the result of query to w as CSV, holding at most a
+// chunk of rows in memory. It returns the number of rows written.
+func ExportCSV(ctx context.Context, db Queryer, w io.Writer, opts ExportOptions,
+	query string, args ...interface{}) (int64, error) {
+
+	cw := csv.NewWriter(w)
+	chunk := opts.chunkRows()
+	time_format := opts.timeFormat()
+	var record []string
+	buffered := 0
+
+	n, err := exportRows(ctx, db, query, args, func(cols []*sql.ColumnType) error {
+		record = make([]string, len(cols))
+		if opts.NoHeader {
+			return nil
+		}
+		for i := range cols {
+			record[i] = cols[i].Name()
+		}
+		return cw.Write(record)
+	}, func(vals []interface{}) error {
+		for i := range vals {
+			record[i] = csvValue(vals[i], time_format)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+		if buffered++; buffered >= chunk {
+			buffered = 0
+			cw.Flush()
+			return cw.Error()
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
+
+func parquetNode(kind int, nullable bool) parquet.Node {
+	var node parquet.Node
+	switch kind {
+	case colInt:
+		node = parquet.Leaf(parquet.Int64Type)
+	case colFloat:
+		node = parquet.Leaf(parquet.DoubleType)
+	case colBool:
+		node = parquet.Leaf(parquet.BooleanType)
+	case colTime:
+		node = parquet.Timestamp(parquet.Microsecond)
+	default:
+		node = parquet.String()
+	}
+	if nullable {
+		node = parquet.Optional(node)
+	}
+	return node
+}
+
+// parquetValue converts a scanned value to the column kind. Drivers return
+// some types as text, so those are parsed.
+func parquetValue(kind int, v interface{}) (parquet.Value, error) {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	s, is_str := v.(string)
+	switch kind {
+	case colInt:
+		if is_str {
+			i, err := strconv.ParseInt(s, 10, 64)
+			return parquet.ValueOf(i), err
+		}
+	case colFloat:
+		if is_str {
+			f, err := strconv.ParseFloat(s, 64)
+			return parquet.ValueOf(f), err
+		}
+	case colBool:
+		if is_str {
+			b, err := strconv.ParseBool(s)
+			return parquet.ValueOf(b), err
+		}
+	case colTime:
+		if t, ok := v.(time.Time); ok {
+			return parquet.ValueOf(t.UnixNano() / int64(time.Microsecond)), nil
+		}
+		return parquet.Value{}, fmt.Errorf("unexpected time value %T", v)
+	default:
+		if !is_str {
+			s = fmt.Sprint(v)
+		}
+		return parquet.ValueOf(s), nil
+	}
+	return parquet.ValueOf(v), nil
+}
+
+// ExportParquet writes the result of query to w as a Parquet file, one row
+// group per chunk of rows. Columns are optional unless the database reports
+// them as NOT NULL. It returns the number of rows written.
+func ExportParquet(ctx context.Context, db Queryer, w io.Writer, opts ExportOptions,
+	query string, args ...interface{}) (int64, error) {
+
+	chunk := opts.chunkRows()
+	var (
+		pw	*parquet.Writer
+		kinds	[]int
+		// Parquet orders the columns of a group by name.
+		leaf	[]int
+		nullable []bool
+		buf	[]parquet.Row
+	)
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		if _, err := pw.WriteRows(buf); err != nil {
+			return err
+		}
+		buf = buf[:0]
+		return pw.Flush()
+	}
+
+	n, err := exportRows(ctx, db, query, args, func(cols []*sql.ColumnType) error {
+		group := make(parquet.Group, len(cols))
+		kinds = make([]int, len(cols))
+		nullable = make([]bool, len(cols))
+		for i, col := range cols {
+			if _, dup := group[col.Name()]; dup {
+				return fmt.Errorf("duplicate column %s", col.Name())
+			}
+			is_nullable, ok := col.Nullable()
+			kinds[i] = columnKind(col)
+			nullable[i] = !ok || is_nullable
+			group[col.Name()] = parquetNode(kinds[i], nullable[i])
+		}
+		schema := parquet.NewSchema("export", group)
+		leaf = make([]int, len(cols))
+		for i, col := range cols {
+			for j, f := range schema.Fields() {
+				if f.Name() == col.Name() {
+					leaf[i] = j
+				}
+			}
+		}
+		pw = parquet.NewWriter(w, schema)
+		buf = make([]parquet.Row, 0, chunk)
+		return nil
+	}, func(vals []interface{}) error {
+		row := make(parquet.Row, len(vals))
+		for i, v := range vals {
+			col := leaf[i]
+			if v == nil {
+				if !nullable[i] {
+					return fmt.Errorf("NULL in NOT NULL column %d", i)
+				}
+				row[col] = parquet.Value{}.Level(0, 0, col)
+				continue
+			}
+			pv, err := parquetValue(kinds[i], v)
+			if err != nil {
+				return err
+			}
+			def := 0
+			if nullable[i] {
+				def = 1
+			}
+			row[col] = pv.Level(0, def, col)
+		}
+		buf = append(buf, row)
+		if len(buf) >= chunk {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if pw == nil {
+		return 0, nil
+	}
+	if err = flush(); err != nil {
+		return 0, err
+	}
+	return n, pw.Close()
+}
+
+// ExportToFileStore streams the result of query into the object name of
+// store, in format EXPORT_CSV or EXPORT_PARQUET.
+func ExportToFileStore(ctx context.Context, db Queryer, store FileStore, name, format string,
+	opts ExportOptions, query string, args ...interface{}) (int64, error) {
+
+	var export func(context.Context, Queryer, io.Writer, ExportOptions, string, ...interface{}) (int64, error)
+	switch format {
+	case EXPORT_CSV:
+		export = ExportCSV
+	case EXPORT_PARQUET:
+		export = ExportParquet
+	default:
+		return 0, fmt.Errorf("unknown export format %s", format)
+	}
+
+	pr, pw := io.Pipe()
+	var n int64
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		n, err = export(ctx, db, pw, opts, query, args...)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	put_err := store.Put(name, pr)
+	// Unblock the export if Put gave up early.
+	pr.CloseWithError(put_err)
+	if err := <-done; err != nil {
+		return n, err
+	}
+	return n, put_err
+}
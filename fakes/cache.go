@@ -0,0 +1,64 @@
+package fakes
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"github.com/aloknerurkar/backend_utils"
+)
+
+type cacheEntry struct {
+	val	[]byte
+	expiry	time.Time
+}
+
+// Cache is an in-memory backend_utils.Cache which counts hits and misses.
+type Cache struct {
+	mtx	sync.Mutex
+	entries	map[string] cacheEntry
+	Hits	int
+	Misses	int
+}
+
+func NewCache() *Cache {
+	return &Cache{entries: make(map[string] cacheEntry)}
+}
+
+func (c *Cache) Get(key string) ([]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.entries[key]
+	if !ok || (!e.expiry.IsZero() && time.Now().After(e.expiry)) {
+		c.Misses++
+		return nil, backend_utils.ErrCacheMiss
+	}
+	c.Hits++
+	return e.val, nil
+}
+
+func (c *Cache) Set(key string, val []byte, ttl time.Duration) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e := cacheEntry{val: val}
+	if ttl > 0 {
+		e.expiry = time.Now().Add(ttl)
+	}
+	c.entries[key] = e
+	return nil
+}
+
+func (c *Cache) Delete(key string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+func (c *Cache) AssertHits(t testing.TB, hits, misses int) {
+	t.Helper()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.Hits != hits || c.Misses != misses {
+		t.Errorf("Expected %d hits %d misses, got %d hits %d misses", hits, misses, c.Hits, c.Misses)
+	}
+}
@@ -0,0 +1,107 @@
+package fakes
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/aloknerurkar/backend_utils"
+)
+
+// FileStore is an in-memory backend_utils.FileStore.
+type FileStore struct {
+	mtx	sync.Mutex
+	objs	map[string] []byte
+	mtimes	map[string] time.Time
+}
+
+func NewFileStore() *FileStore {
+	return &FileStore{
+		objs: make(map[string] []byte),
+		mtimes: make(map[string] time.Time),
+	}
+}
+
+func (f *FileStore) Put(name string, r io.Reader) error {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.objs[name] = buf
+	f.mtimes[name] = time.Now()
+	return nil
+}
+
+func (f *FileStore) Get(name string) (io.ReadCloser, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	buf, ok := f.objs[name]
+	if !ok {
+		return nil, backend_utils.ErrObjectNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (f *FileStore) Stat(name string) (*backend_utils.ObjectInfo, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	buf, ok := f.objs[name]
+	if !ok {
+		return nil, backend_utils.ErrObjectNotFound
+	}
+	return &backend_utils.ObjectInfo{Name: name, Size: int64(len(buf)), ModTime: f.mtimes[name]}, nil
+}
+
+func (f *FileStore) Delete(name string) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, ok := f.objs[name]; !ok {
+		return backend_utils.ErrObjectNotFound
+	}
+	delete(f.objs, name)
+	delete(f.mtimes, name)
+	return nil
+}
+
+func (f *FileStore) List(prefix string) ([]backend_utils.ObjectInfo, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	var objs []backend_utils.ObjectInfo
+	for name, buf := range f.objs {
+		if strings.HasPrefix(name, prefix) {
+			objs = append(objs, backend_utils.ObjectInfo{
+				Name: name, Size: int64(len(buf)), ModTime: f.mtimes[name]})
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Name < objs[j].Name })
+	return objs, nil
+}
+
+func (f *FileStore) AssertContent(t testing.TB, name string, content []byte) {
+	t.Helper()
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	buf, ok := f.objs[name]
+	if !ok {
+		t.Errorf("Object %s not found", name)
+		return
+	}
+	if !bytes.Equal(buf, content) {
+		t.Errorf("Object %s has content %q, expected %q", name, buf, content)
+	}
+}
+
+func (f *FileStore) AssertNotExists(t testing.TB, name string) {
+	t.Helper()
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, ok := f.objs[name]; ok {
+		t.Errorf("Object %s exists", name)
+	}
+}
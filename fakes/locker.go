@@ -0,0 +1,81 @@
+package fakes
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"github.com/aloknerurkar/backend_utils"
+)
+
+// Locker is an in-process backend_utils.Locker which counts lock calls.
+type Locker struct {
+	mtx	sync.Mutex
+	locks	map[string] chan struct{}
+	counts	map[string] int
+}
+
+func NewLocker() *Locker {
+	return &Locker{
+		locks: make(map[string] chan struct{}),
+		counts: make(map[string] int),
+	}
+}
+
+func (l *Locker) lockChan(key string) chan struct{} {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	ch, ok := l.locks[key]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		l.locks[key] = ch
+	}
+	return ch
+}
+
+func (l *Locker) Lock(key string, timeout time.Duration) error {
+	select {
+	case l.lockChan(key) <- struct{}{}:
+	case <-time.After(timeout):
+		return backend_utils.ErrLockTimeout
+	}
+	l.mtx.Lock()
+	l.counts[key]++
+	l.mtx.Unlock()
+	return nil
+}
+
+func (l *Locker) Unlock(key string) error {
+	select {
+	case <-l.lockChan(key):
+		return nil
+	default:
+		return backend_utils.ErrNotLocked
+	}
+}
+
+func (l *Locker) Held(key string) bool {
+	return len(l.lockChan(key)) > 0
+}
+
+func (l *Locker) AssertHeld(t testing.TB, key string) {
+	t.Helper()
+	if !l.Held(key) {
+		t.Errorf("Lock %s not held", key)
+	}
+}
+
+func (l *Locker) AssertNotHeld(t testing.TB, key string) {
+	t.Helper()
+	if l.Held(key) {
+		t.Errorf("Lock %s is held", key)
+	}
+}
+
+func (l *Locker) AssertLockCount(t testing.TB, key string, n int) {
+	t.Helper()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.counts[key] != n {
+		t.Errorf("Expected lock %s taken %d times, got %d", key, n, l.counts[key])
+	}
+}
@@ -0,0 +1,67 @@
+// Package fakes has in-memory implementations of the backend_utils interfaces
+// which record what was done to them, for unit tests of downstream services.
+package fakes
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type SentEmail struct {
+	To		string
+	Subject		string
+	Message		string
+}
+
+// Mailer implements backend_utils.MailerDaemonType.
+type Mailer struct {
+	mtx	sync.Mutex
+	sent	[]SentEmail
+}
+
+func NewMailer() *Mailer {
+	return &Mailer{}
+}
+
+func (m *Mailer) SendEmail(to, subject, message string, args... interface{}) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.sent = append(m.sent, SentEmail{
+		To: to,
+		Subject: subject,
+		Message: fmt.Sprintf(message, args...),
+	})
+}
+
+func (m *Mailer) Sent() []SentEmail {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]SentEmail(nil), m.sent...)
+}
+
+func (m *Mailer) Reset() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.sent = nil
+}
+
+// AssertSent fails the test unless a mail was sent to `to` with a subject
+// containing subject.
+func (m *Mailer) AssertSent(t testing.TB, to, subject string) {
+	t.Helper()
+	for _, e := range m.Sent() {
+		if e.To == to && strings.Contains(e.Subject, subject) {
+			return
+		}
+	}
+	t.Errorf("No email to %s with subject %q. Sent:%+v", to, subject, m.Sent())
+}
+
+func (m *Mailer) AssertSentCount(t testing.TB, n int) {
+	t.Helper()
+	if got := len(m.Sent()); got != n {
+		t.Errorf("Expected %d emails, sent %d", n, got)
+	}
+}
@@ -0,0 +1,68 @@
+package fakes
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// Queue is an in-memory backend_utils.Queue. Publish delivers to the
+// subscribers synchronously and records the message.
+type Queue struct {
+	mtx		sync.Mutex
+	subs		map[string] []func([]byte) error
+	published	map[string] [][]byte
+	closed		bool
+}
+
+func NewQueue() *Queue {
+	return &Queue{
+		subs: make(map[string] []func([]byte) error),
+		published: make(map[string] [][]byte),
+	}
+}
+
+func (q *Queue) Publish(topic string, msg []byte) error {
+	q.mtx.Lock()
+	if q.closed {
+		q.mtx.Unlock()
+		return errors.New("Queue closed.")
+	}
+	q.published[topic] = append(q.published[topic], msg)
+	subs := append([]func([]byte) error(nil), q.subs[topic]...)
+	q.mtx.Unlock()
+
+	for _, h := range subs {
+		if err := h(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) Subscribe(topic string, handler func([]byte) error) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.subs[topic] = append(q.subs[topic], handler)
+	return nil
+}
+
+func (q *Queue) Close() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.closed = true
+	return nil
+}
+
+func (q *Queue) Published(topic string) [][]byte {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return append([][]byte(nil), q.published[topic]...)
+}
+
+func (q *Queue) AssertPublished(t testing.TB, topic string, n int) {
+	t.Helper()
+	if got := len(q.Published(topic)); got != n {
+		t.Errorf("Expected %d messages on %s, got %d", n, topic, got)
+	}
+}
@@ -0,0 +1,230 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+type FeatureFlag struct {
+	Name		string		`json:"name"`
+	Enabled		bool		`json:"enabled"`
+	// Share of users, 0-100, who get the feature. Ignored if Enabled is false.
+	Percentage	float64		`json:"percentage"`
+	// Users who always get the feature if it is enabled.
+	Users		[]string	`json:"users"`
+}
+
+// enabledFor buckets users by a hash of the flag name and user, so a user
+// stays in or out of a rollout as the percentage grows.
+func (f *FeatureFlag) enabledFor(user string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if f.Percentage >= 100 {
+		return true
+	}
+	for _, u := range f.Users {
+		if u == user {
+			return true
+		}
+	}
+	if len(user) == 0 || f.Percentage <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(f.Name + ":" + user))
+	return float64(h.Sum32() % 10000) < f.Percentage * 100
+}
+
+type FlagSource interface {
+	Load() ([]FeatureFlag, error)
+}
+
+// FileFlagSource reads the feature_flags section of a config file.
+type FileFlagSource struct {
+	Path	string
+}
+
+func (f *FileFlagSource) Load() ([]FeatureFlag, error) {
+	buf, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	var conf struct {
+		FeatureFlags	[]FeatureFlag	`json:"feature_flags"`
+	}
+	err = json.Unmarshal(stripJSONComments(buf), &conf)
+	return conf.FeatureFlags, err
+}
+
+// PostgresFlagSource reads the feature_flags table. Users are stored
+// comma separated.
+type PostgresFlagSource struct {
+	DB	*sql.DB
+}
+
+func (p *PostgresFlagSource) CreateTable() error {
+	_, err := p.DB.Exec(`CREATE TABLE IF NOT EXISTS feature_flags (
+		name TEXT PRIMARY KEY,
+		enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		percentage DOUBLE PRECISION NOT NULL DEFAULT 0,
+		users TEXT NOT NULL DEFAULT '')`)
+	return err
+}
+
+func (p *PostgresFlagSource) Load() ([]FeatureFlag, error) {
+	rows, err := p.DB.Query("SELECT name, enabled, percentage, users FROM feature_flags")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flags []FeatureFlag
+	for rows.Next() {
+		var f FeatureFlag
+		var users string
+		err = rows.Scan(&f.Name, &f.Enabled, &f.Percentage, &users)
+		if err != nil {
+			return nil, err
+		}
+		if len(users) > 0 {
+			f.Users = strings.Split(users, ",")
+		}
+		flags = append(flags, f)
+	}
+	return flags, rows.Err()
+}
+
+type FeatureFlags struct {
+	mtx		sync.RWMutex
+	flags		map[string] *FeatureFlag
+	source		FlagSource
+	// stop is made by the first StartReloading and closed by the first
+	// Stop after it.
+	stop_mtx	sync.Mutex
+	stop		chan struct{}
+	stop_once	sync.Once
+}
+
+func NewFeatureFlags(source FlagSource) (*FeatureFlags, error) {
+	f := &FeatureFlags{source: source}
+	return f, f.Reload()
+}
+
+// Reload replaces the flags with the ones in the source. On error the
+// current flags are kept.
+func (f *FeatureFlags) Reload() error {
+	list, err := f.source.Load()
+	if err != nil {
+		return err
+	}
+	flags := make(map[string] *FeatureFlag, len(list))
+	for i := range list {
+		flags[list[i].Name] = &list[i]
+	}
+	f.mtx.Lock()
+	f.flags = flags
+	f.mtx.Unlock()
+	return nil
+}
+
+// StartReloading reloads the flags every interval till Stop is called.
+// Failed reloads are logged and retried on the next tick. Only the first
+// call starts reloading, later ones do nothing.
+func (f *FeatureFlags) StartReloading(interval time.Duration, logger *LogUtil) {
+	f.stop_mtx.Lock()
+	defer f.stop_mtx.Unlock()
+	if f.stop != nil {
+		return
+	}
+	f.stop = make(chan struct{})
+	stop := f.stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := f.Reload(); err != nil && logger != nil {
+					logger.Error(err, "Failed reloading feature flags")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops reloading. It may be called more than once.
+func (f *FeatureFlags) Stop() {
+	f.stop_mtx.Lock()
+	stop := f.stop
+	f.stop_mtx.Unlock()
+	if stop != nil {
+		f.stop_once.Do(func() { close(stop) })
+	}
+}
+
+func (f *FeatureFlags) Enabled(name, user string) bool {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	flag, ok := f.flags[name]
+	return ok && flag.enabledFor(user)
+}
+
+// FlagSnapshot has the flags evaluated for one user at one point in time,
+// so a request sees the same values even if the flags are reloaded.
+type FlagSnapshot struct {
+	user	string
+	enabled	map[string]bool
+}
+
+func (f *FeatureFlags) Snapshot(user string) *FlagSnapshot {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	s := &FlagSnapshot{user: user, enabled: make(map[string]bool, len(f.flags))}
+	for name, flag := range f.flags {
+		s.enabled[name] = flag.enabledFor(user)
+	}
+	return s
+}
+
+func (s *FlagSnapshot) Enabled(name string) bool {
+	if s == nil {
+		return false
+	}
+	return s.enabled[name]
+}
+
+type flagsKey struct{}
+
+// FlagsFromContext returns the snapshot taken by the feature flag
+// interceptor. A nil snapshot has all flags off.
+func FlagsFromContext(ctx context.Context) *FlagSnapshot {
+	s, _ := ctx.Value(flagsKey{}).(*FlagSnapshot)
+	return s
+}
+
+// UnaryInterceptor takes a snapshot for the JWT subject of every call.
+func (f *FeatureFlags) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		ctx = context.WithValue(ctx, flagsKey{}, f.Snapshot(jwtSubject(ctx)))
+		return handler(ctx, req)
+	}
+}
+
+func (f *FeatureFlags) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		ctx := context.WithValue(ss.Context(), flagsKey{}, f.Snapshot(jwtSubject(ss.Context())))
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
@@ -0,0 +1,144 @@
+package backend_utils
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Prefix of values produced by EncryptField. Bumped if the layout changes.
+const fieldCryptVersion = "e1:"
+
+var (
+	ErrCorruptField = errors.New("Encrypted field is corrupt.")
+	ErrNoFieldKeys = errors.New("Field encryption keys not set.")
+)
+
+// FieldKeyProvider returns the keys for EncryptField from FieldKeys.
+func (dbConf *PostgresDBConfig) FieldKeyProvider() (KeyProvider, error) {
+	if len(dbConf.FieldKeys) == 0 {
+		return nil, ErrNoFieldKeys
+	}
+	return NewStaticKeyProvider(dbConf.FieldKeys, dbConf.FieldKeyID)
+}
+
+// EncryptField seals plaintext with AES-256-GCM under the current key of
+// keys, for storing in a TEXT column. The value records the key id, so keys
+// can be rotated while old values stay readable. ad is optional additional
+// data, e.g. the table, column and row key, binding the value to where it
+// is stored; the same ad must be passed to DecryptField.
+//
+// Values look like "e1:<key id>:<base64 nonce | sealed>".
+func EncryptField(keys KeyProvider, plaintext, ad []byte) (string, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(id, ":") {
+		return "", fmt.Errorf("Field key id %q must not contain ':'.", id)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, ad)
+	return fieldCryptVersion + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func parseField(value string) (string, []byte, error) {
+	if !strings.HasPrefix(value, fieldCryptVersion) {
+		return "", nil, ErrCorruptField
+	}
+	parts := strings.SplitN(value[len(fieldCryptVersion):], ":", 2)
+	if len(parts) != 2 {
+		return "", nil, ErrCorruptField
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, ErrCorruptField
+	}
+	return parts[0], sealed, nil
+}
+
+// DecryptField opens a value of EncryptField with the key it was sealed
+// with.
+func DecryptField(keys KeyProvider, value string, ad []byte) ([]byte, error) {
+	id, sealed, err := parseField(value)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrCorruptField
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrCorruptField
+	}
+	return plaintext, nil
+}
+
+// FieldKeyID returns the id of the key value was sealed with, e.g. to find
+// the rows to re-encrypt after a rotation.
+func FieldKeyID(value string) (string, error) {
+	id, _, err := parseField(value)
+	return id, err
+}
+
+var field_keys KeyProvider
+
+// SetFieldKeys sets the keys EncryptedString uses. Call it at startup,
+// before any queries.
+func SetFieldKeys(keys KeyProvider) {
+	field_keys = keys
+}
+
+// EncryptedString is a string stored encrypted by EncryptField with the
+// keys of SetFieldKeys, without additional data. Use it as a query argument
+// and as a Scan destination for the column. NULL scans as "".
+type EncryptedString string
+
+func (s EncryptedString) Value() (driver.Value, error) {
+	if field_keys == nil {
+		return nil, ErrNoFieldKeys
+	}
+	return EncryptField(field_keys, []byte(s), nil)
+}
+
+func (s *EncryptedString) Scan(src interface{}) error {
+	var value string
+	switch v := src.(type) {
+	case nil:
+		*s = ""
+		return nil
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("Cannot scan %T into EncryptedString.", src)
+	}
+	if field_keys == nil {
+		return ErrNoFieldKeys
+	}
+	plaintext, err := DecryptField(field_keys, value, nil)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
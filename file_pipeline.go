@@ -0,0 +1,309 @@
+package backend_utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aloknerurkar/task-runner"
+	"golang.org/x/image/draw"
+)
+
+// Processing states of an object.
+const (
+	PROCESSING_PENDING = "pending"
+	PROCESSING_RUNNING = "running"
+	PROCESSING_DONE = "done"
+	// A step failed. The other steps still ran.
+	PROCESSING_FAILED = "failed"
+	// A step rejected the object, which was deleted.
+	PROCESSING_REJECTED = "rejected"
+
+	DEFAULT_PROCESSING_STATUS_TTL = 7 * 24 * time.Hour
+)
+
+// ErrRejectObject is returned by processors, like virus scanners, to have
+// the object deleted and the rest of the pipeline skipped.
+var ErrRejectObject = errors.New("Object rejected.")
+
+// ObjectProcessor is a step run on objects after they are uploaded. It may
+// return metadata about the object, which is kept in its status.
+type ObjectProcessor interface {
+	Name() string
+	Process(store FileStore, info *ObjectInfo) (map[string] string, error)
+}
+
+type StepResult struct {
+	Error		string			`json:"error,omitempty"`
+	Metadata	map[string] string	`json:"metadata,omitempty"`
+}
+
+type ProcessingStatus struct {
+	Object		string			`json:"object"`
+	State		string			`json:"state"`
+	Steps		map[string] StepResult	`json:"steps"`
+	UpdatedAt	time.Time		`json:"updated_at"`
+}
+
+// FilePipeline runs the processors on objects in the background using a
+// task runner. Statuses are kept in a Cache, so any instance sharing it
+// can answer Status.
+type FilePipeline struct {
+	store		FileStore
+	status		Cache
+	status_ttl	time.Duration
+	steps		[]ObjectProcessor
+	runner		*task_runner.TaskRunner
+}
+
+func NewFilePipeline(store FileStore, status Cache, workers int, steps ...ObjectProcessor) *FilePipeline {
+	return &FilePipeline{
+		store: store,
+		status: status,
+		status_ttl: DEFAULT_PROCESSING_STATUS_TTL,
+		steps: steps,
+		runner: task_runner.StartTaskRunner(workers, os.Stdout),
+	}
+}
+
+func processingKey(name string) string {
+	return "file_processing:" + name
+}
+
+func (p *FilePipeline) setStatus(st *ProcessingStatus) error {
+	st.UpdatedAt = pkgClock().Now()
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return p.status.Set(processingKey(st.Object), buf, p.status_ttl)
+}
+
+// Status returns the processing status of an object, ErrCacheMiss if it
+// was never submitted or the status expired.
+func (p *FilePipeline) Status(name string) (*ProcessingStatus, error) {
+	buf, err := p.status.Get(processingKey(name))
+	if err != nil {
+		return nil, err
+	}
+	st := new(ProcessingStatus)
+	if err = json.Unmarshal(buf, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Submit queues an object for processing.
+func (p *FilePipeline) Submit(name string) error {
+	err := p.setStatus(&ProcessingStatus{Object: name, State: PROCESSING_PENDING})
+	if err != nil {
+		return err
+	}
+	p.runner.EnqueueTask(&processTask{pipeline: p, name: name})
+	return nil
+}
+
+// Store returns a FileStore which submits objects after they are Put, e.g.
+// for use with UploadHandler.
+func (p *FilePipeline) Store() FileStore {
+	return &pipelineStore{FileStore: p.store, pipeline: p}
+}
+
+type pipelineStore struct {
+	FileStore
+	pipeline	*FilePipeline
+}
+
+func (s *pipelineStore) Put(name string, r io.Reader) error {
+	if err := s.FileStore.Put(name, r); err != nil {
+		return err
+	}
+	return s.pipeline.Submit(name)
+}
+
+type processTask struct {
+	pipeline	*FilePipeline
+	name		string
+}
+
+func (t *processTask) Execute() {
+	p := t.pipeline
+	st := &ProcessingStatus{
+		Object: t.name,
+		State: PROCESSING_RUNNING,
+		Steps: make(map[string] StepResult, len(p.steps)),
+	}
+	p.setStatus(st)
+
+	info, err := p.store.Stat(t.name)
+	if err != nil {
+		st.State = PROCESSING_FAILED
+		st.Steps["stat"] = StepResult{Error: err.Error()}
+		p.setStatus(st)
+		return
+	}
+
+	st.State = PROCESSING_DONE
+	for _, step := range p.steps {
+		md, err := step.Process(p.store, info)
+		res := StepResult{Metadata: md}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		st.Steps[step.Name()] = res
+		if err == ErrRejectObject {
+			st.State = PROCESSING_REJECTED
+			p.store.Delete(t.name)
+			break
+		}
+		if err != nil {
+			st.State = PROCESSING_FAILED
+		}
+	}
+	p.setStatus(st)
+}
+
+// ScanProcessor runs a scanner, e.g. a ClamAV client, on the object. The
+// scanner should return ErrRejectObject for infected content.
+type ScanProcessor struct {
+	Scan	func(r io.Reader) error
+}
+
+func (s *ScanProcessor) Name() string { return "scan" }
+
+func (s *ScanProcessor) Process(store FileStore, info *ObjectInfo) (map[string] string, error) {
+	obj, err := store.Get(info.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return nil, s.Scan(obj)
+}
+
+// MetadataProcessor records the content type, size, SHA-256 and, for
+// images, the dimensions.
+type MetadataProcessor struct{}
+
+func (m *MetadataProcessor) Name() string { return "metadata" }
+
+func (m *MetadataProcessor) Process(store FileStore, info *ObjectInfo) (map[string] string, error) {
+	obj, err := store.Get(info.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(obj, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	hash := sha256.New()
+	hash.Write(head)
+	if _, err = io.Copy(hash, obj); err != nil {
+		return nil, err
+	}
+
+	md := map[string] string{
+		"content_type": http.DetectContentType(head),
+		"size": strconv.FormatInt(info.Size, 10),
+		"sha256": hex.EncodeToString(hash.Sum(nil)),
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+		md["width"] = strconv.Itoa(cfg.Width)
+		md["height"] = strconv.Itoa(cfg.Height)
+	}
+	return md, nil
+}
+
+// Largest image ThumbnailProcessor decodes by default, about 200MB as RGBA.
+const DEFAULT_THUMBNAIL_MAX_PIXELS = 50 * 1000 * 1000
+
+// ThumbnailProcessor stores a JPEG thumbnail of images, fitting in
+// MaxWidth x MaxHeight, as <name>.thumb.jpg. Objects which are not images
+// are left alone.
+type ThumbnailProcessor struct {
+	MaxWidth	int
+	MaxHeight	int
+	// Images with more pixels fail the step without being decoded, so
+	// that small files with huge dimensions can't exhaust memory.
+	// DEFAULT_THUMBNAIL_MAX_PIXELS if 0.
+	MaxPixels	int64
+}
+
+func (t *ThumbnailProcessor) Name() string { return "thumbnail" }
+
+func (t *ThumbnailProcessor) Process(store FileStore, info *ObjectInfo) (map[string] string, error) {
+	obj, err := store.Get(info.Name)
+	if err != nil {
+		return nil, err
+	}
+	conf, _, err := image.DecodeConfig(obj)
+	obj.Close()
+	if err == image.ErrFormat {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	max_pixels := t.MaxPixels
+	if max_pixels <= 0 {
+		max_pixels = DEFAULT_THUMBNAIL_MAX_PIXELS
+	}
+	if int64(conf.Width) * int64(conf.Height) > max_pixels {
+		return nil, fmt.Errorf("Image of %dx%d is over the limit of %d pixels.",
+			conf.Width, conf.Height, max_pixels)
+	}
+
+	if obj, err = store.Get(info.Name); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(obj)
+	obj.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if t.MaxWidth > 0 && w > t.MaxWidth {
+		h = h * t.MaxWidth / w
+		w = t.MaxWidth
+	}
+	if t.MaxHeight > 0 && h > t.MaxHeight {
+		w = w * t.MaxHeight / h
+		h = t.MaxHeight
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	thumb := info.Name + ".thumb.jpg"
+	if err = store.Put(thumb, &buf); err != nil {
+		return nil, err
+	}
+	return map[string] string{"thumbnail": thumb}, nil
+}
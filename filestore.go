@@ -0,0 +1,146 @@
+package backend_utils
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrObjectNotFound = errors.New("Object not found.")
+	ErrInvalidObjectName = errors.New("Invalid object name.")
+)
+
+type ObjectInfo struct {
+	Name	string
+	Size	int64
+	ModTime	time.Time
+}
+
+// FileStore keeps named objects. Names use "/" as separator.
+type FileStore interface {
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	Stat(name string) (*ObjectInfo, error)
+	Delete(name string) error
+	// List returns the objects whose names start with prefix.
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// LocalFileStore stores objects as files under RootPath.
+type LocalFileStore struct {
+	root	string
+}
+
+func (c *FsConfig) NewFileStore() (*LocalFileStore, error) {
+	if len(c.RootPath) == 0 {
+		return nil, errors.New("Root path not specified for file store.")
+	}
+	err := os.MkdirAll(c.RootPath, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalFileStore{root: filepath.Clean(c.RootPath)}, nil
+}
+
+func (f *LocalFileStore) path(name string) (string, error) {
+	p := filepath.Join(f.root, filepath.FromSlash(name))
+	if !strings.HasPrefix(p, f.root + string(filepath.Separator)) {
+		return "", ErrInvalidObjectName
+	}
+	return p, nil
+}
+
+// Objects are written to a temp file first so that readers never see a
+// partial object.
+func (f *LocalFileStore) Put(name string, r io.Reader) error {
+
+	p, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".tmp_")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (f *LocalFileStore) Get(name string) (io.ReadCloser, error) {
+	p, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return fp, err
+}
+
+func (f *LocalFileStore) Stat(name string) (*ObjectInfo, error) {
+	p, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (f *LocalFileStore) Delete(name string) error {
+	p, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	return err
+}
+
+func (f *LocalFileStore) List(prefix string) ([]ObjectInfo, error) {
+
+	var objs []ObjectInfo
+	err := filepath.Walk(f.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".tmp_") {
+			return nil
+		}
+		rel, err := filepath.Rel(f.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			objs = append(objs, ObjectInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+		return nil
+	})
+	return objs, err
+}
@@ -0,0 +1,341 @@
+package backend_utils
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Plaintext bytes sealed together. Objects are encrypted in chunks so
+	// they never need to fit in memory.
+	CRYPT_CHUNK_SIZE = 64 << 10
+
+	cryptMagic = "BUE1"
+	// Length prefix and GCM tag added to every chunk.
+	cryptChunkOverhead = 4 + 16
+)
+
+var ErrCorruptObject = errors.New("Encrypted object is corrupt.")
+
+// KeyProvider supplies the master keys wrapping the per-object data keys.
+// Old keys must stay available under their id as long as objects wrapped
+// with them exist.
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeyProvider serves fixed 32 byte keys, e.g. from the config file.
+type StaticKeyProvider struct {
+	Current	string
+	Keys	map[string] []byte
+}
+
+// NewStaticKeyProvider decodes base64 32 byte keys by id, as found in the
+// config file. current must be one of them.
+func NewStaticKeyProvider(b64_keys map[string] string, current string) (*StaticKeyProvider, error) {
+	keys := &StaticKeyProvider{Current: current, Keys: make(map[string] []byte)}
+	for id, b64 := range b64_keys {
+		key, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Encryption key %q must be 32 bytes in base64.", id)
+		}
+		keys.Keys[id] = key
+	}
+	if _, _, err := keys.CurrentKey(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := s.Key(s.Current)
+	return s.Current, key, err
+}
+
+func (s *StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := s.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown encryption key %q.", id)
+	}
+	return key, nil
+}
+
+// OpenFileStore returns the local file store, wrapped in an
+// EncryptedFileStore if encryption keys are configured.
+func (c *FsConfig) OpenFileStore() (FileStore, error) {
+	store, err := c.NewFileStore()
+	if err != nil {
+		return nil, err
+	}
+	if len(c.EncryptionKeys) == 0 {
+		return store, nil
+	}
+	keys, err := NewStaticKeyProvider(c.EncryptionKeys, c.EncryptionKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptedFileStore(store, keys), nil
+}
+
+// EncryptedFileStore encrypts objects with AES-256-GCM before handing them
+// to the wrapped store. Every object has its own random data key, stored
+// in the object header wrapped by the current master key. Sizes reported
+// by Stat and List are of the plaintext.
+//
+// Object layout:
+//	magic | key id len (1) | key id | wrapped key len (2) | wrapped key |
+//	nonce prefix (8) | chunks
+// Each chunk is its sealed length (4) followed by the sealed plaintext. The
+// last chunk is shorter than CRYPT_CHUNK_SIZE, possibly empty, and sealed
+// with a different additional data so truncation is detected.
+type EncryptedFileStore struct {
+	FileStore
+	keys	KeyProvider
+}
+
+func NewEncryptedFileStore(store FileStore, keys KeyProvider) *EncryptedFileStore {
+	return &EncryptedFileStore{FileStore: store, keys: keys}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, idx uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], idx)
+	return nonce
+}
+
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func (e *EncryptedFileStore) Put(name string, r io.Reader) error {
+
+	key_id, master, err := e.keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+	data_key := make([]byte, 32)
+	prefix := make([]byte, 8)
+	if _, err = rand.Read(data_key); err != nil {
+		return err
+	}
+	if _, err = rand.Read(prefix); err != nil {
+		return err
+	}
+	wrap, err := newGCM(master)
+	if err != nil {
+		return err
+	}
+	wrap_nonce := make([]byte, wrap.NonceSize())
+	if _, err = rand.Read(wrap_nonce); err != nil {
+		return err
+	}
+	wrapped := wrap.Seal(wrap_nonce, wrap_nonce, data_key, []byte(key_id))
+	gcm, err := newGCM(data_key)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		hdr := []byte(cryptMagic)
+		hdr = append(hdr, byte(len(key_id)))
+		hdr = append(hdr, key_id...)
+		hdr = append(hdr, byte(len(wrapped) >> 8), byte(len(wrapped)))
+		hdr = append(hdr, wrapped...)
+		hdr = append(hdr, prefix...)
+		_, err := w.Write(hdr)
+
+		buf := make([]byte, CRYPT_CHUNK_SIZE)
+		len_buf := make([]byte, 4)
+		for idx := uint32(0); err == nil; idx++ {
+			var n int
+			n, err = io.ReadFull(r, buf)
+			final := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !final {
+				break
+			}
+			sealed := gcm.Seal(nil, chunkNonce(prefix, idx), buf[:n], chunkAD(final))
+			binary.BigEndian.PutUint32(len_buf, uint32(len(sealed)))
+			if _, err = w.Write(len_buf); err == nil {
+				_, err = w.Write(sealed)
+			}
+			if final && err == nil {
+				err = w.Flush()
+				break
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err = e.FileStore.Put(name, pr)
+	pr.Close()
+	return err
+}
+
+type cryptReader struct {
+	src	io.ReadCloser
+	r	*bufio.Reader
+	gcm	cipher.AEAD
+	prefix	[]byte
+	idx	uint32
+	buf	[]byte
+	done	bool
+	hdr_len	int64
+}
+
+func (e *EncryptedFileStore) open(name string) (*cryptReader, error) {
+	src, err := e.FileStore.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	cr := &cryptReader{src: src, r: bufio.NewReader(src)}
+	if err = cr.readHeader(e.keys); err != nil {
+		src.Close()
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (c *cryptReader) readHeader(keys KeyProvider) error {
+	magic := make([]byte, len(cryptMagic) + 1)
+	if _, err := io.ReadFull(c.r, magic); err != nil || string(magic[:len(cryptMagic)]) != cryptMagic {
+		return ErrCorruptObject
+	}
+	key_id := make([]byte, int(magic[len(cryptMagic)]))
+	wrapped_len := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, key_id); err != nil {
+		return ErrCorruptObject
+	}
+	if _, err := io.ReadFull(c.r, wrapped_len); err != nil {
+		return ErrCorruptObject
+	}
+	wrapped := make([]byte, int(binary.BigEndian.Uint16(wrapped_len)))
+	c.prefix = make([]byte, 8)
+	if _, err := io.ReadFull(c.r, wrapped); err != nil {
+		return ErrCorruptObject
+	}
+	if _, err := io.ReadFull(c.r, c.prefix); err != nil {
+		return ErrCorruptObject
+	}
+	c.hdr_len = int64(len(magic) + len(key_id) + 2 + len(wrapped) + 8)
+
+	master, err := keys.Key(string(key_id))
+	if err != nil {
+		return err
+	}
+	wrap, err := newGCM(master)
+	if err != nil {
+		return err
+	}
+	if len(wrapped) < wrap.NonceSize() {
+		return ErrCorruptObject
+	}
+	data_key, err := wrap.Open(nil, wrapped[:wrap.NonceSize()], wrapped[wrap.NonceSize():], key_id)
+	if err != nil {
+		return ErrCorruptObject
+	}
+	c.gcm, err = newGCM(data_key)
+	return err
+}
+
+func (c *cryptReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		len_buf := make([]byte, 4)
+		if _, err := io.ReadFull(c.r, len_buf); err != nil {
+			return 0, ErrCorruptObject
+		}
+		sealed_len := binary.BigEndian.Uint32(len_buf)
+		if sealed_len > CRYPT_CHUNK_SIZE + 16 {
+			return 0, ErrCorruptObject
+		}
+		sealed := make([]byte, sealed_len)
+		if _, err := io.ReadFull(c.r, sealed); err != nil {
+			return 0, ErrCorruptObject
+		}
+		final := sealed_len < CRYPT_CHUNK_SIZE + 16
+		plain, err := c.gcm.Open(nil, chunkNonce(c.prefix, c.idx), sealed, chunkAD(final))
+		if err != nil {
+			return 0, ErrCorruptObject
+		}
+		c.idx++
+		c.buf = plain
+		c.done = final
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *cryptReader) Close() error {
+	return c.src.Close()
+}
+
+func (e *EncryptedFileStore) Get(name string) (io.ReadCloser, error) {
+	return e.open(name)
+}
+
+// plainSize works out the plaintext size from the stored size.
+func (e *EncryptedFileStore) plainSize(info *ObjectInfo) error {
+	cr, err := e.open(info.Name)
+	if err != nil {
+		return err
+	}
+	cr.Close()
+	body := info.Size - cr.hdr_len
+	full := int64(CRYPT_CHUNK_SIZE + cryptChunkOverhead)
+	last := body % full - cryptChunkOverhead
+	if last < 0 {
+		return ErrCorruptObject
+	}
+	info.Size = body / full * CRYPT_CHUNK_SIZE + last
+	return nil
+}
+
+func (e *EncryptedFileStore) Stat(name string) (*ObjectInfo, error) {
+	info, err := e.FileStore.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.plainSize(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// List reads the header of every object to report plaintext sizes.
+func (e *EncryptedFileStore) List(prefix string) ([]ObjectInfo, error) {
+	objs, err := e.FileStore.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range objs {
+		if err = e.plainSize(&objs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return objs, nil
+}
@@ -0,0 +1,187 @@
+package backend_utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// DEFAULT_MAX_UPLOAD is the upload size limit if none is given.
+const DEFAULT_MAX_UPLOAD = 32 << 20
+
+// Content types FileServerHandler serves inline. Anything else, HTML and
+// SVG in particular, is sent as an application/octet-stream attachment so
+// that uploads can't run scripts on the service's origin.
+var SafeInlineTypes = map[string]bool{
+	"image/png": true,
+	"image/jpeg": true,
+	"image/gif": true,
+	"image/webp": true,
+	"text/plain": true,
+	"application/json": true,
+}
+
+// objectName maps the request path under prefix to an object name.
+func objectName(r *http.Request, prefix string) (string, bool) {
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	name = strings.TrimPrefix(path.Clean("/" + name), "/")
+	if len(name) == 0 || name == "." {
+		return "", false
+	}
+	return name, true
+}
+
+func objectETag(info *ObjectInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size)
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrObjectNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrInvalidObjectName:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+	}
+}
+
+// FileServerHandler serves the objects of store with GET and HEAD. The
+// object name is the request path with prefix removed. Only the
+// SafeInlineTypes are served inline, see there. Range requests,
+// ETag/If-None-Match and If-Modified-Since are handled if the store returns
+// seekable readers, like LocalFileStore does. Otherwise the full object is
+// always sent.
+func FileServerHandler(store FileStore, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name, ok := objectName(r, prefix)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		info, err := store.Stat(name)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		etag := objectETag(info)
+		w.Header().Set("ETag", etag)
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if media, _, err := mime.ParseMediaType(ctype); err != nil || !SafeInlineTypes[media] {
+			ctype = "application/octet-stream"
+			w.Header().Set("Content-Disposition",
+				mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+		}
+		// Always set, so the content is never sniffed.
+		w.Header().Set("Content-Type", ctype)
+		// Don't let browsers render user content as something else, or run
+		// anything in it.
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+
+		obj, err := store.Get(name)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		defer obj.Close()
+
+		if seeker, ok := obj.(io.ReadSeeker); ok {
+			// Handles ranges and conditional requests.
+			http.ServeContent(w, r, name, info.ModTime, seeker)
+			return
+		}
+
+		if match := r.Header.Get("If-None-Match"); len(match) > 0 &&
+			(match == "*" || strings.Contains(match, etag)) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Accept-Ranges", "none")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size))
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodHead {
+			return
+		}
+		io.Copy(w, obj)
+	})
+}
+
+// UploadHandler stores request bodies in store under the request path with
+// prefix removed. PUT takes the raw body, POST a multipart form with the
+// content in the "file" field. Bodies over max_size are rejected; 0 means
+// DEFAULT_MAX_UPLOAD. The stored object's info is returned as JSON.
+func UploadHandler(store FileStore, prefix string, max_size int64) http.Handler {
+	if max_size <= 0 {
+		max_size = DEFAULT_MAX_UPLOAD
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		name, ok := objectName(r, prefix)
+		if !ok {
+			http.Error(w, ErrInvalidObjectName.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.ContentLength > max_size {
+			http.Error(w, "Upload too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max_size)
+
+		var body io.Reader
+		switch r.Method {
+		case http.MethodPut:
+			body = r.Body
+		case http.MethodPost:
+			mr, err := r.MultipartReader()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for {
+				part, err := mr.NextPart()
+				if err != nil {
+					http.Error(w, "Missing file field.", http.StatusBadRequest)
+					return
+				}
+				if part.FormName() == "file" {
+					body = part
+					break
+				}
+			}
+		default:
+			w.Header().Set("Allow", "PUT, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := store.Put(name, body); err != nil {
+			if strings.Contains(err.Error(), "request body too large") {
+				http.Error(w, "Upload too large.", http.StatusRequestEntityTooLarge)
+				return
+			}
+			writeStoreError(w, err)
+			return
+		}
+		info, err := store.Stat(name)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", objectETag(info))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+	})
+}
@@ -0,0 +1,250 @@
+package backend_utils
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RetentionRule applies to objects whose names start with Prefix. Objects
+// are moved to the archive store ArchiveAfter their last modification and
+// deleted DeleteAfter it. A zero duration disables that action. On a
+// VersionedFileStore only the newest KeepVersions versions are kept, 0
+// keeps all, and deleted objects are purged with all their versions
+// DeleteAfter they were deleted.
+type RetentionRule struct {
+	Prefix		string		`json:"prefix"`
+	ArchiveAfter	Duration	`json:"archive_after"`
+	DeleteAfter	Duration	`json:"delete_after"`
+	KeepVersions	int		`json:"keep_versions"`
+}
+
+var ErrNoArchiveStore = errors.New("Retention rule archives but there is no archive store.")
+
+// Interval of the RetentionManager of FsConfig.NewRetentionManager if
+// retention_interval is not set.
+const DEFAULT_RETENTION_INTERVAL = time.Hour
+
+type RetentionResult struct {
+	Archived	int
+	Deleted		int
+	// Old versions removed by KeepVersions, or with deleted objects.
+	Pruned		int
+	Errors		int
+}
+
+// RetentionManager enforces retention rules on a store, e.g. so temporary
+// upload directories don't grow forever. When several rules match an
+// object the one with the longest prefix is used.
+type RetentionManager struct {
+	store		FileStore
+	archive		FileStore
+	rules		[]RetentionRule
+	stop		chan struct{}
+	wg		sync.WaitGroup
+	logger		Logger
+	clock		Clock
+}
+
+// NewRetentionManager returns a manager for store. archive may be nil if
+// no rule archives.
+func NewRetentionManager(store, archive FileStore, rules []RetentionRule) *RetentionManager {
+	return &RetentionManager{store: store, archive: archive, rules: rules}
+}
+
+// NewRetentionManager returns a manager applying the retention rules of
+// the config to store, nil if there are none. archive may only be nil if
+// no rule sets archive_after.
+func (c *FsConfig) NewRetentionManager(store, archive FileStore) (*RetentionManager, error) {
+	if len(c.Retention) == 0 {
+		return nil, nil
+	}
+	if archive == nil {
+		for _, rule := range c.Retention {
+			if rule.ArchiveAfter.Duration > 0 {
+				return nil, ErrNoArchiveStore
+			}
+		}
+	}
+	return NewRetentionManager(store, archive, c.Retention), nil
+}
+
+func (c *FsConfig) retentionInterval() time.Duration {
+	if c.RetentionInterval.Duration > 0 {
+		return c.RetentionInterval.Duration
+	}
+	return DEFAULT_RETENTION_INTERVAL
+}
+
+// WithClock ages objects and schedules runs by c instead of the package
+// clock.
+func (m *RetentionManager) WithClock(c Clock) *RetentionManager {
+	m.clock = c
+	return m
+}
+
+// WithLogger logs the retention runs to l instead of the package logger.
+func (m *RetentionManager) WithLogger(l Logger) *RetentionManager {
+	m.logger = l
+	return m
+}
+
+func (m *RetentionManager) ruleFor(name string) *RetentionRule {
+	var best *RetentionRule
+	for i := range m.rules {
+		if strings.HasPrefix(name, m.rules[i].Prefix) &&
+			(best == nil || len(m.rules[i].Prefix) > len(best.Prefix)) {
+			best = &m.rules[i]
+		}
+	}
+	return best
+}
+
+// RunOnce applies the rules to all the objects once.
+func (m *RetentionManager) RunOnce() (RetentionResult, error) {
+	var res RetentionResult
+	objs, err := m.store.List("")
+	if err != nil {
+		return res, err
+	}
+	now := clockOr(m.clock).Now()
+	versioned, _ := m.store.(*VersionedFileStore)
+	for _, obj := range objs {
+		rule := m.ruleFor(obj.Name)
+		if rule == nil {
+			continue
+		}
+		if versioned != nil && rule.KeepVersions > 0 {
+			n, err := versioned.PruneVersions(obj.Name, rule.KeepVersions)
+			res.Pruned += n
+			if err != nil {
+				loggerOr(m.logger).Errorf("Pruning versions of %s failed. Err:%s", obj.Name, err.Error())
+				res.Errors++
+			}
+		}
+		age := now.Sub(obj.ModTime)
+		switch {
+		case rule.DeleteAfter.Duration > 0 && age > rule.DeleteAfter.Duration:
+			err = m.store.Delete(obj.Name)
+			if err == nil {
+				res.Deleted++
+			}
+		case rule.ArchiveAfter.Duration > 0 && age > rule.ArchiveAfter.Duration && m.archive != nil:
+			err = m.moveToArchive(obj.Name)
+			if err == nil {
+				res.Archived++
+			}
+		default:
+			continue
+		}
+		if err != nil && err != ErrObjectNotFound {
+			loggerOr(m.logger).Errorf("Retention failed on object %s. Err:%s", obj.Name, err.Error())
+			res.Errors++
+		}
+	}
+	if versioned != nil {
+		if err = m.runDeleted(versioned, now, &res); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// runDeleted applies the rules to the versions of the deleted objects of
+// v, which List leaves out.
+func (m *RetentionManager) runDeleted(v *VersionedFileStore, now time.Time, res *RetentionResult) error {
+	names, err := v.objectNames("")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		rule := m.ruleFor(name)
+		if rule == nil {
+			continue
+		}
+		vers, err := v.Versions(name)
+		if err != nil || len(vers) == 0 || !vers[0].Deleted {
+			continue
+		}
+		if rule.DeleteAfter.Duration > 0 && now.Sub(vers[0].ModTime) > rule.DeleteAfter.Duration {
+			err = v.Purge(name)
+			if err == nil {
+				res.Pruned += len(vers)
+			}
+		} else if rule.KeepVersions > 0 {
+			var n int
+			n, err = v.PruneVersions(name, rule.KeepVersions)
+			res.Pruned += n
+		}
+		if err != nil {
+			loggerOr(m.logger).Errorf("Retention failed on deleted object %s. Err:%s", name, err.Error())
+			res.Errors++
+		}
+	}
+	return nil
+}
+
+func (m *RetentionManager) moveToArchive(name string) error {
+	obj, err := m.store.Get(name)
+	if err != nil {
+		return err
+	}
+	err = m.archive.Put(name, obj)
+	obj.Close()
+	if err != nil {
+		return err
+	}
+	return m.store.Delete(name)
+}
+
+// Start runs the rules every interval in the background till Stop.
+func (m *RetentionManager) Start(interval time.Duration) {
+	m.stop = make(chan struct{})
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := clockOr(m.clock).NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C():
+			}
+			res, err := m.RunOnce()
+			if err != nil {
+				loggerOr(m.logger).Errorf("Retention run failed. Err:%s", err.Error())
+				continue
+			}
+			loggerOr(m.logger).Infof("Retention run archived %d, deleted %d objects, pruned %d versions, %d errors.",
+				res.Archived, res.Deleted, res.Pruned, res.Errors)
+		}
+	}()
+}
+
+func (m *RetentionManager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	m.wg.Wait()
+	m.stop = nil
+}
+
+// Hook runs the manager for the lifetime of an App.
+func (m *RetentionManager) Hook(interval time.Duration) LifecycleHook {
+	return LifecycleHook{
+		Name: "file_retention",
+		OnStart: func(context.Context) error {
+			m.Start(interval)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			m.Stop()
+			return nil
+		},
+	}
+}
@@ -0,0 +1,217 @@
+package backend_utils
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Objects of a VersionedFileStore are kept in the wrapped store as
+// VERSIONS_PREFIX<name>/<version id>.
+const VERSIONS_PREFIX = ".versions/"
+
+const deleteMarkerSuffix = ".deleted"
+
+type ObjectVersion struct {
+	ID	string
+	Size	int64
+	ModTime	time.Time
+	// Set for the markers left by Delete.
+	Deleted	bool
+}
+
+// VersionedFileStore keeps every version of an object. Put adds a version,
+// Delete only hides the object by adding a delete marker, and old versions
+// stay readable with GetVersion till they are purged. It works on top of
+// any FileStore.
+type VersionedFileStore struct {
+	store	FileStore
+}
+
+func NewVersionedFileStore(store FileStore) *VersionedFileStore {
+	return &VersionedFileStore{store: store}
+}
+
+// Version ids sort in the order they were created.
+func newVersionID() string {
+	return fmt.Sprintf("%016x%04x", time.Now().UnixNano(), rand.Intn(1 << 16))
+}
+
+func versionName(name, id string) string {
+	return VERSIONS_PREFIX + name + "/" + id
+}
+
+func (v *VersionedFileStore) Put(name string, r io.Reader) error {
+	_, err := v.PutVersion(name, r)
+	return err
+}
+
+// PutVersion stores a new version of name and returns its id.
+func (v *VersionedFileStore) PutVersion(name string, r io.Reader) (string, error) {
+	if len(name) == 0 || strings.HasSuffix(name, "/") {
+		return "", ErrInvalidObjectName
+	}
+	id := newVersionID()
+	return id, v.store.Put(versionName(name, id), r)
+}
+
+// Versions returns the versions of name, newest first.
+func (v *VersionedFileStore) Versions(name string) ([]ObjectVersion, error) {
+	objs, err := v.store.List(VERSIONS_PREFIX + name + "/")
+	if err != nil {
+		return nil, err
+	}
+	vers := make([]ObjectVersion, 0, len(objs))
+	for _, obj := range objs {
+		id := strings.TrimPrefix(obj.Name, VERSIONS_PREFIX + name + "/")
+		// Versions of objects nested under name.
+		if strings.Contains(id, "/") {
+			continue
+		}
+		ver := ObjectVersion{ID: id, Size: obj.Size, ModTime: obj.ModTime}
+		if strings.HasSuffix(id, deleteMarkerSuffix) {
+			ver.ID = strings.TrimSuffix(id, deleteMarkerSuffix)
+			ver.Deleted = true
+		}
+		vers = append(vers, ver)
+	}
+	sort.Slice(vers, func(i, j int) bool { return vers[i].ID > vers[j].ID })
+	return vers, nil
+}
+
+func (v *VersionedFileStore) latest(name string) (*ObjectVersion, error) {
+	vers, err := v.Versions(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(vers) == 0 || vers[0].Deleted {
+		return nil, ErrObjectNotFound
+	}
+	return &vers[0], nil
+}
+
+func (v *VersionedFileStore) Get(name string) (io.ReadCloser, error) {
+	ver, err := v.latest(name)
+	if err != nil {
+		return nil, err
+	}
+	return v.GetVersion(name, ver.ID)
+}
+
+func (v *VersionedFileStore) GetVersion(name, id string) (io.ReadCloser, error) {
+	return v.store.Get(versionName(name, id))
+}
+
+func (v *VersionedFileStore) Stat(name string) (*ObjectInfo, error) {
+	ver, err := v.latest(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Name: name, Size: ver.Size, ModTime: ver.ModTime}, nil
+}
+
+// Delete hides name behind a delete marker. Its versions are kept.
+func (v *VersionedFileStore) Delete(name string) error {
+	if _, err := v.latest(name); err != nil {
+		return err
+	}
+	return v.store.Put(versionName(name, newVersionID() + deleteMarkerSuffix), strings.NewReader(""))
+}
+
+// DeleteVersion removes one version for good.
+func (v *VersionedFileStore) DeleteVersion(name, id string) error {
+	err := v.store.Delete(versionName(name, id))
+	if err == ErrObjectNotFound {
+		err = v.store.Delete(versionName(name, id + deleteMarkerSuffix))
+	}
+	return err
+}
+
+// Purge removes all the versions of name.
+func (v *VersionedFileStore) Purge(name string) error {
+	vers, err := v.Versions(name)
+	if err != nil {
+		return err
+	}
+	for _, ver := range vers {
+		if err = v.DeleteVersion(name, ver.ID); err != nil && err != ErrObjectNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneVersions removes all but the newest keep versions of name, and the
+// delete markers older than those. Markers don't count as versions, and
+// the ones newer than the oldest kept version stay so deleted objects stay
+// deleted.
+func (v *VersionedFileStore) PruneVersions(name string, keep int) (int, error) {
+	vers, err := v.Versions(name)
+	if err != nil {
+		return 0, err
+	}
+	removed, kept := 0, 0
+	for _, ver := range vers {
+		if kept < keep {
+			if !ver.Deleted {
+				kept++
+			}
+			continue
+		}
+		if err = v.DeleteVersion(name, ver.ID); err != nil && err != ErrObjectNotFound {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// objectNames returns the names of the objects with versions under prefix,
+// deleted or not.
+func (v *VersionedFileStore) objectNames(prefix string) ([]string, error) {
+	objs, err := v.store.List(VERSIONS_PREFIX + prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string] bool)
+	var names []string
+	for _, obj := range objs {
+		name := strings.TrimPrefix(obj.Name, VERSIONS_PREFIX)
+		slash := strings.LastIndex(name, "/")
+		// Not a version, stored right under VERSIONS_PREFIX.
+		if slash < 0 {
+			continue
+		}
+		name = name[:slash]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// List returns the latest version of the objects under prefix which are
+// not deleted.
+func (v *VersionedFileStore) List(prefix string) ([]ObjectInfo, error) {
+	names, err := v.objectNames(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var objs []ObjectInfo
+	for _, name := range names {
+		info, err := v.Stat(name)
+		if err == ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, *info)
+	}
+	return objs, nil
+}
@@ -74,4 +74,8 @@ var (
 	ErrUnavailable = func(msg string, args... interface{}) error {
 		return status.Errorf(codes.Unavailable, msg, args...)
 	}
+
+	ErrAborted = func(msg string, args... interface{}) error {
+		return status.Errorf(codes.Aborted, msg, args...)
+	}
 )
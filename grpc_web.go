@@ -0,0 +1,69 @@
+package backend_utils
+
+import (
+	"net/http"
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"google.golang.org/grpc"
+)
+
+type CorsConfig struct {
+	// Origins allowed to make cross-origin calls. Empty or "*" allows any.
+	AllowedOrigins		[]string	`json:"allowed_origins"`
+	// Extra request headers browsers may send, on top of the grpc-web ones.
+	AllowedHeaders		[]string	`json:"allowed_headers"`
+	AllowWebsockets		bool		`json:"allow_websockets"`
+}
+
+func (c *CorsConfig) originAllowed(origin string) bool {
+	if len(c.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CorsConfig) grpcWebOpts() []grpcweb.Option {
+	opts := []grpcweb.Option{
+		grpcweb.WithOriginFunc(c.originAllowed),
+		grpcweb.WithCorsForRegisteredEndpointsOnly(true),
+	}
+	if len(c.AllowedHeaders) > 0 {
+		opts = append(opts, grpcweb.WithAllowedRequestHeaders(c.AllowedHeaders))
+	}
+	if c.AllowWebsockets {
+		opts = append(opts, grpcweb.WithWebsockets(true))
+		opts = append(opts, grpcweb.WithWebsocketOriginFunc(func(r *http.Request) bool {
+			return c.originAllowed(r.Header.Get("Origin"))
+		}))
+	}
+	return opts
+}
+
+// GrpcWebHandler lets browser clients call grpc_srv using grpc-web. Requests
+// which are not grpc-web (or its CORS preflight) are passed on to next. If
+// EnableGrpcWeb is not set, next is returned as is.
+func (c *GrpcServerConfig) GrpcWebHandler(grpc_srv *grpc.Server, next http.Handler) http.Handler {
+
+	if !c.EnableGrpcWeb {
+		return next
+	}
+
+	web_srv := grpcweb.WrapServer(grpc_srv, c.GrpcWebCors.grpcWebOpts()...)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if web_srv.IsGrpcWebRequest(r) || web_srv.IsAcceptableGrpcCorsRequest(r) ||
+			web_srv.IsGrpcWebSocketRequest(r) {
+			web_srv.ServeHTTP(w, r)
+			return
+		}
+		if next == nil {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
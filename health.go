@@ -0,0 +1,198 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// Component of WatchDB.
+	HEALTH_POSTGRES = "postgres"
+	// Components of WatchPools are this followed by the service name.
+	HEALTH_POOL_PREFIX = "pool:"
+
+	DEFAULT_DB_HEALTH_INTERVAL = 10 * time.Second
+)
+
+// ComponentHealth is the state of a component in a HealthRegistry.
+type ComponentHealth struct {
+	Component	string
+	Healthy		bool
+	// Why the component is unhealthy, if known.
+	Err		error
+	// When Healthy last changed.
+	Since		time.Time
+}
+
+// HealthRegistry tracks the health of the parts of a service, e.g. its
+// DB, pools or consumers, and mirrors it to the gRPC health server under
+// the component name. Listeners are told about transitions.
+type HealthRegistry struct {
+	server		*health.Server
+	clock		Clock
+	mtx		sync.Mutex
+	components	map[string] *ComponentHealth
+	listeners	[]func(ComponentHealth)
+}
+
+// NewHealthRegistry mirrors states to server, which may be nil.
+func NewHealthRegistry(server *health.Server) *HealthRegistry {
+	return &HealthRegistry{
+		server: server,
+		clock: pkgClock(),
+		components: make(map[string] *ComponentHealth),
+	}
+}
+
+// WithClock times transitions by c instead of the package clock.
+func (h *HealthRegistry) WithClock(c Clock) *HealthRegistry {
+	h.clock = c
+	return h
+}
+
+// OnChange calls fn on every transition. fn runs inline and should be
+// quick.
+func (h *HealthRegistry) OnChange(fn func(ComponentHealth)) {
+	h.mtx.Lock()
+	h.listeners = append(h.listeners, fn)
+	h.mtx.Unlock()
+}
+
+// Set records the state of component. err says why it is unhealthy.
+func (h *HealthRegistry) Set(component string, healthy bool, err error) {
+	h.mtx.Lock()
+	c, ok := h.components[component]
+	if ok && c.Healthy == healthy {
+		c.Err = err
+		h.mtx.Unlock()
+		return
+	}
+	c = &ComponentHealth{Component: component, Healthy: healthy, Err: err, Since: h.clock.Now()}
+	h.components[component] = c
+	state := *c
+	listeners := h.listeners
+	h.mtx.Unlock()
+
+	if h.server != nil {
+		status := healthpb.HealthCheckResponse_SERVING
+		if !healthy {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		h.server.SetServingStatus(component, status)
+	}
+	for _, fn := range listeners {
+		fn(state)
+	}
+}
+
+// Get returns the state of component, ok is false if it was never set.
+func (h *HealthRegistry) Get(component string) (ComponentHealth, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	c, ok := h.components[component]
+	if !ok {
+		return ComponentHealth{}, false
+	}
+	return *c, true
+}
+
+// All returns the states of all the components by name.
+func (h *HealthRegistry) All() []ComponentHealth {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	all := make([]ComponentHealth, 0, len(h.components))
+	for _, c := range h.components {
+		all = append(all, *c)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Component < all[j].Component })
+	return all
+}
+
+// WatchDB pings db every interval, DEFAULT_DB_HEALTH_INTERVAL if 0, and
+// records the outcome as HEALTH_POSTGRES till stop is called.
+func (h *HealthRegistry) WatchDB(db *sql.DB, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = DEFAULT_DB_HEALTH_INTERVAL
+	}
+	done := make(chan struct{})
+	ping := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		defer cancel()
+		err := db.PingContext(ctx)
+		h.Set(HEALTH_POSTGRES, err == nil, err)
+	}
+	go func() {
+		ticker := h.clock.NewTicker(interval)
+		defer ticker.Stop()
+		ping()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				ping()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// WatchPools records the health of the client pools of c, created with
+// CreateClientPool, as HEALTH_POOL_PREFIX + service name. A service is
+// unhealthy while all its endpoints are down, see RpcClientPool.Watch.
+// Watching ends with stop, or when the pools are closed.
+func (h *HealthRegistry) WatchPools(c *Configurations) (stop func()) {
+	c.pools_mtx.RLock()
+	pools := make(map[string] *RpcClientPool, len(c.client_map))
+	for svc, pool := range c.client_map {
+		pools[svc] = pool
+	}
+	c.pools_mtx.RUnlock()
+
+	unwatch := make([]func(), 0, len(pools))
+	for svc, pool := range pools {
+		states, fn := pool.Watch(16)
+		unwatch = append(unwatch, fn)
+		go h.watchPool(HEALTH_POOL_PREFIX + svc, len(pool.endpoints_map), states)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, fn := range unwatch {
+				fn()
+			}
+		})
+	}
+}
+
+func (h *HealthRegistry) watchPool(component string, endpoints int, states <-chan EndpointState) {
+	down := make(map[string] error)
+	for s := range states {
+		ep := endpointName(s.Endpoint)
+		if s.Up {
+			delete(down, ep)
+		} else {
+			down[ep] = s.Err
+		}
+		if len(down) < endpoints {
+			h.Set(component, true, nil)
+			continue
+		}
+		h.Set(component, false, fmt.Errorf("All endpoints down, %s: %v", ep, s.Err))
+	}
+}
+
+func endpointName(ep interface{}) string {
+	if conf, ok := ep.(GrpcClientConfig); ok {
+		return conf.primaryAddr()
+	}
+	return fmt.Sprint(ep)
+}
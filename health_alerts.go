@@ -0,0 +1,236 @@
+package backend_utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	CHANNEL_PAGERDUTY = "pagerduty"
+
+	DEFAULT_ALERT_AFTER = time.Minute
+)
+
+var pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+type HealthAlertConfig struct {
+	// How long a component must stay unhealthy before alerting.
+	// Defaults to DEFAULT_ALERT_AFTER.
+	After		Duration	`json:"after"`
+	SlackWebhook	string		`json:"slack_webhook" secret:"true"`
+	// Sent through the emailer.
+	Emails		[]string	`json:"emails"`
+	PagerDutyKey	string		`json:"pagerduty_routing_key" secret:"true"`
+	// Also notify when an alerted component recovers.
+	NotifyResolved	bool		`json:"notify_resolved"`
+}
+
+func (c *HealthAlertConfig) Enabled() bool {
+	return len(c.SlackWebhook) > 0 || len(c.Emails) > 0 || len(c.PagerDutyKey) > 0
+}
+
+// PagerDutyChannel triggers PagerDuty incidents through the Events API v2.
+// The address is the routing key of the service.
+type PagerDutyChannel struct {
+	// Source of the events, the host name if empty.
+	Source	string
+}
+
+func (p *PagerDutyChannel) Channel() string { return CHANNEL_PAGERDUTY }
+
+func (p *PagerDutyChannel) Send(ctx context.Context, to, subject, body string) error {
+	return p.event(ctx, to, "trigger", subject, subject + "\n" + body)
+}
+
+// Resolve resolves the incident Send triggered with subject.
+func (p *PagerDutyChannel) Resolve(ctx context.Context, to, subject string) error {
+	return p.event(ctx, to, "resolve", subject, subject)
+}
+
+func (p *PagerDutyChannel) event(ctx context.Context, key, action, dedup, summary string) error {
+	source := p.Source
+	if len(source) == 0 {
+		source, _ = os.Hostname()
+	}
+	buf, err := json.Marshal(map[string] interface{}{
+		"routing_key": key,
+		"event_action": action,
+		// Incidents are keyed by subject, so the resolve finds the trigger.
+		"dedup_key": dedup,
+		"payload": map[string] string{
+			"summary": summary,
+			"source": source,
+			"severity": "critical",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, pagerDutyEventsURL, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return postNotification(ctx, req)
+}
+
+type alertTarget struct {
+	sender	ChannelSender
+	to	string
+}
+
+type healthNote struct {
+	c		ComponentHealth
+	resolved	bool
+}
+
+// HealthAlerter notifies when a component of a HealthRegistry stays
+// unhealthy for longer than the configured threshold, and optionally when
+// it recovers.
+type HealthAlerter struct {
+	service		string
+	conf		HealthAlertConfig
+	registry	*HealthRegistry
+	clock		Clock
+	targets		[]alertTarget
+	mtx		sync.Mutex
+	// Components alerted on and not recovered since.
+	alerted		map[string] bool
+	// Notifications to send, in the order the transitions were seen, so
+	// that a resolve doesn't overtake its alert.
+	queue		[]healthNote
+	wake		chan struct{}
+	logger		Logger
+}
+
+// NewHealthAlerter watches registry and alerts the targets of conf. mailer
+// is needed for Emails only and may be nil otherwise.
+func NewHealthAlerter(service string, registry *HealthRegistry, conf HealthAlertConfig,
+	mailer MailerDaemonType) *HealthAlerter {
+
+	if conf.After.Duration <= 0 {
+		conf.After.Duration = DEFAULT_ALERT_AFTER
+	}
+	a := &HealthAlerter{
+		service: service,
+		conf: conf,
+		registry: registry,
+		clock: registry.clock,
+		alerted: make(map[string] bool),
+		wake: make(chan struct{}, 1),
+	}
+	if len(conf.SlackWebhook) > 0 {
+		a.targets = append(a.targets, alertTarget{&SlackChannel{AnyURL: true}, conf.SlackWebhook})
+	}
+	if mailer != nil {
+		for _, to := range conf.Emails {
+			a.targets = append(a.targets, alertTarget{&EmailChannel{Mailer: mailer}, to})
+		}
+	}
+	if len(conf.PagerDutyKey) > 0 {
+		a.targets = append(a.targets, alertTarget{&PagerDutyChannel{}, conf.PagerDutyKey})
+	}
+	registry.OnChange(a.changed)
+	go a.sender()
+	return a
+}
+
+// WithLogger logs failed notifications to l instead of the package logger.
+func (a *HealthAlerter) WithLogger(l Logger) *HealthAlerter {
+	a.logger = l
+	return a
+}
+
+func (a *HealthAlerter) subject(component string) string {
+	return fmt.Sprintf("[%s] %s is unhealthy", a.service, component)
+}
+
+func (a *HealthAlerter) changed(c ComponentHealth) {
+	if !c.Healthy {
+		go a.alertAfter(c)
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.alerted[c.Component] && a.conf.NotifyResolved {
+		a.enqueue(healthNote{c, true})
+	}
+	delete(a.alerted, c.Component)
+}
+
+// alertAfter alerts if c is still in the same unhealthy spell after the
+// threshold.
+func (a *HealthAlerter) alertAfter(c ComponentHealth) {
+	<-a.clock.After(a.conf.After.Duration)
+	// Checked under mtx, so that a recovery either comes before and
+	// cancels the alert, or after and resolves it.
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	now, ok := a.registry.Get(c.Component)
+	if !ok || now.Healthy || !now.Since.Equal(c.Since) {
+		return
+	}
+	a.alerted[c.Component] = true
+	a.enqueue(healthNote{now, false})
+}
+
+// enqueue is called with mtx held.
+func (a *HealthAlerter) enqueue(n healthNote) {
+	a.queue = append(a.queue, n)
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *HealthAlerter) sender() {
+	for range a.wake {
+		for {
+			a.mtx.Lock()
+			if len(a.queue) == 0 {
+				a.mtx.Unlock()
+				break
+			}
+			n := a.queue[0]
+			a.queue = a.queue[1:]
+			a.mtx.Unlock()
+			a.notify(n.c, n.resolved)
+		}
+	}
+}
+
+func (a *HealthAlerter) notify(c ComponentHealth, resolved bool) {
+	subject := a.subject(c.Component)
+	body := fmt.Sprintf("%s of %s has been unhealthy since %s.", c.Component, a.service,
+		c.Since.Format(time.RFC3339))
+	if c.Err != nil {
+		body += "\nError: " + c.Err.Error()
+	}
+	if resolved {
+		body = fmt.Sprintf("%s of %s recovered at %s.", c.Component, a.service, c.Since.Format(time.RFC3339))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+	defer cancel()
+	for _, t := range a.targets {
+		var err error
+		if pd, ok := t.sender.(*PagerDutyChannel); ok && resolved {
+			err = pd.Resolve(ctx, t.to, subject)
+		} else if resolved {
+			err = t.sender.Send(ctx, t.to, "[RESOLVED] " + subject, body)
+		} else {
+			err = t.sender.Send(ctx, t.to, subject, body)
+		}
+		if err != nil {
+			loggerOr(a.logger).Errorf("Failed sending %s health alert for %s. Err:%s",
+				t.sender.Channel(), c.Component, err.Error())
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package backend_utils
+
+import (
+	"time"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+type HedgingPolicy struct {
+	// Time to wait for the first attempt before sending the hedged one.
+	Delay		Duration	`json:"delay"`
+}
+
+type hedgedCallKey struct{}
+
+type hedgeResult struct {
+	reply	proto.Message
+	err	error
+}
+
+// Hedged calls are only sent for methods in policies, and only when the conn
+// belongs to a pool so that a second connection can be borrowed. Both attempts
+// decode into their own copy of reply and the winner is merged in at the end.
+func hedgingInterceptor(policies map[string]*HedgingPolicy, pool *RpcClientPool) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+		policy, ok := policies[method]
+		msg, is_proto := reply.(proto.Message)
+		if !ok || !is_proto || policy.Delay.Duration <= 0 || ctx.Value(hedgedCallKey{}) != nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		ctx, cancel := context.WithCancel(context.WithValue(ctx, hedgedCallKey{}, true))
+		defer cancel()
+
+		call := func(conn *grpc.ClientConn, results chan<- hedgeResult) {
+			r := proto.Clone(msg)
+			r.Reset()
+			results <- hedgeResult{reply: r, err: invoker(ctx, method, req, r, conn, opts...)}
+		}
+
+		results := make(chan hedgeResult, 2)
+		go call(cc, results)
+		pending := 1
+
+		timer := time.NewTimer(policy.Delay.Duration)
+		defer timer.Stop()
+
+		var first hedgeResult
+		for pending > 0 {
+			select {
+			case res := <-results:
+				pending--
+				if res.err == nil {
+					msg.Reset()
+					proto.Merge(msg, res.reply)
+					return nil
+				}
+				if first.err == nil {
+					first = res
+				}
+			case <-timer.C:
+				conn, err := pool.GetConn()
+				if err != nil {
+					continue
+				}
+				// Put back once the hedge is done, which the cancel on
+				// return ensures, so the connection is never returned
+				// with a call still running on it.
+				go func() {
+					call(conn, results)
+					pool.Put(conn)
+				}()
+				pending++
+			}
+		}
+		return first.err
+	}
+}
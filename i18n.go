@@ -0,0 +1,271 @@
+package backend_utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata keys the locale of a call is negotiated from, the second one as
+// forwarded by grpc-gateway.
+const (
+	LOCALE_MD_KEY = "accept-language"
+	GATEWAY_LOCALE_MD_KEY = "grpcgateway-accept-language"
+)
+
+type I18nConfig struct {
+	// Directory of the message catalogs, one <locale>.json file each.
+	Dir		string	`json:"dir"`
+	// Locale used for messages missing in the negotiated ones.
+	DefaultLocale	string	`json:"default_locale"`
+}
+
+// Catalog holds messages by locale. A message is a fmt format, or a set of
+// them by plural category for Localizer.N.
+type Catalog struct {
+	def_locale	string
+	mtx		sync.RWMutex
+	// By locale, then key, then plural category.
+	messages	map[string] map[string] map[string] string
+}
+
+func NewCatalog(def_locale string) *Catalog {
+	return &Catalog{
+		def_locale: NormalizeLocale(def_locale),
+		messages: make(map[string] map[string] map[string] string),
+	}
+}
+
+// LoadCatalog loads the <locale>.json files of Dir. Each maps message keys
+// to a format, or to an object of formats by plural category:
+//
+//	{"cart.items": {"one": "%d item", "other": "%d items"}, "hello": "Hello %s"}
+func (c *I18nConfig) LoadCatalog() (*Catalog, error) {
+	cat := NewCatalog(c.DefaultLocale)
+	files, err := filepath.Glob(filepath.Join(c.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var msgs map[string] json.RawMessage
+		if err = json.Unmarshal(buf, &msgs); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		locale := strings.TrimSuffix(filepath.Base(path), ".json")
+		for key, raw := range msgs {
+			var forms map[string] string
+			var msg string
+			if err = json.Unmarshal(raw, &msg); err == nil {
+				forms = map[string] string{PLURAL_OTHER: msg}
+			} else if err = json.Unmarshal(raw, &forms); err != nil {
+				return nil, fmt.Errorf("%s: message %s: %s", path, key, err.Error())
+			}
+			cat.AddPlural(locale, key, forms)
+		}
+	}
+	return cat, nil
+}
+
+// Add adds messages of locale, keyed by message key.
+func (c *Catalog) Add(locale string, messages map[string] string) {
+	for key, msg := range messages {
+		c.AddPlural(locale, key, map[string] string{PLURAL_OTHER: msg})
+	}
+}
+
+// AddPlural adds a message with a format per plural category, see
+// PluralForm. The PLURAL_OTHER one is used for categories missing.
+func (c *Catalog) AddPlural(locale, key string, forms map[string] string) {
+	locale = NormalizeLocale(locale)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.messages[locale] == nil {
+		c.messages[locale] = make(map[string] map[string] string)
+	}
+	c.messages[locale][key] = forms
+}
+
+// Locales lists the locales with messages.
+func (c *Catalog) Locales() []string {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	locales := make([]string, 0, len(c.messages))
+	for l := range c.messages {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+func (c *Catalog) lookup(chain []string, key string) (map[string] string, string) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	for _, l := range chain {
+		if forms, ok := c.messages[l][key]; ok {
+			return forms, l
+		}
+	}
+	return nil, ""
+}
+
+// ParseAcceptLanguage returns the locales of an Accept-Language value by
+// preference, e.g. "da, en-GB;q=0.8, en;q=0.7".
+func ParseAcceptLanguage(header string) []string {
+	type pref struct {
+		locale	string
+		q	float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		locale := strings.TrimSpace(fields[0])
+		if len(locale) == 0 || locale == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if f = strings.TrimSpace(f); strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, pref{NormalizeLocale(locale), q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	locales := make([]string, len(prefs))
+	for i := range prefs {
+		locales[i] = prefs[i].locale
+	}
+	return locales
+}
+
+// Localizer renders the messages of a catalog in the locales negotiated
+// for a caller. A nil Localizer renders the keys.
+type Localizer struct {
+	catalog	*Catalog
+	chain	[]string
+}
+
+// Localizer returns a localizer for the locales in preference order,
+// falling back to less specific ones and then the default locale.
+func (c *Catalog) Localizer(locales ...string) *Localizer {
+	l := &Localizer{catalog: c}
+	seen := make(map[string] bool)
+	prefs := append(append([]string{}, locales...), c.def_locale)
+	for _, locale := range prefs {
+		for _, ll := range LocaleChain(locale, "") {
+			if !seen[ll] {
+				seen[ll] = true
+				l.chain = append(l.chain, ll)
+			}
+		}
+	}
+	return l
+}
+
+// Locale returns the preferred locale the catalog has messages in.
+func (l *Localizer) Locale() string {
+	if l == nil {
+		return ""
+	}
+	l.catalog.mtx.RLock()
+	defer l.catalog.mtx.RUnlock()
+	for _, locale := range l.chain {
+		if _, ok := l.catalog.messages[locale]; ok {
+			return locale
+		}
+	}
+	return l.catalog.def_locale
+}
+
+// T renders the message key with args. Missing messages render as the key.
+func (l *Localizer) T(key string, args ...interface{}) string {
+	if l == nil {
+		return key
+	}
+	forms, _ := l.catalog.lookup(l.chain, key)
+	if forms == nil {
+		return key
+	}
+	return fmt.Sprintf(forms[PLURAL_OTHER], args...)
+}
+
+// N renders the message key in the plural form for n. n is passed to the
+// format before args.
+func (l *Localizer) N(key string, n int, args ...interface{}) string {
+	if l == nil {
+		return key
+	}
+	forms, locale := l.catalog.lookup(l.chain, key)
+	if forms == nil {
+		return key
+	}
+	format, ok := forms[PluralForm(locale, n)]
+	if !ok {
+		format = forms[PLURAL_OTHER]
+	}
+	return fmt.Sprintf(format, append([]interface{}{n}, args...)...)
+}
+
+type localizerKey struct{}
+
+func WithLocalizer(ctx context.Context, l *Localizer) context.Context {
+	return context.WithValue(ctx, localizerKey{}, l)
+}
+
+// LocalizerFromContext returns the localizer of the call, nil if there is
+// none.
+func LocalizerFromContext(ctx context.Context) *Localizer {
+	l, _ := ctx.Value(localizerKey{}).(*Localizer)
+	return l
+}
+
+// ErrLocalized is a status error with the message key rendered for the
+// caller.
+func ErrLocalized(ctx context.Context, code codes.Code, key string, args ...interface{}) error {
+	return status.Error(code, LocalizerFromContext(ctx).T(key, args...))
+}
+
+func (c *Catalog) negotiate(ctx context.Context) context.Context {
+	var locales []string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, k := range []string{LOCALE_MD_KEY, GATEWAY_LOCALE_MD_KEY} {
+			for _, v := range md[k] {
+				locales = append(locales, ParseAcceptLanguage(v)...)
+			}
+		}
+	}
+	return WithLocalizer(ctx, c.Localizer(locales...))
+}
+
+func (c *Catalog) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(c.negotiate(ctx), req)
+	}
+}
+
+func (c *Catalog) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: c.negotiate(ss.Context())})
+	}
+}
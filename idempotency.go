@@ -0,0 +1,287 @@
+package backend_utils
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata key carrying the client chosen idempotency key.
+const IDEMPOTENCY_MD_KEY = "idempotency-key"
+
+const DEFAULT_IDEMPOTENCY_TTL = 24 * time.Hour
+
+// How long a call holds its key. Calls with a deadline hold it till then
+// plus IDEMPOTENCY_LEASE_MARGIN, so that a crashed call doesn't block
+// retries for the whole TTL.
+const (
+	DEFAULT_IDEMPOTENCY_LEASE = 5 * time.Minute
+	IDEMPOTENCY_LEASE_MARGIN = 30 * time.Second
+)
+
+// IdempotentResult is the outcome of a call, kept for replaying.
+type IdempotentResult struct {
+	MsgType		string		`json:"msg_type"`
+	Body		[]byte		`json:"body"`
+	Code		codes.Code	`json:"code"`
+	Message		string		`json:"message"`
+	// Hash of the request, a retry with the key must send the same one.
+	RequestHash	string		`json:"request_hash"`
+}
+
+type IdempotencyStore interface {
+	// Reserve returns the stored result if key has completed. Otherwise
+	// reserved tells if the caller now owns key, for lease. If it is
+	// neither, another call with key is still running.
+	Reserve(key string, lease time.Duration) (res *IdempotentResult, reserved bool, err error)
+	// Complete stores res for ttl, replacing the reservation.
+	Complete(key string, res *IdempotentResult, ttl time.Duration) error
+	// Release drops the reservation so that a retry runs the call again.
+	Release(key string) error
+}
+
+// Errors which will be the same on a retry are replayed. Others are not
+// stored, so the retry gets another chance.
+func replayableCode(code codes.Code) bool {
+	switch code {
+	case codes.OK, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.PermissionDenied, codes.FailedPrecondition, codes.OutOfRange:
+		return true
+	}
+	return false
+}
+
+func idempotencyRequestHash(req proto.Message) (string, error) {
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(req); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (r *IdempotentResult) replay() (interface{}, error) {
+	if r.Code != codes.OK {
+		return nil, status.Error(r.Code, r.Message)
+	}
+	typ := proto.MessageType(r.MsgType)
+	if typ == nil {
+		return nil, ErrInternal("Unknown stored response type")
+	}
+	msg := reflect.New(typ.Elem()).Interface().(proto.Message)
+	if err := proto.Unmarshal(r.Body, msg); err != nil {
+		return nil, ErrInternal("Failed decoding stored response")
+	}
+	return msg, nil
+}
+
+// IdempotencyInterceptor runs calls carrying an idempotency key at most once
+// per key within ttl. Keys are scoped to the method and JWT subject, and
+// reusing one with a different request fails with InvalidArgument. Calls
+// whose request or reply isn't a proto message aren't deduplicated.
+func IdempotencyInterceptor(store IdempotencyStore, ttl time.Duration) grpc.UnaryServerInterceptor {
+
+	if ttl <= 0 {
+		ttl = DEFAULT_IDEMPOTENCY_TTL
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok || len(md[IDEMPOTENCY_MD_KEY]) == 0 {
+			return handler(ctx, req)
+		}
+		req_msg, ok := req.(proto.Message)
+		if !ok {
+			return handler(ctx, req)
+		}
+		req_hash, err := idempotencyRequestHash(req_msg)
+		if err != nil {
+			return handler(ctx, req)
+		}
+		key := info.FullMethod + ":" + jwtSubject(ctx) + ":" + md[IDEMPOTENCY_MD_KEY][0]
+
+		res, reserved, err := store.Reserve(key, idempotencyLease(ctx))
+		if err != nil {
+			return nil, ErrUnavailable("Idempotency store unavailable")
+		}
+		if res != nil {
+			if res.RequestHash != req_hash {
+				return nil, ErrInvalidArg("Idempotency key reused with a different request")
+			}
+			return res.replay()
+		}
+		if !reserved {
+			return nil, status.Error(codes.Aborted, "Request with the same idempotency key in progress")
+		}
+
+		resp, err := handler(ctx, req)
+
+		release := func() {
+			if err := store.Release(key); err != nil {
+				pkgLog().Errorf("Failed releasing idempotency key for %s. Err:%s", info.FullMethod, err)
+			}
+		}
+
+		code := status.Code(err)
+		if !replayableCode(code) {
+			release()
+			return resp, err
+		}
+
+		res = &IdempotentResult{Code: code, RequestHash: req_hash}
+		if err != nil {
+			res.Message = status.Convert(err).Message()
+		} else {
+			msg, ok := resp.(proto.Message)
+			if !ok {
+				release()
+				return resp, err
+			}
+			res.MsgType = proto.MessageName(msg)
+			if res.Body, err = proto.Marshal(msg); err != nil {
+				pkgLog().Errorf("Failed encoding response of %s for replay. Err:%s", info.FullMethod, err)
+				release()
+				return resp, nil
+			}
+		}
+		if err := store.Complete(key, res, ttl); err != nil {
+			pkgLog().Errorf("Failed storing idempotent result of %s. Err:%s", info.FullMethod, err)
+		}
+		return resp, err
+	}
+}
+
+func idempotencyLease(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return DEFAULT_IDEMPOTENCY_LEASE
+	}
+	return time.Until(deadline) + IDEMPOTENCY_LEASE_MARGIN
+}
+
+type RedisIdempotencyStore struct {
+	client	*redis.Client
+}
+
+func NewRedisIdempotencyStore(client *redis.Client) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{client: client}
+}
+
+const idempotencyPending = "pending"
+
+func (r *RedisIdempotencyStore) Reserve(key string, lease time.Duration) (*IdempotentResult, bool, error) {
+
+	key = "idempotency:" + key
+	ok, err := r.client.SetNX(key, idempotencyPending, lease).Result()
+	if err != nil || ok {
+		return nil, ok, err
+	}
+
+	val, err := r.client.Get(key).Bytes()
+	if err == redis.Nil {
+		// Expired in between, try again.
+		return r.Reserve(key[len("idempotency:"):], lease)
+	}
+	if err != nil || string(val) == idempotencyPending {
+		return nil, false, err
+	}
+	res := new(IdempotentResult)
+	return res, false, json.Unmarshal(val, res)
+}
+
+func (r *RedisIdempotencyStore) Complete(key string, res *IdempotentResult, ttl time.Duration) error {
+	buf, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return r.client.Set("idempotency:" + key, buf, ttl).Err()
+}
+
+func (r *RedisIdempotencyStore) Release(key string) error {
+	return r.client.Del("idempotency:" + key).Err()
+}
+
+// PostgresIdempotencyStore keeps results in the idempotency_keys table.
+// Call CreateTable once before using it.
+type PostgresIdempotencyStore struct {
+	db	*sql.DB
+	clock	Clock
+}
+
+func NewPostgresIdempotencyStore(db *sql.DB) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{db: db}
+}
+
+// WithClock expires keys by c instead of the package clock.
+func (p *PostgresIdempotencyStore) WithClock(c Clock) *PostgresIdempotencyStore {
+	p.clock = c
+	return p
+}
+
+func (p *PostgresIdempotencyStore) CreateTable() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key TEXT PRIMARY KEY,
+		completed BOOLEAN NOT NULL DEFAULT FALSE,
+		result BYTEA,
+		expires_at TIMESTAMPTZ NOT NULL)`)
+	return err
+}
+
+func (p *PostgresIdempotencyStore) Reserve(key string, lease time.Duration) (*IdempotentResult, bool, error) {
+
+	now := clockOr(p.clock).Now()
+	_, err := p.db.Exec("DELETE FROM idempotency_keys WHERE key = $1 AND expires_at < $2", key, now)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r, err := p.db.Exec("INSERT INTO idempotency_keys (key, expires_at) VALUES ($1, $2) " +
+		"ON CONFLICT (key) DO NOTHING", key, now.Add(lease))
+	if err != nil {
+		return nil, false, err
+	}
+	if n, _ := r.RowsAffected(); n == 1 {
+		return nil, true, nil
+	}
+
+	var completed bool
+	var buf []byte
+	err = p.db.QueryRow("SELECT completed, result FROM idempotency_keys WHERE key = $1", key).Scan(
+		&completed, &buf)
+	if err == sql.ErrNoRows {
+		return p.Reserve(key, lease)
+	}
+	if err != nil || !completed {
+		return nil, false, err
+	}
+	res := new(IdempotentResult)
+	return res, false, json.Unmarshal(buf, res)
+}
+
+func (p *PostgresIdempotencyStore) Complete(key string, res *IdempotentResult, ttl time.Duration) error {
+	buf, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec("UPDATE idempotency_keys SET completed = TRUE, result = $2, expires_at = $3 " +
+		"WHERE key = $1", key, buf, clockOr(p.clock).Now().Add(ttl))
+	return err
+}
+
+func (p *PostgresIdempotencyStore) Release(key string) error {
+	_, err := p.db.Exec("DELETE FROM idempotency_keys WHERE key = $1", key)
+	return err
+}
@@ -0,0 +1,145 @@
+package backend_utils
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// memIdempotencyStore is IdempotencyStore in a map, without leases.
+type memIdempotencyStore struct {
+	mtx	sync.Mutex
+	keys	map[string] *IdempotentResult
+}
+
+func (m *memIdempotencyStore) Reserve(key string, lease time.Duration) (*IdempotentResult, bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	res, ok := m.keys[key]
+	if !ok {
+		m.keys[key] = nil
+		return nil, true, nil
+	}
+	return res, false, nil
+}
+
+func (m *memIdempotencyStore) Complete(key string, res *IdempotentResult, ttl time.Duration) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.keys[key] = res
+	return nil
+}
+
+func (m *memIdempotencyStore) Release(key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.keys, key)
+	return nil
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	first := &healthpb.HealthCheckRequest{Service: "a"}
+	other := &healthpb.HealthCheckRequest{Service: "b"}
+	tests := []struct {
+		name		string
+		key		string
+		second		interface{}
+		// Result of each handler call.
+		reply		interface{}
+		err		error
+		want_calls	int
+		want_code	codes.Code
+	}{
+		{
+			name: "replays the reply",
+			key: "k1",
+			second: first,
+			reply: &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING},
+			want_calls: 1,
+		},
+		{
+			name: "replays a final error",
+			key: "k1",
+			second: first,
+			err: ErrNotFound("No such service"),
+			want_calls: 1,
+			want_code: codes.NotFound,
+		},
+		{
+			name: "retries a transient error",
+			key: "k1",
+			second: first,
+			err: ErrUnavailable("Try again"),
+			want_calls: 2,
+			want_code: codes.Unavailable,
+		},
+		{
+			name: "rejects another request with the key",
+			key: "k1",
+			second: other,
+			reply: &healthpb.HealthCheckResponse{},
+			want_calls: 1,
+			want_code: codes.InvalidArgument,
+		},
+		{
+			name: "runs calls without a key",
+			second: first,
+			reply: &healthpb.HealthCheckResponse{},
+			want_calls: 2,
+		},
+		{
+			name: "doesn't store replies which aren't protos",
+			key: "k1",
+			second: first,
+			reply: "not a proto",
+			want_calls: 2,
+		},
+		{
+			name: "runs requests which aren't protos",
+			key: "k1",
+			second: "not a proto",
+			reply: &healthpb.HealthCheckResponse{},
+			want_calls: 2,
+		},
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			interceptor := IdempotencyInterceptor(&memIdempotencyStore{keys: map[string] *IdempotentResult{}}, time.Hour)
+			calls := 0
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				calls++
+				return tc.reply, tc.err
+			}
+			ctx := context.Background()
+			if len(tc.key) > 0 {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(IDEMPOTENCY_MD_KEY, tc.key))
+			}
+
+			interceptor(ctx, first, info, handler)
+			resp, err := interceptor(ctx, tc.second, info, handler)
+
+			if calls != tc.want_calls {
+				t.Fatalf("Handler called %d times, want %d.", calls, tc.want_calls)
+			}
+			if code := status.Code(err); code != tc.want_code {
+				t.Fatalf("Got %s, want %s.", code, tc.want_code)
+			}
+			if err != nil {
+				return
+			}
+			if want, ok := tc.reply.(proto.Message); ok && !proto.Equal(resp.(proto.Message), want) {
+				t.Fatalf("Got reply %v, want %v.", resp, want)
+			}
+		})
+	}
+}
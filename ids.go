@@ -0,0 +1,213 @@
+package backend_utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ID schemes of IDConfig.
+const (
+	ID_UUIDV4 = "uuidv4"
+	ID_UUIDV7 = "uuidv7"
+	ID_ULID = "ulid"
+	ID_SNOWFLAKE = "snowflake"
+)
+
+// Snowflake layout: 41 bits of milliseconds since the epoch, 10 of worker
+// id and 12 of sequence.
+const (
+	SNOWFLAKE_WORKER_BITS = 10
+	SNOWFLAKE_SEQ_BITS = 12
+	MAX_SNOWFLAKE_WORKER = 1 << SNOWFLAKE_WORKER_BITS - 1
+
+	// Lock key prefix of the worker ids claimed by ClaimWorkerID.
+	snowflakeWorkerLock = "snowflake-worker-"
+)
+
+// 2020-01-01T00:00:00Z, the snowflake epoch if none is configured.
+var DefaultSnowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	ErrClockBackwards = errors.New("Clock moved backwards.")
+	ErrNoWorkerID = errors.New("No free snowflake worker id.")
+)
+
+type IDConfig struct {
+	// One of ID_UUIDV4, ID_UUIDV7, ID_ULID or ID_SNOWFLAKE. Defaults to
+	// ID_UUIDV4.
+	Scheme		string		`json:"scheme"`
+	// Snowflake worker id. If not set one is claimed through the locker,
+	// see ClaimWorkerID.
+	WorkerID	*int		`json:"worker_id"`
+	// Snowflake epoch, DefaultSnowflakeEpoch if zero.
+	Epoch		time.Time	`json:"epoch"`
+}
+
+// IDGenerator generates IDs of one scheme.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// IDGeneratorFunc adapts a function to IDGenerator.
+type IDGeneratorFunc func() (string, error)
+
+func (f IDGeneratorFunc) NewID() (string, error) {
+	return f()
+}
+
+// NewIDGenerator returns the generator of the configured scheme. locker is
+// only used for snowflakes without a worker_id, and may be nil otherwise.
+func (c *IDConfig) NewIDGenerator(locker Locker) (IDGenerator, error) {
+	switch c.Scheme {
+	case "", ID_UUIDV4:
+		return IDGeneratorFunc(NewUUID), nil
+	case ID_UUIDV7:
+		return IDGeneratorFunc(NewUUIDv7), nil
+	case ID_ULID:
+		return IDGeneratorFunc(NewULID), nil
+	case ID_SNOWFLAKE:
+		var worker int
+		if c.WorkerID != nil {
+			worker = *c.WorkerID
+		} else {
+			if locker == nil {
+				return nil, errors.New("Snowflake IDs need a worker_id or a locker.")
+			}
+			var err error
+			if worker, err = ClaimWorkerID(locker, DEFAULT_LOCK_CLAIM_TIMEOUT); err != nil {
+				return nil, err
+			}
+		}
+		sf, err := NewSnowflake(worker, c.Epoch)
+		if err != nil {
+			return nil, err
+		}
+		return IDGeneratorFunc(sf.NewID), nil
+	}
+	return nil, fmt.Errorf("Unknown ID scheme %q.", c.Scheme)
+}
+
+// Time waited for each worker id lock by NewIDGenerator.
+const DEFAULT_LOCK_CLAIM_TIMEOUT = 100 * time.Millisecond
+
+// ClaimWorkerID locks the first free snowflake worker id through locker,
+// e.g. one backed by ZooKeeper. The lock is held for the life of the
+// process, or till ReleaseWorkerID.
+func ClaimWorkerID(locker Locker, timeout time.Duration) (int, error) {
+	for id := 0; id <= MAX_SNOWFLAKE_WORKER; id++ {
+		err := locker.Lock(fmt.Sprintf("%s%d", snowflakeWorkerLock, id), timeout)
+		if err == nil {
+			return id, nil
+		}
+		if err != ErrLockTimeout {
+			return 0, err
+		}
+	}
+	return 0, ErrNoWorkerID
+}
+
+func ReleaseWorkerID(locker Locker, id int) error {
+	return locker.Unlock(fmt.Sprintf("%s%d", snowflakeWorkerLock, id))
+}
+
+func formatUUID(uuid []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// NewUUIDv7 returns a time ordered UUID: 48 bits of Unix milliseconds
+// followed by random bits, so they index well as primary keys.
+func NewUUIDv7() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, uuid[6:]); err != nil {
+		return "", err
+	}
+	ms := uint64(pkgClock().Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(uuid[0:2], uint16(ms >> 32))
+	binary.BigEndian.PutUint32(uuid[2:6], uint32(ms))
+	uuid[6] = uuid[6]&^0xf0 | 0x70
+	uuid[8] = uuid[8]&^0xc0 | 0x80
+	return formatUUID(uuid), nil
+}
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID returns a ULID: 48 bits of Unix milliseconds and 80 random bits
+// as 26 Crockford base32 characters, which sort by time.
+func NewULID() (string, error) {
+	var id [16]byte
+	if _, err := io.ReadFull(rand.Reader, id[6:]); err != nil {
+		return "", err
+	}
+	ms := uint64(pkgClock().Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms >> 32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo & 31]
+		lo = lo >> 5 | hi << 59
+		hi >>= 5
+	}
+	return string(out), nil
+}
+
+// Snowflake generates 63 bit IDs ordered by time, unique across workers
+// as long as every worker has its own id.
+type Snowflake struct {
+	mtx	sync.Mutex
+	epoch	time.Time
+	worker	int64
+	last_ms	int64
+	seq	int64
+}
+
+func NewSnowflake(worker int, epoch time.Time) (*Snowflake, error) {
+	if worker < 0 || worker > MAX_SNOWFLAKE_WORKER {
+		return nil, fmt.Errorf("Snowflake worker id must be in 0-%d.", MAX_SNOWFLAKE_WORKER)
+	}
+	if epoch.IsZero() {
+		epoch = DefaultSnowflakeEpoch
+	}
+	return &Snowflake{epoch: epoch, worker: int64(worker), last_ms: -1}, nil
+}
+
+// Next returns the next ID. If the sequence of the current millisecond is
+// used up it waits for the next one. It returns ErrClockBackwards if the
+// clock moved back past the last ID.
+func (s *Snowflake) Next() (int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ms := int64(pkgClock().Since(s.epoch) / time.Millisecond)
+	if ms < s.last_ms {
+		return 0, ErrClockBackwards
+	}
+	if ms == s.last_ms {
+		s.seq = (s.seq + 1) & (1 << SNOWFLAKE_SEQ_BITS - 1)
+		if s.seq == 0 {
+			for ms <= s.last_ms {
+				time.Sleep(100 * time.Microsecond)
+				ms = int64(pkgClock().Since(s.epoch) / time.Millisecond)
+			}
+		}
+	} else {
+		s.seq = 0
+	}
+	s.last_ms = ms
+	return ms << (SNOWFLAKE_WORKER_BITS + SNOWFLAKE_SEQ_BITS) | s.worker << SNOWFLAKE_SEQ_BITS | s.seq, nil
+}
+
+// NewID returns Next in decimal.
+func (s *Snowflake) NewID() (string, error) {
+	id, err := s.Next()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d", id), nil
+}
@@ -0,0 +1,105 @@
+package backend_utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"golang.org/x/net/context"
+)
+
+// Timeout used for hooks which don't set one.
+const DEFAULT_HOOK_TIMEOUT = 15 * time.Second
+
+type LifecycleHook struct {
+	Name		string
+	OnStart		func(context.Context) error
+	OnStop		func(context.Context) error
+	Timeout		time.Duration
+}
+
+// LifecycleError collects the errors of all the hooks which failed.
+type LifecycleError struct {
+	Errs	[]error
+}
+
+func (e *LifecycleError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i := range e.Errs {
+		msgs[i] = e.Errs[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *LifecycleError) add(err error) {
+	if err == nil {
+		return
+	}
+	if l, ok := err.(*LifecycleError); ok {
+		e.Errs = append(e.Errs, l.Errs...)
+		return
+	}
+	e.Errs = append(e.Errs, err)
+}
+
+// runHook fails fn once the timeout expires, but still waits for it to
+// return, so that a hook never runs alongside the next one. fn is expected
+// to return soon after its context is done.
+func runHook(name string, timeout time.Duration, fn func(context.Context) error) error {
+
+	if timeout <= 0 {
+		timeout = DEFAULT_HOOK_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- fn(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		pkgLog().Errorf("Hook %s timed out, waiting for it to return.", name)
+		<-done
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+// Hooks are started in order. If one fails, the ones already started are
+// stopped again. Returns the number of hooks started.
+func runStartHooks(hooks []LifecycleHook) (int, error) {
+
+	for i := range hooks {
+		if hooks[i].OnStart == nil {
+			continue
+		}
+		err := runHook(hooks[i].Name+" start", hooks[i].Timeout, hooks[i].OnStart)
+		if err != nil {
+			errs := &LifecycleError{}
+			errs.add(err)
+			errs.add(runStopHooks(hooks[:i]))
+			return i, errs
+		}
+	}
+	return len(hooks), nil
+}
+
+// Hooks are stopped in reverse order. All of them are run even if some fail.
+func runStopHooks(hooks []LifecycleHook) error {
+
+	errs := &LifecycleError{}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if hooks[i].OnStop == nil {
+			continue
+		}
+		errs.add(runHook(hooks[i].Name+" stop", hooks[i].Timeout, hooks[i].OnStop))
+	}
+	if len(errs.Errs) > 0 {
+		return errs
+	}
+	return nil
+}
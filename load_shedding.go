@@ -0,0 +1,83 @@
+package backend_utils
+
+import (
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Calls whose deadline leaves less than min are failed right away with
+// DeadlineExceeded instead of loading a service which can't answer in time.
+func budgetCheck(ctx context.Context, min time.Duration) error {
+	dl, ok := ctx.Deadline()
+	if ok && time.Until(dl) < min {
+		return status.Error(codes.DeadlineExceeded, "Not enough time left for the call")
+	}
+	return nil
+}
+
+func budgetUnaryInterceptor(min time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if err := budgetCheck(ctx, min); err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func budgetStreamInterceptor(min time.Duration) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if err := budgetCheck(ctx, min); err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+// TrimDeadline returns ctx with its deadline moved reserve earlier, leaving
+// the caller that long to handle the result of calls made with it. ctx is
+// returned as it is if it has no deadline. If the trimmed deadline has
+// already passed, the returned context is done.
+func TrimDeadline(ctx context.Context, reserve time.Duration) (context.Context, context.CancelFunc) {
+	dl, ok := ctx.Deadline()
+	if !ok || reserve <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, dl.Add(-reserve))
+}
+
+func trimUnaryInterceptor(reserve time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, cancel := TrimDeadline(ctx, reserve)
+		defer cancel()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// The trimmed context lives as long as the stream, so it is cancelled by
+// the stream ending rather than here.
+func trimStreamInterceptor(reserve time.Duration) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		dl, ok := ctx.Deadline()
+		if !ok || reserve <= 0 {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		ctx, cancel := context.WithDeadline(ctx, dl.Add(-reserve))
+		s, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		go func() {
+			<-s.Context().Done()
+			cancel()
+		}()
+		return s, nil
+	}
+}
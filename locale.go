@@ -0,0 +1,134 @@
+package backend_utils
+
+import (
+	"strings"
+)
+
+// Plural categories, as in the CLDR plural rules.
+const (
+	PLURAL_ZERO = "zero"
+	PLURAL_ONE = "one"
+	PLURAL_TWO = "two"
+	PLURAL_FEW = "few"
+	PLURAL_MANY = "many"
+	PLURAL_OTHER = "other"
+)
+
+// NormalizeLocale turns "pt_br" or "PT-br" into "pt-BR".
+func NormalizeLocale(locale string) string {
+	parts := strings.Split(strings.Replace(strings.TrimSpace(locale), "_", "-", -1), "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// LocaleChain lists the locales to try for locale, most specific first,
+// ending with def. "pt-BR" gives "pt-BR", "pt" and def.
+func LocaleChain(locale, def string) []string {
+	var chain []string
+	add := func(l string) {
+		for _, c := range chain {
+			if c == l {
+				return
+			}
+		}
+		chain = append(chain, l)
+	}
+	if locale = NormalizeLocale(locale); len(locale) > 0 {
+		for l := locale; len(l) > 0; {
+			add(l)
+			i := strings.LastIndex(l, "-")
+			if i < 0 {
+				break
+			}
+			l = l[:i]
+		}
+	}
+	if def = NormalizeLocale(def); len(def) > 0 {
+		add(def)
+	}
+	return chain
+}
+
+func localeLang(locale string) string {
+	return strings.SplitN(NormalizeLocale(locale), "-", 2)[0]
+}
+
+// PluralForm returns the plural category of n in the language of locale.
+// Only the rules of common languages are covered, others get English
+// rules.
+func PluralForm(locale string, n int) string {
+	if n < 0 {
+		n = -n
+	}
+	switch localeLang(locale) {
+	case "ja", "zh", "ko", "vi", "th", "id", "ms", "tr":
+		return PLURAL_OTHER
+	case "fr", "pt":
+		if n <= 1 {
+			return PLURAL_ONE
+		}
+	case "ru", "uk", "be", "sr", "hr", "bs":
+		switch {
+		case n % 10 == 1 && n % 100 != 11:
+			return PLURAL_ONE
+		case n % 10 >= 2 && n % 10 <= 4 && (n % 100 < 12 || n % 100 > 14):
+			return PLURAL_FEW
+		}
+		return PLURAL_MANY
+	case "pl":
+		switch {
+		case n == 1:
+			return PLURAL_ONE
+		case n % 10 >= 2 && n % 10 <= 4 && (n % 100 < 12 || n % 100 > 14):
+			return PLURAL_FEW
+		}
+		return PLURAL_MANY
+	case "cs", "sk":
+		switch {
+		case n == 1:
+			return PLURAL_ONE
+		case n >= 2 && n <= 4:
+			return PLURAL_FEW
+		}
+	case "ar":
+		switch {
+		case n == 0:
+			return PLURAL_ZERO
+		case n == 1:
+			return PLURAL_ONE
+		case n == 2:
+			return PLURAL_TWO
+		case n % 100 >= 3 && n % 100 <= 10:
+			return PLURAL_FEW
+		case n % 100 >= 11:
+			return PLURAL_MANY
+		}
+	default:
+		if n == 1 {
+			return PLURAL_ONE
+		}
+	}
+	return PLURAL_OTHER
+}
+
+// pluralPick picks the text of the category of n from forms, given as
+// category, text pairs, e.g. "one", "%d item", "other", "%d items". It falls
+// back to "other".
+func pluralPick(locale string, n int, forms []string) string {
+	want := PluralForm(locale, n)
+	var other string
+	for i := 0; i + 1 < len(forms); i += 2 {
+		if forms[i] == want {
+			return forms[i + 1]
+		}
+		if forms[i] == PLURAL_OTHER {
+			other = forms[i + 1]
+		}
+	}
+	return other
+}
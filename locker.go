@@ -0,0 +1,19 @@
+package backend_utils
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrLockTimeout = errors.New("Timed out waiting for lock.")
+	ErrNotLocked = errors.New("Lock not held.")
+)
+
+// Locker provides named locks, usually shared between service instances.
+// See LockerConfig.
+type Locker interface {
+	// Lock returns ErrLockTimeout if key could not be locked within timeout.
+	Lock(key string, timeout time.Duration) error
+	Unlock(key string) error
+}
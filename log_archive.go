@@ -0,0 +1,204 @@
+package backend_utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	DEFAULT_LOG_CHUNK_BYTES = 4 << 20
+	DEFAULT_LOG_FLUSH_INTERVAL = time.Minute
+	// Chunks kept for retry while the store is failing, oldest are
+	// dropped first.
+	DEFAULT_LOG_PENDING_CHUNKS = 16
+)
+
+type LogArchiveOptions struct {
+	// Object name prefix, e.g. "logs/orders".
+	Prefix		string
+	// Uncompressed bytes per chunk. Defaults to DEFAULT_LOG_CHUNK_BYTES.
+	ChunkBytes	int
+	// Chunks are shipped at least this often. Defaults to
+	// DEFAULT_LOG_FLUSH_INTERVAL.
+	FlushInterval	time.Duration
+	// Defaults to DEFAULT_LOG_PENDING_CHUNKS.
+	MaxPending	int
+	// Defaults to the package clock, see SetClock.
+	Clock		Clock
+}
+
+type logChunk struct {
+	name	string
+	data	[]byte
+}
+
+// LogArchiver batches log lines into gzip chunks and ships them to a
+// FileStore, for environments without a central logging stack. Chunks are
+// named by the time they were started:
+//
+//	<prefix>/2006/01/02/15/<host>-20060102T150405.000Z-<seq>.log.gz
+//
+// It is an io.Writer, so it can be added to a LogUtil with AddSink, or
+// used with NewWriterLogger. Its own failures go to stderr, as logging
+// them could loop back into it.
+type LogArchiver struct {
+	store	FileStore
+	opts	LogArchiveOptions
+	clock	Clock
+	host	string
+	mtx	sync.Mutex
+	buf	bytes.Buffer
+	gz	*gzip.Writer
+	size	int
+	started	time.Time
+	seq	uint64
+	pending	[]logChunk
+	stop	chan struct{}
+	wg	sync.WaitGroup
+}
+
+func NewLogArchiver(store FileStore, opts LogArchiveOptions) *LogArchiver {
+	if opts.ChunkBytes <= 0 {
+		opts.ChunkBytes = DEFAULT_LOG_CHUNK_BYTES
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DEFAULT_LOG_FLUSH_INTERVAL
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = DEFAULT_LOG_PENDING_CHUNKS
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	a := &LogArchiver{store: store, opts: opts, clock: clockOr(opts.Clock), host: host}
+	a.gz = gzip.NewWriter(&a.buf)
+	return a
+}
+
+// Write adds p to the current chunk, shipping it once it is full.
+func (a *LogArchiver) Write(p []byte) (int, error) {
+	a.mtx.Lock()
+	if a.size == 0 {
+		a.started = a.clock.Now()
+	}
+	n, err := a.gz.Write(p)
+	a.size += n
+	var chunk *logChunk
+	if err == nil && a.size >= a.opts.ChunkBytes {
+		chunk, err = a.cut()
+	}
+	a.mtx.Unlock()
+	if chunk != nil {
+		a.ship(chunk)
+	}
+	return n, err
+}
+
+// cut closes the current chunk and starts a new one. Called with mtx held.
+func (a *LogArchiver) cut() (*logChunk, error) {
+	if a.size == 0 {
+		return nil, nil
+	}
+	if err := a.gz.Close(); err != nil {
+		return nil, err
+	}
+	a.seq++
+	t := a.started.UTC()
+	chunk := &logChunk{
+		name: path.Join(a.opts.Prefix, t.Format("2006/01/02/15"),
+			fmt.Sprintf("%s-%s-%d.log.gz", a.host, t.Format("20060102T150405.000Z"), a.seq)),
+		data: append([]byte(nil), a.buf.Bytes()...),
+	}
+	a.buf.Reset()
+	a.gz.Reset(&a.buf)
+	a.size = 0
+	return chunk, nil
+}
+
+// ship puts the chunks left over from earlier failures and then chunk.
+func (a *LogArchiver) ship(chunk *logChunk) error {
+	a.mtx.Lock()
+	if chunk != nil {
+		a.pending = append(a.pending, *chunk)
+		if drop := len(a.pending) - a.opts.MaxPending; drop > 0 {
+			fmt.Fprintf(os.Stderr, "Log archive dropping %d chunks.\n", drop)
+			a.pending = a.pending[drop:]
+		}
+	}
+	todo := a.pending
+	a.pending = nil
+	a.mtx.Unlock()
+
+	for i, c := range todo {
+		if err := a.store.Put(c.name, bytes.NewReader(c.data)); err != nil {
+			fmt.Fprintf(os.Stderr, "Log archive failed to store %s. Err:%s\n", c.name, err.Error())
+			a.mtx.Lock()
+			a.pending = append(todo[i:], a.pending...)
+			a.mtx.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush ships the current chunk, however small, and retries pending ones.
+func (a *LogArchiver) Flush() error {
+	a.mtx.Lock()
+	chunk, err := a.cut()
+	a.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	return a.ship(chunk)
+}
+
+// Start flushes every FlushInterval in the background till Stop.
+func (a *LogArchiver) Start() {
+	a.stop = make(chan struct{})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		ticker := a.clock.NewTicker(a.opts.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C():
+			}
+			a.Flush()
+		}
+	}()
+}
+
+// Stop stops the background flushes and ships what is left.
+func (a *LogArchiver) Stop() error {
+	if a.stop != nil {
+		close(a.stop)
+		a.wg.Wait()
+		a.stop = nil
+	}
+	return a.Flush()
+}
+
+// Hook runs the archiver for the lifetime of an App.
+func (a *LogArchiver) Hook() LifecycleHook {
+	return LifecycleHook{
+		Name: "log_archive",
+		OnStart: func(context.Context) error {
+			a.Start()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			return a.Stop()
+		},
+	}
+}
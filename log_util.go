@@ -3,12 +3,17 @@ package backend_utils
 import (
 	"github.com/goinggo/tracelog"
 	"fmt"
+	"io"
+	"sync"
+	"time"
 )
 
 type LogUtil struct {
 	pkg_name string
 	trace_level int32
 	email_alerts []string
+	sinks_mtx sync.Mutex
+	sinks []io.Writer
 }
 
 func InitLogger(pkgName string, traceLevel int32, use_stdout bool) *LogUtil {
@@ -29,6 +34,28 @@ func (l *LogUtil) AddEmailAlert(emails []string) {
 	tracelog.ConfigureEmail("smtp.gmail.com", 587, "username", "password", l.email_alerts)
 }
 
+// AddSink copies the Info and Error logs to w as well, one line each, e.g.
+// to a LogArchiver.
+func (l *LogUtil) AddSink(w io.Writer) *LogUtil {
+	l.sinks_mtx.Lock()
+	l.sinks = append(l.sinks, w)
+	l.sinks_mtx.Unlock()
+	return l
+}
+
+func (l *LogUtil) toSinks(level, caller, msg string) {
+	l.sinks_mtx.Lock()
+	defer l.sinks_mtx.Unlock()
+	if len(l.sinks) == 0 {
+		return
+	}
+	line := []byte(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", pkgClock().Now().UTC().Format(time.RFC3339Nano),
+		level, l.pkg_name, caller, msg))
+	for _, w := range l.sinks {
+		w.Write(line)
+	}
+}
+
 func (l *LogUtil) FuncEntry(format string, args... interface{}) {
 	tracelog.Startedfcd(3, l.pkg_name, MyCaller(), format, args...)
 }
@@ -40,10 +67,13 @@ func (l *LogUtil) FuncExit(format string, args... interface{}) {
 func (l *LogUtil) Info(format string, args... interface{}) {
 	msg := fmt.Sprintf(format, args...)
 	tracelog.Infocd(3, l.pkg_name, MyCaller(), msg)
+	l.toSinks("INFO", MyCaller(), msg)
 }
 
 func (l *LogUtil) Error(e error, format string, args... interface{}) error {
 	tracelog.Errorfcd(3, e, l.pkg_name, MyCaller(), format, args...)
+	l.toSinks("ERROR", MyCaller(), fmt.Sprintf(format, args...) + " Err:" + fmt.Sprint(e))
+	ReportError(e, map[string] string{"logger": l.pkg_name, "caller": MyCaller()})
 	return e
 }
 
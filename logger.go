@@ -0,0 +1,100 @@
+package backend_utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"github.com/goinggo/tracelog"
+)
+
+// Logger is what the package logs through. Adapt zap, zerolog etc. to it
+// and install it with SetLogger, or per subsystem with their WithLogger.
+// *LogUtil implements it.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger logs through the standard log package, as the package always
+// did.
+type stdLogger struct{}
+
+func (stdLogger) Infof(format string, args ...interface{}) {
+	log.Output(3, fmt.Sprintf(format, args...))
+}
+
+func (stdLogger) Errorf(format string, args ...interface{}) {
+	log.Output(3, "ERROR: " + fmt.Sprintf(format, args...))
+}
+
+// NewWriterLogger logs to w, prefixing lines with prefix and the level.
+func NewWriterLogger(w io.Writer, prefix string) Logger {
+	return &writerLogger{
+		info: log.New(w, prefix + "\tINFO\t", log.Ldate|log.Ltime|log.Lshortfile),
+		err: log.New(w, prefix + "\tERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+}
+
+type writerLogger struct {
+	info	*log.Logger
+	err	*log.Logger
+}
+
+func (w *writerLogger) Infof(format string, args ...interface{}) {
+	w.info.Output(3, fmt.Sprintf(format, args...))
+}
+
+func (w *writerLogger) Errorf(format string, args ...interface{}) {
+	w.err.Output(3, fmt.Sprintf(format, args...))
+}
+
+var pkgLogger = struct {
+	sync.RWMutex
+	l	Logger
+}{l: stdLogger{}}
+
+// SetLogger routes the logs of the package to l. Subsystems given their own
+// logger with WithLogger keep using it.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = stdLogger{}
+	}
+	pkgLogger.Lock()
+	pkgLogger.l = l
+	pkgLogger.Unlock()
+}
+
+func pkgLog() Logger {
+	pkgLogger.RLock()
+	defer pkgLogger.RUnlock()
+	return pkgLogger.l
+}
+
+// pkgLogProxy logs to whatever the package logger is when called.
+type pkgLogProxy struct{}
+
+func (pkgLogProxy) Infof(format string, args ...interface{}) {
+	pkgLog().Infof(format, args...)
+}
+
+func (pkgLogProxy) Errorf(format string, args ...interface{}) {
+	pkgLog().Errorf(format, args...)
+}
+
+// loggerOr returns l if set, else the package logger.
+func loggerOr(l Logger) Logger {
+	if l != nil {
+		return l
+	}
+	return pkgLog()
+}
+
+func (l *LogUtil) Infof(format string, args ...interface{}) {
+	l.Info(format, args...)
+}
+
+func (l *LogUtil) Errorf(format string, args ...interface{}) {
+	tracelog.Errorfcd(3, fmt.Errorf(format, args...), l.pkg_name, MyCaller(), "")
+	l.toSinks("ERROR", MyCaller(), fmt.Sprintf(format, args...))
+}
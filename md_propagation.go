@@ -0,0 +1,52 @@
+package backend_utils
+
+import (
+	"strings"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata forwarded to downstream calls when PropagateMetadata is not set.
+var DefaultPropagatedMetadata = []string{"x-request-id", "x-b3-traceid", "x-b3-spanid", "traceparent"}
+
+// Copies the listed keys from the incoming metadata of ctx, i.e. the call
+// being served, to the outgoing metadata. Keys already set on the outgoing
+// side are left alone.
+func propagateMetadata(ctx context.Context, keys []string) context.Context {
+
+	in, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	out, _ := metadata.FromOutgoingContext(ctx)
+
+	var kv []string
+	for _, k := range keys {
+		k = strings.ToLower(k)
+		if len(out[k]) > 0 {
+			continue
+		}
+		for _, v := range in[k] {
+			kv = append(kv, k, v)
+		}
+	}
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+func propagationUnaryInterceptor(keys []string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(propagateMetadata(ctx, keys), method, req, reply, cc, opts...)
+	}
+}
+
+func propagationStreamInterceptor(keys []string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(propagateMetadata(ctx, keys), desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,171 @@
+package backend_utils
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+const DEFAULT_MEMO_ENTRIES = 1024
+
+// MemoFunc is a client call, e.g. a method of a generated client with the
+// call options bound:
+//
+//	func(ctx context.Context, req proto.Message) (proto.Message, error) {
+//		return cli.GetConfig(ctx, req.(*pb.GetConfigReq))
+//	}
+type MemoFunc func(ctx context.Context, req proto.Message) (proto.Message, error)
+
+type MemoizeOptions struct {
+	// How long results are reused. Required.
+	TTL		time.Duration
+	// Results kept, least recently used ones are dropped first. Defaults
+	// to DEFAULT_MEMO_ENTRIES.
+	MaxEntries	int
+	// Defaults to the package clock, see SetClock.
+	Clock		Clock
+}
+
+type memoEntry struct {
+	key	string
+	resp	proto.Message
+	expiry	time.Time
+}
+
+// Memoizer reuses the results of a client call for identical requests,
+// for config and metadata lookups which would otherwise hammer a
+// downstream service. Requests are compared by their deterministic
+// encoding and the metadata in ResponseCacheVaryMetadata, so callers with
+// different credentials or tenants don't share results. Errors are not memoized, and concurrent misses of a request
+// make one call.
+type Memoizer struct {
+	fn		MemoFunc
+	opts		MemoizeOptions
+	clock		Clock
+	mtx		sync.Mutex
+	// Most recently used first.
+	lru		*list.List
+	entries		map[string] *list.Element
+	inflight	Coalescer
+}
+
+func NewMemoizer(fn MemoFunc, opts MemoizeOptions) *Memoizer {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DEFAULT_MEMO_ENTRIES
+	}
+	return &Memoizer{
+		fn: fn,
+		opts: opts,
+		clock: clockOr(opts.Clock),
+		lru: list.New(),
+		entries: make(map[string] *list.Element),
+	}
+}
+
+// Memoize wraps fn in a Memoizer keeping up to max_entries results for ttl.
+func Memoize(fn MemoFunc, ttl time.Duration, max_entries int) MemoFunc {
+	return NewMemoizer(fn, MemoizeOptions{TTL: ttl, MaxEntries: max_entries}).Call
+}
+
+func memoKey(ctx context.Context, req proto.Message) (string, error) {
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(req); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(buf.Bytes())
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for _, k := range ResponseCacheVaryMetadata {
+		for _, v := range md[k] {
+			h.Write([]byte{0})
+			h.Write([]byte(k + "=" + v))
+		}
+	}
+	return string(h.Sum(nil)), nil
+}
+
+func (m *Memoizer) lookup(key string) proto.Message {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	elem, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*memoEntry)
+	if m.clock.Now().After(e.expiry) {
+		m.lru.Remove(elem)
+		delete(m.entries, key)
+		return nil
+	}
+	m.lru.MoveToFront(elem)
+	return e.resp
+}
+
+func (m *Memoizer) store(key string, resp proto.Message) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		m.lru.Remove(elem)
+	}
+	m.entries[key] = m.lru.PushFront(&memoEntry{key: key, resp: resp, expiry: m.clock.Now().Add(m.opts.TTL)})
+	for m.lru.Len() > m.opts.MaxEntries {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoEntry).key)
+	}
+}
+
+// Call returns the memoized response to req, calling the wrapped function
+// if there is none. Callers get their own copy of the response.
+func (m *Memoizer) Call(ctx context.Context, req proto.Message) (proto.Message, error) {
+	key, err := memoKey(ctx, req)
+	if err != nil {
+		return m.fn(ctx, req)
+	}
+	if resp := m.lookup(key); resp != nil {
+		return proto.Clone(resp), nil
+	}
+	// Waiters give up with their own ctx, and call again if the call they
+	// waited for failed because its ctx was done.
+	val, err, _ := m.inflight.DoContext(ctx, key, func(ctx context.Context) (interface{}, error) {
+		resp, err := m.fn(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		m.store(key, proto.Clone(resp))
+		return resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(val.(proto.Message)), nil
+}
+
+// Forget drops the response memoized for req made with the metadata in ctx.
+func (m *Memoizer) Forget(ctx context.Context, req proto.Message) {
+	key, err := memoKey(ctx, req)
+	if err != nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		m.lru.Remove(elem)
+		delete(m.entries, key)
+	}
+}
+
+// Purge drops all memoized responses.
+func (m *Memoizer) Purge() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.lru.Init()
+	m.entries = make(map[string] *list.Element)
+}
@@ -0,0 +1,314 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Usage is metered per hour.
+const METERING_PERIOD = time.Hour
+
+// UsageRecord is the usage of one method by one key in the period starting
+// at Period.
+type UsageRecord struct {
+	Key		string
+	Method		string
+	Period		time.Time
+	Calls		int64
+	BytesIn		int64
+	BytesOut	int64
+}
+
+type UsageStore interface {
+	// Add adds the records to the stored ones for the same key, method and
+	// period.
+	Add(records []UsageRecord) error
+	// Usage returns the records of key with periods in [from, to).
+	Usage(key string, from, to time.Time) ([]UsageRecord, error)
+}
+
+// MeterKeyFunc picks whom a call is billed to. Calls with an empty key are
+// not metered.
+type MeterKeyFunc func(ctx context.Context) string
+
+// MeterByTenant bills calls to the tenant, or to the JWT subject for calls
+// without one.
+func MeterByTenant(ctx context.Context) string {
+	if tenant, ok := TenantFromContext(ctx); ok {
+		return tenant
+	}
+	return jwtSubject(ctx)
+}
+
+// QuotaFunc is consulted before every metered call. Returning an error,
+// e.g. ErrResourceExhausted, fails the call with it.
+type QuotaFunc func(ctx context.Context, key, method string) error
+
+type usageKey struct {
+	key	string
+	method	string
+	period	time.Time
+}
+
+// Meter counts calls and message bytes per key and method in memory and
+// adds them to the store on Flush.
+type Meter struct {
+	store		UsageStore
+	key_func	MeterKeyFunc
+	quota		QuotaFunc
+	mtx		sync.Mutex
+	pending		map[usageKey] *UsageRecord
+	stop		chan struct{}
+	wg		sync.WaitGroup
+	clock		Clock
+}
+
+// NewMeter returns a meter writing to store. key_func defaults to
+// MeterByTenant.
+func NewMeter(store UsageStore, key_func MeterKeyFunc) *Meter {
+	if key_func == nil {
+		key_func = MeterByTenant
+	}
+	return &Meter{store: store, key_func: key_func, pending: make(map[usageKey] *UsageRecord)}
+}
+
+// WithQuota enforces quota on the metered calls.
+func (m *Meter) WithQuota(quota QuotaFunc) *Meter {
+	m.quota = quota
+	return m
+}
+
+// WithClock picks periods and flushes by c instead of the package clock.
+func (m *Meter) WithClock(c Clock) *Meter {
+	m.clock = c
+	return m
+}
+
+// Record adds usage of method by key.
+func (m *Meter) Record(key, method string, calls, bytes_in, bytes_out int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.add(UsageRecord{Key: key, Method: method, Period: clockOr(m.clock).Now().UTC().Truncate(METERING_PERIOD),
+		Calls: calls, BytesIn: bytes_in, BytesOut: bytes_out})
+}
+
+// add merges u into the pending usage of its period. Called with mtx held.
+func (m *Meter) add(u UsageRecord) {
+	k := usageKey{key: u.Key, method: u.Method, period: u.Period}
+	rec, ok := m.pending[k]
+	if !ok {
+		rec = &UsageRecord{Key: u.Key, Method: u.Method, Period: u.Period}
+		m.pending[k] = rec
+	}
+	rec.Calls += u.Calls
+	rec.BytesIn += u.BytesIn
+	rec.BytesOut += u.BytesOut
+}
+
+// Flush writes the pending usage to the store. On failure it is kept, in
+// its own period, for the next Flush.
+func (m *Meter) Flush() error {
+	m.mtx.Lock()
+	pending := m.pending
+	m.pending = make(map[usageKey] *UsageRecord)
+	m.mtx.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	records := make([]UsageRecord, 0, len(pending))
+	for _, rec := range pending {
+		records = append(records, *rec)
+	}
+	err := m.store.Add(records)
+	if err != nil {
+		m.mtx.Lock()
+		for _, rec := range records {
+			m.add(rec)
+		}
+		m.mtx.Unlock()
+	}
+	return err
+}
+
+// Usage returns the stored usage of key with periods in [from, to).
+// Usage not flushed yet is not included.
+func (m *Meter) Usage(key string, from, to time.Time) ([]UsageRecord, error) {
+	return m.store.Usage(key, from, to)
+}
+
+// Start flushes every interval in the background till Stop, which flushes
+// one last time.
+func (m *Meter) Start(interval time.Duration) {
+	m.stop = make(chan struct{})
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := clockOr(m.clock).NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C():
+			}
+			if err := m.Flush(); err != nil {
+				pkgLog().Errorf("Failed flushing usage. Err:%s", err.Error())
+			}
+		}
+	}()
+}
+
+func (m *Meter) Stop() error {
+	if m.stop != nil {
+		close(m.stop)
+		m.wg.Wait()
+		m.stop = nil
+	}
+	return m.Flush()
+}
+
+// Hook flushes the meter for the lifetime of an App.
+func (m *Meter) Hook(interval time.Duration) LifecycleHook {
+	return LifecycleHook{
+		Name: "metering",
+		OnStart: func(context.Context) error {
+			m.Start(interval)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			return m.Stop()
+		},
+	}
+}
+
+func msgSize(msg interface{}) int64 {
+	if pm, ok := msg.(proto.Message); ok {
+		return int64(proto.Size(pm))
+	}
+	return 0
+}
+
+func (m *Meter) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		key := m.key_func(ctx)
+		if len(key) == 0 {
+			return handler(ctx, req)
+		}
+		if m.quota != nil {
+			if err := m.quota(ctx, key, info.FullMethod); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := handler(ctx, req)
+		m.Record(key, info.FullMethod, 1, msgSize(req), msgSize(resp))
+		return resp, err
+	}
+}
+
+type meteredServerStream struct {
+	grpc.ServerStream
+	bytes_in	int64
+	bytes_out	int64
+}
+
+func (s *meteredServerStream) RecvMsg(msg interface{}) error {
+	err := s.ServerStream.RecvMsg(msg)
+	if err == nil {
+		s.bytes_in += msgSize(msg)
+	}
+	return err
+}
+
+func (s *meteredServerStream) SendMsg(msg interface{}) error {
+	err := s.ServerStream.SendMsg(msg)
+	if err == nil {
+		s.bytes_out += msgSize(msg)
+	}
+	return err
+}
+
+func (m *Meter) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		key := m.key_func(ss.Context())
+		if len(key) == 0 {
+			return handler(srv, ss)
+		}
+		if m.quota != nil {
+			if err := m.quota(ss.Context(), key, info.FullMethod); err != nil {
+				return err
+			}
+		}
+		ms := &meteredServerStream{ServerStream: ss}
+		err := handler(srv, ms)
+		m.Record(key, info.FullMethod, 1, ms.bytes_in, ms.bytes_out)
+		return err
+	}
+}
+
+// PostgresUsageStore keeps usage in the usage_records table. Call
+// CreateTable once before using it.
+type PostgresUsageStore struct {
+	db	*sql.DB
+}
+
+func NewPostgresUsageStore(db *sql.DB) *PostgresUsageStore {
+	return &PostgresUsageStore{db: db}
+}
+
+func (p *PostgresUsageStore) CreateTable() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS usage_records (
+		key TEXT NOT NULL,
+		method TEXT NOT NULL,
+		period TIMESTAMPTZ NOT NULL,
+		calls BIGINT NOT NULL,
+		bytes_in BIGINT NOT NULL,
+		bytes_out BIGINT NOT NULL,
+		PRIMARY KEY (key, period, method))`)
+	return err
+}
+
+func (p *PostgresUsageStore) Add(records []UsageRecord) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		_, err = tx.Exec("INSERT INTO usage_records (key, method, period, calls, bytes_in, bytes_out) " +
+			"VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (key, period, method) DO UPDATE SET " +
+			"calls = usage_records.calls + EXCLUDED.calls, " +
+			"bytes_in = usage_records.bytes_in + EXCLUDED.bytes_in, " +
+			"bytes_out = usage_records.bytes_out + EXCLUDED.bytes_out",
+			r.Key, r.Method, r.Period, r.Calls, r.BytesIn, r.BytesOut)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresUsageStore) Usage(key string, from, to time.Time) ([]UsageRecord, error) {
+	rows, err := p.db.Query("SELECT key, method, period, calls, bytes_in, bytes_out FROM usage_records " +
+		"WHERE key = $1 AND period >= $2 AND period < $3 ORDER BY period, method", key, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []UsageRecord
+	for rows.Next() {
+		var r UsageRecord
+		if err = rows.Scan(&r.Key, &r.Method, &r.Period, &r.Calls, &r.BytesIn, &r.BytesOut); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,94 @@
+package backend_utils
+
+import (
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata key carrying the priority of a call, see MethodConfig.Priority.
+const PRIORITY_METADATA_KEY = "x-priority"
+
+// MethodConfig overrides the client settings for a single method. Unset
+// fields fall back to the ones of the client config.
+type MethodConfig struct {
+	Timeout		Duration	`json:"timeout"`
+	Retry		*RetryPolicy	`json:"retry_policy"`
+	Hedging		*HedgingPolicy	`json:"hedging"`
+	// Sent to the server in PRIORITY_METADATA_KEY, e.g. PRIORITY_LOW for
+	// batch calls. Not sent if empty.
+	Priority	string		`json:"priority"`
+	// Cache responses this long, if the client has WithResponseCache.
+	CacheTTL	Duration	`json:"cache_ttl"`
+}
+
+// hedgingPolicies returns Hedging with the per-method ones added in.
+func (c *GrpcClientConfig) hedgingPolicies() map[string]*HedgingPolicy {
+	policies := make(map[string]*HedgingPolicy, len(c.Hedging))
+	for m, p := range c.Hedging {
+		policies[m] = p
+	}
+	for m, mc := range c.Methods {
+		if mc != nil && mc.Hedging != nil {
+			policies[m] = mc.Hedging
+		}
+	}
+	return policies
+}
+
+func (c *GrpcClientConfig) hasMethodRetries() bool {
+	for _, mc := range c.Methods {
+		if mc != nil && mc.Retry != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// methodTimeouts returns the timeout of each method that overrides it.
+func (c *GrpcClientConfig) methodTimeouts() map[string]time.Duration {
+	timeouts := map[string]time.Duration{}
+	for m, mc := range c.Methods {
+		if mc != nil && mc.Timeout.Duration > 0 {
+			timeouts[m] = mc.Timeout.Duration
+		}
+	}
+	return timeouts
+}
+
+// Adds the method's retry options to the call, overriding the ones the retry
+// interceptor was created with. Has to be chained before the retry
+// interceptor.
+func methodRetryInterceptor(methods map[string]*MethodConfig) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if mc, ok := methods[method]; ok && mc != nil && mc.Retry != nil {
+			for _, o := range mc.Retry.callOptions() {
+				opts = append(opts, o)
+			}
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func methodPriorityContext(ctx context.Context, methods map[string]*MethodConfig, method string) context.Context {
+	if mc, ok := methods[method]; ok && mc != nil && len(mc.Priority) > 0 {
+		return metadata.AppendToOutgoingContext(ctx, PRIORITY_METADATA_KEY, mc.Priority)
+	}
+	return ctx
+}
+
+func methodPriorityUnaryInterceptor(methods map[string]*MethodConfig) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(methodPriorityContext(ctx, methods, method), method, req, reply, cc, opts...)
+	}
+}
+
+func methodPriorityStreamInterceptor(methods map[string]*MethodConfig) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(methodPriorityContext(ctx, methods, method), desc, cc, method, opts...)
+	}
+}
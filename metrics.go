@@ -0,0 +1,31 @@
+package backend_utils
+
+import (
+	"fmt"
+	"net/http"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsServer returns a server exposing the Prometheus metrics on
+// MetricsPort under /metrics. If pools is given, e.g.
+// Configurations.PoolDebugHandler, it is served under /debug/pools. Stop it
+// with Shutdown.
+func (c *GrpcServerConfig) MetricsServer(pools ...http.Handler) *http.Server {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if len(pools) > 0 && pools[0] != nil {
+		mux.Handle("/debug/pools", pools[0])
+	}
+	return &http.Server{Addr: fmt.Sprintf(":%d", c.MetricsPort), Handler: mux}
+}
+
+// ServeMetrics serves MetricsServer. It blocks like http.ListenAndServe.
+func (c *GrpcServerConfig) ServeMetrics(pools ...http.Handler) error {
+
+	err := c.MetricsServer(pools...).ListenAndServe()
+	if err != nil {
+		pkgLog().Errorf("Metrics server stopped.ERR:%s\n", err)
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package backend_utils
+
+import (
+	"net"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Time given to an address before the next one is dialed in parallel, as in
+// happy eyeballs (RFC 8305).
+const DEFAULT_FALLBACK_DELAY = 300 * time.Millisecond
+
+// addrs returns ServerAddr followed by ServerAddrs.
+func (c *GrpcClientConfig) addrs() []string {
+	var addrs []string
+	if len(c.ServerAddr) > 0 {
+		addrs = append(addrs, c.ServerAddr)
+	}
+	return append(addrs, c.ServerAddrs...)
+}
+
+// primaryAddr is the first address of the endpoint, used to name it.
+func (c *GrpcClientConfig) primaryAddr() string {
+	if addrs := c.addrs(); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
+
+// fallbackDialer dials addrs in order, starting the next one whenever the
+// previous ones haven't connected within delay or have failed. The first
+// connection made wins and the others are closed.
+func fallbackDialer(addrs []string, delay time.Duration, dial DialFunc) DialFunc {
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		type result struct {
+			conn	net.Conn
+			err	error
+		}
+		results := make(chan result, len(addrs))
+		start := func(addr string) {
+			go func() {
+				conn, err := dial(ctx, addr)
+				results <- result{conn, err}
+			}()
+		}
+
+		start(addrs[0])
+		next, pending := 1, 1
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		var first_err error
+		var winner net.Conn
+		for pending > 0 {
+			select {
+			case res := <-results:
+				pending--
+				if res.err == nil {
+					if winner == nil {
+						winner = res.conn
+						cancel()
+					} else {
+						res.conn.Close()
+					}
+					continue
+				}
+				if first_err == nil {
+					first_err = res.err
+				}
+				if winner == nil && next < len(addrs) {
+					start(addrs[next])
+					next++
+					pending++
+				}
+			case <-timer.C:
+				if winner == nil && next < len(addrs) {
+					start(addrs[next])
+					next++
+					pending++
+					timer.Reset(delay)
+				}
+			}
+		}
+		if winner != nil {
+			return winner, nil
+		}
+		return nil, first_err
+	}
+}
+
+// baseDialer dials a single address of the config.
+func (c *GrpcClientConfig) baseDialer() (DialFunc, error) {
+
+	dial := c.dialer
+	if dial == nil && len(c.Proxy) > 0 {
+		var err error
+		dial, err = ProxyDialer(c.Proxy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dial == nil {
+		var d net.Dialer
+		dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}
+	}
+	// Unix and in-process addresses never go through the dialer or proxy.
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		if isCustomTransport(addr) {
+			return transportDialer(ctx, addr)
+		}
+		return dial(ctx, addr)
+	}, nil
+}
+
+// dialOpts returns the dial option for the config's addresses, dialer and
+// proxy, or none if grpc can dial it by itself.
+func (c *GrpcClientConfig) dialOpts() ([]grpc.DialOption, error) {
+
+	// xDS resolves the endpoints itself.
+	if c.Xds != nil {
+		return nil, nil
+	}
+	addrs := c.addrs()
+	if len(addrs) <= 1 && c.dialer == nil && len(c.Proxy) == 0 && !isCustomTransport(c.ServerAddr) {
+		return nil, nil
+	}
+
+	dial, err := c.baseDialer()
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) > 1 {
+		delay := c.FallbackDelay.Duration
+		if delay <= 0 {
+			delay = DEFAULT_FALLBACK_DELAY
+		}
+		dial = fallbackDialer(addrs, delay, dial)
+	}
+	return []grpc.DialOption{grpc.WithContextDialer(dial)}, nil
+}
@@ -0,0 +1,64 @@
+package backend_utils
+
+import (
+	"crypto/tls"
+	"net/http"
+	"github.com/soheilhy/cmux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+)
+
+// ServeMultiplexed serves the gRPC server and an HTTP handler (grpc-gateway,
+// grpc-web, health pages etc.) on the single configured Port. Native gRPC
+// calls are told apart by their content-type, everything else is handed to
+// http_handler. If EnableGrpcWeb is set, grpc-web calls are served as well.
+//
+// The server config should have Multiplex set before GetServerOpts is called.
+// TLS is then terminated on the shared listener instead of inside gRPC.
+func (c *GrpcServerConfig) ServeMultiplexed(grpc_srv *grpc.Server, http_handler http.Handler) error {
+
+	lis, err := c.Listen()
+	if err != nil {
+		pkgLog().Errorf("Failed to listen on %s.ERR:%s\n", c.ListenAddr(), err)
+		return err
+	}
+
+	if c.UseTls || c.Spiffe != nil {
+		conf, err := c.TLSConfig()
+		if err != nil {
+			pkgLog().Errorf("Failed creating TLS config.ERR:%s\n", err)
+			lis.Close()
+			return err
+		}
+		conf.NextProtos = []string{"h2", "http/1.1"}
+		lis = tls.NewListener(lis, conf)
+	}
+
+	http_handler = c.GrpcWebHandler(grpc_srv, http_handler)
+
+	m := cmux.New(lis)
+	grpc_lis := m.MatchWithWriters(
+		cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"),
+		cmux.HTTP2MatchHeaderFieldPrefixSendSettings("content-type", "application/grpc+"))
+	http_lis := m.Match(cmux.Any())
+
+	// Connections reach the HTTP server already decrypted, so HTTP/2 has to
+	// be accepted in cleartext form.
+	http_srv := &http.Server{
+		Handler: h2c.NewHandler(http_handler, &http2.Server{}),
+	}
+
+	errc := make(chan error, 3)
+	go func() { errc <- grpc_srv.Serve(grpc_lis) }()
+	go func() { errc <- http_srv.Serve(http_lis) }()
+	go func() { errc <- m.Serve() }()
+
+	err = <-errc
+	pkgLog().Errorf("Multiplexed server stopped.ERR:%v\n", err)
+
+	grpc_srv.Stop()
+	http_srv.Close()
+	lis.Close()
+	return err
+}
@@ -0,0 +1,304 @@
+package backend_utils
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Names of the built in notification channels.
+const (
+	CHANNEL_EMAIL = "email"
+	CHANNEL_SMS = "sms"
+	CHANNEL_PUSH = "push"
+	CHANNEL_SLACK = "slack"
+)
+
+var (
+	ErrNoChannels = errors.New("No channel to notify user on.")
+	ErrInvalidSlackWebhook = errors.New("Slack webhooks must be https://hooks.slack.com/ URLs.")
+)
+
+// ChannelSender delivers a rendered notification to an address on one
+// channel, e.g. an email address, a phone number or a device token.
+type ChannelSender interface {
+	Channel() string
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// EmailChannel sends notifications through a mailer.
+type EmailChannel struct {
+	Mailer	MailerDaemonType
+}
+
+func (e *EmailChannel) Channel() string { return CHANNEL_EMAIL }
+
+func (e *EmailChannel) Send(ctx context.Context, to, subject, body string) error {
+	// The body is already rendered, don't let the mailer format it again.
+	e.Mailer.SendEmail(to, subject, "%s", body)
+	return nil
+}
+
+var notifyHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+func postNotification(ctx context.Context, req *http.Request) error {
+	resp, err := notifyHttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// TwilioSMSChannel sends text messages using the Twilio REST API.
+type TwilioSMSChannel struct {
+	AccountSID	string
+	AuthToken	string
+	From		string
+}
+
+func (t *TwilioSMSChannel) Channel() string { return CHANNEL_SMS }
+
+func (t *TwilioSMSChannel) Send(ctx context.Context, to, subject, body string) error {
+	form := url.Values{"To": {to}, "From": {t.From}, "Body": {body}}
+	req, err := http.NewRequest(http.MethodPost,
+		"https://api.twilio.com/2010-04-01/Accounts/" + t.AccountSID + "/Messages.json",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return postNotification(ctx, req)
+}
+
+// FCMPushChannel sends push notifications to device tokens using the FCM
+// HTTP API. FCM delivers to iOS devices through APNs as well.
+type FCMPushChannel struct {
+	ServerKey	string
+}
+
+func (f *FCMPushChannel) Channel() string { return CHANNEL_PUSH }
+
+func (f *FCMPushChannel) Send(ctx context.Context, to, subject, body string) error {
+	buf, err := json.Marshal(map[string]interface{}{
+		"to": to,
+		"notification": map[string]string{"title": subject, "body": body},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://fcm.googleapis.com/fcm/send", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "key=" + f.ServerKey)
+	req.Header.Set("Content-Type", "application/json")
+	return postNotification(ctx, req)
+}
+
+// SlackChannel posts to Slack incoming webhooks. The address is the
+// webhook URL, which must be a ValidSlackWebhook so that user preferences
+// can't point the server at internal hosts.
+type SlackChannel struct {
+	// Accept any URL, for webhooks taken from config only, e.g. of a Slack
+	// compatible chat.
+	AnyURL	bool
+}
+
+// ValidSlackWebhook tells if addr is a Slack incoming webhook URL.
+func ValidSlackWebhook(addr string) bool {
+	u, err := url.Parse(addr)
+	return err == nil && u.Scheme == "https" && u.Host == "hooks.slack.com" && len(u.User.String()) == 0
+}
+
+func (s *SlackChannel) Channel() string { return CHANNEL_SLACK }
+
+func (s *SlackChannel) Send(ctx context.Context, to, subject, body string) error {
+	if !s.AnyURL && !ValidSlackWebhook(to) {
+		return ErrInvalidSlackWebhook
+	}
+	text := body
+	if len(subject) > 0 {
+		text = "*" + subject + "*\n" + body
+	}
+	buf, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, to, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return postNotification(ctx, req)
+}
+
+// ChannelPreference is where and whether a user wants notifications on a
+// channel.
+type ChannelPreference struct {
+	Channel	string
+	Address	string
+	Enabled	bool
+}
+
+type PreferenceStore interface {
+	Preferences(user string) ([]ChannelPreference, error)
+	SetPreference(user string, pref ChannelPreference) error
+}
+
+// PostgresPreferenceStore keeps preferences in the notification_prefs
+// table. Call CreateTable once before using it.
+type PostgresPreferenceStore struct {
+	db	*sql.DB
+}
+
+func NewPostgresPreferenceStore(db *sql.DB) *PostgresPreferenceStore {
+	return &PostgresPreferenceStore{db: db}
+}
+
+func (p *PostgresPreferenceStore) CreateTable() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS notification_prefs (
+		user_id TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		address TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL,
+		PRIMARY KEY (user_id, channel))`)
+	return err
+}
+
+func (p *PostgresPreferenceStore) Preferences(user string) ([]ChannelPreference, error) {
+	rows, err := p.db.Query("SELECT channel, address, enabled FROM notification_prefs " +
+		"WHERE user_id = $1", user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var prefs []ChannelPreference
+	for rows.Next() {
+		var pref ChannelPreference
+		if err = rows.Scan(&pref.Channel, &pref.Address, &pref.Enabled); err != nil {
+			return nil, err
+		}
+		prefs = append(prefs, pref)
+	}
+	return prefs, rows.Err()
+}
+
+// SetPreference returns ErrInvalidSlackWebhook for Slack addresses which
+// are not a ValidSlackWebhook.
+func (p *PostgresPreferenceStore) SetPreference(user string, pref ChannelPreference) error {
+	if pref.Channel == CHANNEL_SLACK && !ValidSlackWebhook(pref.Address) {
+		return ErrInvalidSlackWebhook
+	}
+	_, err := p.db.Exec("INSERT INTO notification_prefs (user_id, channel, address, enabled) " +
+		"VALUES ($1, $2, $3, $4) ON CONFLICT (user_id, channel) DO UPDATE " +
+		"SET address = EXCLUDED.address, enabled = EXCLUDED.enabled",
+		user, pref.Channel, pref.Address, pref.Enabled)
+	return err
+}
+
+type channelTemplate struct {
+	subject	*template.Template
+	body	*template.Template
+}
+
+// NotificationService renders a named template for each channel a user
+// has enabled and sends it there. Channels without a template for the
+// notification are skipped, so e.g. a receipt can go out only by email.
+type NotificationService struct {
+	prefs		PreferenceStore
+	mtx		sync.RWMutex
+	senders		map[string] ChannelSender
+	templates	map[string] map[string] *channelTemplate
+}
+
+func NewNotificationService(prefs PreferenceStore, senders ...ChannelSender) *NotificationService {
+	n := &NotificationService{
+		prefs: prefs,
+		senders: make(map[string] ChannelSender, len(senders)),
+		templates: make(map[string] map[string] *channelTemplate),
+	}
+	for _, s := range senders {
+		n.senders[s.Channel()] = s
+	}
+	return n
+}
+
+// AddTemplate registers the text/template sources of notification name on
+// channel. subject may be empty for channels without one, like SMS.
+func (n *NotificationService) AddTemplate(name, channel, subject, body string) error {
+	tpl := new(channelTemplate)
+	var err error
+	if tpl.subject, err = template.New(name + ".subject").Parse(subject); err != nil {
+		return err
+	}
+	if tpl.body, err = template.New(name + ".body").Parse(body); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.templates[name] == nil {
+		n.templates[name] = make(map[string] *channelTemplate)
+	}
+	n.templates[name][channel] = tpl
+	return nil
+}
+
+// Notify sends notification name to user on all their enabled channels.
+// It returns ErrNoChannels if there was nothing to send on, otherwise the
+// first send error after trying all the channels.
+func (n *NotificationService) Notify(ctx context.Context, user, name string, data interface{}) error {
+	prefs, err := n.prefs.Preferences(user)
+	if err != nil {
+		return err
+	}
+
+	n.mtx.RLock()
+	templates := n.templates[name]
+	n.mtx.RUnlock()
+
+	sent := 0
+	var first_err error
+	for _, pref := range prefs {
+		tpl, ok := templates[pref.Channel]
+		sender, found := n.senders[pref.Channel]
+		if !pref.Enabled || !ok || !found {
+			continue
+		}
+		var subject, body bytes.Buffer
+		if err = tpl.subject.Execute(&subject, data); err == nil {
+			err = tpl.body.Execute(&body, data)
+		}
+		if err == nil {
+			err = sender.Send(ctx, pref.Address, subject.String(), body.String())
+		}
+		if err != nil {
+			if first_err == nil {
+				first_err = fmt.Errorf("%s: %s", pref.Channel, err.Error())
+			}
+			continue
+		}
+		sent++
+	}
+	if first_err != nil {
+		return first_err
+	}
+	if sent == 0 {
+		return ErrNoChannels
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+	"github.com/lib/pq"
+)
+
+const (
+	NOTIFIER_MIN_RECONNECT = 1 * time.Second
+	NOTIFIER_MAX_RECONNECT = 1 * time.Minute
+	// Idle time after which the listener connection is pinged.
+	NOTIFIER_PING_INTERVAL = 90 * time.Second
+)
+
+var ErrNotifierClosed = errors.New("Notifier closed.")
+
+// Notification is a message received on a Postgres channel. Reconnected is
+// set instead of Payload after the listener lost its connection, since
+// notifications sent in the meantime are lost. Subscribers caching data
+// should drop it then.
+type Notification struct {
+	Channel		string
+	Payload		string
+	Reconnected	bool
+}
+
+// Notifier fans out Postgres LISTEN/NOTIFY messages to Go channels. It
+// uses a connection of its own, reconnecting as needed.
+type Notifier struct {
+	listener	*pq.Listener
+	// Serializes Listen and Unlisten. They wait on the listener's
+	// connection, which waits on run draining Notify, so mtx, which run
+	// needs to deliver, must not be held across them.
+	listen_mtx	sync.Mutex
+	mtx		sync.Mutex
+	subs		map[string] []chan Notification
+	done		chan struct{}
+	closed		bool
+	logger		Logger
+}
+
+func (dbConf *PostgresDBConfig) NewNotifier() *Notifier {
+	n := &Notifier{
+		subs: make(map[string] []chan Notification),
+		done: make(chan struct{}),
+	}
+	n.listener = pq.NewListener(dbConf.connString(), NOTIFIER_MIN_RECONNECT, NOTIFIER_MAX_RECONNECT,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				loggerOr(n.logger).Errorf("Notifier connection event %d Err:%s", ev, err.Error())
+			}
+		})
+	go n.run()
+	return n
+}
+
+func (n *Notifier) run() {
+	for {
+		select {
+		case <-n.done:
+			return
+		case msg := <-n.listener.Notify:
+			if msg == nil {
+				n.reconnected()
+				continue
+			}
+			n.deliver(msg.Channel, Notification{Channel: msg.Channel, Payload: msg.Extra})
+		case <-time.After(NOTIFIER_PING_INTERVAL):
+			go n.listener.Ping()
+		}
+	}
+}
+
+func (n *Notifier) reconnected() {
+	n.mtx.Lock()
+	channels := make([]string, 0, len(n.subs))
+	for channel := range n.subs {
+		channels = append(channels, channel)
+	}
+	n.mtx.Unlock()
+	for _, channel := range channels {
+		n.deliver(channel, Notification{Channel: channel, Reconnected: true})
+	}
+}
+
+// Subscribers which are not keeping up miss notifications rather than
+// blocking the others.
+func (n *Notifier) deliver(channel string, msg Notification) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	for _, ch := range n.subs[channel] {
+		select {
+		case ch <- msg:
+		default:
+			loggerOr(n.logger).Errorf("Notifier dropped message on channel %s, subscriber is slow.", channel)
+		}
+	}
+}
+
+// WithLogger logs the notifier's errors to l instead of the package logger.
+func (n *Notifier) WithLogger(l Logger) *Notifier {
+	n.logger = l
+	return n
+}
+
+// Subscribe returns a channel receiving the notifications sent on the
+// Postgres channel. buf is the number of messages buffered for it.
+func (n *Notifier) Subscribe(channel string, buf int) (<-chan Notification, error) {
+	n.listen_mtx.Lock()
+	defer n.listen_mtx.Unlock()
+
+	n.mtx.Lock()
+	closed, first := n.closed, len(n.subs[channel]) == 0
+	n.mtx.Unlock()
+	if closed {
+		return nil, ErrNotifierClosed
+	}
+	if first {
+		if err := n.listener.Listen(channel); err != nil && err != pq.ErrChannelAlreadyOpen {
+			return nil, err
+		}
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.closed {
+		return nil, ErrNotifierClosed
+	}
+	ch := make(chan Notification, buf)
+	n.subs[channel] = append(n.subs[channel], ch)
+	return ch, nil
+}
+
+// Unsubscribe stops and closes a channel returned by Subscribe.
+func (n *Notifier) Unsubscribe(channel string, sub <-chan Notification) error {
+	n.listen_mtx.Lock()
+	defer n.listen_mtx.Unlock()
+
+	n.mtx.Lock()
+	subs := n.subs[channel]
+	for i := range subs {
+		if subs[i] == sub {
+			close(subs[i])
+			n.subs[channel] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(n.subs[channel]) > 0 || n.closed {
+		n.mtx.Unlock()
+		return nil
+	}
+	delete(n.subs, channel)
+	n.mtx.Unlock()
+	return n.listener.Unlisten(channel)
+}
+
+// Close stops listening and closes all the subscriber channels.
+func (n *Notifier) Close() error {
+	n.mtx.Lock()
+	if n.closed {
+		n.mtx.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.done)
+	for channel, subs := range n.subs {
+		for _, ch := range subs {
+			close(ch)
+		}
+		delete(n.subs, channel)
+	}
+	n.mtx.Unlock()
+	return n.listener.Close()
+}
+
+// Notify sends payload on a Postgres channel. Listeners get it once the
+// current transaction, if any, commits.
+func Notify(db *sql.DB, channel, payload string) error {
+	_, err := db.Exec("SELECT pg_notify($1, $2)", channel, payload)
+	return err
+}
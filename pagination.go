@@ -0,0 +1,138 @@
+package backend_utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 50
+	MAX_PAGE_SIZE = 1000
+)
+
+var ErrInvalidCursor = errors.New("Invalid page token.")
+
+// Cursor is the position of the next page. Clients only see it as an opaque
+// token which they can't alter, see Paginator.EncodeCursor.
+type Cursor struct {
+	Offset	int64		`json:"o,omitempty"`
+	// Values of the keyset columns of the last row returned.
+	Keys	[]interface{}	`json:"k,omitempty"`
+}
+
+type Paginator struct {
+	key		[]byte
+	DefaultSize	int
+	MaxSize		int
+}
+
+// Tokens are signed with secret, so all the instances of a service need the
+// same one.
+func NewPaginator(secret []byte) *Paginator {
+	return &Paginator{key: secret, DefaultSize: DEFAULT_PAGE_SIZE, MaxSize: MAX_PAGE_SIZE}
+}
+
+// PageSize clamps the size asked for by the client. 0 or less gets the
+// default size.
+func (p *Paginator) PageSize(requested int32) int {
+	if requested <= 0 {
+		return p.DefaultSize
+	}
+	if int(requested) > p.MaxSize {
+		return p.MaxSize
+	}
+	return int(requested)
+}
+
+func (p *Paginator) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(payload)
+	return mac.Sum(nil)[:16]
+}
+
+func (p *Paginator) EncodeCursor(c *Cursor) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(payload, p.sign(payload)...)), nil
+}
+
+// DecodeCursor returns an empty cursor for an empty token, i.e. the first
+// page.
+func (p *Paginator) DecodeCursor(token string) (*Cursor, error) {
+
+	c := new(Cursor)
+	if len(token) == 0 {
+		return c, nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) <= 16 {
+		return nil, ErrInvalidCursor
+	}
+	payload, sig := buf[:len(buf)-16], buf[len(buf)-16:]
+	if !hmac.Equal(sig, p.sign(payload)) {
+		return nil, ErrInvalidCursor
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(payload)))
+	dec.UseNumber()
+	if err = dec.Decode(c); err != nil || c.Offset < 0 {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// OffsetPage returns the LIMIT and OFFSET for a list call. The LIMIT is one
+// more than the page size, so that NextOffsetToken can tell if there is
+// another page.
+func (p *Paginator) OffsetPage(token string, requested int32) (limit, offset int, err error) {
+	c, err := p.DecodeCursor(token)
+	if err != nil {
+		return 0, 0, err
+	}
+	return p.PageSize(requested) + 1, int(c.Offset), nil
+}
+
+// NextOffsetToken returns the token of the page after the one at offset, or
+// "" if rows, the number of rows the query returned, shows it was the last.
+func (p *Paginator) NextOffsetToken(offset, limit, rows int) (string, error) {
+	if rows < limit {
+		return "", nil
+	}
+	return p.EncodeCursor(&Cursor{Offset: int64(offset + limit - 1)})
+}
+
+// KeysetClause returns the condition selecting rows after the cursor for a
+// query ordered by columns, e.g. `("created_at", "id") > ($2, $3)` with
+// first_arg 2. It returns "" for the first page.
+func KeysetClause(c *Cursor, columns []string, first_arg int) (string, []interface{}, error) {
+
+	if len(c.Keys) == 0 {
+		return "", nil, nil
+	}
+	if len(c.Keys) != len(columns) {
+		return "", nil, ErrInvalidCursor
+	}
+
+	cols := make([]string, len(columns))
+	params := make([]string, len(columns))
+	for i := range columns {
+		cols[i] = QuoteIdent(columns[i])
+		params[i] = fmt.Sprintf("$%d", first_arg + i)
+	}
+	clause := "(" + strings.Join(cols, ", ") + ") > (" + strings.Join(params, ", ") + ")"
+	return clause, c.Keys, nil
+}
+
+// NextKeysetToken returns the token of the page after the row with the
+// given keyset column values.
+func (p *Paginator) NextKeysetToken(last_keys... interface{}) (string, error) {
+	return p.EncodeCursor(&Cursor{Keys: last_keys})
+}
@@ -0,0 +1,168 @@
+package backend_utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	ALGO_BCRYPT = "bcrypt"
+	ALGO_ARGON2ID = "argon2id"
+)
+
+var ErrInvalidHash = errors.New("Invalid password hash.")
+
+// PasswordConfig selects the algorithm and cost used for new hashes. Hashes
+// made with other settings still verify and are reported for rehashing.
+type PasswordConfig struct {
+	// bcrypt or argon2id. Defaults to argon2id.
+	Algorithm	string	`json:"algorithm"`
+	BcryptCost	int	`json:"bcrypt_cost"`
+	// argon2id parameters. Memory is in KiB.
+	Argon2Time	uint32	`json:"argon2_time"`
+	Argon2Memory	uint32	`json:"argon2_memory"`
+	Argon2Threads	uint8	`json:"argon2_threads"`
+}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen = 32
+	// Largest memory, in KiB, of the stored hashes VerifyPassword accepts.
+	argon2MaxMemory = 1 << 20
+)
+
+// Zero values are replaced by the recommended defaults.
+func (c PasswordConfig) withDefaults() PasswordConfig {
+	if len(c.Algorithm) == 0 {
+		c.Algorithm = ALGO_ARGON2ID
+	}
+	if c.BcryptCost == 0 {
+		c.BcryptCost = bcrypt.DefaultCost
+	}
+	if c.Argon2Time == 0 {
+		c.Argon2Time = 3
+	}
+	if c.Argon2Memory == 0 {
+		c.Argon2Memory = 64 * 1024
+	}
+	if c.Argon2Threads == 0 {
+		c.Argon2Threads = 2
+	}
+	return c
+}
+
+type argon2Params struct {
+	time	uint32
+	memory	uint32
+	threads	uint8
+	salt	[]byte
+	key	[]byte
+}
+
+// HashPassword returns the hash in the usual encoded form, "$2a$..." for
+// bcrypt and "$argon2id$v=19$m=...,t=...,p=...$salt$key" for argon2id.
+func (c PasswordConfig) HashPassword(password string) (string, error) {
+
+	c = c.withDefaults()
+
+	switch c.Algorithm {
+	case ALGO_BCRYPT:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), c.BcryptCost)
+		return string(hash), err
+	case ALGO_ARGON2ID:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, c.Argon2Time, c.Argon2Memory, c.Argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			c.Argon2Memory, c.Argon2Time, c.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	return "", fmt.Errorf("Unknown password hash algorithm %s", c.Algorithm)
+}
+
+// VerifyPassword checks password against hash in constant time. If it
+// matches but hash was made with different settings, new_hash has a fresh
+// hash that should be stored in place of the old one.
+func (c PasswordConfig) VerifyPassword(password, hash string) (match bool, new_hash string, err error) {
+
+	c = c.withDefaults()
+
+	var rehash bool
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, "", nil
+		}
+		if err != nil {
+			return false, "", err
+		}
+		cost, _ := bcrypt.Cost([]byte(hash))
+		rehash = c.Algorithm != ALGO_BCRYPT || cost != c.BcryptCost
+	case strings.HasPrefix(hash, "$argon2id$"):
+		p, perr := parseArgon2Hash(hash)
+		if perr != nil {
+			return false, "", perr
+		}
+		key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+		if subtle.ConstantTimeCompare(key, p.key) != 1 {
+			return false, "", nil
+		}
+		rehash = c.Algorithm != ALGO_ARGON2ID || p.time != c.Argon2Time ||
+			p.memory != c.Argon2Memory || p.threads != c.Argon2Threads
+	default:
+		return false, "", ErrInvalidHash
+	}
+
+	if rehash {
+		new_hash, err = c.HashPassword(password)
+		if err != nil {
+			return true, "", err
+		}
+	}
+	return true, new_hash, nil
+}
+
+func parseArgon2Hash(hash string) (*argon2Params, error) {
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, ErrInvalidHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, ErrInvalidHash
+	}
+
+	p := new(argon2Params)
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return nil, ErrInvalidHash
+	}
+	// argon2 panics on a zero time or thread count, and a crafted memory
+	// size would exhaust ours.
+	if p.time < 1 || p.threads < 1 || p.memory < 1 || p.memory > argon2MaxMemory {
+		return nil, ErrInvalidHash
+	}
+
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, ErrInvalidHash
+	}
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(p.key) == 0 {
+		return nil, ErrInvalidHash
+	}
+	return p, nil
+}
@@ -0,0 +1,66 @@
+package backend_utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseArgon2Hash(t *testing.T) {
+	conf := PasswordConfig{Algorithm: ALGO_ARGON2ID, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+	valid, err := conf.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("Failed hashing. Err:%s", err)
+	}
+	parts := strings.Split(valid, "$")
+	salt, key := parts[4], parts[5]
+	with := func(params string) string {
+		return strings.Join([]string{"", "argon2id", "v=19", params, salt, key}, "$")
+	}
+
+	tests := []struct {
+		name	string
+		hash	string
+		want	*argon2Params
+	}{
+		{"valid", valid, &argon2Params{time: 1, memory: 1024, threads: 1}},
+		{"max memory", with("m=1048576,t=1,p=1"), &argon2Params{time: 1, memory: argon2MaxMemory, threads: 1}},
+		{"missing part", strings.Join(parts[:5], "$"), nil},
+		{"wrong version", strings.Replace(valid, "v=19", "v=16", 1), nil},
+		{"bad params", with("m=x,t=1,p=1"), nil},
+		{"zero time", with("m=1024,t=0,p=1"), nil},
+		{"zero threads", with("m=1024,t=1,p=0"), nil},
+		{"zero memory", with("m=0,t=1,p=1"), nil},
+		{"oversized memory", with("m=1048577,t=1,p=1"), nil},
+		{"bad salt", strings.Join([]string{"", "argon2id", "v=19", "m=1024,t=1,p=1", "!!", key}, "$"), nil},
+		{"empty key", strings.Join([]string{"", "argon2id", "v=19", "m=1024,t=1,p=1", salt, ""}, "$"), nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := parseArgon2Hash(tc.hash)
+			if tc.want == nil {
+				if err != ErrInvalidHash {
+					t.Fatalf("Got %v, want ErrInvalidHash.", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed parsing. Err:%s", err)
+			}
+			if p.time != tc.want.time || p.memory != tc.want.memory || p.threads != tc.want.threads {
+				t.Fatalf("Got t=%d m=%d p=%d, want t=%d m=%d p=%d.", p.time, p.memory, p.threads,
+					tc.want.time, tc.want.memory, tc.want.threads)
+			}
+		})
+	}
+}
+
+// Malformed stored hashes fail verification instead of panicking.
+func TestVerifyPasswordInvalidHash(t *testing.T) {
+	conf := PasswordConfig{}
+	for _, hash := range []string{"", "plain", "$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5"} {
+		if match, _, err := conf.VerifyPassword("secret", hash); match || err == nil {
+			t.Fatalf("Hash %q verified with %t, %v.", hash, match, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package backend_utils
+
+import (
+	"strings"
+	"sync"
+	"github.com/golang/protobuf/proto"
+	"github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Buckets of the payload size histograms, from 64B to 16MB.
+var DefaultSizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
+
+// MetricsConfig tunes the RPC metrics collected when MetricsPort is set.
+type MetricsConfig struct {
+	// Buckets, in seconds, of the handling time histogram. The histogram is
+	// only collected if set.
+	LatencyBuckets	[]float64	`json:"latency_buckets"`
+	// Collect request and response message sizes per method.
+	PayloadSizes	bool		`json:"payload_sizes"`
+	// Buckets, in bytes, of the size histograms. Defaults to
+	// DefaultSizeBuckets.
+	SizeBuckets	[]float64	`json:"size_buckets"`
+}
+
+// The histograms are process wide, so the buckets of the first server
+// config setting them up are used.
+var payloadMetrics struct {
+	once		sync.Once
+	request		*prometheus.HistogramVec
+	response	*prometheus.HistogramVec
+}
+
+var latencyHistogramOnce sync.Once
+
+func (m *MetricsConfig) setup() {
+
+	if len(m.LatencyBuckets) > 0 {
+		latencyHistogramOnce.Do(func() {
+			grpc_prometheus.EnableHandlingTimeHistogram(grpc_prometheus.WithHistogramBuckets(m.LatencyBuckets))
+		})
+	}
+
+	if m.PayloadSizes {
+		payloadMetrics.once.Do(func() {
+			buckets := m.SizeBuckets
+			if len(buckets) == 0 {
+				buckets = DefaultSizeBuckets
+			}
+			labels := []string{"grpc_service", "grpc_method"}
+			payloadMetrics.request = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name: "backend_utils_grpc_request_bytes",
+				Help: "Size of the messages received by the server, by method.",
+				Buckets: buckets,
+			}, labels)
+			payloadMetrics.response = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name: "backend_utils_grpc_response_bytes",
+				Help: "Size of the messages sent by the server, by method.",
+				Buckets: buckets,
+			}, labels)
+			prometheus.MustRegister(payloadMetrics.request, payloadMetrics.response)
+		})
+	}
+}
+
+// "/pkg.Service/Method" to "pkg.Service", "Method".
+func splitFullMethod(full string) (string, string) {
+	full = strings.TrimPrefix(full, "/")
+	if i := strings.LastIndex(full, "/"); i >= 0 {
+		return full[:i], full[i+1:]
+	}
+	return "unknown", full
+}
+
+func observeSize(h *prometheus.HistogramVec, full_method string, msg interface{}) {
+	if m, ok := msg.(proto.Message); ok {
+		svc, method := splitFullMethod(full_method)
+		h.WithLabelValues(svc, method).Observe(float64(proto.Size(m)))
+	}
+}
+
+func payloadUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	observeSize(payloadMetrics.request, info.FullMethod, req)
+	resp, err := handler(ctx, req)
+	if err == nil {
+		observeSize(payloadMetrics.response, info.FullMethod, resp)
+	}
+	return resp, err
+}
+
+type sizeObservingStream struct {
+	grpc.ServerStream
+	method	string
+}
+
+func (s *sizeObservingStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		observeSize(payloadMetrics.request, s.method, m)
+	}
+	return err
+}
+
+func (s *sizeObservingStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		observeSize(payloadMetrics.response, s.method, m)
+	}
+	return err
+}
+
+func payloadStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	return handler(srv, &sizeObservingStream{ServerStream: ss, method: info.FullMethod})
+}
@@ -0,0 +1,115 @@
+package backend_utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"unicode"
+)
+
+// Kinds of PII Tokenizer normalizes before hashing.
+const (
+	PII_EMAIL = "email"
+	PII_PHONE = "phone"
+)
+
+// Tokenizer replaces PII with deterministic keyed hashes, so pipelines can
+// join and count on it without carrying the raw values. Tokens of the same
+// value and kind are equal as long as the key is; without the key they
+// cannot be reversed or brute forced.
+type Tokenizer struct {
+	key	[]byte
+}
+
+// NewTokenizer returns a tokenizer hashing with key, which should be at
+// least 32 random bytes shared by all the producers of joined data.
+func NewTokenizer(key []byte) *Tokenizer {
+	return &Tokenizer{key: key}
+}
+
+// NewTokenizerFromKeys uses the current key of keys. Tokens only match
+// within the same key, so rotating it starts a new token space.
+func NewTokenizerFromKeys(keys KeyProvider) (*Tokenizer, error) {
+	_, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenizer(key), nil
+}
+
+// NormalizePII returns the canonical form of value for kind: emails are
+// trimmed and lower cased, phones reduced to their digits and a leading
+// '+'. Other kinds are only trimmed.
+func NormalizePII(kind, value string) string {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case PII_EMAIL:
+		return strings.ToLower(value)
+	case PII_PHONE:
+		var b strings.Builder
+		for i, r := range value {
+			if unicode.IsDigit(r) || (r == '+' && i == 0) {
+				b.WriteRune(r)
+			}
+		}
+		return b.String()
+	}
+	return value
+}
+
+// Token returns the token of value. kind separates the token spaces, so the
+// same string as an email and as a name gives different tokens.
+func (t *Tokenizer) Token(kind, value string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(NormalizePII(kind, value)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func maskRunes(s string, keep_first, keep_last int) string {
+	runes := []rune(s)
+	for i := range runes {
+		if i >= keep_first && i < len(runes) - keep_last {
+			runes[i] = '*'
+		}
+	}
+	return string(runes)
+}
+
+// MaskEmail keeps the first letter of the local part and the domain, e.g.
+// "jdoe@example.com" gives "j***@example.com". Values without an '@' are
+// masked whole.
+func MaskEmail(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return maskRunes(email, 0, 0)
+	}
+	keep := 1
+	if len([]rune(email[:i])) <= 1 {
+		keep = 0
+	}
+	return maskRunes(email[:i], keep, 0) + email[i:]
+}
+
+// MaskPhone masks all but the last 4 digits, keeping the formatting, e.g.
+// "+1 (415) 555-0132" gives "+* (***) ***-0132".
+func MaskPhone(phone string) string {
+	digits := 0
+	for _, r := range phone {
+		if unicode.IsDigit(r) {
+			digits++
+		}
+	}
+	runes := []rune(phone)
+	for i, r := range runes {
+		if unicode.IsDigit(r) {
+			if digits > 4 {
+				runes[i] = '*'
+			}
+			digits--
+		}
+	}
+	return string(runes)
+}
@@ -0,0 +1,94 @@
+package backend_utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Pools created from config are shared by all the Configurations which
+// dial the same endpoints of a service, so that components loading the
+// same config file don't each open their own connections. The pool is
+// closed once the last of them releases it.
+var poolRegistry = struct {
+	sync.Mutex
+	pools map[string] *sharedPool
+}{pools: make(map[string] *sharedPool)}
+
+type sharedPool struct {
+	pool	*RpcClientPool
+	refs	int
+}
+
+// The key covers the service, its endpoint addresses and the pool size.
+// Other pool settings are taken from whoever created the pool first.
+func poolKey(svc_name string, endpoints []interface{}, conn_per_ep int) string {
+	addrs := make([]string, 0, len(endpoints))
+	for _, ep := range endpoints {
+		switch ep.(type) {
+		case GrpcClientConfig:
+			cli := ep.(GrpcClientConfig)
+			addrs = append(addrs, strings.Join(cli.addrs(), "+"))
+		case ConnEndpointInfo:
+			info := ep.(ConnEndpointInfo)
+			addrs = append(addrs, strings.Join(append([]string{info.ServerAddr}, info.ServerAddrs...), "+"))
+		}
+	}
+	sort.Strings(addrs)
+	return fmt.Sprintf("%s|%d|%s", svc_name, conn_per_ep, strings.Join(addrs, ","))
+}
+
+// acquirePool returns the pool registered under key, calling create if
+// there is none. create dials, so it runs without the registry lock, and
+// the pool is closed again if another caller registered one meanwhile.
+func acquirePool(key string, create func() *RpcClientPool) *RpcClientPool {
+	if pool := addPoolRef(key); pool != nil {
+		return pool
+	}
+
+	pool := create()
+	if pool == nil {
+		return nil
+	}
+
+	poolRegistry.Lock()
+	if shared, ok := poolRegistry.pools[key]; ok {
+		shared.refs++
+		poolRegistry.Unlock()
+		pool.Close()
+		return shared.pool
+	}
+	poolRegistry.pools[key] = &sharedPool{pool: pool, refs: 1}
+	poolRegistry.Unlock()
+	return pool
+}
+
+func addPoolRef(key string) *RpcClientPool {
+	poolRegistry.Lock()
+	defer poolRegistry.Unlock()
+	if shared, ok := poolRegistry.pools[key]; ok {
+		shared.refs++
+		return shared.pool
+	}
+	return nil
+}
+
+// releasePool drops a reference to the pool under key and closes it once
+// nobody uses it.
+func releasePool(key string) {
+	poolRegistry.Lock()
+	shared, ok := poolRegistry.pools[key]
+	if !ok {
+		poolRegistry.Unlock()
+		return
+	}
+	shared.refs--
+	if shared.refs > 0 {
+		poolRegistry.Unlock()
+		return
+	}
+	delete(poolRegistry.pools, key)
+	poolRegistry.Unlock()
+	shared.pool.Close()
+}
@@ -0,0 +1,140 @@
+package backend_utils
+
+import (
+	"errors"
+	"time"
+	"google.golang.org/grpc/connectivity"
+)
+
+// How often Watch checks the connectivity state of the connections.
+const WATCH_POLL_INTERVAL = 1 * time.Second
+
+var errConnsFailing = errors.New("All connections in TRANSIENT_FAILURE.")
+
+// EndpointState is an up/down transition of a pool endpoint. Err is the
+// cause of going down.
+type EndpointState struct {
+	// Endpoint as passed to the pool.
+	Endpoint	interface{}
+	Up		bool
+	Err		error
+	Time		time.Time
+}
+
+// Watch returns a channel receiving the up/down transitions of the pool's
+// endpoints, e.g. to pause consumers while a dependency is dark. An
+// endpoint goes down when dialing it fails, its heartbeats fail
+// HeartbeatFailures times in a row or all its connections are in
+// TRANSIENT_FAILURE. It is up again on a successful heartbeat, or on a
+// successful dial or READY connection unless its heartbeats are failing.
+//
+// Up to buf transitions are buffered, watchers not keeping up miss the
+// rest. The returned func stops watching and closes the channel; Close
+// closes it as well.
+func (r *RpcClientPool) Watch(buf int) (<-chan EndpointState, func()) {
+	ch := make(chan EndpointState, buf)
+	r.mtx.Lock()
+	if r.closed {
+		r.mtx.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if r.watchers == nil {
+		r.watchers = make(map[chan EndpointState] bool)
+		r.stop_watch = make(chan struct{})
+		go r.watchConns(r.stop_watch)
+	}
+	r.watchers[ch] = true
+	r.mtx.Unlock()
+
+	return ch, func() {
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		if r.watchers[ch] {
+			delete(r.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// setEndpointState records the state of ep, notifying the watchers and the
+// OnEndpointState hook if it changed.
+func (r *RpcClientPool) setEndpointState(ep int, up bool, err error) {
+	r.mtx.Lock()
+	if prev, ok := r.ep_up[ep]; ok && prev == up {
+		r.mtx.Unlock()
+		return
+	}
+	r.ep_up[ep] = up
+	state := EndpointState{Endpoint: r.endpoints_map[ep], Up: up, Err: err, Time: r.clock.Now()}
+	for ch := range r.watchers {
+		select {
+		case ch <- state:
+		default:
+		}
+	}
+	r.mtx.Unlock()
+
+	if up {
+		r.logger.Infof("Endpoint %+v is up.\n", state.Endpoint)
+	} else {
+		r.logger.Errorf("Endpoint %+v is down. ERR:%v\n", state.Endpoint, err)
+	}
+	if r.hooks.OnEndpointState != nil {
+		r.hooks.OnEndpointState(state.Endpoint, up, err)
+	}
+}
+
+// watchConns derives endpoint states from the connectivity state of their
+// connections till stop is closed.
+func (r *RpcClientPool) watchConns(stop chan struct{}) {
+	ticker := r.clock.NewTicker(WATCH_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+		}
+
+		ready := make(map[int] bool)
+		failing := make(map[int] bool)
+		r.mtx.Lock()
+		for conn, ep := range r.conn_endpoints {
+			switch conn.GetState() {
+			case connectivity.Ready:
+				ready[ep] = true
+			case connectivity.TransientFailure, connectivity.Shutdown:
+				if _, seen := failing[ep]; !seen {
+					failing[ep] = true
+				}
+				continue
+			}
+			failing[ep] = false
+		}
+		r.mtx.Unlock()
+
+		for ep := range ready {
+			r.markUp(ep)
+		}
+		for ep, down := range failing {
+			if down {
+				r.setEndpointState(ep, false, errConnsFailing)
+			}
+		}
+	}
+}
+
+// closeWatchers stops watchConns and closes the watch channels.
+func (r *RpcClientPool) closeWatchers() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.stop_watch != nil {
+		close(r.stop_watch)
+		r.stop_watch = nil
+	}
+	for ch := range r.watchers {
+		close(ch)
+	}
+	r.watchers = nil
+}
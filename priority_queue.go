@@ -0,0 +1,229 @@
+package backend_utils
+
+import (
+	"container/list"
+	"sync"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Priority bands, highest first. Calls name theirs in PRIORITY_METADATA_KEY.
+const (
+	PRIORITY_HIGH = "high"
+	PRIORITY_NORMAL = "normal"
+	PRIORITY_LOW = "low"
+)
+
+var priorityBands = []string{PRIORITY_HIGH, PRIORITY_NORMAL, PRIORITY_LOW}
+
+// Share of the freed slots each band gets while several are waiting.
+var DefaultPriorityWeights = map[string]int{PRIORITY_HIGH: 8, PRIORITY_NORMAL: 4, PRIORITY_LOW: 1}
+
+// PriorityConfig queues calls once MaxInFlight are being served, and
+// serves the queued ones by priority band, so that batch traffic can't
+// crowd out interactive calls during overload.
+type PriorityConfig struct {
+	// Calls served at once. 0 disables queueing.
+	MaxInFlight	int			`json:"max_in_flight"`
+	// Calls queued per band. Further ones are rejected. Defaults to
+	// MaxInFlight.
+	MaxQueue	int			`json:"max_queue"`
+	// Queued calls are rejected after waiting this long. 0 waits till the
+	// call's deadline.
+	MaxWait		Duration		`json:"max_wait"`
+	// Band of methods without a priority in their metadata, keyed by full
+	// method name.
+	MethodPriority	map[string]string	`json:"method_priority"`
+	// Band of calls without one otherwise. Defaults to PRIORITY_NORMAL.
+	DefaultPriority	string			`json:"default_priority"`
+	// Relative share of freed slots per band. Defaults to
+	// DefaultPriorityWeights.
+	Weights		map[string]int		`json:"weights"`
+}
+
+type priorityWaiter struct {
+	ready	chan struct{}
+	granted	bool
+}
+
+type PriorityQueue struct {
+	conf		PriorityConfig
+	mtx		sync.Mutex
+	in_flight	int
+	queues		map[string]*list.List
+	credits		map[string]int
+}
+
+func NewPriorityQueue(conf PriorityConfig) *PriorityQueue {
+	if conf.MaxQueue <= 0 {
+		conf.MaxQueue = conf.MaxInFlight
+	}
+	if len(conf.DefaultPriority) == 0 {
+		conf.DefaultPriority = PRIORITY_NORMAL
+	}
+	weights := make(map[string]int)
+	for _, b := range priorityBands {
+		weights[b] = DefaultPriorityWeights[b]
+		if w, ok := conf.Weights[b]; ok && w > 0 {
+			weights[b] = w
+		}
+	}
+	conf.Weights = weights
+
+	q := &PriorityQueue{
+		conf: conf,
+		queues: make(map[string]*list.List),
+		credits: make(map[string]int),
+	}
+	for _, b := range priorityBands {
+		q.queues[b] = list.New()
+	}
+	return q
+}
+
+// Priority returns the band of a call: the one in its metadata, else the
+// one configured for the method, else the default. Callers without a JWT
+// may only lower their band through metadata, so that anonymous traffic
+// can't jump the queue.
+func (q *PriorityQueue) Priority(ctx context.Context, method string) string {
+	band := PRIORITY_NORMAL
+	if p, ok := q.conf.MethodPriority[method]; ok && q.queues[p] != nil {
+		band = p
+	} else if q.queues[q.conf.DefaultPriority] != nil {
+		band = q.conf.DefaultPriority
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md[PRIORITY_METADATA_KEY]) > 0 {
+		p := md[PRIORITY_METADATA_KEY][0]
+		if q.queues[p] != nil && (len(jwtSubject(ctx)) > 0 || bandRank(p) >= bandRank(band)) {
+			return p
+		}
+	}
+	return band
+}
+
+// bandRank is 0 for the highest band.
+func bandRank(band string) int {
+	for i, b := range priorityBands {
+		if b == band {
+			return i
+		}
+	}
+	return len(priorityBands)
+}
+
+// nextBand picks the band the next free slot goes to. Bands are served in
+// order till they use up their credits, which are topped up to the weights
+// once every waiting band has none left.
+func (q *PriorityQueue) nextBand() string {
+	for round := 0; round < 2; round++ {
+		waiting := false
+		for _, b := range priorityBands {
+			if q.queues[b].Len() == 0 {
+				continue
+			}
+			waiting = true
+			if q.credits[b] > 0 {
+				q.credits[b]--
+				return b
+			}
+		}
+		if !waiting {
+			return ""
+		}
+		for _, b := range priorityBands {
+			q.credits[b] = q.conf.Weights[b]
+		}
+	}
+	return ""
+}
+
+func (q *PriorityQueue) acquire(ctx context.Context, band string) error {
+
+	q.mtx.Lock()
+	if q.in_flight < q.conf.MaxInFlight {
+		q.in_flight++
+		q.mtx.Unlock()
+		return nil
+	}
+	if q.queues[band].Len() >= q.conf.MaxQueue {
+		q.mtx.Unlock()
+		return ErrResourceExhausted("Server overloaded")
+	}
+	w := &priorityWaiter{ready: make(chan struct{})}
+	elem := q.queues[band].PushBack(w)
+	q.mtx.Unlock()
+
+	var timeout <-chan time.Time
+	if q.conf.MaxWait.Duration > 0 {
+		timeout = pkgClock().After(q.conf.MaxWait.Duration)
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timeout:
+		err = ErrResourceExhausted("Server overloaded")
+	case <-ctx.Done():
+		err = status.Error(codes.DeadlineExceeded, "Deadline exceeded while queued")
+		if ctx.Err() == context.Canceled {
+			err = status.Error(codes.Canceled, ctx.Err().Error())
+		}
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if w.granted {
+		// Granted meanwhile. The slot is ours to return.
+		q.releaseLocked()
+	} else {
+		q.queues[band].Remove(elem)
+	}
+	return err
+}
+
+func (q *PriorityQueue) release() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.releaseLocked()
+}
+
+// The slot goes straight to the next waiter, if any.
+func (q *PriorityQueue) releaseLocked() {
+	band := q.nextBand()
+	if len(band) == 0 {
+		q.in_flight--
+		return
+	}
+	w := q.queues[band].Remove(q.queues[band].Front()).(*priorityWaiter)
+	w.granted = true
+	close(w.ready)
+}
+
+func (q *PriorityQueue) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if err := q.acquire(ctx, q.Priority(ctx, info.FullMethod)); err != nil {
+			return nil, err
+		}
+		defer q.release()
+		return handler(ctx, req)
+	}
+}
+
+// Streams hold their slot while they are open.
+func (q *PriorityQueue) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		if err := q.acquire(ctx, q.Priority(ctx, info.FullMethod)); err != nil {
+			return err
+		}
+		defer q.release()
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,146 @@
+package backend_utils
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Callers in all the bands acquire and release slots while some of them
+// give up, racing their cancellation with the slot being granted to them.
+// Run with -race.
+func TestPriorityQueueGrantCancel(t *testing.T) {
+	tests := []struct {
+		name		string
+		conf		PriorityConfig
+		callers		int
+		// Share of the callers cancelled after a random delay.
+		cancel		float64
+		want_codes	[]codes.Code
+	}{
+		{
+			name: "all served",
+			conf: PriorityConfig{MaxInFlight: 2, MaxQueue: 200},
+			callers: 200,
+			want_codes: []codes.Code{codes.OK},
+		},
+		{
+			name: "cancelled while queued",
+			conf: PriorityConfig{MaxInFlight: 1, MaxQueue: 200},
+			callers: 200,
+			cancel: 0.5,
+			want_codes: []codes.Code{codes.OK, codes.Canceled},
+		},
+		{
+			name: "max wait",
+			conf: PriorityConfig{MaxInFlight: 1, MaxQueue: 200, MaxWait: Duration{time.Millisecond}},
+			callers: 200,
+			cancel: 0.2,
+			want_codes: []codes.Code{codes.OK, codes.Canceled, codes.ResourceExhausted},
+		},
+		{
+			name: "queue full",
+			conf: PriorityConfig{MaxInFlight: 1, MaxQueue: 1},
+			callers: 200,
+			want_codes: []codes.Code{codes.OK, codes.ResourceExhausted},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewPriorityQueue(tc.conf)
+			var in_flight, served int32
+			var wg sync.WaitGroup
+			for i := 0; i < tc.callers; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				if rand.Float64() < tc.cancel {
+					time.AfterFunc(time.Duration(rand.Intn(500)) * time.Microsecond, cancel)
+				}
+				band := priorityBands[i % len(priorityBands)]
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer cancel()
+					err := q.acquire(ctx, band)
+					if !codeIn(status.Code(err), tc.want_codes) {
+						t.Errorf("Unexpected error %v.", err)
+					}
+					if err != nil {
+						return
+					}
+					if n := atomic.AddInt32(&in_flight, 1); int(n) > tc.conf.MaxInFlight {
+						t.Errorf("%d calls in flight, limit %d.", n, tc.conf.MaxInFlight)
+					}
+					atomic.AddInt32(&served, 1)
+					time.Sleep(time.Duration(rand.Intn(50)) * time.Microsecond)
+					atomic.AddInt32(&in_flight, -1)
+					q.release()
+				}()
+			}
+			wg.Wait()
+
+			if served == 0 {
+				t.Fatal("No call served.")
+			}
+			q.mtx.Lock()
+			defer q.mtx.Unlock()
+			if q.in_flight != 0 {
+				t.Fatalf("%d slots still taken.", q.in_flight)
+			}
+			for band, l := range q.queues {
+				if l.Len() != 0 {
+					t.Fatalf("%d callers left queued in %s.", l.Len(), band)
+				}
+			}
+		})
+	}
+}
+
+func codeIn(code codes.Code, want []codes.Code) bool {
+	for _, c := range want {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// A slot freed while a queued caller gives up goes to the next caller
+// instead of getting lost.
+func TestPriorityQueueGrantToNext(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		q := NewPriorityQueue(PriorityConfig{MaxInFlight: 1})
+		if err := q.acquire(context.Background(), PRIORITY_NORMAL); err != nil {
+			t.Fatalf("Failed acquiring a free slot. Err:%s", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		first := make(chan error, 1)
+		go func() { first <- q.acquire(ctx, PRIORITY_NORMAL) }()
+		for queued := 0; queued == 0; {
+			q.mtx.Lock()
+			queued = q.queues[PRIORITY_NORMAL].Len()
+			q.mtx.Unlock()
+		}
+
+		go cancel()
+		q.release()
+		if err := <-first; err == nil {
+			q.release()
+		}
+
+		next_ctx, next_cancel := context.WithTimeout(context.Background(), time.Second)
+		err := q.acquire(next_ctx, PRIORITY_NORMAL)
+		next_cancel()
+		if err != nil {
+			t.Fatalf("Slot lost after a cancelled grant. Err:%s", err)
+		}
+		q.release()
+	}
+}
@@ -0,0 +1,132 @@
+package backend_utils
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+	"golang.org/x/net/context"
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc dials addr, the host:port of the server. See
+// GrpcClientConfig.WithDialer.
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// WithDialer makes the client dial servers with dial instead of directly or
+// through Proxy.
+func (c *GrpcClientConfig) WithDialer(dial DialFunc) *GrpcClientConfig {
+	c.dialer = dial
+	return c
+}
+
+// ProxyDialer returns a DialFunc connecting through the proxy at proxy_url.
+// socks5:// and http:// (CONNECT) proxies are supported, with credentials
+// taken from the URL's user info.
+func ProxyDialer(proxy_url string) (DialFunc, error) {
+
+	u, err := url.Parse(proxy_url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return socksDialer(d), nil
+	case "http":
+		return httpConnectDialer(u), nil
+	}
+	return nil, fmt.Errorf("Unsupported proxy scheme %q", u.Scheme)
+}
+
+// proxy.Dialer has no context, so the dial is abandoned rather than
+// cancelled once ctx is done.
+func socksDialer(d proxy.Dialer) DialFunc {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		type result struct {
+			conn	net.Conn
+			err	error
+		}
+		done := make(chan result, 1)
+		go func() {
+			conn, err := d.Dial("tcp", addr)
+			done <- result{conn, err}
+		}()
+		select {
+		case res := <-done:
+			return res.conn, res.err
+		case <-ctx.Done():
+			go func() {
+				if res := <-done; res.conn != nil {
+					res.conn.Close()
+				}
+			}()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// bufferedConn hands out what the reader read past the CONNECT response
+// before reading from the conn again.
+type bufferedConn struct {
+	net.Conn
+	r	*bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func httpConnectDialer(u *url.URL) DialFunc {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		if dl, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(dl)
+			defer conn.SetDeadline(time.Time{})
+		}
+
+		req := &http.Request{
+			Method: "CONNECT",
+			URL: &url.URL{Opaque: addr},
+			Host: addr,
+			Header: http.Header{},
+		}
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+			req.Header.Set("Proxy-Authorization", "Basic " + creds)
+		}
+		if err = req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("Proxy %s refused CONNECT to %s: %s", u.Host, addr, resp.Status)
+		}
+		if r.Buffered() > 0 {
+			return &bufferedConn{Conn: conn, r: r}, nil
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,10 @@
+package backend_utils
+
+// Queue delivers messages published on a topic to its subscribers.
+type Queue interface {
+	Publish(topic string, msg []byte) error
+	// A handler error means the message was not processed and may be
+	// redelivered, depending on the implementation.
+	Subscribe(topic string, handler func(msg []byte) error) error
+	Close() error
+}
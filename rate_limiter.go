@@ -0,0 +1,347 @@
+package backend_utils
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+var ErrInvalidRateLimit = errors.New("Invalid rate limit.")
+
+var rateLimitErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "backend_utils_rate_limit_errors_total",
+	Help: "Rate limiter backend errors, the calls were let through.",
+})
+
+func init() {
+	prometheus.MustRegister(rateLimitErrors)
+}
+
+// RateLimiter decides whether an action identified by key, e.g. a user or
+// an API key, may happen now. When it may not, retry_after is how long to
+// wait before trying again.
+type RateLimiter interface {
+	Allow(key string) (allowed bool, retry_after time.Duration, err error)
+}
+
+type tokenBucket struct {
+	tokens	float64
+	last	time.Time
+}
+
+// LocalTokenBucket allows bursts of up to Burst actions per key, refilled
+// at Rate per second. State is local to the process. Rate must be positive
+// and Burst at least 1.
+type LocalTokenBucket struct {
+	rate	float64
+	burst	float64
+	mtx	sync.Mutex
+	buckets	map[string] *tokenBucket
+	sweep	time.Time
+}
+
+func validTokenBucket(rate float64, burst int) error {
+	if !(rate > 0) || math.IsInf(rate, 1) || burst < 1 {
+		return ErrInvalidRateLimit
+	}
+	return nil
+}
+
+func NewLocalTokenBucket(rate float64, burst int) (*LocalTokenBucket, error) {
+	if err := validTokenBucket(rate, burst); err != nil {
+		return nil, err
+	}
+	return &LocalTokenBucket{
+		rate: rate,
+		burst: float64(burst),
+		buckets: make(map[string] *tokenBucket),
+		sweep: pkgClock().Now(),
+	}, nil
+}
+
+func (l *LocalTokenBucket) Allow(key string) (bool, time.Duration, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := pkgClock().Now()
+	l.sweepFull(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens + now.Sub(b.last).Seconds() * l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), nil
+}
+
+// Buckets which refilled completely are the same as missing ones, drop
+// them now and then so the map doesn't grow with every key ever seen.
+func (l *LocalTokenBucket) sweepFull(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.sweep) < full || now.Sub(l.sweep) < time.Minute {
+		return
+	}
+	l.sweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type windowCount struct {
+	start	time.Time
+	prev	int
+	curr	int
+}
+
+// LocalSlidingWindow allows Limit actions per key in any Window. It
+// weighs the previous fixed window by how much of it overlaps the sliding
+// one, which is close to exact and needs two counters per key. Limit must
+// be at least 1 and Window at least a millisecond.
+type LocalSlidingWindow struct {
+	limit	int
+	window	time.Duration
+	mtx	sync.Mutex
+	counts	map[string] *windowCount
+	sweep	time.Time
+}
+
+func validSlidingWindow(limit int, window time.Duration) error {
+	if limit < 1 || window < time.Millisecond {
+		return ErrInvalidRateLimit
+	}
+	return nil
+}
+
+func NewLocalSlidingWindow(limit int, window time.Duration) (*LocalSlidingWindow, error) {
+	if err := validSlidingWindow(limit, window); err != nil {
+		return nil, err
+	}
+	return &LocalSlidingWindow{
+		limit: limit,
+		window: window,
+		counts: make(map[string] *windowCount),
+		sweep: pkgClock().Now(),
+	}, nil
+}
+
+func (l *LocalSlidingWindow) Allow(key string) (bool, time.Duration, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := pkgClock().Now()
+	start := now.Truncate(l.window)
+	l.sweepStale(start)
+	c, ok := l.counts[key]
+	switch {
+	case !ok || start.Sub(c.start) > l.window:
+		c = &windowCount{start: start}
+		l.counts[key] = c
+	case start.After(c.start):
+		c.prev, c.curr, c.start = c.curr, 0, start
+	}
+
+	overlap := 1 - float64(now.Sub(start)) / float64(l.window)
+	if float64(c.prev) * overlap + float64(c.curr) >= float64(l.limit) {
+		return false, start.Add(l.window).Sub(now), nil
+	}
+	c.curr++
+	return true, 0, nil
+}
+
+// Counts which no longer overlap the sliding window are the same as missing
+// ones, drop them now and then so the map doesn't grow with every key ever
+// seen.
+func (l *LocalSlidingWindow) sweepStale(start time.Time) {
+	if start.Sub(l.sweep) < l.window || start.Sub(l.sweep) < time.Minute {
+		return
+	}
+	l.sweep = start
+	for key, c := range l.counts {
+		if start.Sub(c.start) > l.window {
+			delete(l.counts, key)
+		}
+	}
+}
+
+// Refills the bucket in KEYS[1] and takes a token if there is one. Returns
+// {allowed, milliseconds to wait}.
+var redisTokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// Sliding window over the fixed window counters KEYS[1] (current) and
+// KEYS[2] (previous). Returns {allowed, milliseconds to wait}.
+var redisSlidingWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local elapsed = tonumber(ARGV[3])
+local curr = tonumber(redis.call("GET", KEYS[1]) or "0")
+local prev = tonumber(redis.call("GET", KEYS[2]) or "0")
+if prev * (1 - elapsed / window) + curr >= limit then
+	return {0, window - elapsed}
+end
+redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], window * 2)
+return {1, 0}
+`)
+
+func redisLimitResult(res interface{}, err error) (bool, time.Duration, error) {
+	if err != nil {
+		return false, 0, err
+	}
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return false, 0, ErrInternal("Unexpected rate limit script result.")
+	}
+	allowed, _ := vals[0].(int64)
+	wait, _ := vals[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+// RedisTokenBucket is LocalTokenBucket shared by all the instances using
+// the same Redis.
+type RedisTokenBucket struct {
+	client	*redis.Client
+	prefix	string
+	rate	float64
+	burst	int
+}
+
+func NewRedisTokenBucket(client *redis.Client, prefix string, rate float64, burst int) (*RedisTokenBucket, error) {
+	if err := validTokenBucket(rate, burst); err != nil {
+		return nil, err
+	}
+	return &RedisTokenBucket{client: client, prefix: prefix, rate: rate, burst: burst}, nil
+}
+
+func (r *RedisTokenBucket) Allow(key string) (bool, time.Duration, error) {
+	now := pkgClock().Now().UnixNano() / int64(time.Millisecond)
+	return redisLimitResult(redisTokenBucketScript.Run(r.client, []string{r.prefix + key},
+		r.rate, r.burst, now).Result())
+}
+
+// RedisSlidingWindow is LocalSlidingWindow shared by all the instances
+// using the same Redis.
+type RedisSlidingWindow struct {
+	client	*redis.Client
+	prefix	string
+	limit	int
+	window	time.Duration
+}
+
+func NewRedisSlidingWindow(client *redis.Client, prefix string, limit int, window time.Duration) (*RedisSlidingWindow, error) {
+	if err := validSlidingWindow(limit, window); err != nil {
+		return nil, err
+	}
+	return &RedisSlidingWindow{client: client, prefix: prefix, limit: limit, window: window}, nil
+}
+
+func (r *RedisSlidingWindow) Allow(key string) (bool, time.Duration, error) {
+	now := pkgClock().Now()
+	start := now.Truncate(r.window)
+	idx := start.UnixNano() / int64(r.window)
+	window_ms := int64(r.window / time.Millisecond)
+	elapsed_ms := int64(now.Sub(start) / time.Millisecond)
+	keys := []string{
+		r.prefix + key + ":" + strconv.FormatInt(idx, 10),
+		r.prefix + key + ":" + strconv.FormatInt(idx - 1, 10),
+	}
+	return redisLimitResult(redisSlidingWindowScript.Run(r.client, keys, r.limit, window_ms,
+		elapsed_ms).Result())
+}
+
+// RateLimitKeyFunc picks the key a call is limited by. Calls with an empty
+// key are not limited.
+type RateLimitKeyFunc func(ctx context.Context, method string) string
+
+// RateLimitBySubject limits calls per JWT subject, falling back to the
+// peer host for calls without a token. The port is left out, so that
+// reconnecting doesn't give a client a new limit.
+func RateLimitBySubject(ctx context.Context, method string) string {
+	if sub := jwtSubject(ctx); len(sub) > 0 {
+		return "sub:" + sub
+	}
+	return "peer:" + peerHost(ctx)
+}
+
+// peerHost is peerAddr without the port.
+func peerHost(ctx context.Context) string {
+	addr := peerAddr(ctx)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func rateLimited(ctx context.Context, limiter RateLimiter, key_func RateLimitKeyFunc, method string) error {
+	key := key_func(ctx, method)
+	if len(key) == 0 {
+		return nil
+	}
+	allowed, retry_after, err := limiter.Allow(key)
+	if err != nil {
+		// Don't take the service down with the limiter's backend.
+		pkgLog().Errorf("Rate limiter failed for %s, letting the call through. Err:%s", method, err)
+		rateLimitErrors.Inc()
+		return nil
+	}
+	if allowed {
+		return nil
+	}
+	ms := strconv.FormatInt(int64(retry_after / time.Millisecond), 10)
+	grpc.SetTrailer(ctx, metadata.Pairs("grpc-retry-pushback-ms", ms))
+	return ErrResourceExhausted("Rate limit exceeded")
+}
+
+func RateLimitUnaryInterceptor(limiter RateLimiter, key_func RateLimitKeyFunc) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if err := rateLimited(ctx, limiter, key_func, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func RateLimitStreamInterceptor(limiter RateLimiter, key_func RateLimitKeyFunc) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		if err := rateLimited(ss.Context(), limiter, key_func, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,308 @@
+package backend_utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strings"
+	"time"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata never recorded, on top of RecorderOptions.DropMetadata.
+var DefaultDroppedMetadata = []string{"authorization", "cookie", "x-api-key"}
+
+// Message fields redacted when RecorderOptions.SanitizeFields is nil.
+var DefaultSanitizeFields = []string{"password", "token", "access_token", "refresh_token",
+	"secret", "client_secret", "authorization", "api_key", "otp"}
+
+// RecordedCall is a unary call as stored by RpcRecorder. Messages are kept
+// as JSON so that recordings can be read and edited by hand.
+type RecordedCall struct {
+	Method		string			`json:"method"`
+	Time		time.Time		`json:"time"`
+	Metadata	map[string][]string	`json:"metadata"`
+	RequestType	string			`json:"request_type"`
+	Request		json.RawMessage		`json:"request"`
+	ResponseType	string			`json:"response_type"`
+	Response	json.RawMessage		`json:"response,omitempty"`
+	Code		string			`json:"code"`
+	Message		string			`json:"message,omitempty"`
+}
+
+type RecorderOptions struct {
+	// Objects are named <Prefix>/<method>/<time>-<n>.json.
+	Prefix		string
+	// Share of calls recorded, 0 to 100.
+	Percent		float64
+	// Full method names to record. All if empty.
+	Methods		[]string
+	// Message fields, by their JSON name, replaced with REDACTED wherever
+	// they appear, e.g. "password". DefaultSanitizeFields if nil, set an
+	// empty list to record messages as they are.
+	SanitizeFields	[]string
+	DropMetadata	[]string
+}
+
+// RpcRecorder writes a sample of the unary calls served to a FileStore,
+// for ReplayRecordings to fire at another instance later. Calls are written
+// in the background and write errors only logged.
+type RpcRecorder struct {
+	store		FileStore
+	opts		RecorderOptions
+	methods		map[string]bool
+	sanitize	map[string]bool
+	drop		map[string]bool
+}
+
+func NewRpcRecorder(store FileStore, opts RecorderOptions) *RpcRecorder {
+	r := &RpcRecorder{
+		store: store,
+		opts: opts,
+		methods: make(map[string]bool),
+		sanitize: make(map[string]bool),
+		drop: make(map[string]bool),
+	}
+	for _, m := range opts.Methods {
+		r.methods[m] = true
+	}
+	fields := opts.SanitizeFields
+	if fields == nil {
+		fields = DefaultSanitizeFields
+	}
+	for _, f := range fields {
+		r.sanitize[f] = true
+	}
+	for _, k := range append(DefaultDroppedMetadata, opts.DropMetadata...) {
+		r.drop[strings.ToLower(k)] = true
+	}
+	return r
+}
+
+// WithRecorder records the calls served with r.
+func (c *GrpcServerConfig) WithRecorder(r *RpcRecorder) {
+	c.recorder = r
+}
+
+var recordMarshaler = jsonpb.Marshaler{OrigName: true}
+
+func (r *RpcRecorder) sanitizeJSON(v interface{}) interface{} {
+	switch v.(type) {
+	case map[string]interface{}:
+		m := v.(map[string]interface{})
+		for k := range m {
+			if r.sanitize[k] {
+				m[k] = REDACTED
+			} else {
+				m[k] = r.sanitizeJSON(m[k])
+			}
+		}
+	case []interface{}:
+		l := v.([]interface{})
+		for i := range l {
+			l[i] = r.sanitizeJSON(l[i])
+		}
+	}
+	return v
+}
+
+func (r *RpcRecorder) messageJSON(msg proto.Message) (json.RawMessage, error) {
+	str, err := recordMarshaler.MarshalToString(msg)
+	if err != nil || len(r.sanitize) == 0 {
+		return json.RawMessage(str), err
+	}
+	var doc interface{}
+	if err = json.Unmarshal([]byte(str), &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(r.sanitizeJSON(doc))
+}
+
+func (r *RpcRecorder) record(ctx context.Context, method string, req, resp interface{}, call_err error) {
+
+	req_msg, ok := req.(proto.Message)
+	if !ok {
+		return
+	}
+	rec := &RecordedCall{
+		Method: method,
+		Time: time.Now().UTC(),
+		Metadata: map[string][]string{},
+		RequestType: proto.MessageName(req_msg),
+		Code: status.Code(call_err).String(),
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, v := range md {
+			if !r.drop[k] {
+				rec.Metadata[k] = v
+			}
+		}
+	}
+
+	var err error
+	if rec.Request, err = r.messageJSON(req_msg); err != nil {
+		pkgLog().Errorf("Failed to record request of %s. Err:%s", method, err.Error())
+		return
+	}
+	if resp_msg, ok := resp.(proto.Message); ok && call_err == nil {
+		rec.ResponseType = proto.MessageName(resp_msg)
+		if rec.Response, err = r.messageJSON(resp_msg); err != nil {
+			pkgLog().Errorf("Failed to record response of %s. Err:%s", method, err.Error())
+			return
+		}
+	}
+	if call_err != nil {
+		rec.Message = status.Convert(call_err).Message()
+	}
+
+	go func() {
+		buf, err := json.MarshalIndent(rec, "", "  ")
+		if err != nil {
+			return
+		}
+		name := fmt.Sprintf("%s/%s/%s-%d.json", r.opts.Prefix, strings.TrimPrefix(method, "/"),
+			rec.Time.Format("20060102T150405.000000000"), rand.Int63())
+		if err = r.store.Put(name, bytes.NewReader(buf)); err != nil {
+			pkgLog().Errorf("Failed to store recording of %s. Err:%s", method, err.Error())
+		}
+	}()
+}
+
+func (r *RpcRecorder) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+
+		if (len(r.methods) > 0 && !r.methods[info.FullMethod]) || rand.Float64() * 100 >= r.opts.Percent {
+			return handler(ctx, req)
+		}
+		resp, err := handler(ctx, req)
+		r.record(ctx, info.FullMethod, req, resp, err)
+		return resp, err
+	}
+}
+
+// ReplayResult compares a replayed call with its recording.
+type ReplayResult struct {
+	Name		string
+	Method		string
+	RecordedCode	string
+	Code		string
+	// Response, as JSON, of the replayed call.
+	Response	json.RawMessage
+	// The code and, if recorded, the response are the same.
+	Matched		bool
+	Err		error
+}
+
+func newMessage(type_name string) (proto.Message, error) {
+	typ := proto.MessageType(type_name)
+	if typ == nil {
+		return nil, fmt.Errorf("Message type %s not linked in", type_name)
+	}
+	return reflect.New(typ.Elem()).Interface().(proto.Message), nil
+}
+
+func replayCall(ctx context.Context, conn *grpc.ClientConn, rec *RecordedCall) (*ReplayResult, error) {
+
+	req, err := newMessage(rec.RequestType)
+	if err != nil {
+		return nil, err
+	}
+	if err = jsonpb.Unmarshal(bytes.NewReader(rec.Request), req); err != nil {
+		return nil, err
+	}
+	resp_type := rec.ResponseType
+	if len(resp_type) == 0 {
+		// Failed calls don't record a response. Any message decodes the
+		// error trailers.
+		resp_type = "google.protobuf.Empty"
+	}
+	resp, err := newMessage(resp_type)
+	if err != nil {
+		return nil, err
+	}
+
+	md := metadata.MD{}
+	for k, v := range rec.Metadata {
+		md[k] = v
+	}
+	call_err := conn.Invoke(metadata.NewOutgoingContext(ctx, md), rec.Method, req, resp)
+
+	res := &ReplayResult{
+		Method: rec.Method,
+		RecordedCode: rec.Code,
+		Code: status.Code(call_err).String(),
+	}
+	res.Matched = res.Code == res.RecordedCode
+	if call_err == nil && len(rec.ResponseType) > 0 {
+		str, err := recordMarshaler.MarshalToString(resp)
+		if err != nil {
+			return nil, err
+		}
+		res.Response = json.RawMessage(str)
+		res.Matched = res.Matched && jsonEqual(rec.Response, res.Response)
+	}
+	return res, nil
+}
+
+func jsonEqual(a, b []byte) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// ReplayRecordings fires the calls recorded under prefix at conn, in name
+// order, i.e. per method in the order they were recorded. The message types
+// must be linked into the binary. Sanitized fields are sent as REDACTED,
+// so calls depending on them may not match.
+func ReplayRecordings(ctx context.Context, conn *grpc.ClientConn, store FileStore,
+	prefix string) ([]ReplayResult, error) {
+
+	objs, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ReplayResult
+	for _, obj := range objs {
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		res, err := replayObject(ctx, conn, store, obj.Name)
+		if err != nil {
+			res = &ReplayResult{Err: err}
+		}
+		res.Name = obj.Name
+		results = append(results, *res)
+	}
+	return results, nil
+}
+
+func replayObject(ctx context.Context, conn *grpc.ClientConn, store FileStore, name string) (*ReplayResult, error) {
+
+	rc, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rec := new(RecordedCall)
+	if err = json.Unmarshal(buf, rec); err != nil {
+		return nil, err
+	}
+	return replayCall(ctx, conn, rec)
+}
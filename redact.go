@@ -0,0 +1,77 @@
+package backend_utils
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Value logged in place of fields tagged `secret:"true"`.
+const REDACTED = "******"
+
+// Redact returns a copy of v with all the string fields tagged
+// `secret:"true"` replaced by REDACTED. Other secret fields are zeroed. Nested structs, pointers and slices
+// are copied as well, so v itself is never modified.
+func Redact(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return redactValue(reflect.ValueOf(v)).Interface()
+}
+
+func redactValue(v reflect.Value) reflect.Value {
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type().Elem())
+		out.Elem().Set(redactValue(v.Elem()))
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(redactValue(v.Index(i)))
+		}
+		return out
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if f.Tag.Get("secret") == "true" {
+				if f.Type.Kind() == reflect.String && v.Field(i).Len() > 0 {
+					out.Field(i).SetString(REDACTED)
+				} else if f.Type.Kind() != reflect.String {
+					out.Field(i).Set(reflect.Zero(f.Type))
+				}
+				continue
+			}
+			out.Field(i).Set(redactValue(v.Field(i)))
+		}
+		return out
+	}
+	return v
+}
+
+func redactedJSON(v interface{}) string {
+	buf, err := json.Marshal(Redact(v))
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(buf)
+}
+
+func (c *Configurations) String() string {
+	return redactedJSON(c)
+}
+
+func (c GrpcClientConfig) String() string {
+	return redactedJSON(c)
+}
@@ -0,0 +1,58 @@
+package backend_utils
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+	"github.com/go-redis/redis"
+)
+
+func (c *RedisConfig) NewClient() (*redis.Client, error) {
+
+	db := 0
+	if len(c.DBName) > 0 {
+		var err error
+		db, err = strconv.Atoi(c.DBName)
+		if err != nil {
+			return nil, fmt.Errorf("Redis db_name should be a DB number. Got %s", c.DBName)
+		}
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("%s:%d", c.Hostname, c.Port),
+		DB: db,
+	})
+	err := client.Ping().Err()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// RedisCache is a Cache shared by all the instances using the same Redis.
+type RedisCache struct {
+	client	*redis.Client
+	prefix	string
+}
+
+// Keys are prefixed with prefix so that several caches can share one DB.
+func NewRedisCache(client *redis.Client, prefix string) *RedisCache {
+	return &RedisCache{client: client, prefix: prefix}
+}
+
+func (r *RedisCache) Get(key string) ([]byte, error) {
+	val, err := r.client.Get(r.prefix + key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrCacheMiss
+	}
+	return val, err
+}
+
+func (r *RedisCache) Set(key string, val []byte, ttl time.Duration) error {
+	return r.client.Set(r.prefix + key, val, ttl).Err()
+}
+
+func (r *RedisCache) Delete(key string) error {
+	return r.client.Del(r.prefix + key).Err()
+}
@@ -0,0 +1,320 @@
+package backend_utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	DEFAULT_ACCESS_TOKEN_TTL = 15 * time.Minute
+	DEFAULT_REFRESH_TOKEN_TTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("Invalid refresh token.")
+	// Refresh tokens would let the TOTP step be skipped.
+	ErrRefreshTotpPending = errors.New("Refresh tokens are only issued once TOTP is verified.")
+)
+
+// RefreshToken is what is stored for an issued refresh token. The token
+// itself is never stored, only its SHA-256 hash.
+type RefreshToken struct {
+	Hash		string		`json:"hash"`
+	Subject		string		`json:"subject"`
+	IssuedAt	time.Time	`json:"issued_at"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+	Revoked		bool		`json:"revoked"`
+	// Extra claims of the access tokens issued for it, e.g. roles and
+	// tenant.
+	Claims		jwt.MapClaims	`json:"claims,omitempty"`
+}
+
+type RefreshTokenStore interface {
+	Save(t *RefreshToken) error
+	// Get returns ErrInvalidRefreshToken if hash is not known.
+	Get(hash string) (*RefreshToken, error)
+	// Revoke is the compare and set of a rotation: it returns
+	// ErrInvalidRefreshToken unless it was this call that revoked hash.
+	Revoke(hash string) error
+}
+
+// Stores implementing SubjectRevoker have all the tokens of a subject
+// revoked when a rotated token is presented again.
+type SubjectRevoker interface {
+	RevokeSubject(subject string) error
+}
+
+type TokenIssuer struct {
+	PrivKey		*rsa.PrivateKey
+	Store		RefreshTokenStore
+	AccessTTL	time.Duration
+	RefreshTTL	time.Duration
+	// Defaults to the package clock, see SetClock.
+	Clock		Clock
+}
+
+// NewTokenIssuer signs access tokens with PrivKeyFile, using the TTLs from
+// the server config.
+func (c *GrpcServerConfig) NewTokenIssuer(store RefreshTokenStore) (*TokenIssuer, error) {
+
+	if c.PrivKey == nil {
+		var err error
+		c.PrivKey, err = ParseJWTprivKeyFile(c.PrivKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t := &TokenIssuer{
+		PrivKey: c.PrivKey,
+		Store: store,
+		AccessTTL: c.AccessTokenTTL.Duration,
+		RefreshTTL: c.RefreshTokenTTL.Duration,
+	}
+	if t.AccessTTL == 0 {
+		t.AccessTTL = DEFAULT_ACCESS_TOKEN_TTL
+	}
+	if t.RefreshTTL == 0 {
+		t.RefreshTTL = DEFAULT_REFRESH_TOKEN_TTL
+	}
+	return t, nil
+}
+
+// IssueAccessToken returns a JWT for subject. Extra claims are added as is.
+func (t *TokenIssuer) IssueAccessToken(subject string, extra jwt.MapClaims) (string, error) {
+	now := clockOr(t.Clock).Now()
+	claims := jwt.MapClaims{}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	claims["sub"] = subject
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(t.AccessTTL).Unix()
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(t.PrivKey)
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *TokenIssuer) IssueRefreshToken(subject string) (string, error) {
+	return t.IssueRefreshTokenWithClaims(subject, nil)
+}
+
+// IssueRefreshTokenWithClaims returns a refresh token whose access tokens
+// carry claims, as passed to IssueAccessToken. It returns
+// ErrRefreshTotpPending if claims has TOTP_PENDING_CLAIM set.
+func (t *TokenIssuer) IssueRefreshTokenWithClaims(subject string, claims jwt.MapClaims) (string, error) {
+
+	if pending, _ := claims[TOTP_PENDING_CLAIM].(bool); pending {
+		return "", ErrRefreshTotpPending
+	}
+	extra := jwt.MapClaims{}
+	for k, v := range claims {
+		switch k {
+		case "sub", "iat", "exp":
+		default:
+			extra[k] = v
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	now := clockOr(t.Clock).Now()
+	err := t.Store.Save(&RefreshToken{
+		Hash: hashRefreshToken(token),
+		Subject: subject,
+		IssuedAt: now,
+		ExpiresAt: now.Add(t.RefreshTTL),
+		Claims: extra,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ExchangeRefreshToken validates refresh and returns a new access token for
+// its subject, with the claims it was issued with. The refresh token is
+// rotated: the old one is revoked and a new one returned in its place. Only
+// one of concurrent exchanges of a token succeeds. Presenting a rotated token again is taken as theft, and all the
+// tokens of the subject are revoked if the store is a SubjectRevoker.
+func (t *TokenIssuer) ExchangeRefreshToken(refresh string) (access, new_refresh string, err error) {
+
+	rt, err := t.Store.Get(hashRefreshToken(refresh))
+	if err != nil {
+		return "", "", err
+	}
+	if clockOr(t.Clock).Now().After(rt.ExpiresAt) {
+		return "", "", ErrInvalidRefreshToken
+	}
+	if rt.Revoked {
+		return "", "", t.reused(rt)
+	}
+
+	err = t.Store.Revoke(rt.Hash)
+	if err == ErrInvalidRefreshToken {
+		// Lost the race to another exchange of the same token.
+		return "", "", t.reused(rt)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	new_refresh, err = t.IssueRefreshTokenWithClaims(rt.Subject, rt.Claims)
+	if err != nil {
+		return "", "", err
+	}
+	access, err = t.IssueAccessToken(rt.Subject, rt.Claims)
+	if err != nil {
+		return "", "", err
+	}
+	return access, new_refresh, nil
+}
+
+func (t *TokenIssuer) reused(rt *RefreshToken) error {
+	if sr, ok := t.Store.(SubjectRevoker); ok {
+		if err := sr.RevokeSubject(rt.Subject); err != nil {
+			pkgLog().Errorf("Failed revoking tokens of %s on refresh token reuse. Err:%s",
+				rt.Subject, err.Error())
+		}
+	}
+	return ErrInvalidRefreshToken
+}
+
+// PostgresRefreshTokenStore keeps tokens in the refresh_tokens table. Call
+// CreateTable once before using it.
+type PostgresRefreshTokenStore struct {
+	db	*sql.DB
+}
+
+func NewPostgresRefreshTokenStore(db *sql.DB) *PostgresRefreshTokenStore {
+	return &PostgresRefreshTokenStore{db: db}
+}
+
+func (p *PostgresRefreshTokenStore) CreateTable() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS refresh_tokens (
+		hash TEXT PRIMARY KEY,
+		subject TEXT NOT NULL,
+		issued_at TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		revoked BOOLEAN NOT NULL DEFAULT FALSE,
+		claims TEXT)`)
+	if err != nil {
+		return err
+	}
+	// Tables created before claims were kept.
+	_, err = p.db.Exec("ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS claims TEXT")
+	return err
+}
+
+func (p *PostgresRefreshTokenStore) Save(t *RefreshToken) error {
+	claims, err := json.Marshal(t.Claims)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec("INSERT INTO refresh_tokens (hash, subject, issued_at, expires_at, revoked, claims) " +
+		"VALUES ($1, $2, $3, $4, $5, $6)", t.Hash, t.Subject, t.IssuedAt, t.ExpiresAt, t.Revoked, string(claims))
+	return err
+}
+
+func (p *PostgresRefreshTokenStore) Get(hash string) (*RefreshToken, error) {
+	t := new(RefreshToken)
+	var claims sql.NullString
+	err := p.db.QueryRow("SELECT hash, subject, issued_at, expires_at, revoked, claims FROM refresh_tokens " +
+		"WHERE hash = $1", hash).Scan(&t.Hash, &t.Subject, &t.IssuedAt, &t.ExpiresAt, &t.Revoked, &claims)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.Valid && len(claims.String) > 0 {
+		if err = json.Unmarshal([]byte(claims.String), &t.Claims); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (p *PostgresRefreshTokenStore) Revoke(hash string) error {
+	res, err := p.db.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE hash = $1 AND NOT revoked", hash)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrInvalidRefreshToken
+	}
+	return nil
+}
+
+// RevokeSubject revokes all the tokens of subject, e.g. on password change.
+func (p *PostgresRefreshTokenStore) RevokeSubject(subject string) error {
+	_, err := p.db.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE subject = $1", subject)
+	return err
+}
+
+// CacheRefreshTokenStore keeps tokens in a Cache till they expire, revoked
+// ones included so that reuse is detected. Revoke is only atomic within the
+// process, and RevokeSubject is not supported. Use
+// PostgresRefreshTokenStore when several replicas exchange tokens.
+type CacheRefreshTokenStore struct {
+	mtx	sync.Mutex
+	cache	Cache
+}
+
+func NewCacheRefreshTokenStore(cache Cache) *CacheRefreshTokenStore {
+	return &CacheRefreshTokenStore{cache: cache}
+}
+
+func (c *CacheRefreshTokenStore) Save(t *RefreshToken) error {
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return c.cache.Set("refresh:" + t.Hash, buf, t.ExpiresAt.Sub(pkgClock().Now()))
+}
+
+func (c *CacheRefreshTokenStore) Get(hash string) (*RefreshToken, error) {
+	buf, err := c.cache.Get("refresh:" + hash)
+	if err == ErrCacheMiss {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := new(RefreshToken)
+	return t, json.Unmarshal(buf, t)
+}
+
+func (c *CacheRefreshTokenStore) Revoke(hash string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t, err := c.Get(hash)
+	if err != nil {
+		return err
+	}
+	if t.Revoked {
+		return ErrInvalidRefreshToken
+	}
+	t.Revoked = true
+	return c.Save(t)
+}
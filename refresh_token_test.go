@@ -0,0 +1,164 @@
+package backend_utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	testIssuerKey		*rsa.PrivateKey
+	testIssuerKeyOnce	sync.Once
+)
+
+func testTokenIssuer(t *testing.T) (*TokenIssuer, *FakeClock) {
+	testIssuerKeyOnce.Do(func() {
+		var err error
+		if testIssuerKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatalf("Failed generating key. Err:%s", err)
+		}
+	})
+	clock := NewFakeClock(time.Now())
+	return &TokenIssuer{
+		PrivKey: testIssuerKey,
+		Store: NewCacheRefreshTokenStore(NewMemoryCache().WithClock(clock)),
+		AccessTTL: time.Minute,
+		RefreshTTL: time.Hour,
+		Clock: clock,
+	}, clock
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	tests := []struct {
+		name		string
+		claims		jwt.MapClaims
+		// Time passed before the exchange.
+		advance		time.Duration
+		// Exchange the token once more after rotating it.
+		reuse		bool
+		// Exchange this instead of the issued token.
+		token		string
+		want_err	error
+		want_issue_err	error
+	}{
+		{name: "rotates"},
+		{name: "keeps claims", claims: jwt.MapClaims{"role": "admin", "tenant": "t1"}},
+		{name: "drops reserved claims", claims: jwt.MapClaims{"sub": "other", "exp": 1}},
+		{name: "expired", advance: 2 * time.Hour, want_err: ErrInvalidRefreshToken},
+		{name: "reused", reuse: true, want_err: ErrInvalidRefreshToken},
+		{name: "unknown", token: "bogus", want_err: ErrInvalidRefreshToken},
+		{
+			name: "totp pending",
+			claims: jwt.MapClaims{TOTP_PENDING_CLAIM: true},
+			want_issue_err: ErrRefreshTotpPending,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			issuer, clock := testTokenIssuer(t)
+			refresh, err := issuer.IssueRefreshTokenWithClaims("user1", tc.claims)
+			if err != tc.want_issue_err {
+				t.Fatalf("Issuing got %v, want %v.", err, tc.want_issue_err)
+			}
+			if err != nil {
+				return
+			}
+			if len(tc.token) > 0 {
+				refresh = tc.token
+			}
+			clock.Advance(tc.advance)
+
+			access, next, err := issuer.ExchangeRefreshToken(refresh)
+			if tc.reuse {
+				if err != nil {
+					t.Fatalf("First exchange failed. Err:%s", err)
+				}
+				_, _, err = issuer.ExchangeRefreshToken(refresh)
+			}
+			if err != tc.want_err {
+				t.Fatalf("Exchange got %v, want %v.", err, tc.want_err)
+			}
+			if err != nil {
+				return
+			}
+			if next == refresh {
+				t.Fatal("Refresh token not rotated.")
+			}
+
+			parsed, err := jwt.Parse(access, func(*jwt.Token) (interface{}, error) {
+				return &testIssuerKey.PublicKey, nil
+			})
+			if err != nil {
+				t.Fatalf("Invalid access token. Err:%s", err)
+			}
+			got := parsed.Claims.(jwt.MapClaims)
+			if got["sub"] != "user1" {
+				t.Fatalf("Access token for %v, want user1.", got["sub"])
+			}
+			for k, v := range tc.claims {
+				if k == "sub" || k == "exp" {
+					continue
+				}
+				if got[k] != v {
+					t.Fatalf("Claim %s is %v, want %v.", k, got[k], v)
+				}
+			}
+
+			// The rotated token works in turn, and carries the claims on.
+			access, _, err = issuer.ExchangeRefreshToken(next)
+			if err != nil {
+				t.Fatalf("Exchanging the rotated token failed. Err:%s", err)
+			}
+			parsed, _ = jwt.Parse(access, func(*jwt.Token) (interface{}, error) {
+				return &testIssuerKey.PublicKey, nil
+			})
+			for k, v := range tc.claims {
+				if k != "sub" && k != "exp" && parsed.Claims.(jwt.MapClaims)[k] != v {
+					t.Fatalf("Claim %s lost on the second rotation.", k)
+				}
+			}
+		})
+	}
+}
+
+// Only one of concurrent exchanges of a token gets a new one.
+func TestRefreshTokenConcurrentExchange(t *testing.T) {
+	issuer, _ := testTokenIssuer(t)
+	refresh, err := issuer.IssueRefreshToken("user1")
+	if err != nil {
+		t.Fatalf("Failed issuing. Err:%s", err)
+	}
+
+	const exchanges = 20
+	errs := make(chan error, exchanges)
+	var wg sync.WaitGroup
+	for i := 0; i < exchanges; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := issuer.ExchangeRefreshToken(refresh)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	ok := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			ok++
+		case ErrInvalidRefreshToken:
+		default:
+			t.Fatalf("Unexpected error %s.", err)
+		}
+	}
+	if ok != 1 {
+		t.Fatalf("%d exchanges succeeded, want 1.", ok)
+	}
+}
@@ -0,0 +1,96 @@
+package backend_utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Outgoing metadata which responses are assumed to vary by. Calls with
+// different values never share a cache entry.
+var ResponseCacheVaryMetadata = []string{"authorization", TENANT_MD_KEY}
+
+// WithResponseCache caches the responses of the methods with cache_ttl set
+// in their MethodConfig. Only use it for idempotent reads.
+func (c *GrpcClientConfig) WithResponseCache(cache Cache) *GrpcClientConfig {
+	c.response_cache = cache
+	return c
+}
+
+func (c *GrpcClientConfig) cacheTTLs() map[string]time.Duration {
+	ttls := map[string]time.Duration{}
+	for m, mc := range c.Methods {
+		if mc != nil && mc.CacheTTL.Duration > 0 {
+			ttls[m] = mc.CacheTTL.Duration
+		}
+	}
+	return ttls
+}
+
+// responseCacheKey hashes the method, the request and the metadata the
+// response may vary by. Requests are marshalled deterministically so that
+// map fields don't change the key.
+func responseCacheKey(ctx context.Context, method string, req proto.Message) (string, error) {
+
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(req); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write(buf.Bytes())
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for _, k := range ResponseCacheVaryMetadata {
+		for _, v := range md[k] {
+			h.Write([]byte{0})
+			h.Write([]byte(k + "=" + v))
+		}
+	}
+	return "rpc_cache:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func responseCacheInterceptor(cache Cache, ttls map[string]time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+		ttl, ok := ttls[method]
+		req_msg, is_req := req.(proto.Message)
+		reply_msg, is_reply := reply.(proto.Message)
+		if !ok || !is_req || !is_reply {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		key, err := responseCacheKey(ctx, method, req_msg)
+		if err != nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		// Identical calls missing together make one call, see
+		// GetOrFillContext.
+		filled := false
+		buf, err := GetOrFillContext(ctx, cache, key, ttl, func(ctx context.Context) ([]byte, error) {
+			if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+				return nil, err
+			}
+			filled = true
+			return proto.Marshal(reply_msg)
+		})
+		if filled {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = proto.Unmarshal(buf, reply_msg); err != nil {
+			reply_msg.Reset()
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,118 @@
+package backend_utils
+
+import (
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	DEFAULT_RETRY_INITIAL = 100 * time.Millisecond
+	DEFAULT_RETRY_MULTIPLIER = 2.0
+)
+
+// BackoffPolicy controls Retry. Attempts stop at whichever of MaxAttempts,
+// MaxElapsed and the context comes first; with none of them set Retry
+// tries till fn succeeds.
+type BackoffPolicy struct {
+	// Attempts including the first one. 0 means no limit.
+	MaxAttempts	int
+	// Wait after the first failure. Defaults to DEFAULT_RETRY_INITIAL.
+	Initial		time.Duration
+	// Cap on the wait. 0 means no cap.
+	Max		time.Duration
+	// Growth of the wait per attempt. Defaults to
+	// DEFAULT_RETRY_MULTIPLIER, 1 waits Initial every time.
+	Multiplier	float64
+	// Waits are randomized by +/- this fraction, e.g. 0.2, so that
+	// clients failing together don't retry together.
+	Jitter		float64
+	// No attempt is started after this long since the first. 0 means no
+	// limit.
+	MaxElapsed	time.Duration
+	// Reports whether an error is worth retrying. nil retries all errors
+	// but the ones wrapped by Permanent.
+	Retryable	func(error) bool
+	// Defaults to the package clock, see SetClock.
+	Clock		Clock
+}
+
+// Delay returns the wait after attempt failed, counting from 1, before
+// jitter.
+func (p *BackoffPolicy) Delay(attempt int) time.Duration {
+	d := p.Initial
+	if d <= 0 {
+		d = DEFAULT_RETRY_INITIAL
+	}
+	mult := p.Multiplier
+	if mult <= 0 {
+		mult = DEFAULT_RETRY_MULTIPLIER
+	}
+	f := float64(d)
+	for i := 1; i < attempt; i++ {
+		f *= mult
+		if p.Max > 0 && f >= float64(p.Max) {
+			return p.Max
+		}
+	}
+	if p.Max > 0 && time.Duration(f) > p.Max {
+		return p.Max
+	}
+	return time.Duration(f)
+}
+
+func (p *BackoffPolicy) jittered(d time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + p.Jitter * (rand.Float64() * 2 - 1)))
+}
+
+type permanentError struct {
+	err	error
+}
+
+func (p *permanentError) Error() string {
+	return p.err.Error()
+}
+
+// Permanent wraps err so that Retry returns it, unwrapped, without further
+// attempts.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// Retry calls fn till it returns nil or the policy gives up, and returns
+// the last error of fn, also when ctx is done while waiting.
+func Retry(ctx context.Context, p BackoffPolicy, fn func(ctx context.Context) error) error {
+	clock := clockOr(p.Clock)
+	start := clock.Now()
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+		if perm, ok := err.(*permanentError); ok {
+			return perm.err
+		}
+		if p.Retryable != nil && !p.Retryable(err) {
+			return err
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return err
+		}
+		wait := p.jittered(p.Delay(attempt))
+		if p.MaxElapsed > 0 && clock.Since(start) + wait > p.MaxElapsed {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-clock.After(wait):
+		}
+	}
+}
@@ -2,18 +2,48 @@ package backend_utils
 
 import (
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"errors"
-	"log"
 	"io"
+	"math/rand"
+	"sync"
+	"time"
+	"golang.org/x/net/context"
 )
 
 const (
 	PKG_NAME = "RpcClientPool"
 	VERSION = "1.1"
+
+	// Weight given to endpoints which don't specify one.
+	DEFAULT_EP_WEIGHT = 100
+
+	// Time a heartbeat gets before the connection is treated as dead.
+	DEFAULT_HEARTBEAT_TIMEOUT = 2 * time.Second
+	// Heartbeats in a row which fail before the endpoint is reported down.
+	DEFAULT_HEARTBEAT_FAILURES = 3
+
+	// Pool modes. Eager dials all connections before the pool is returned,
+	// lazy dials them on Get as needed and async dials them in the
+	// background, see Ready.
+	POOL_EAGER = "eager"
+	POOL_LAZY = "lazy"
+	POOL_ASYNC = "async"
 )
 
 var (
 	ERR_FATAL error = errors.New("Fatal error.")
+
+	// Returned by GetConn when every endpoint has conn_per_ep connections
+	// and none of them is idle.
+	ErrPoolExhausted = errors.New("connection pool exhausted")
+	// Returned by GetConn when no endpoint could be dialed.
+	ErrAllEndpointsDown = errors.New("all endpoints down")
+	ErrPoolClosed = errors.New("connection pool closed")
+
+	// dial is at the connection limit of the endpoint.
+	errEndpointFull = errors.New("endpoint at connection limit")
 )
 
 type ConnEndpointInfo struct {
@@ -21,48 +51,385 @@ type ConnEndpointInfo struct {
 	CertFile string
 	ServerHostOverride string
 	ServerAddr string
+	// Fallback addresses, see GrpcClientConfig.ServerAddrs.
+	ServerAddrs []string
+	// Relative share of Get calls served by this endpoint.
+	Weight uint
+	// Proxy URL for this endpoint, see ProxyDialer.
+	Proxy string
+}
+
+// HeartbeatFunc checks that conn is usable. It should give up once ctx is
+// done.
+type HeartbeatFunc func(ctx context.Context, conn *grpc.ClientConn) error
+
+// LegacyHeartbeat adapts heartbeats which don't take a context. The pool
+// stops waiting on timeout, but fn itself keeps running till it returns.
+func LegacyHeartbeat(fn func(*grpc.ClientConn) error) HeartbeatFunc {
+	return func(ctx context.Context, conn *grpc.ClientConn) error {
+		done := make(chan error, 1)
+		go func() { done <- fn(conn) }()
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type PoolOptions struct {
+	// One of POOL_EAGER, POOL_LAZY or POOL_ASYNC. Defaults to POOL_EAGER.
+	Mode string
+	HeartbeatTimeout time.Duration
+	// Connections are redialed after about this long, so that calls spread
+	// over backends added behind a load balancer. 0 disables.
+	MaxConnAge time.Duration
+	// Idle connections unused for this long are closed. 0 disables.
+	MaxConnIdle time.Duration
+	// Number of endpoints Invoke tries before giving up. 0 means all.
+	FailoverEndpoints int
+	// Idle connections kept per endpoint. 0 keeps up to conn_per_ep.
+	MaxIdle int
+	// Get skips the heartbeat of connections checked within this long.
+	// 0 checks on every Get.
+	HeartbeatInterval time.Duration
+	// Heartbeats in a row which fail before the endpoint is reported
+	// down, see Watch. Defaults to DEFAULT_HEARTBEAT_FAILURES.
+	HeartbeatFailures int
+	// Overrides the dial timeout of the endpoints if set.
+	DialTimeout time.Duration
+	// Dialer for endpoints which set neither a dialer nor a proxy.
+	Dialer DialFunc
+	// Logger for the pool. Overrides the writer passed in.
+	Logger Logger
+	// Clock for heartbeats and connection ages. Defaults to the package
+	// clock, see SetClock.
+	Clock Clock
+	Hooks PoolHooks
+}
+
+// PoolHooks are called on pool events, e.g. to record metrics or add trace
+// annotations. Any of them may be nil. ep is the endpoint the connection
+// belongs to as passed to the pool. Hooks run inline, so they should be
+// quick.
+type PoolHooks struct {
+	OnGet func(ep interface{}, conn *grpc.ClientConn)
+	OnPut func(ep interface{}, conn *grpc.ClientConn)
+	OnDialFail func(ep interface{}, err error)
+	OnHeartbeatFail func(ep interface{}, conn *grpc.ClientConn, err error)
+	// Called on endpoint up/down transitions, see Watch.
+	OnEndpointState func(ep interface{}, up bool, err error)
+}
+
+type connInfo struct {
+	expires time.Time
+	last_used time.Time
+	last_checked time.Time
+	// Handed out by Get and not Put back yet.
+	in_use bool
 }
 
 type RpcClientPool struct {
-	doHeartBeat func(*grpc.ClientConn) error
-	conn_pool chan *grpc.ClientConn
+	doHeartBeat HeartbeatFunc
+	heartbeat_timeout time.Duration
+	mode string
+	conn_per_ep int
+	ready chan struct{}
+	// Guards ep_conns, conn_info, conn_endpoints, ep_up, hb_fails, watchers
+	// and the closed and pool_created flags. endpoints_map, ep_pools and ep_weights are only
+	// written by createPool, before the pool is shared.
+	mtx sync.Mutex
+	// Connections dialed per endpoint, idle or not.
+	ep_conns map[int] int
+	conn_info map[*grpc.ClientConn] *connInfo
+	max_conn_age time.Duration
+	max_conn_idle time.Duration
+	failover_eps int
+	max_idle int
+	heartbeat_interval time.Duration
+	max_hb_fails int
+	// Heartbeats failed in a row per endpoint.
+	hb_fails map[int] int
+	dial_timeout time.Duration
+	dialer DialFunc
+	hooks PoolHooks
+	stop_recycler chan struct{}
+	ep_pools map[int] chan *grpc.ClientConn
+	ep_weights map[int] uint
+	total_weight uint
 	conn_endpoints map[*grpc.ClientConn] int
 	endpoints_map map[int] interface{}
-	elog *log.Logger
-	ilog *log.Logger
+	// Last known state of the endpoints, see Watch.
+	ep_up map[int] bool
+	watchers map[chan EndpointState] bool
+	stop_watch chan struct{}
+	logger Logger
+	clock Clock
 	pool_created bool
+	closed bool
 }
 
 func (r *RpcClientPool) createPool(endpoints []interface{}, conn_per_ep int) error {
 
 	if len(endpoints) == 0 || conn_per_ep == 0 {
-		r.elog.Println("Failed creating conn pool.")
+		r.logger.Errorf("Failed creating conn pool.")
 		return ERR_FATAL
 	}
 
+	r.conn_per_ep = conn_per_ep
 	r.conn_endpoints = make(map[*grpc.ClientConn] int, conn_per_ep * len(endpoints))
-	r.conn_pool = make(chan *grpc.ClientConn, conn_per_ep * len(endpoints))
+	r.ep_pools = make(map[int] chan *grpc.ClientConn, len(endpoints))
+	r.ep_weights = make(map[int] uint, len(endpoints))
+	r.ep_conns = make(map[int] int, len(endpoints))
+	r.conn_info = make(map[*grpc.ClientConn] *connInfo, conn_per_ep * len(endpoints))
 	r.endpoints_map = make(map[int] interface{}, len(endpoints))
+	r.ep_up = make(map[int] bool, len(endpoints))
+	r.hb_fails = make(map[int] int, len(endpoints))
+	r.ready = make(chan struct{})
 
 	for i := range endpoints {
 		r.endpoints_map[i] = endpoints[i]
-		for j := 0; j < conn_per_ep; j++ {
-			new_conn, err := r.newRPCConn(endpoints[i])
+		r.ep_pools[i] = make(chan *grpc.ClientConn, conn_per_ep)
+		r.ep_weights[i] = endpointWeight(endpoints[i])
+		r.total_weight += r.ep_weights[i]
+	}
+
+	switch r.mode {
+	case POOL_LAZY:
+		close(r.ready)
+	case POOL_ASYNC:
+		go func() {
+			r.warmUp()
+			close(r.ready)
+		}()
+	default:
+		r.warmUp()
+		close(r.ready)
+		if r.connCount() == 0 {
+			r.logger.Errorf("Failed creating any connection.")
+			return ERR_FATAL
+		}
+	}
+	if r.max_conn_age > 0 || r.max_conn_idle > 0 {
+		r.stop_recycler = make(chan struct{})
+		go r.recycler()
+	}
+	r.mtx.Lock()
+	r.pool_created = true
+	r.mtx.Unlock()
+	return nil
+}
+
+func (r *RpcClientPool) created() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.pool_created
+}
+
+func (r *RpcClientPool) warmUp() {
+	for i := range r.endpoints_map {
+		for j := 0; j < r.conn_per_ep; j++ {
+			new_conn, err := r.dial(i)
 			if err != nil {
-				r.elog.Printf("Failed creating connection Ep: %+v. Err:%s\n", endpoints[i], err.Error())
+				r.logger.Errorf("Failed creating connection Ep: %+v. Err:%s\n", r.endpoints_map[i], err.Error())
 				continue
 			}
-			r.conn_endpoints[new_conn] = i
-			r.Put(new_conn)
-			r.ilog.Printf("Successfully created new connection to Ep:%+v\n", endpoints[i])
+			r.put(new_conn)
+			r.logger.Infof("Successfully created new connection to Ep:%+v\n", r.endpoints_map[i])
 		}
 	}
-	if len(r.conn_endpoints) == 0 {
-		r.elog.Println("Failed creating any connection.")
-		return ERR_FATAL
+}
+
+func (r *RpcClientPool) connCount() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return len(r.conn_endpoints)
+}
+
+// Ready is closed once the pool has dialed its connections. For lazy pools
+// it is closed right away.
+func (r *RpcClientPool) Ready() <-chan struct{} {
+	return r.ready
+}
+
+// dial makes a new connection to endpoint ep if it has less than
+// conn_per_ep connections.
+func (r *RpcClientPool) dial(ep int) (*grpc.ClientConn, error) {
+
+	r.mtx.Lock()
+	if r.closed {
+		r.mtx.Unlock()
+		return nil, ErrPoolClosed
+	}
+	if r.ep_conns[ep] >= r.conn_per_ep {
+		r.mtx.Unlock()
+		return nil, errEndpointFull
+	}
+	// Reserve the slot so that concurrent dials don't go over the limit.
+	r.ep_conns[ep]++
+	r.mtx.Unlock()
+
+	conn, err := r.newRPCConn(r.endpoints_map[ep])
+
+	if err != nil {
+		if r.hooks.OnDialFail != nil {
+			r.hooks.OnDialFail(r.endpoints_map[ep], err)
+		}
+		r.mtx.Lock()
+		r.ep_conns[ep]--
+		r.mtx.Unlock()
+		r.setEndpointState(ep, false, err)
+		return nil, err
+	}
+	r.markUp(ep)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.conn_endpoints[conn] = ep
+	now := r.clock.Now()
+	info := &connInfo{last_used: now, last_checked: now}
+	if r.max_conn_age > 0 {
+		// +/- 10% jitter so that connections dialed together don't all
+		// expire together.
+		jitter := time.Duration((rand.Float64() * 0.2 - 0.1) * float64(r.max_conn_age))
+		info.expires = now.Add(r.max_conn_age + jitter)
+	}
+	r.conn_info[conn] = info
+	return conn, nil
+}
+
+func (r *RpcClientPool) expired(conn *grpc.ClientConn, now time.Time) (aged, idle bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	info, ok := r.conn_info[conn]
+	if !ok {
+		return false, false
+	}
+	aged = !info.expires.IsZero() && now.After(info.expires)
+	idle = r.max_conn_idle > 0 && now.Sub(info.last_used) > r.max_conn_idle
+	return
+}
+
+// recycler periodically goes over the idle connections. Aged ones are
+// replaced by new connections, ones idle for too long are just closed.
+func (r *RpcClientPool) recycler() {
+
+	interval := r.max_conn_age
+	if interval == 0 || (r.max_conn_idle > 0 && r.max_conn_idle < interval) {
+		interval = r.max_conn_idle
+	}
+	ticker := r.clock.NewTicker(interval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop_recycler:
+			return
+		case <-ticker.C():
+		}
+
+		now := r.clock.Now()
+		for ep := range r.ep_pools {
+			for n := len(r.ep_pools[ep]); n > 0; n-- {
+				var conn *grpc.ClientConn
+				select {
+				case conn = <- r.ep_pools[ep]:
+				default:
+				}
+				if conn == nil {
+					break
+				}
+				aged, idle := r.expired(conn, now)
+				if !aged && !idle {
+					// Not Put, which would reset its idle time.
+					select {
+					case r.ep_pools[ep] <- conn:
+					default:
+						r.forget(conn)
+					}
+					continue
+				}
+				r.forget(conn)
+				if aged && !idle {
+					r.redial(ep)
+				}
+			}
+		}
 	}
-	r.pool_created = true
-	return nil
+}
+
+// Retries of the redial replacing an aged connection.
+var redialBackoff = BackoffPolicy{MaxAttempts: 3, Initial: 200 * time.Millisecond, Jitter: 0.2}
+
+// redial replaces a connection of ep closed for its age.
+func (r *RpcClientPool) redial(ep int) {
+	policy := redialBackoff
+	policy.Clock = r.clock
+	err := Retry(context.Background(), policy, func(ctx context.Context) error {
+		new_conn, err := r.dial(ep)
+		if err == ErrPoolClosed || err == errEndpointFull {
+			return Permanent(err)
+		}
+		if err == nil {
+			r.put(new_conn)
+		}
+		return err
+	})
+	if err != nil && err != ErrPoolClosed && err != errEndpointFull {
+		r.logger.Errorf("Failed replacing aged connection Ep: %+v. Err:%s\n", r.endpoints_map[ep], err.Error())
+	}
+}
+
+// forget drops conn from the pool and closes it.
+func (r *RpcClientPool) forget(conn *grpc.ClientConn) {
+	r.mtx.Lock()
+	ep, ok := r.conn_endpoints[conn]
+	if ok {
+		delete(r.conn_endpoints, conn)
+		delete(r.conn_info, conn)
+		r.ep_conns[ep]--
+	}
+	r.mtx.Unlock()
+	conn.Close()
+}
+
+func endpointWeight(ep interface{}) uint {
+	var weight uint
+	switch ep.(type) {
+	case ConnEndpointInfo:
+		weight = ep.(ConnEndpointInfo).Weight
+	case GrpcClientConfig:
+		weight = ep.(GrpcClientConfig).Weight
+	}
+	if weight == 0 {
+		weight = DEFAULT_EP_WEIGHT
+	}
+	return weight
+}
+
+// Endpoints are tried in a weighted random order, so each one serves
+// roughly its share of calls as long as it has idle connections.
+func (r *RpcClientPool) pickEndpoints() []int {
+	order := make([]int, 0, len(r.ep_pools))
+	remaining := r.total_weight
+	picked := make(map[int] bool, len(r.ep_pools))
+	for len(order) < len(r.ep_pools) {
+		n := uint(rand.Int63n(int64(remaining)))
+		for i := 0; i < len(r.ep_pools); i++ {
+			if picked[i] {
+				continue
+			}
+			if n < r.ep_weights[i] {
+				order = append(order, i)
+				picked[i] = true
+				remaining -= r.ep_weights[i]
+				break
+			}
+			n -= r.ep_weights[i]
+		}
+	}
+	return order
 }
 
 func (r *RpcClientPool) newRPCConn(ep interface{}) (*grpc.ClientConn, error) {
@@ -75,78 +442,382 @@ func (r *RpcClientPool) newRPCConn(ep interface{}) (*grpc.ClientConn, error) {
 			UseTls: ep.(ConnEndpointInfo).Tls,
 			ServerHostOverride: ep.(ConnEndpointInfo).ServerHostOverride,
 			ServerAddr: ep.(ConnEndpointInfo).ServerAddr,
+			ServerAddrs: ep.(ConnEndpointInfo).ServerAddrs,
+			Proxy: ep.(ConnEndpointInfo).Proxy,
 			UseJwt: false,
 		}
 		break
 	case GrpcClientConfig:
-		cli = &GrpcClientConfig{
-			UseTls: ep.(GrpcClientConfig).UseTls,
-			ServerHostOverride: ep.(GrpcClientConfig).ServerHostOverride,
-			ServerAddr: ep.(GrpcClientConfig).ServerAddr,
-			UseJwt: ep.(GrpcClientConfig).UseJwt,
-			JwtToken: ep.(GrpcClientConfig).JwtToken,
-		}
+		conf := ep.(GrpcClientConfig)
+		cli = &conf
+		cli.pool = r
 		break
 	}
+	if r.dial_timeout > 0 {
+		cli.DialTimeout = Duration{r.dial_timeout}
+	}
+	if cli.dialer == nil && len(cli.Proxy) == 0 {
+		cli.dialer = r.dialer
+	}
 
 	conn, err := cli.NewRPCConn()
 	if err != nil {
-		r.elog.Printf("Failed to dial. ERR:%s\n", err.Error())
+		r.logger.Errorf("Failed to dial. ERR:%s\n", err.Error())
 		return nil, err
 	}
 
-	r.ilog.Printf("Established new RPC connection to %s.\n", cli.ServerAddr)
+	r.logger.Infof("Established new RPC connection to %s.\n", cli.primaryAddr())
 	return conn, nil
 }
 
+// NewRpcClientPool is NewRpcClientPoolWithContext for heartbeats without a
+// context, using DEFAULT_HEARTBEAT_TIMEOUT.
 func NewRpcClientPool(do_heartbeat func(*grpc.ClientConn) error, endpoints []interface{},
 		      conn_per_ep int, logr_op io.Writer) *RpcClientPool {
+	return NewRpcClientPoolWithContext(LegacyHeartbeat(do_heartbeat), DEFAULT_HEARTBEAT_TIMEOUT,
+		endpoints, conn_per_ep, logr_op)
+}
+
+func NewRpcClientPoolWithContext(do_heartbeat HeartbeatFunc, heartbeat_timeout time.Duration,
+		endpoints []interface{}, conn_per_ep int, logr_op io.Writer) *RpcClientPool {
+	return NewRpcClientPoolWithOptions(do_heartbeat, endpoints, conn_per_ep, logr_op,
+		PoolOptions{HeartbeatTimeout: heartbeat_timeout})
+}
+
+func NewRpcClientPoolWithOptions(do_heartbeat HeartbeatFunc, endpoints []interface{}, conn_per_ep int,
+		logr_op io.Writer, opts PoolOptions) *RpcClientPool {
 	client_pool := new(RpcClientPool)
 	client_pool.doHeartBeat = do_heartbeat
-	client_pool.initLogger(logr_op)
+	client_pool.heartbeat_timeout = opts.HeartbeatTimeout
+	if client_pool.heartbeat_timeout <= 0 {
+		client_pool.heartbeat_timeout = DEFAULT_HEARTBEAT_TIMEOUT
+	}
+	client_pool.mode = opts.Mode
+	client_pool.max_conn_age = opts.MaxConnAge
+	client_pool.max_conn_idle = opts.MaxConnIdle
+	client_pool.failover_eps = opts.FailoverEndpoints
+	client_pool.max_idle = opts.MaxIdle
+	client_pool.heartbeat_interval = opts.HeartbeatInterval
+	client_pool.max_hb_fails = opts.HeartbeatFailures
+	if client_pool.max_hb_fails <= 0 {
+		client_pool.max_hb_fails = DEFAULT_HEARTBEAT_FAILURES
+	}
+	client_pool.dial_timeout = opts.DialTimeout
+	client_pool.dialer = opts.Dialer
+	client_pool.hooks = opts.Hooks
+	client_pool.clock = clockOr(opts.Clock)
+	client_pool.initLogger(logr_op, opts.Logger)
 	if err := client_pool.createPool(endpoints, conn_per_ep); err != nil {
-		client_pool.elog.Printf("Failed to create RPC pool. ERR:%s\n", err.Error())
+		client_pool.logger.Errorf("Failed to create RPC pool. ERR:%s\n", err.Error())
 		return nil
 	}
 	return client_pool
 }
 
-func (r *RpcClientPool) initLogger(logger_op io.Writer)  {
-	err_prefix := PKG_NAME + ":" + VERSION + "\tERROR\t"
-	info_prefix := PKG_NAME + ":" + VERSION + "\tINFO\t"
+// Logs go to logger if set, else to logger_op if set, else to the package
+// logger at the time of logging, so that a later SetLogger applies.
+func (r *RpcClientPool) initLogger(logger_op io.Writer, logger Logger) {
+	switch {
+	case logger != nil:
+		r.logger = logger
+	case logger_op != nil:
+		r.logger = NewWriterLogger(logger_op, PKG_NAME + ":" + VERSION)
+	default:
+		r.logger = pkgLogProxy{}
+	}
+}
+
+func (r *RpcClientPool) heartbeat(conn *grpc.ClientConn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.heartbeat_timeout)
+	defer cancel()
+	err := r.doHeartBeat(ctx, conn)
+	r.mtx.Lock()
+	ep, ok := r.conn_endpoints[conn]
+	if !ok {
+		r.mtx.Unlock()
+		return err
+	}
+	if err != nil {
+		r.hb_fails[ep]++
+		down := r.hb_fails[ep] >= r.max_hb_fails
+		r.mtx.Unlock()
+		if down {
+			r.setEndpointState(ep, false, err)
+		}
+		return err
+	}
+	if info, found := r.conn_info[conn]; found {
+		info.last_checked = r.clock.Now()
+	}
+	r.hb_fails[ep] = 0
+	r.mtx.Unlock()
+	r.setEndpointState(ep, true, nil)
+	return nil
+}
 
-	r.elog = log.New(logger_op, err_prefix, log.Ldate|log.Ltime|log.Lshortfile)
-	r.ilog = log.New(logger_op, info_prefix, log.Ldate|log.Ltime|log.Lshortfile)
+// markUp reports ep up after a dial or a READY connection, unless its
+// heartbeats keep failing. Only a heartbeat brings those back.
+func (r *RpcClientPool) markUp(ep int) {
+	r.mtx.Lock()
+	failing := r.max_hb_fails > 0 && r.hb_fails[ep] >= r.max_hb_fails
+	r.mtx.Unlock()
+	if !failing {
+		r.setEndpointState(ep, true, nil)
+	}
+}
+
+func (r *RpcClientPool) checkedRecently(conn *grpc.ClientConn) bool {
+	if r.heartbeat_interval <= 0 {
+		return false
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	info, ok := r.conn_info[conn]
+	return ok && r.clock.Since(info.last_checked) < r.heartbeat_interval
 }
 
+// GetConn returns an idle connection, dialing a new one if an endpoint has
+// less than conn_per_ep connections. If none is available it returns
+// ErrPoolExhausted, ErrAllEndpointsDown or ErrPoolClosed.
+func (r *RpcClientPool) GetConn() (*grpc.ClientConn, error) {
+	r.mtx.Lock()
+	closed := r.closed
+	r.mtx.Unlock()
+	if closed {
+		return nil, ErrPoolClosed
+	}
+	return r.get(nil)
+}
+
+// Get is GetConn returning nil if no connection is available.
+//
+// Deprecated: use GetConn, which says why.
 func (r *RpcClientPool) Get() *grpc.ClientConn {
-	if len(r.conn_endpoints) == 0 {
-		r.elog.Println("No more connections in map.")
-		return nil
+	conn, _ := r.GetConn()
+	return conn
+}
+
+// GetN returns n connections for fanning out calls, from distinct
+// endpoints as long as there are endpoints left with a connection
+// available. If n connections can't be had, the ones got are put back and
+// the error is returned. Return them with PutAll.
+func (r *RpcClientPool) GetN(n int) ([]*grpc.ClientConn, error) {
+	r.mtx.Lock()
+	closed := r.closed
+	r.mtx.Unlock()
+	if closed {
+		return nil, ErrPoolClosed
+	}
+
+	conns := make([]*grpc.ClientConn, 0, n)
+	used := make(map[int] bool, len(r.ep_pools))
+	for len(conns) < n {
+		if len(used) == len(r.ep_pools) {
+			used = make(map[int] bool, len(r.ep_pools))
+		}
+		conn, err := r.get(used)
+		if err != nil && len(used) > 0 {
+			// Share endpoints rather than fail.
+			used = make(map[int] bool, len(r.ep_pools))
+			continue
+		}
+		if err != nil {
+			r.PutAll(conns)
+			return nil, err
+		}
+		r.mtx.Lock()
+		used[r.conn_endpoints[conn]] = true
+		r.mtx.Unlock()
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// PutAll puts back the connections got with GetN.
+func (r *RpcClientPool) PutAll(conns []*grpc.ClientConn) {
+	for _, conn := range conns {
+		r.Put(conn)
+	}
+}
+
+func (r *RpcClientPool) endpointOf(conn *grpc.ClientConn) interface{} {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.endpoints_map[r.conn_endpoints[conn]]
+}
+
+func (r *RpcClientPool) gotConn(conn *grpc.ClientConn) (*grpc.ClientConn, error) {
+	r.mtx.Lock()
+	if info, ok := r.conn_info[conn]; ok {
+		info.in_use = true
+	}
+	r.mtx.Unlock()
+	if r.hooks.OnGet != nil {
+		r.hooks.OnGet(r.endpointOf(conn), conn)
+	}
+	return conn, nil
+}
+
+// get is Get skipping the endpoints in exclude.
+func (r *RpcClientPool) get(exclude map[int] bool) (*grpc.ClientConn, error) {
+	order := make([]int, 0, len(r.ep_pools))
+	for _, ep := range r.pickEndpoints() {
+		if !exclude[ep] {
+			order = append(order, ep)
+		}
 	}
 	var conn *grpc.ClientConn
-	select {
-	case conn = <- r.conn_pool:
-		if err := r.doHeartBeat(conn); err != nil {
-			ep := r.conn_endpoints[conn]
-			delete(r.conn_endpoints, conn)
-			conn, err = r.newRPCConn(r.endpoints_map[ep])
-			if err != nil {
-				r.elog.Printf("Failed to re-establish connection. Ep:%+v ERR:%s\n", ep, err.Error())
-				// Try to get another connection.
-				return r.Get()
+	for _, ep := range order {
+		select {
+		case conn = <- r.ep_pools[ep]:
+		default:
+			continue
+		}
+		break
+	}
+	if conn == nil {
+		// Exhausted if any endpoint is merely busy, down if all of them
+		// failed to dial.
+		get_err := ErrAllEndpointsDown
+		for _, ep := range order {
+			var err error
+			conn, err = r.dial(ep)
+			if err == nil {
+				return r.gotConn(conn)
+			}
+			if err == ErrPoolClosed {
+				return nil, err
+			}
+			if err == errEndpointFull {
+				get_err = ErrPoolExhausted
 			}
-			r.conn_endpoints[conn] = ep
 		}
-	default:
+		r.logger.Errorf("No more connections available. ERR:%s\n", get_err.Error())
+		return nil, get_err
 	}
-	return conn
+	if r.checkedRecently(conn) {
+		return r.gotConn(conn)
+	}
+	if err := r.heartbeat(conn); err != nil {
+		r.mtx.Lock()
+		ep := r.conn_endpoints[conn]
+		r.mtx.Unlock()
+		if r.hooks.OnHeartbeatFail != nil {
+			r.hooks.OnHeartbeatFail(r.endpoints_map[ep], conn, err)
+		}
+		r.forget(conn)
+		conn, err = r.dial(ep)
+		if err != nil {
+			r.logger.Errorf("Failed to re-establish connection. Ep:%+v ERR:%s\n", ep, err.Error())
+			// Try to get another connection.
+			return r.get(exclude)
+		}
+	}
+	return r.gotConn(conn)
 }
 
+// Invoke runs fn on a pooled connection. If fn fails with UNAVAILABLE, the
+// connection is dropped and fn is retried on a connection to a different
+// endpoint, up to FailoverEndpoints endpoints. The last error is returned.
+func (r *RpcClientPool) Invoke(ctx context.Context,
+		fn func(ctx context.Context, conn *grpc.ClientConn) error) error {
+
+	max_eps := r.failover_eps
+	if max_eps <= 0 || max_eps > len(r.ep_pools) {
+		max_eps = len(r.ep_pools)
+	}
+	tried := make(map[int] bool, max_eps)
+	var err error
+	for len(tried) < max_eps {
+		if ctx.Err() == context.Canceled {
+			return status.Error(codes.Canceled, ctx.Err().Error())
+		} else if ctx.Err() != nil {
+			return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+		}
+		conn, get_err := r.get(tried)
+		if get_err != nil {
+			if err == nil {
+				err = status.Error(codes.Unavailable, get_err.Error())
+			}
+			break
+		}
+		r.mtx.Lock()
+		ep := r.conn_endpoints[conn]
+		r.mtx.Unlock()
+		tried[ep] = true
+
+		err = fn(ctx, conn)
+		if status.Code(err) != codes.Unavailable {
+			r.Put(conn)
+			return err
+		}
+		r.logger.Errorf("Call failed on Ep:%+v, failing over. ERR:%s\n", r.endpoints_map[ep], err.Error())
+		r.forget(conn)
+	}
+	if err == nil {
+		err = status.Error(codes.Unavailable, ErrAllEndpointsDown.Error())
+	}
+	return err
+}
 
 func (r *RpcClientPool) Put(conn *grpc.ClientConn) {
+	if r.hooks.OnPut != nil {
+		r.hooks.OnPut(r.endpointOf(conn), conn)
+	}
+	r.put(conn)
+}
+
+// put is Put without the hook, for connections the pool dialed itself.
+func (r *RpcClientPool) put(conn *grpc.ClientConn) {
+	r.mtx.Lock()
+	ep, ok := r.conn_endpoints[conn]
+	closed := r.closed
+	if info, found := r.conn_info[conn]; found {
+		info.last_used = r.clock.Now()
+		info.in_use = false
+	}
+	r.mtx.Unlock()
+	if !ok {
+		return
+	}
+	if aged, _ := r.expired(conn, r.clock.Now()); closed || aged {
+		r.forget(conn)
+		return
+	}
+	if r.max_idle > 0 && len(r.ep_pools[ep]) >= r.max_idle {
+		r.forget(conn)
+		return
+	}
 	select {
-	case r.conn_pool <- conn:
+	case r.ep_pools[ep] <- conn:
 	default:
 	}
 }
+
+// Close closes all the idle connections. Connections which are checked out
+// are closed when they are Put back.
+func (r *RpcClientPool) Close() {
+	r.mtx.Lock()
+	if r.closed {
+		r.mtx.Unlock()
+		return
+	}
+	r.closed = true
+	r.pool_created = false
+	r.mtx.Unlock()
+	if r.stop_recycler != nil {
+		close(r.stop_recycler)
+	}
+	r.closeWatchers()
+	for ep := range r.ep_pools {
+		for {
+			select {
+			case conn := <- r.ep_pools[ep]:
+				r.forget(conn)
+				continue
+			default:
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package backend_utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Events queued for sending, more are dropped.
+const SENTRY_QUEUE_SIZE = 100
+
+// SentryReporter sends events to Sentry's store endpoint in the
+// background.
+type SentryReporter struct {
+	endpoint	string
+	auth		string
+	client		*http.Client
+	queue		chan *ErrorEvent
+}
+
+// NewSentryReporter parses dsn, https://<key>@<host>/<project id>.
+func NewSentryReporter(dsn string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	project := strings.Trim(u.Path, "/")
+	if u.User == nil || len(u.User.Username()) == 0 || len(project) == 0 {
+		return nil, fmt.Errorf("Invalid Sentry DSN.")
+	}
+	s := &SentryReporter{
+		endpoint: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		auth: fmt.Sprintf("Sentry sentry_version=7, sentry_client=backend_utils/%s, sentry_key=%s",
+			VERSION, u.User.Username()),
+		client: &http.Client{Timeout: 5 * time.Second},
+		queue: make(chan *ErrorEvent, SENTRY_QUEUE_SIZE),
+	}
+	go s.sender()
+	return s, nil
+}
+
+func (s *SentryReporter) Report(ev *ErrorEvent) {
+	select {
+	case s.queue <- ev:
+	default:
+	}
+}
+
+func (s *SentryReporter) sender() {
+	for ev := range s.queue {
+		if err := s.send(ev); err != nil {
+			// Not through the package logger, whose errors may be reported.
+			fmt.Fprintf(os.Stderr, "Failed to send event to Sentry. Err:%s\n", err.Error())
+		}
+	}
+}
+
+func (s *SentryReporter) send(ev *ErrorEvent) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	host, _ := os.Hostname()
+	body := map[string] interface{}{
+		"event_id": hex.EncodeToString(id),
+		"timestamp": ev.Time.UTC().Format("2006-01-02T15:04:05"),
+		"level": ev.Level,
+		"platform": "go",
+		"server_name": host,
+		"release": ev.Tags["release"],
+		"environment": ev.Tags["environment"],
+		"tags": ev.Tags,
+		"fingerprint": []string{ev.Fingerprint},
+		"exception": map[string] interface{}{
+			"values": []map[string] string{{"type": ev.Type, "value": ev.Message}},
+		},
+		"extra": map[string] string{"stack": string(ev.Stack)},
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Sentry returned %s.", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package backend_utils
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// ServerTransportConfig holds the connection level settings of the server.
+// Zero values keep the grpc defaults.
+type ServerTransportConfig struct {
+	// Streams, i.e. calls, served at once on a single connection.
+	MaxConcurrentStreams	uint32		`json:"max_concurrent_streams"`
+	// Connections accepted at once. Further ones wait to be accepted.
+	MaxConnections		int		`json:"max_connections"`
+	// Idle connections are closed after this long.
+	MaxConnectionIdle	Duration	`json:"max_connection_idle"`
+	// Connections are closed after this long, so that clients rebalance,
+	// giving calls in flight MaxConnectionAgeGrace to finish.
+	MaxConnectionAge	Duration	`json:"max_connection_age"`
+	MaxConnectionAgeGrace	Duration	`json:"max_connection_age_grace"`
+	// Ping idle clients after KeepaliveTime, closing the connection if
+	// there is no answer within KeepaliveTimeout.
+	KeepaliveTime		Duration	`json:"keepalive_time"`
+	KeepaliveTimeout	Duration	`json:"keepalive_timeout"`
+	// Clients pinging more often than this are disconnected.
+	MinPingInterval		Duration	`json:"min_ping_interval"`
+	PermitPingWithoutStream	bool		`json:"permit_ping_without_stream"`
+	// HTTP/2 flow control windows in bytes, per stream and per connection.
+	InitialWindowSize	int32		`json:"initial_window_size"`
+	InitialConnWindowSize	int32		`json:"initial_conn_window_size"`
+	MaxRecvMsgSize		int		`json:"max_recv_msg_size"`
+	MaxSendMsgSize		int		`json:"max_send_msg_size"`
+}
+
+func (t *ServerTransportConfig) serverOpts() []grpc.ServerOption {
+
+	var opts []grpc.ServerOption
+	if t.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(t.MaxConcurrentStreams))
+	}
+
+	params := keepalive.ServerParameters{
+		MaxConnectionIdle: t.MaxConnectionIdle.Duration,
+		MaxConnectionAge: t.MaxConnectionAge.Duration,
+		MaxConnectionAgeGrace: t.MaxConnectionAgeGrace.Duration,
+		Time: t.KeepaliveTime.Duration,
+		Timeout: t.KeepaliveTimeout.Duration,
+	}
+	if params != (keepalive.ServerParameters{}) {
+		opts = append(opts, grpc.KeepaliveParams(params))
+	}
+	if t.MinPingInterval.Duration > 0 || t.PermitPingWithoutStream {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime: t.MinPingInterval.Duration,
+			PermitWithoutStream: t.PermitPingWithoutStream,
+		}))
+	}
+
+	if t.InitialWindowSize > 0 {
+		opts = append(opts, grpc.InitialWindowSize(t.InitialWindowSize))
+	}
+	if t.InitialConnWindowSize > 0 {
+		opts = append(opts, grpc.InitialConnWindowSize(t.InitialConnWindowSize))
+	}
+	if t.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(t.MaxRecvMsgSize))
+	}
+	if t.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(t.MaxSendMsgSize))
+	}
+	return opts
+}
@@ -0,0 +1,33 @@
+package backend_utils
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Load balancing policies for GrpcClientConfig.LoadBalancing.
+const (
+	LB_PICK_FIRST = "pick_first"
+	LB_ROUND_ROBIN = "round_robin"
+)
+
+// serviceConfig returns the gRPC service config for the client, or "" if
+// neither ServiceConfig nor LoadBalancing is set. ServiceConfig wins if both
+// are.
+func (c *GrpcClientConfig) serviceConfig() (string, error) {
+
+	if len(c.ServiceConfig) > 0 {
+		if !json.Valid([]byte(c.ServiceConfig)) {
+			return "", fmt.Errorf("service_config of %s is not valid JSON", c.SvcName)
+		}
+		return c.ServiceConfig, nil
+	}
+
+	switch c.LoadBalancing {
+	case "":
+		return "", nil
+	case LB_PICK_FIRST, LB_ROUND_ROBIN:
+		return fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, c.LoadBalancing), nil
+	}
+	return "", fmt.Errorf("Unknown load_balancing policy %q of %s", c.LoadBalancing, c.SvcName)
+}
@@ -0,0 +1,161 @@
+package backend_utils
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata key carrying the session ID.
+const SESSION_MD_KEY = "session-id"
+
+var ErrSessionNotFound = errors.New("Session not found.")
+
+type Session struct {
+	ID		string			`json:"id"`
+	Subject		string			`json:"subject"`
+	Metadata	map[string]string	`json:"metadata"`
+	CreatedAt	time.Time		`json:"created_at"`
+	ExpiresAt	time.Time		`json:"expires_at"`
+}
+
+type SessionStore interface {
+	Create(subject string, md map[string]string, ttl time.Duration) (*Session, error)
+	// Get returns ErrSessionNotFound for unknown, expired and revoked sessions.
+	Get(id string) (*Session, error)
+	// Refresh extends the session to expire ttl from now.
+	Refresh(id string, ttl time.Duration) (*Session, error)
+	Revoke(id string) error
+}
+
+// CacheSessionStore keeps sessions in a Cache, e.g. NewMemoryCache for a
+// single instance or NewRedisCache for sessions shared between instances.
+type CacheSessionStore struct {
+	cache	Cache
+}
+
+func NewCacheSessionStore(cache Cache) *CacheSessionStore {
+	return &CacheSessionStore{cache: cache}
+}
+
+func (s *CacheSessionStore) save(sess *Session) error {
+	buf, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return s.cache.Set("session:" + sess.ID, buf, sess.ExpiresAt.Sub(pkgClock().Now()))
+}
+
+func (s *CacheSessionStore) Create(subject string, md map[string]string, ttl time.Duration) (*Session, error) {
+
+	id, err := NewUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := pkgClock().Now()
+	sess := &Session{
+		ID: id,
+		Subject: subject,
+		Metadata: md,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	return sess, s.save(sess)
+}
+
+func (s *CacheSessionStore) Get(id string) (*Session, error) {
+
+	buf, err := s.cache.Get("session:" + id)
+	if err == ErrCacheMiss {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sess := new(Session)
+	err = json.Unmarshal(buf, sess)
+	if err != nil {
+		return nil, err
+	}
+	if pkgClock().Now().After(sess.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+func (s *CacheSessionStore) Refresh(id string, ttl time.Duration) (*Session, error) {
+	sess, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	sess.ExpiresAt = pkgClock().Now().Add(ttl)
+	return sess, s.save(sess)
+}
+
+func (s *CacheSessionStore) Revoke(id string) error {
+	return s.cache.Delete("session:" + id)
+}
+
+type sessionKey struct{}
+
+// SessionFromContext returns the session resolved by the session interceptor.
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	sess, ok := ctx.Value(sessionKey{}).(*Session)
+	return sess, ok
+}
+
+// Calls without a session ID are let through, so that sessions can be used
+// alongside JWT. Calls with an unknown or expired session are rejected.
+func resolveSession(ctx context.Context, store SessionStore) (context.Context, error) {
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md[SESSION_MD_KEY]) == 0 {
+		return ctx, nil
+	}
+
+	sess, err := store.Get(md[SESSION_MD_KEY][0])
+	if err == ErrSessionNotFound {
+		return nil, ErrUnauthenticated("Invalid session")
+	}
+	if err != nil {
+		return nil, ErrInternal("Failed reading session")
+	}
+	return context.WithValue(ctx, sessionKey{}, sess), nil
+}
+
+func SessionUnaryInterceptor(store SessionStore) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := resolveSession(ctx, store)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Wraps a ServerStream to hand a derived context to the handler.
+type wrappedServerStream struct {
+	grpc.ServerStream
+	ctx	context.Context
+}
+
+func (s *wrappedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func SessionStreamInterceptor(store SessionStore) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		ctx, err := resolveSession(ss.Context(), store)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
@@ -0,0 +1,135 @@
+package backend_utils
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"golang.org/x/net/context"
+)
+
+// SpiffeConfig takes the TLS identity of the service from the SPIFFE
+// workload API instead of cert files. SVIDs and trust bundles are rotated
+// by the workload API without restarting.
+type SpiffeConfig struct {
+	// Workload API socket, e.g. "unix:///run/spire/agent.sock". Defaults to
+	// SPIFFE_ENDPOINT_SOCKET from the environment.
+	SocketPath	string		`json:"socket_path"`
+	// SPIFFE IDs allowed as the peer, e.g. "spiffe://example.org/users". If
+	// empty, any peer of TrustDomain is.
+	AuthorizedIDs	[]string	`json:"authorized_ids"`
+	// Trust domain of the peers if AuthorizedIDs is empty. If both are
+	// empty, any peer with a valid SVID is allowed.
+	TrustDomain	string		`json:"trust_domain"`
+	// How long to wait for the first SVID. Defaults to
+	// DEFAULT_SPIFFE_TIMEOUT.
+	Timeout		Duration	`json:"timeout"`
+}
+
+const DEFAULT_SPIFFE_TIMEOUT = 10 * time.Second
+
+// X509 sources are shared by all the configs using the same socket, as
+// each one keeps a stream to the workload API open.
+var spiffeSources = struct {
+	sync.Mutex
+	m	map[string]*workloadapi.X509Source
+}{m: map[string]*workloadapi.X509Source{}}
+
+func spiffeSource(socket_path string, timeout time.Duration) (*workloadapi.X509Source, error) {
+	spiffeSources.Lock()
+	src, ok := spiffeSources.m[socket_path]
+	spiffeSources.Unlock()
+	if ok {
+		return src, nil
+	}
+
+	var opts []workloadapi.X509SourceOption
+	if len(socket_path) > 0 {
+		opts = append(opts, workloadapi.WithClientOptions(workloadapi.WithAddr(socket_path)))
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_SPIFFE_TIMEOUT
+	}
+	// Blocks till the first SVID is received, without holding the lock
+	// so that other sockets aren't held up.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	src, err := workloadapi.NewX509Source(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	spiffeSources.Lock()
+	defer spiffeSources.Unlock()
+	if prev, ok := spiffeSources.m[socket_path]; ok {
+		// Another config got there first.
+		src.Close()
+		return prev, nil
+	}
+	spiffeSources.m[socket_path] = src
+	return src, nil
+}
+
+// CloseSpiffeSources closes the workload API connections. Configs using
+// SPIFFE can't create new connections afterwards.
+func CloseSpiffeSources() {
+	spiffeSources.Lock()
+	defer spiffeSources.Unlock()
+
+	for path, src := range spiffeSources.m {
+		src.Close()
+		delete(spiffeSources.m, path)
+	}
+}
+
+func (s *SpiffeConfig) authorizer() (tlsconfig.Authorizer, error) {
+	if len(s.AuthorizedIDs) > 0 {
+		ids := make([]spiffeid.ID, 0, len(s.AuthorizedIDs))
+		for _, str := range s.AuthorizedIDs {
+			id, err := spiffeid.FromString(str)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return tlsconfig.AuthorizeOneOf(ids...), nil
+	}
+	if len(s.TrustDomain) > 0 {
+		td, err := spiffeid.TrustDomainFromString(s.TrustDomain)
+		if err != nil {
+			return nil, err
+		}
+		return tlsconfig.AuthorizeMemberOf(td), nil
+	}
+	return tlsconfig.AuthorizeAny(), nil
+}
+
+// ServerTLSConfig returns an mTLS config presenting the service's SVID and
+// verifying the clients' ones.
+func (s *SpiffeConfig) ServerTLSConfig() (*tls.Config, error) {
+	src, err := spiffeSource(s.SocketPath, s.Timeout.Duration)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := s.authorizer()
+	if err != nil {
+		return nil, err
+	}
+	return tlsconfig.MTLSServerConfig(src, src, auth), nil
+}
+
+// ClientTLSConfig returns an mTLS config presenting the service's SVID and
+// verifying the server's one.
+func (s *SpiffeConfig) ClientTLSConfig() (*tls.Config, error) {
+	src, err := spiffeSource(s.SocketPath, s.Timeout.Duration)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := s.authorizer()
+	if err != nil {
+		return nil, err
+	}
+	return tlsconfig.MTLSClientConfig(src, src, auth), nil
+}
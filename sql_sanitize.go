@@ -0,0 +1,63 @@
+package backend_utils
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Postgres truncates longer identifiers.
+const MAX_IDENT_LEN = 63
+
+var ErrInvalidIdent = errors.New("Invalid SQL identifier.")
+
+var identRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// ValidateIdent checks that name is a plain identifier, e.g. a database or
+// table name from config, so that it means the same quoted or not.
+func ValidateIdent(name string) error {
+	if len(name) > MAX_IDENT_LEN || !identRegexp.MatchString(name) {
+		return ErrInvalidIdent
+	}
+	return nil
+}
+
+// QuoteIdent quotes a Postgres identifier.
+func QuoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// QuoteQualifiedIdent quotes every part of a dotted name, e.g.
+// "schema.table".
+func QuoteQualifiedIdent(name string) string {
+	parts := strings.Split(name, ".")
+	for i := range parts {
+		parts[i] = QuoteIdent(parts[i])
+	}
+	return strings.Join(parts, ".")
+}
+
+// QuoteLiteral quotes a string literal, for the few statements which don't
+// take parameters. Use parameters everywhere else.
+func QuoteLiteral(s string) string {
+	s = strings.Replace(s, `'`, `''`, -1)
+	if strings.Contains(s, `\`) {
+		return `E'` + strings.Replace(s, `\`, `\\`, -1) + `'`
+	}
+	return `'` + s + `'`
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EscapeLike escapes the wildcards in s, so that it matches literally in a
+// LIKE pattern, e.g. "name LIKE $1" with EscapeLike(prefix) + "%".
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+var connValueEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// connValue quotes a value of a libpq connection string.
+func connValue(s string) string {
+	return `'` + connValueEscaper.Replace(s) + `'`
+}
@@ -0,0 +1,195 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Backoff between the checks of a dependency.
+var dependencyBackoff = BackoffPolicy{Initial: 500 * time.Millisecond, Max: 10 * time.Second, Jitter: 0.2}
+
+// Time each check of a dependency gets.
+const DEPENDENCY_CHECK_TIMEOUT = 5 * time.Second
+
+// WaitConfig lists the dependencies to wait for at startup, each with how
+// long to wait. Dependencies left out are not waited for.
+type WaitConfig struct {
+	Postgres	Duration		`json:"postgres"`
+	Redis		Duration		`json:"redis"`
+	// The lock service, e.g. ZooKeeper, at locker_config.address.
+	Locker		Duration		`json:"locker"`
+	// Client services by svc_name. At least one of their endpoints must
+	// accept connections.
+	Clients		map[string] Duration	`json:"clients"`
+}
+
+// Dependency is something a service needs before it can serve.
+type Dependency struct {
+	Name	string
+	// How long to keep checking.
+	Timeout	time.Duration
+	Check	func(ctx context.Context) error
+}
+
+// DependencyError lists the dependencies which were not reachable in
+// time, with their last errors.
+type DependencyError struct {
+	Errs	map[string] error
+}
+
+func (e *DependencyError) Error() string {
+	names := make([]string, 0, len(e.Errs))
+	for n := range e.Errs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, n := range names {
+		msgs[i] = n + ": " + e.Errs[n].Error()
+	}
+	return "Dependencies not reachable: " + strings.Join(msgs, "; ")
+}
+
+// WaitFor checks the dependencies in parallel, with backoff, till all of
+// them pass. It returns a *DependencyError naming the ones still failing
+// at their timeout, so that cold cluster starts wait instead of crash
+// looping.
+func WaitFor(ctx context.Context, deps ...Dependency) error {
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[string] error)
+	for _, d := range deps {
+		wg.Add(1)
+		go func(d Dependency) {
+			defer wg.Done()
+			policy := dependencyBackoff
+			policy.MaxElapsed = d.Timeout
+			attempt := 0
+			err := Retry(ctx, policy, func(ctx context.Context) error {
+				attempt++
+				check_ctx, cancel := context.WithTimeout(ctx, DEPENDENCY_CHECK_TIMEOUT)
+				defer cancel()
+				err := d.Check(check_ctx)
+				if err != nil {
+					pkgLog().Infof("Waiting for %s, attempt %d. Err:%s", d.Name, attempt, err.Error())
+				}
+				return err
+			})
+			if err != nil {
+				mtx.Lock()
+				errs[d.Name] = err
+				mtx.Unlock()
+				return
+			}
+			pkgLog().Infof("Dependency %s is reachable.", d.Name)
+		}(d)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return &DependencyError{Errs: errs}
+	}
+	return nil
+}
+
+func dialAny(ctx context.Context, addrs []string) error {
+	var d net.Dialer
+	err := errors.New("No addresses.")
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, "tcp", addr); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return err
+}
+
+// clientDialable dials the endpoint of conf within ctx. SPIFFE endpoints
+// only get a TCP dial, as the SVID is fetched with a timeout of its own.
+func clientDialable(ctx context.Context, conf GrpcClientConfig) error {
+	if conf.Spiffe != nil {
+		return dialAny(ctx, conf.addrs())
+	}
+	// A dial timeout makes NewRPCConn block till the connection is up.
+	conf.DialTimeout = Duration{DEPENDENCY_CHECK_TIMEOUT}
+	if deadline, ok := ctx.Deadline(); ok {
+		conf.DialTimeout.Duration = time.Until(deadline)
+	}
+	conn, err := conf.NewRPCConn()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// clientReachable dials the endpoints of svc till one connects.
+func (c *Configurations) clientReachable(ctx context.Context, svc string) error {
+	err := fmt.Errorf("No client config for %s.", svc)
+	for i := range c.ClientConfig {
+		if c.ClientConfig[i].SvcName != svc {
+			continue
+		}
+		if err = clientDialable(ctx, c.ClientConfig[i]); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Dependencies returns the checks of the dependencies in conf.
+func (c *Configurations) Dependencies(conf WaitConfig) []Dependency {
+	var deps []Dependency
+	if conf.Postgres.Duration > 0 {
+		deps = append(deps, Dependency{Name: "postgres", Timeout: conf.Postgres.Duration,
+			Check: func(ctx context.Context) error {
+				// The server, as the database may only be created on start.
+				db, err := sql.Open("postgres", c.PostgresDB.serverConnString())
+				if err != nil {
+					return err
+				}
+				defer db.Close()
+				return db.PingContext(ctx)
+			}})
+	}
+	if conf.Redis.Duration > 0 {
+		deps = append(deps, Dependency{Name: "redis", Timeout: conf.Redis.Duration,
+			Check: func(ctx context.Context) error {
+				client, err := c.RedisDB.NewClient()
+				if err != nil {
+					return err
+				}
+				return client.Close()
+			}})
+	}
+	if conf.Locker.Duration > 0 {
+		deps = append(deps, Dependency{Name: "locker", Timeout: conf.Locker.Duration,
+			Check: func(ctx context.Context) error {
+				return dialAny(ctx, c.Locker.Address)
+			}})
+	}
+	for svc, timeout := range conf.Clients {
+		if timeout.Duration <= 0 {
+			continue
+		}
+		svc := svc
+		deps = append(deps, Dependency{Name: "client " + svc, Timeout: timeout.Duration,
+			Check: func(ctx context.Context) error {
+				return c.clientReachable(ctx, svc)
+			}})
+	}
+	return deps
+}
+
+// WaitForDependencies blocks till the dependencies in conf are reachable,
+// see WaitFor.
+func (c *Configurations) WaitForDependencies(ctx context.Context, conf WaitConfig) error {
+	return WaitFor(ctx, c.Dependencies(conf)...)
+}
@@ -0,0 +1,215 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// Postgres allows at most this many bind parameters in a statement.
+const PQ_MAX_PARAMS = 65535
+
+var stmtCacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backend_utils_stmt_cache_total",
+	Help: "Prepared statement cache lookups, by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(stmtCacheCounter)
+}
+
+// StmtDB is a sql.DB which keeps prepared statements around, keyed by the
+// query text. Only use it with a bounded set of queries, statements are
+// never evicted.
+type StmtDB struct {
+	*sql.DB
+	mtx sync.Mutex
+	stmts map[string] *sql.Stmt
+}
+
+func NewStmtDB(db *sql.DB) *StmtDB {
+	return &StmtDB{DB: db, stmts: make(map[string] *sql.Stmt)}
+}
+
+// Stmt returns the prepared statement for query, preparing it on first use.
+// Statements are prepared without the lock held, so a slow prepare doesn't
+// hold up the other queries. Of concurrent prepares of a query the first
+// one stored is kept.
+func (d *StmtDB) Stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	d.mtx.Lock()
+	stmt, ok := d.stmts[query]
+	d.mtx.Unlock()
+	if ok {
+		stmtCacheCounter.WithLabelValues("hit").Inc()
+		return stmt, nil
+	}
+	stmtCacheCounter.WithLabelValues("miss").Inc()
+	stmt, err := d.DB.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if prev, ok := d.stmts[query]; ok {
+		stmt.Close()
+		return prev, nil
+	}
+	d.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (d *StmtDB) ExecStmt(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := d.Stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (d *StmtDB) QueryStmt(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := d.Stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+// QueryRowStmt is QueryRowContext using the cached statement. Preparing
+// errors are returned by Scan.
+func (d *StmtDB) QueryRowStmt(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	stmt, err := d.Stmt(ctx, query)
+	if err != nil {
+		// Let the DB return the same error through a Row.
+		return d.DB.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+// Close closes the cached statements and the DB.
+func (d *StmtDB) Close() error {
+	d.mtx.Lock()
+	for query, stmt := range d.stmts {
+		stmt.Close()
+		delete(d.stmts, query)
+	}
+	d.mtx.Unlock()
+	return d.DB.Close()
+}
+
+// InsertRows inserts rows into table using multi-row INSERT statements,
+// split so each stays under PQ_MAX_PARAMS. All rows go in one
+// transaction. It returns the number of rows inserted.
+func (d *StmtDB) InsertRows(ctx context.Context, table string, columns []string,
+	rows [][]interface{}) (int64, error) {
+
+	if len(rows) == 0 || len(columns) == 0 {
+		return 0, nil
+	}
+	if err := checkRowLengths(columns, rows); err != nil {
+		return 0, err
+	}
+	per_stmt := PQ_MAX_PARAMS / len(columns)
+
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	var inserted int64
+	for start := 0; start < len(rows); start += per_stmt {
+		end := start + per_stmt
+		if end > len(rows) {
+			end = len(rows)
+		}
+		query, args := multiRowInsert(table, columns, rows[start:end])
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		inserted += n
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return inserted, nil
+}
+
+func checkRowLengths(columns []string, rows [][]interface{}) error {
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return fmt.Errorf("Row %d has %d values for %d columns.", i, len(row), len(columns))
+		}
+	}
+	return nil
+}
+
+func multiRowInsert(table string, columns []string, rows [][]interface{}) (string, []interface{}) {
+	quoted := make([]string, len(columns))
+	for i := range columns {
+		quoted[i] = QuoteIdent(columns[i])
+	}
+
+	var b strings.Builder
+	b.WriteString("INSERT INTO " + QuoteIdent(table) + " (" + strings.Join(quoted, ", ") + ") VALUES ")
+	args := make([]interface{}, 0, len(rows) * len(columns))
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for j := range columns {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			args = append(args, row[j])
+			b.WriteString("$" + strconv.Itoa(len(args)))
+		}
+		b.WriteString(")")
+	}
+	return b.String(), args
+}
+
+// CopyRows loads rows into table using COPY, which is faster than
+// InsertRows for large batches but fails the whole batch on any conflict.
+func (d *StmtDB) CopyRows(ctx context.Context, table string, columns []string,
+	rows [][]interface{}) error {
+
+	if err := checkRowLengths(columns, rows); err != nil {
+		return err
+	}
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, row := range rows {
+		if _, err = stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	// Flushes the buffered rows.
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return err
+	}
+	if err = stmt.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
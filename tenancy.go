@@ -0,0 +1,187 @@
+package backend_utils
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata key carrying the tenant ID between services.
+const TENANT_MD_KEY = "tenant-id"
+
+var (
+	ErrNoTenant = errors.New("No tenant in context.")
+	ErrInvalidTenant = errors.New("Invalid tenant ID.")
+)
+
+var tenantRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,63}$`)
+
+type TenancyConfig struct {
+	Enabled		bool		`json:"enabled"`
+	// JWT claim holding the tenant ID. Defaults to "tenant".
+	Claim		string		`json:"claim"`
+	// Reject calls without a tenant.
+	Required	bool		`json:"required"`
+	// Callers which may name the tenant in TENANT_MD_KEY when their token
+	// has none, e.g. other services. Matched against CallerIdentities like
+	// AuthzRule.Callers. Others naming a tenant that way are denied.
+	MetadataCallers	[]string	`json:"metadata_callers"`
+}
+
+type tenantKey struct{}
+
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func TenantFromContext(ctx context.Context) (string, bool) {
+	t, ok := ctx.Value(tenantKey{}).(string)
+	return t, ok && len(t) > 0
+}
+
+// The JWT claim wins over the metadata. Metadata is only trusted when the
+// token doesn't name a tenant and the caller is one of MetadataCallers, e.g.
+// for calls between services.
+func (t *TenancyConfig) resolveTenant(ctx context.Context) (context.Context, error) {
+
+	claim := t.Claim
+	if len(claim) == 0 {
+		claim = "tenant"
+	}
+
+	var from_jwt, from_md string
+	if token, ok := ctx.Value("jwt_token").(*jwt.Token); ok {
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			from_jwt, _ = claims[claim].(string)
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md[TENANT_MD_KEY]) > 0 {
+		from_md = md[TENANT_MD_KEY][0]
+	}
+
+	tenant := from_jwt
+	if len(tenant) == 0 && len(from_md) > 0 {
+		if !t.metadataCaller(ctx) {
+			return nil, ErrPermissionDenied("Caller may not name the tenant")
+		}
+		tenant = from_md
+	} else if len(from_md) > 0 && from_md != from_jwt {
+		return nil, ErrPermissionDenied("Tenant does not match token")
+	}
+
+	if len(tenant) == 0 {
+		if t.Required {
+			return nil, ErrUnauthenticated("Tenant not specified")
+		}
+		return ctx, nil
+	}
+	if !tenantRegexp.MatchString(tenant) {
+		return nil, ErrInvalidArg("Invalid tenant")
+	}
+	return WithTenant(ctx, tenant), nil
+}
+
+func (t *TenancyConfig) metadataCaller(ctx context.Context) bool {
+	for _, id := range CallerIdentities(ctx, "") {
+		if matchesAny(t.MetadataCallers, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TenancyConfig) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := t.resolveTenant(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (t *TenancyConfig) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		ctx, err := t.resolveTenant(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// Adds the tenant in ctx, if any, to the outgoing metadata.
+func tenantClientInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if tenant, ok := TenantFromContext(ctx); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, TENANT_MD_KEY, tenant)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func tenantStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if tenant, ok := TenantFromContext(ctx); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, TENANT_MD_KEY, tenant)
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// TenantSchema is the Postgres schema used for the tenant in
+// schema-per-tenant setups.
+func TenantSchema(tenant string) string {
+	return "tenant_" + strings.ToLower(strings.Replace(tenant, "-", "_", -1))
+}
+
+// TenantConn is a DB connection scoped to the tenant of a request. Close
+// must be called to clear the tenant before the connection is reused.
+type TenantConn struct {
+	*sql.Conn
+	ctx	context.Context
+}
+
+// NewTenantConn takes a connection from db and sets the app.tenant_id
+// setting for row-level security policies. With schema_per_tenant, the
+// search_path is set to the TenantSchema as well.
+func NewTenantConn(ctx context.Context, db *sql.DB, schema_per_tenant bool) (*TenantConn, error) {
+
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	if !tenantRegexp.MatchString(tenant) {
+		return nil, ErrInvalidTenant
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.ExecContext(ctx, "SELECT set_config('app.tenant_id', $1, false)", tenant)
+	if err == nil && schema_per_tenant {
+		_, err = conn.ExecContext(ctx, "SET search_path TO " + QuoteIdent(TenantSchema(tenant)))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &TenantConn{Conn: conn, ctx: ctx}, nil
+}
+
+func (t *TenantConn) Close() error {
+	_, err := t.Conn.ExecContext(context.Background(), "RESET app.tenant_id; RESET search_path")
+	if err != nil {
+		// Don't hand a connection with the tenant still set back to the pool.
+		t.Conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	return t.Conn.Close()
+}
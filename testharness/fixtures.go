@@ -0,0 +1,224 @@
+package testharness
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aloknerurkar/backend_utils"
+	"gopkg.in/yaml.v2"
+)
+
+// Fixtures are rows to load keyed by table name. Each row maps column names
+// to values. Files look like
+//
+//	{"users": [{"id": 1, "name": "alice"}], "orders": [{"user_id": 1}]}
+//
+// or the same in YAML.
+type Fixtures map[string] []map[string] interface{}
+
+// LoadFixtureFile reads fixtures from a .json, .yaml or .yml file.
+func LoadFixtureFile(path string) (Fixtures, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := Fixtures{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var raw map[string] []map[string] interface{}
+		if err = yaml.Unmarshal(buf, &raw); err != nil {
+			return nil, err
+		}
+		f = raw
+	default:
+		if err = json.Unmarshal(buf, &f); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Tables returns the fixture tables ordered so that tables come after the
+// ones they reference through foreign keys.
+func (f Fixtures) Tables(db *sql.DB) ([]string, error) {
+
+	rows, err := db.Query(`
+		SELECT DISTINCT tc.table_name, ccu.table_name
+		FROM information_schema.table_constraints tc
+		JOIN information_schema.constraint_column_usage ccu
+		  ON tc.constraint_name = ccu.constraint_name
+		 AND tc.constraint_schema = ccu.constraint_schema
+		WHERE tc.constraint_type = 'FOREIGN KEY'
+		  AND tc.table_schema = ANY(current_schemas(false))`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deps := make(map[string] []string)
+	for rows.Next() {
+		var table, ref string
+		if err = rows.Scan(&table, &ref); err != nil {
+			return nil, err
+		}
+		if table != ref {
+			deps[table] = append(deps[table], ref)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(f))
+	for table := range f {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+
+	order := make([]string, 0, len(f))
+	state := make(map[string] int)
+	var visit func(string) error
+	visit = func(table string) error {
+		switch state[table] {
+		case 1:
+			return fmt.Errorf("foreign key cycle at table %s", table)
+		case 2:
+			return nil
+		}
+		state[table] = 1
+		for _, ref := range deps[table] {
+			if _, ok := f[ref]; !ok {
+				continue
+			}
+			if err := visit(ref); err != nil {
+				return err
+			}
+		}
+		state[table] = 2
+		order = append(order, table)
+		return nil
+	}
+	for _, table := range names {
+		if err = visit(table); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Load inserts the fixtures in foreign key order in one transaction.
+func (f Fixtures) Load(db *sql.DB) error {
+	order, err := f.Tables(db)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range order {
+		for _, row := range f[table] {
+			cols := make([]string, 0, len(row))
+			for col := range row {
+				cols = append(cols, col)
+			}
+			sort.Strings(cols)
+
+			quoted := make([]string, len(cols))
+			params := make([]string, len(cols))
+			args := make([]interface{}, len(cols))
+			for i, col := range cols {
+				quoted[i] = backend_utils.QuoteIdent(col)
+				params[i] = fmt.Sprintf("$%d", i + 1)
+				args[i] = row[col]
+			}
+			query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", backend_utils.QuoteIdent(table),
+				strings.Join(quoted, ", "), strings.Join(params, ", "))
+			if _, err = tx.Exec(query, args...); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("loading fixture into %s: %s", table, err.Error())
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Truncate empties tables, resetting their sequences. Tables referencing
+// them are emptied too.
+func Truncate(db *sql.DB, tables ...string) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(tables))
+	for i := range tables {
+		quoted[i] = backend_utils.QuoteIdent(tables[i])
+	}
+	_, err := db.Exec("TRUNCATE " + strings.Join(quoted, ", ") + " RESTART IDENTITY CASCADE")
+	return err
+}
+
+// LoadFixtures loads the fixture files for a test and truncates the tables
+// when it ends.
+func LoadFixtures(t testing.TB, db *sql.DB, paths ...string) {
+	all := Fixtures{}
+	for _, path := range paths {
+		f, err := LoadFixtureFile(path)
+		if err != nil {
+			t.Fatalf("Failed reading fixtures %s.ERR:%s", path, err)
+		}
+		for table, rows := range f {
+			all[table] = append(all[table], rows...)
+		}
+	}
+	if err := all.Load(db); err != nil {
+		t.Fatalf("Failed loading fixtures.ERR:%s", err)
+	}
+	t.Cleanup(func() {
+		tables := make([]string, 0, len(all))
+		for table := range all {
+			tables = append(tables, table)
+		}
+		if err := Truncate(db, tables...); err != nil {
+			t.Errorf("Failed truncating fixture tables.ERR:%s", err)
+		}
+	})
+}
+
+// EphemeralSchema creates a schema with a random name and returns a copy
+// of conf using it, so tests running in parallel don't see each other's
+// rows. The schema is dropped when the test ends.
+func EphemeralSchema(t testing.TB, conf *backend_utils.PostgresDBConfig) *backend_utils.PostgresDBConfig {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		t.Fatalf("Failed generating schema name.ERR:%s", err)
+	}
+	schema := "test_" + hex.EncodeToString(buf)
+
+	db, err := conf.OpenDB()
+	if err != nil {
+		t.Fatalf("Failed opening DB.ERR:%s", err)
+	}
+	if _, err = db.Exec("CREATE SCHEMA " + backend_utils.QuoteIdent(schema)); err != nil {
+		db.Close()
+		t.Fatalf("Failed creating schema.ERR:%s", err)
+	}
+
+	t.Cleanup(func() {
+		defer db.Close()
+		if _, err := db.Exec("DROP SCHEMA " + backend_utils.QuoteIdent(schema) + " CASCADE"); err != nil {
+			t.Errorf("Failed dropping schema %s.ERR:%s", schema, err)
+		}
+	})
+
+	schema_conf := *conf
+	schema_conf.SearchPath = schema
+	return &schema_conf
+}
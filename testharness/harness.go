@@ -0,0 +1,113 @@
+// Package testharness runs a service built with GrpcServerConfig in memory,
+// so unit tests don't need real ports, certificates or key files.
+package testharness
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"testing"
+	"time"
+	"github.com/aloknerurkar/backend_utils"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const bufSize = 1024 * 1024
+
+// The in-memory listener has no TLS, so there is no peer identity to take
+// from SPIFFE.
+var ErrSpiffeUnsupported = errors.New("SPIFFE is not supported by the test harness.")
+
+type Server struct {
+	Conf	*backend_utils.GrpcServerConfig
+	Srv	*grpc.Server
+	// Ephemeral key used to sign test JWTs. Only set if Conf.UseJwt.
+	PrivKey	*rsa.PrivateKey
+
+	lis	*bufconn.Listener
+}
+
+// NewServer builds the server from conf, lets register add the services and
+// starts serving on an in-memory listener. TLS is turned off, and confs
+// with spiffe set are rejected with ErrSpiffeUnsupported. If conf uses JWT,
+// a new key pair is generated in place of the configured key files. An auth
+// function set with WithAuthFunc is kept and sees the new key in Conf.PubKey.
+func NewServer(conf *backend_utils.GrpcServerConfig, register func(*grpc.Server)) (*Server, error) {
+
+	if conf.Spiffe != nil {
+		return nil, ErrSpiffeUnsupported
+	}
+
+	s := &Server{
+		Conf: conf,
+		lis: bufconn.Listen(bufSize),
+	}
+
+	conf.UseTls = false
+	if conf.UseJwt {
+		var err error
+		s.PrivKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		conf.WithPubKey(&s.PrivKey.PublicKey)
+	}
+
+	opts, err := conf.GetServerOpts()
+	if err != nil {
+		return nil, err
+	}
+
+	s.Srv = grpc.NewServer(opts...)
+	register(s.Srv)
+	go s.Srv.Serve(s.lis)
+
+	return s, nil
+}
+
+// Start is NewServer for tests. The server is stopped when the test ends.
+func Start(t testing.TB, conf *backend_utils.GrpcServerConfig, register func(*grpc.Server)) *Server {
+	s, err := NewServer(conf, register)
+	if err != nil {
+		t.Fatalf("Failed starting test server.ERR:%s", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Token returns a JWT for subject signed with the ephemeral key.
+func (s *Server) Token(subject string, ttl time.Duration) (string, error) {
+	return s.TokenWithClaims(jwt.MapClaims{
+		"sub": subject,
+		"exp": time.Now().Add(ttl).Unix(),
+	})
+}
+
+func (s *Server) TokenWithClaims(claims jwt.Claims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(s.PrivKey)
+}
+
+// Dial returns a client connection to the server. If token is not empty it is
+// sent with every call.
+func (s *Server) Dial(token string) (*grpc.ClientConn, error) {
+
+	opts := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return s.lis.Dial()
+		}),
+	}
+	if len(token) > 0 {
+		opts = append(opts, grpc.WithPerRPCCredentials(backend_utils.NewJwtCredentials(token)))
+	}
+	return grpc.DialContext(context.Background(), "bufnet", opts...)
+}
+
+func (s *Server) Close() {
+	s.Srv.Stop()
+	s.lis.Close()
+}
@@ -0,0 +1,122 @@
+package testharness
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aloknerurkar/backend_utils"
+	"github.com/ory/dockertest/v3"
+)
+
+const (
+	DEFAULT_PG_TAG = "13-alpine"
+	pgUser = "test"
+	pgPassword = "test"
+	pgDB = "test"
+)
+
+type PostgresOptions struct {
+	// Tag of the postgres image. Defaults to DEFAULT_PG_TAG.
+	Tag string
+	// Directory with .sql files run in name order once the DB is up.
+	MigrationsDir string
+	// Called after MigrationsDir is applied.
+	Migrate func(*sql.DB) error
+	// How long to wait for the DB to accept connections. Defaults to a
+	// minute.
+	StartTimeout time.Duration
+}
+
+// StartPostgres runs a disposable Postgres in docker and returns the config
+// to connect to it. The container is removed when the test ends. Tests are
+// skipped if docker is not available.
+func StartPostgres(t testing.TB, opts PostgresOptions) *backend_utils.PostgresDBConfig {
+
+	docker, err := dockertest.NewPool("")
+	if err != nil {
+		t.Skipf("Docker not available.ERR:%s", err)
+	}
+	if opts.StartTimeout > 0 {
+		docker.MaxWait = opts.StartTimeout
+	} else {
+		docker.MaxWait = time.Minute
+	}
+	tag := opts.Tag
+	if len(tag) == 0 {
+		tag = DEFAULT_PG_TAG
+	}
+
+	resource, err := docker.Run("postgres", tag, []string{
+		"POSTGRES_USER=" + pgUser,
+		"POSTGRES_PASSWORD=" + pgPassword,
+		"POSTGRES_DB=" + pgDB,
+	})
+	if err != nil {
+		t.Fatalf("Failed starting postgres container.ERR:%s", err)
+	}
+	t.Cleanup(func() {
+		if err := docker.Purge(resource); err != nil {
+			t.Errorf("Failed removing postgres container.ERR:%s", err)
+		}
+	})
+
+	port, err := strconv.Atoi(resource.GetPort("5432/tcp"))
+	if err != nil {
+		t.Fatalf("Bad postgres port.ERR:%s", err)
+	}
+	conf := &backend_utils.PostgresDBConfig{
+		Hostname: "localhost",
+		Port: port,
+		Username: pgUser,
+		Password: pgPassword,
+		DBName: pgDB,
+	}
+
+	var db *sql.DB
+	err = docker.Retry(func() error {
+		var err error
+		db, err = conf.OpenDB()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Postgres did not come up.ERR:%s", err)
+	}
+	defer db.Close()
+
+	if len(opts.MigrationsDir) > 0 {
+		if err = RunMigrations(db, opts.MigrationsDir); err != nil {
+			t.Fatalf("Failed running migrations.ERR:%s", err)
+		}
+	}
+	if opts.Migrate != nil {
+		if err = opts.Migrate(db); err != nil {
+			t.Fatalf("Failed running migrations.ERR:%s", err)
+		}
+	}
+	return conf
+}
+
+// RunMigrations executes the .sql files in dir in name order.
+func RunMigrations(db *sql.DB, dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if _, err = db.Exec(string(buf)); err != nil {
+			return fmt.Errorf("%s: %s", filepath.Base(file), err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package backend_utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSOptions restricts the TLS versions, cipher suites and curves used.
+// Unset fields keep the Go defaults.
+type TLSOptions struct {
+	// "1.2" or "1.3".
+	MinVersion		string		`json:"min_version"`
+	// Go names of the suites, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+	// Only apply up to TLS 1.2, TLS 1.3 suites are not configurable.
+	CipherSuites		[]string	`json:"cipher_suites"`
+	// "X25519", "P256", "P384" or "P521", in order of preference.
+	CurvePreferences	[]string	`json:"curve_preferences"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256": tls.CurveP256,
+	"P384": tls.CurveP384,
+	"P521": tls.CurveP521,
+}
+
+func (o *TLSOptions) apply(conf *tls.Config) error {
+
+	if len(o.MinVersion) > 0 {
+		v, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			return fmt.Errorf("Unknown TLS version %q", o.MinVersion)
+		}
+		conf.MinVersion = v
+	}
+
+	if len(o.CipherSuites) > 0 {
+		ids := make(map[string]uint16)
+		for _, s := range tls.CipherSuites() {
+			ids[s.Name] = s.ID
+		}
+		conf.CipherSuites = nil
+		for _, name := range o.CipherSuites {
+			id, ok := ids[name]
+			if !ok {
+				return fmt.Errorf("Unknown or insecure cipher suite %q", name)
+			}
+			conf.CipherSuites = append(conf.CipherSuites, id)
+		}
+	}
+
+	if len(o.CurvePreferences) > 0 {
+		conf.CurvePreferences = nil
+		for _, name := range o.CurvePreferences {
+			id, ok := tlsCurves[name]
+			if !ok {
+				return fmt.Errorf("Unknown curve %q", name)
+			}
+			conf.CurvePreferences = append(conf.CurvePreferences, id)
+		}
+	}
+	return nil
+}
+
+// TLSConfig returns the server's TLS config, from SPIFFE if set, else from
+// CertFile and KeyFile, restricted by TLS.
+func (c *GrpcServerConfig) TLSConfig() (*tls.Config, error) {
+
+	var conf *tls.Config
+	if c.Spiffe != nil {
+		var err error
+		conf, err = c.Spiffe.ServerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if err := c.TLS.apply(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// TLSConfig returns the client's TLS config, from SPIFFE if set, else
+// trusting CertFile or the system roots, restricted by TLS and checking
+// PinnedCertSHA256.
+func (c *GrpcClientConfig) TLSConfig() (*tls.Config, error) {
+
+	var conf *tls.Config
+	if c.Spiffe != nil {
+		var err error
+		conf, err = c.Spiffe.ClientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		conf = &tls.Config{ServerName: c.ServerHostOverride}
+		if c.CertFile != "" {
+			pem, err := ioutil.ReadFile(c.CertFile)
+			if err != nil {
+				return nil, err
+			}
+			conf.RootCAs = x509.NewCertPool()
+			if !conf.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificates found in %s", c.CertFile)
+			}
+		}
+	}
+	if err := c.TLS.apply(conf); err != nil {
+		return nil, err
+	}
+	if err := applyPins(conf, c.PinnedCertSHA256, c.PinOnly); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
@@ -0,0 +1,184 @@
+package backend_utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Token types of RFC 8693 used in exchanges.
+const (
+	TOKEN_TYPE_JWT = "urn:ietf:params:oauth:token-type:jwt"
+	TOKEN_TYPE_ACCESS = "urn:ietf:params:oauth:token-type:access_token"
+	GRANT_TYPE_TOKEN_EXCHANGE = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// Exchanged tokens are refreshed this long before they expire.
+const TOKEN_EXCHANGE_EXPIRY_MARGIN = 30 * time.Second
+
+// TokenExchangeConfig sets up the exchange of the caller's token for one
+// scoped to the downstream service, using an RFC 8693 token endpoint.
+type TokenExchangeConfig struct {
+	// Token endpoint of the STS.
+	Endpoint	string		`json:"endpoint"`
+	// Audience requested for the token. Defaults to svc_name.
+	Audience	string		`json:"audience"`
+	Scope		string		`json:"scope"`
+	ClientID	string		`json:"client_id"`
+	ClientSecret	string		`json:"client_secret" secret:"true"`
+	Timeout		Duration	`json:"timeout"`
+}
+
+type exchangedToken struct {
+	token	string
+	expires	time.Time
+}
+
+// TokenExchanger exchanges incoming user tokens for downstream ones and
+// caches them till they are about to expire.
+type TokenExchanger struct {
+	conf	TokenExchangeConfig
+	client	*http.Client
+
+	mtx	sync.Mutex
+	tokens	map[string]exchangedToken
+}
+
+func NewTokenExchanger(conf TokenExchangeConfig) *TokenExchanger {
+	timeout := conf.Timeout.Duration
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &TokenExchanger{
+		conf: conf,
+		client: &http.Client{Timeout: timeout},
+		tokens: map[string]exchangedToken{},
+	}
+}
+
+// Exchange returns the downstream token for subject_token.
+func (t *TokenExchanger) Exchange(ctx context.Context, subject_token string) (string, error) {
+
+	sum := sha256.Sum256([]byte(subject_token))
+	key := hex.EncodeToString(sum[:])
+
+	now := pkgClock().Now()
+	t.mtx.Lock()
+	cached, ok := t.tokens[key]
+	t.mtx.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	form := url.Values{
+		"grant_type": {GRANT_TYPE_TOKEN_EXCHANGE},
+		"subject_token": {subject_token},
+		"subject_token_type": {TOKEN_TYPE_JWT},
+		"requested_token_type": {TOKEN_TYPE_ACCESS},
+		"audience": {t.conf.Audience},
+	}
+	if len(t.conf.Scope) > 0 {
+		form.Set("scope", t.conf.Scope)
+	}
+
+	req, err := http.NewRequest("POST", t.conf.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(t.conf.ClientID) > 0 {
+		req.SetBasicAuth(t.conf.ClientID, t.conf.ClientSecret)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Token exchange failed with %s: %s", resp.Status, body)
+	}
+
+	var res struct {
+		AccessToken	string	`json:"access_token"`
+		ExpiresIn	int64	`json:"expires_in"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		return "", err
+	}
+	if len(res.AccessToken) == 0 {
+		return "", fmt.Errorf("Token exchange returned no access_token")
+	}
+
+	expires := now.Add(time.Duration(res.ExpiresIn) * time.Second - TOKEN_EXCHANGE_EXPIRY_MARGIN)
+	t.mtx.Lock()
+	for k, v := range t.tokens {
+		if now.After(v.expires) {
+			delete(t.tokens, k)
+		}
+	}
+	if expires.After(now) {
+		t.tokens[key] = exchangedToken{token: res.AccessToken, expires: expires}
+	}
+	t.mtx.Unlock()
+	return res.AccessToken, nil
+}
+
+// exchangeContext replaces the outgoing authorization with the exchanged
+// token of the caller. Calls made outside of serving one are left alone.
+func (t *TokenExchanger) exchangeContext(ctx context.Context) (context.Context, error) {
+
+	in, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(in["authorization"]) == 0 {
+		return ctx, nil
+	}
+	subject := strings.TrimPrefix(in["authorization"][0], "Bearer ")
+
+	token, err := t.Exchange(ctx, subject)
+	if err != nil {
+		pkgLog().Errorf("Token exchange for %s failed. Err:%s", t.conf.Audience, err.Error())
+		return nil, ErrUnauthenticated("Token exchange failed")
+	}
+
+	out, _ := metadata.FromOutgoingContext(ctx)
+	out = out.Copy()
+	out.Set("authorization", token)
+	return metadata.NewOutgoingContext(ctx, out), nil
+}
+
+func (t *TokenExchanger) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, err := t.exchangeContext(ctx)
+		if err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func (t *TokenExchanger) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, err := t.exchangeContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,141 @@
+package backend_utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+const (
+	TOTP_DIGITS = 6
+	TOTP_PERIOD = 30 * time.Second
+
+	// Tokens issued after the password check but before the TOTP code is
+	// verified carry this claim set to true. The auth interceptor only lets
+	// them call the methods in TotpPendingMethods.
+	TOTP_PENDING_CLAIM = "totp_pending"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTotpSecret returns a random base32 encoded secret.
+func NewTotpSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TotpProvisioningURI returns the otpauth:// URI to show as a QR code to
+// authenticator apps.
+func TotpProvisioningURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	v.Set("period", fmt.Sprint(int(TOTP_PERIOD.Seconds())))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation from RFC 4226.
+	off := sum[len(sum)-1] & 0x0f
+	val := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, val % mod)
+}
+
+// TotpCode returns the code for secret at time t.
+func TotpCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, uint64(t.Unix()) / uint64(TOTP_PERIOD.Seconds())), nil
+}
+
+// ValidateTotp accepts codes from up to drift periods before or after now,
+// to allow for clock skew and slow typing.
+func ValidateTotp(secret, code string, drift int) (bool, error) {
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return false, err
+	}
+
+	counter := int64(pkgClock().Now().Unix()) / int64(TOTP_PERIOD.Seconds())
+	ok := false
+	for i := -drift; i <= drift; i++ {
+		if counter + int64(i) < 0 {
+			continue
+		}
+		exp := totpCode(key, uint64(counter + int64(i)))
+		// Check all the windows so that timing doesn't leak which matched.
+		if subtle.ConstantTimeCompare([]byte(exp), []byte(code)) == 1 {
+			ok = true
+		}
+	}
+	return ok, nil
+}
+
+// TotpPending tells if the token still needs the TOTP code to be verified.
+func TotpPending(token *jwt.Token) bool {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+	pending, _ := claims[TOTP_PENDING_CLAIM].(bool)
+	return pending
+}
+
+func (c *GrpcServerConfig) checkTotpPending(ctx context.Context, token *jwt.Token) error {
+	if !TotpPending(token) {
+		return nil
+	}
+	method, _ := grpc.Method(ctx)
+	for _, m := range c.TotpPendingMethods {
+		if m == method {
+			return nil
+		}
+	}
+	return ErrUnauthenticated("Two-factor authentication required")
+}
+
+// totpAuthFunc checks the token auth puts in the context, so that custom
+// auth functions don't let tokens waiting for their TOTP code through.
+func (c *GrpcServerConfig) totpAuthFunc(auth func(context.Context) (context.Context, error)) func(context.Context) (context.Context, error) {
+	return func(ctx context.Context) (context.Context, error) {
+		new_ctx, err := auth(ctx)
+		if err != nil || new_ctx == nil {
+			return new_ctx, err
+		}
+		if token, ok := new_ctx.Value("jwt_token").(*jwt.Token); ok {
+			if err = c.checkTotpPending(ctx, token); err != nil {
+				return nil, err
+			}
+		}
+		return new_ctx, nil
+	}
+}
@@ -0,0 +1,131 @@
+package backend_utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"golang.org/x/net/context"
+	"golang.org/x/net/netutil"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Address prefixes understood by GrpcServerConfig.Address and
+// GrpcClientConfig.ServerAddr besides plain host:port.
+const (
+	// unix:///var/run/svc.sock
+	UNIX_ADDR_PREFIX = "unix://"
+	// inproc://name. Only reachable from the same process, e.g. for wiring
+	// several services together in one test binary.
+	INPROC_ADDR_PREFIX = "inproc://"
+)
+
+// Buffer size of in-process connections.
+const INPROC_BUFFER_SIZE = 1024 * 1024
+
+var inprocListeners = struct {
+	sync.Mutex
+	m	map[string]*inprocListener
+}{m: map[string]*inprocListener{}}
+
+type inprocListener struct {
+	*bufconn.Listener
+	name	string
+}
+
+// Close also frees the name for another listener.
+func (l *inprocListener) Close() error {
+	inprocListeners.Lock()
+	if inprocListeners.m[l.name] == l {
+		delete(inprocListeners.m, l.name)
+	}
+	inprocListeners.Unlock()
+	return l.Listener.Close()
+}
+
+func listenInProcess(name string) (net.Listener, error) {
+	inprocListeners.Lock()
+	defer inprocListeners.Unlock()
+
+	if _, ok := inprocListeners.m[name]; ok {
+		return nil, fmt.Errorf("In-process address %s already in use", name)
+	}
+	l := &inprocListener{Listener: bufconn.Listen(INPROC_BUFFER_SIZE), name: name}
+	inprocListeners.m[name] = l
+	return l, nil
+}
+
+func dialInProcess(name string) (net.Conn, error) {
+	inprocListeners.Lock()
+	l, ok := inprocListeners.m[name]
+	inprocListeners.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Nothing listening on %s%s", INPROC_ADDR_PREFIX, name)
+	}
+	return l.Dial()
+}
+
+// Listen listens on Address if set, else on Port on all interfaces. A stale
+// unix socket file left by an earlier run is removed first. At most
+// Transport.MaxConnections connections are accepted at once, if set.
+func (c *GrpcServerConfig) Listen() (net.Listener, error) {
+	lis, err := c.listen()
+	if err != nil || c.Transport.MaxConnections <= 0 {
+		return lis, err
+	}
+	return netutil.LimitListener(lis, c.Transport.MaxConnections), nil
+}
+
+func (c *GrpcServerConfig) listen() (net.Listener, error) {
+
+	switch {
+	case strings.HasPrefix(c.Address, UNIX_ADDR_PREFIX):
+		path := strings.TrimPrefix(c.Address, UNIX_ADDR_PREFIX)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	case strings.HasPrefix(c.Address, INPROC_ADDR_PREFIX):
+		return listenInProcess(strings.TrimPrefix(c.Address, INPROC_ADDR_PREFIX))
+	case len(c.Address) > 0:
+		return net.Listen("tcp", c.Address)
+	}
+	return net.Listen("tcp", fmt.Sprintf(":%d", c.Port))
+}
+
+// ListenAddr is the address Listen listens on, for logging.
+func (c *GrpcServerConfig) ListenAddr() string {
+	if len(c.Address) > 0 {
+		return c.Address
+	}
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+func isCustomTransport(addr string) bool {
+	return strings.HasPrefix(addr, UNIX_ADDR_PREFIX) || strings.HasPrefix(addr, INPROC_ADDR_PREFIX)
+}
+
+// dialTarget is the target to dial the server at. Unix and in-process
+// addresses are passed through to transportDialer as they are, whatever
+// resolvers the grpc version has. So are multiple addresses, which
+// fallbackDialer dials itself. xDS configs dial their xDS target.
+func (c *GrpcClientConfig) dialTarget() string {
+	if c.Xds != nil {
+		return c.Xds.target(c.SvcName)
+	}
+	addr := c.primaryAddr()
+	if isCustomTransport(addr) || len(c.addrs()) > 1 {
+		return "passthrough:///" + addr
+	}
+	return addr
+}
+
+func transportDialer(ctx context.Context, addr string) (net.Conn, error) {
+	if strings.HasPrefix(addr, INPROC_ADDR_PREFIX) {
+		return dialInProcess(strings.TrimPrefix(addr, INPROC_ADDR_PREFIX))
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", strings.TrimPrefix(addr, UNIX_ADDR_PREFIX))
+}
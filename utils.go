@@ -10,7 +10,7 @@ import (
 	"crypto/rand"
 	"net"
 	"errors"
-	"os/exec"
+	"golang.org/x/net/context"
 )
 
 // Generic Errors
@@ -131,21 +131,8 @@ func (c *CmdResult) String() string {
 	return result
 }
 
+// ExecCommand runs the command till it exits. See ExecCommandContext for
+// timeouts and streaming output.
 func ExecCommand(name string, args... string) (result *CmdResult) {
-
-	result = new(CmdResult)
-	cmd := exec.Command(name, args...)
-
-	var stdOut, stdErr bytes.Buffer
-	cmd.Stdout = &stdOut
-	cmd.Stderr = &stdErr
-
-	result.Err = cmd.Run()
-	if result.Err != nil {
-		return
-	}
-
-	result.StdOut = stdOut.String()
-	result.StdErr = stdErr.String()
-	return
-}
\ No newline at end of file
+	return ExecCommandContext(context.Background(), nil, name, args...)
+}
@@ -0,0 +1,111 @@
+package backend_utils
+
+import (
+	"reflect"
+	"sync"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type FieldViolation struct {
+	Field		string
+	Description	string
+}
+
+// ValidatorFunc checks business rules on a request. It returns all the
+// violations found, nil if the request is fine.
+type ValidatorFunc func(ctx context.Context, req interface{}) []FieldViolation
+
+// ValidatorRegistry keeps custom validators per message type. Requests are
+// first checked with their generated Validate() method, if any, and then by
+// all the validators registered for their type.
+type ValidatorRegistry struct {
+	mtx		sync.RWMutex
+	validators	map[reflect.Type] []ValidatorFunc
+}
+
+func NewValidatorRegistry() *ValidatorRegistry {
+	return &ValidatorRegistry{validators: make(map[reflect.Type] []ValidatorFunc)}
+}
+
+// Register adds fn for messages of the same type as msg, e.g.
+// reg.Register(&pb.CreateUserReq{}, checkUser).
+func (v *ValidatorRegistry) Register(msg interface{}, fn ValidatorFunc) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	t := reflect.TypeOf(msg)
+	v.validators[t] = append(v.validators[t], fn)
+}
+
+type validator interface {
+	Validate() error
+}
+
+// Validate returns an InvalidArgument error with a BadRequest detail listing
+// every violation, or nil.
+func (v *ValidatorRegistry) Validate(ctx context.Context, req interface{}) error {
+
+	var violations []FieldViolation
+	if vr, ok := req.(validator); ok {
+		if err := vr.Validate(); err != nil {
+			violations = append(violations, FieldViolation{Description: err.Error()})
+		}
+	}
+
+	v.mtx.RLock()
+	fns := v.validators[reflect.TypeOf(req)]
+	v.mtx.RUnlock()
+
+	for _, fn := range fns {
+		violations = append(violations, fn(ctx, req)...)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	br := &errdetails.BadRequest{}
+	for _, fv := range violations {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field: fv.Field,
+			Description: fv.Description,
+		})
+	}
+	st, err := status.New(codes.InvalidArgument, "Invalid request").WithDetails(br)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, violations[0].Description)
+	}
+	return st.Err()
+}
+
+func (v *ValidatorRegistry) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if err := v.Validate(ctx, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+type validatingServerStream struct {
+	grpc.ServerStream
+	reg	*ValidatorRegistry
+}
+
+func (s *validatingServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.reg.Validate(s.Context(), m)
+}
+
+// StreamInterceptor validates every message received on the stream.
+func (v *ValidatorRegistry) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		return handler(srv, &validatingServerStream{ServerStream: ss, reg: v})
+	}
+}
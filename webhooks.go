@@ -0,0 +1,571 @@
+package backend_utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	WEBHOOK_PENDING = "pending"
+	WEBHOOK_DELIVERED = "delivered"
+	WEBHOOK_FAILED = "failed"
+
+	// Header carrying the payload signature, see SignWebhook.
+	WEBHOOK_SIGNATURE_HEADER = "X-Webhook-Signature"
+	WEBHOOK_EVENT_HEADER = "X-Webhook-Event"
+	WEBHOOK_DELIVERY_HEADER = "X-Webhook-Delivery"
+
+	DEFAULT_WEBHOOK_ATTEMPTS = 8
+	DEFAULT_WEBHOOK_BACKOFF = 30 * time.Second
+	DEFAULT_WEBHOOK_POLL = 5 * time.Second
+	// Longest wait between attempts, however many there were.
+	MAX_WEBHOOK_BACKOFF = 24 * time.Hour
+)
+
+var (
+	ErrWebhookNotFound = errors.New("Webhook not found.")
+	ErrBadWebhookSignature = errors.New("Bad webhook signature.")
+)
+
+// WebhookEndpoint receives the events it subscribed to. An empty Events
+// list subscribes to everything.
+type WebhookEndpoint struct {
+	ID	int64
+	URL	string
+	Secret	string
+	Events	[]string
+	Active	bool
+}
+
+type WebhookDelivery struct {
+	ID		int64
+	EndpointID	int64
+	Event		string
+	Payload		[]byte
+	Status		string
+	Attempts	int
+	LastStatus	int
+	LastError	string
+	NextAttempt	time.Time
+	CreatedAt	time.Time
+}
+
+// WebhookAttempt records one try at sending a delivery. Attempt counts from
+// 1 again after a Redeliver, the earlier attempts are kept.
+type WebhookAttempt struct {
+	DeliveryID	int64
+	Attempt		int
+	// HTTP status of the response, 0 if none was received.
+	Status		int
+	Error		string
+	AttemptedAt	time.Time
+}
+
+type WebhookStore interface {
+	AddEndpoint(ep *WebhookEndpoint) error
+	RemoveEndpoint(id int64) error
+	Endpoint(id int64) (*WebhookEndpoint, error)
+	// Endpoints returns the active endpoints subscribed to event.
+	Endpoints(event string) ([]*WebhookEndpoint, error)
+
+	CreateDelivery(d *WebhookDelivery) error
+	UpdateDelivery(d *WebhookDelivery) error
+	Delivery(id int64) (*WebhookDelivery, error)
+	Deliveries(endpoint_id int64, limit int) ([]*WebhookDelivery, error)
+	// ClaimDue returns up to limit pending deliveries due by now and
+	// pushes their next attempt to now + lease, so other dispatchers
+	// don't pick them up meanwhile. now comes from the dispatcher's clock,
+	// the same one NextAttempt is set by.
+	ClaimDue(now time.Time, lease time.Duration, limit int) ([]*WebhookDelivery, error)
+
+	AddAttempt(a *WebhookAttempt) error
+	// Attempts returns the attempts at a delivery, oldest first.
+	Attempts(delivery_id int64) ([]*WebhookAttempt, error)
+}
+
+// SignWebhook returns the signature header value for payload sent at ts:
+// "t=<unix ts>,v1=<hex HMAC-SHA256 of "<ts>.<payload>">".
+func SignWebhook(secret string, ts time.Time, payload []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(payload)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks a signature made by SignWebhook, rejecting
+// ones older than tolerance to limit replays.
+func VerifyWebhookSignature(secret, header string, payload []byte, tolerance time.Duration) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sig = kv[1]
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sig) == 0 {
+		return ErrBadWebhookSignature
+	}
+	sent := time.Unix(unix, 0)
+	if tolerance > 0 && pkgClock().Since(sent) > tolerance {
+		return ErrBadWebhookSignature
+	}
+	expected := SignWebhook(secret, sent, payload)
+	if !hmac.Equal([]byte(expected[strings.Index(expected, "v1=") + 3:]), []byte(sig)) {
+		return ErrBadWebhookSignature
+	}
+	return nil
+}
+
+type WebhookOptions struct {
+	// Attempts before a delivery is marked failed. Defaults to
+	// DEFAULT_WEBHOOK_ATTEMPTS.
+	MaxAttempts	int
+	// Wait before the first retry, doubled on every further one up to
+	// MAX_WEBHOOK_BACKOFF. Defaults to DEFAULT_WEBHOOK_BACKOFF.
+	Backoff		time.Duration
+	// How often the store is checked for due deliveries. Defaults to
+	// DEFAULT_WEBHOOK_POLL.
+	PollInterval	time.Duration
+	// Concurrent deliveries. Defaults to 4.
+	Workers		int
+	// Timeout of each delivery request. Defaults to 10s.
+	Timeout		time.Duration
+}
+
+// WebhookDispatcher delivers events to the registered endpoints. Deliveries
+// are persisted before being sent, so they survive restarts, and retried
+// with exponential backoff till MaxAttempts.
+type WebhookDispatcher struct {
+	store		WebhookStore
+	opts		WebhookOptions
+	client		*http.Client
+	wake		chan struct{}
+	stop		chan struct{}
+	stop_once	sync.Once
+	wg		sync.WaitGroup
+	logger		Logger
+	clock		Clock
+}
+
+func NewWebhookDispatcher(store WebhookStore, opts WebhookOptions) *WebhookDispatcher {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DEFAULT_WEBHOOK_ATTEMPTS
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DEFAULT_WEBHOOK_BACKOFF
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DEFAULT_WEBHOOK_POLL
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	return &WebhookDispatcher{
+		store: store,
+		opts: opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+}
+
+// WithLogger logs delivery errors to l instead of the package logger.
+func (d *WebhookDispatcher) WithLogger(l Logger) *WebhookDispatcher {
+	d.logger = l
+	return d
+}
+
+// WithClock schedules and signs deliveries by c instead of the package
+// clock.
+func (d *WebhookDispatcher) WithClock(c Clock) *WebhookDispatcher {
+	d.clock = c
+	return d
+}
+
+// Publish queues payload for every endpoint subscribed to event.
+func (d *WebhookDispatcher) Publish(event string, payload []byte) error {
+	eps, err := d.store.Endpoints(event)
+	if err != nil {
+		return err
+	}
+	for _, ep := range eps {
+		err = d.store.CreateDelivery(&WebhookDelivery{
+			EndpointID: ep.ID,
+			Event: event,
+			Payload: payload,
+			Status: WEBHOOK_PENDING,
+			NextAttempt: clockOr(d.clock).Now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	d.poke()
+	return nil
+}
+
+// Redeliver sends a delivery again, e.g. after the receiver fixed a bug.
+// Failed deliveries get a fresh set of attempts.
+func (d *WebhookDispatcher) Redeliver(id int64) error {
+	del, err := d.store.Delivery(id)
+	if err != nil {
+		return err
+	}
+	del.Status = WEBHOOK_PENDING
+	del.Attempts = 0
+	del.NextAttempt = clockOr(d.clock).Now()
+	if err = d.store.UpdateDelivery(del); err != nil {
+		return err
+	}
+	d.poke()
+	return nil
+}
+
+// Attempts returns the attempts at delivery id, oldest first.
+func (d *WebhookDispatcher) Attempts(id int64) ([]*WebhookAttempt, error) {
+	return d.store.Attempts(id)
+}
+
+func (d *WebhookDispatcher) poke() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start begins delivering in the background till Stop.
+func (d *WebhookDispatcher) Start() {
+	d.wg.Add(1)
+	go d.run()
+}
+
+// Stop waits for the deliveries in flight. It can be called more than once.
+func (d *WebhookDispatcher) Stop() {
+	d.stop_once.Do(func() { close(d.stop) })
+	d.wg.Wait()
+}
+
+func (d *WebhookDispatcher) run() {
+	defer d.wg.Done()
+	ticker := clockOr(d.clock).NewTicker(d.opts.PollInterval)
+	defer ticker.Stop()
+	sem := make(chan struct{}, d.opts.Workers)
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C():
+		case <-d.wake:
+		}
+
+		// Only as many as can be sent right away are claimed, and the
+		// lease covers a full request, so a slow delivery isn't claimed
+		// again by another dispatcher. Finished workers poke for more.
+		free := d.opts.Workers - len(sem)
+		if free <= 0 {
+			continue
+		}
+		due, err := d.store.ClaimDue(clockOr(d.clock).Now(), 2 * d.opts.Timeout, free)
+		if err != nil {
+			loggerOr(d.logger).Errorf("Failed fetching due webhooks. Err:%s", err.Error())
+			continue
+		}
+		for _, del := range due {
+			sem <- struct{}{}
+			d.wg.Add(1)
+			go func(del *WebhookDelivery) {
+				defer func() { <-sem; d.poke(); d.wg.Done() }()
+				d.deliver(del)
+			}(del)
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliver(del *WebhookDelivery) {
+	attempted_at := clockOr(d.clock).Now()
+	ep, err := d.store.Endpoint(del.EndpointID)
+	if err == nil && !ep.Active {
+		err = errors.New("Endpoint inactive.")
+	}
+	del.LastStatus = 0
+	if err == nil {
+		del.LastStatus, err = d.post(ep, del)
+	}
+
+	del.Attempts++
+	attempt := &WebhookAttempt{
+		DeliveryID: del.ID,
+		Attempt: del.Attempts,
+		Status: del.LastStatus,
+		AttemptedAt: attempted_at,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	if aerr := d.store.AddAttempt(attempt); aerr != nil {
+		loggerOr(d.logger).Errorf("Failed recording webhook delivery %d attempt. Err:%s", del.ID, aerr.Error())
+	}
+	if err == nil {
+		del.Status = WEBHOOK_DELIVERED
+		del.LastError = ""
+	} else {
+		del.LastError = err.Error()
+		if del.Attempts >= d.opts.MaxAttempts {
+			del.Status = WEBHOOK_FAILED
+		} else {
+			del.NextAttempt = clockOr(d.clock).Now().Add(webhookBackoff(d.opts.Backoff, del.Attempts))
+		}
+	}
+	if err = d.store.UpdateDelivery(del); err != nil {
+		loggerOr(d.logger).Errorf("Failed updating webhook delivery %d. Err:%s", del.ID, err.Error())
+	}
+}
+
+// webhookBackoff is the wait after attempt, doubling base per attempt up to
+// MAX_WEBHOOK_BACKOFF.
+func webhookBackoff(base time.Duration, attempt int) time.Duration {
+	wait := base
+	for i := 1; i < attempt && wait < MAX_WEBHOOK_BACKOFF; i++ {
+		wait *= 2
+	}
+	if wait > MAX_WEBHOOK_BACKOFF {
+		wait = MAX_WEBHOOK_BACKOFF
+	}
+	return wait
+}
+
+func (d *WebhookDispatcher) post(ep *WebhookEndpoint, del *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, ep.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_HEADER, del.Event)
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, strconv.FormatInt(del.ID, 10))
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, SignWebhook(ep.Secret, clockOr(d.clock).Now(), del.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64 << 10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("Endpoint returned %s.", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// PostgresWebhookStore keeps endpoints, deliveries and their attempts in
+// the webhook_endpoints, webhook_deliveries and webhook_attempts tables.
+// Call CreateTable once before using it.
+type PostgresWebhookStore struct {
+	db	*sql.DB
+}
+
+func NewPostgresWebhookStore(db *sql.DB) *PostgresWebhookStore {
+	return &PostgresWebhookStore{db: db}
+}
+
+func (p *PostgresWebhookStore) CreateTable() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS webhook_endpoints (
+		id BIGSERIAL PRIMARY KEY,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT[] NOT NULL DEFAULT '{}',
+		active BOOLEAN NOT NULL DEFAULT TRUE)`)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		endpoint_id BIGINT NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+		event TEXT NOT NULL,
+		payload BYTEA NOT NULL,
+		status TEXT NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		last_status INT NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now())`)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`CREATE INDEX IF NOT EXISTS webhook_deliveries_due
+		ON webhook_deliveries (next_attempt) WHERE status = 'pending'`)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`CREATE TABLE IF NOT EXISTS webhook_attempts (
+		id BIGSERIAL PRIMARY KEY,
+		delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+		attempt INT NOT NULL,
+		status INT NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		attempted_at TIMESTAMPTZ NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`CREATE INDEX IF NOT EXISTS webhook_attempts_delivery
+		ON webhook_attempts (delivery_id)`)
+	return err
+}
+
+func (p *PostgresWebhookStore) AddEndpoint(ep *WebhookEndpoint) error {
+	return p.db.QueryRow("INSERT INTO webhook_endpoints (url, secret, events, active) " +
+		"VALUES ($1, $2, $3, $4) RETURNING id", ep.URL, ep.Secret, pq.Array(ep.Events),
+		ep.Active).Scan(&ep.ID)
+}
+
+func (p *PostgresWebhookStore) RemoveEndpoint(id int64) error {
+	_, err := p.db.Exec("DELETE FROM webhook_endpoints WHERE id = $1", id)
+	return err
+}
+
+func (p *PostgresWebhookStore) Endpoint(id int64) (*WebhookEndpoint, error) {
+	ep := new(WebhookEndpoint)
+	err := p.db.QueryRow("SELECT id, url, secret, events, active FROM webhook_endpoints WHERE id = $1",
+		id).Scan(&ep.ID, &ep.URL, &ep.Secret, pq.Array(&ep.Events), &ep.Active)
+	if err == sql.ErrNoRows {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ep, nil
+}
+
+func (p *PostgresWebhookStore) Endpoints(event string) ([]*WebhookEndpoint, error) {
+	rows, err := p.db.Query("SELECT id, url, secret, events, active FROM webhook_endpoints " +
+		"WHERE active AND (events = '{}' OR $1 = ANY(events))", event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var eps []*WebhookEndpoint
+	for rows.Next() {
+		ep := new(WebhookEndpoint)
+		if err = rows.Scan(&ep.ID, &ep.URL, &ep.Secret, pq.Array(&ep.Events), &ep.Active); err != nil {
+			return nil, err
+		}
+		eps = append(eps, ep)
+	}
+	return eps, rows.Err()
+}
+
+const webhookDeliveryCols = "id, endpoint_id, event, payload, status, attempts, last_status, " +
+	"last_error, next_attempt, created_at"
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]*WebhookDelivery, error) {
+	defer rows.Close()
+	var dels []*WebhookDelivery
+	for rows.Next() {
+		d := new(WebhookDelivery)
+		err := rows.Scan(&d.ID, &d.EndpointID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+			&d.LastStatus, &d.LastError, &d.NextAttempt, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		dels = append(dels, d)
+	}
+	return dels, rows.Err()
+}
+
+func (p *PostgresWebhookStore) CreateDelivery(d *WebhookDelivery) error {
+	return p.db.QueryRow("INSERT INTO webhook_deliveries (endpoint_id, event, payload, status, " +
+		"next_attempt) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at", d.EndpointID, d.Event,
+		d.Payload, d.Status, d.NextAttempt).Scan(&d.ID, &d.CreatedAt)
+}
+
+func (p *PostgresWebhookStore) UpdateDelivery(d *WebhookDelivery) error {
+	_, err := p.db.Exec("UPDATE webhook_deliveries SET status = $2, attempts = $3, last_status = $4, " +
+		"last_error = $5, next_attempt = $6 WHERE id = $1", d.ID, d.Status, d.Attempts, d.LastStatus,
+		d.LastError, d.NextAttempt)
+	return err
+}
+
+func (p *PostgresWebhookStore) Delivery(id int64) (*WebhookDelivery, error) {
+	rows, err := p.db.Query("SELECT " + webhookDeliveryCols + " FROM webhook_deliveries WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	dels, err := scanWebhookDeliveries(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(dels) == 0 {
+		return nil, ErrWebhookNotFound
+	}
+	return dels[0], nil
+}
+
+// Deliveries returns the latest deliveries to an endpoint, newest first.
+func (p *PostgresWebhookStore) Deliveries(endpoint_id int64, limit int) ([]*WebhookDelivery, error) {
+	rows, err := p.db.Query("SELECT " + webhookDeliveryCols + " FROM webhook_deliveries " +
+		"WHERE endpoint_id = $1 ORDER BY id DESC LIMIT $2", endpoint_id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func (p *PostgresWebhookStore) ClaimDue(now time.Time, lease time.Duration, limit int) ([]*WebhookDelivery, error) {
+	rows, err := p.db.Query("UPDATE webhook_deliveries SET next_attempt = $2 " +
+		"WHERE id IN (SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt <= $1 " +
+		"ORDER BY next_attempt LIMIT $3 FOR UPDATE SKIP LOCKED) RETURNING " + webhookDeliveryCols,
+		now, now.Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func (p *PostgresWebhookStore) AddAttempt(a *WebhookAttempt) error {
+	_, err := p.db.Exec("INSERT INTO webhook_attempts (delivery_id, attempt, status, error, attempted_at) " +
+		"VALUES ($1, $2, $3, $4, $5)", a.DeliveryID, a.Attempt, a.Status, a.Error, a.AttemptedAt)
+	return err
+}
+
+func (p *PostgresWebhookStore) Attempts(delivery_id int64) ([]*WebhookAttempt, error) {
+	rows, err := p.db.Query("SELECT delivery_id, attempt, status, error, attempted_at FROM webhook_attempts " +
+		"WHERE delivery_id = $1 ORDER BY id", delivery_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var attempts []*WebhookAttempt
+	for rows.Next() {
+		a := new(WebhookAttempt)
+		if err = rows.Scan(&a.DeliveryID, &a.Attempt, &a.Status, &a.Error, &a.AttemptedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
@@ -0,0 +1,78 @@
+package backend_utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	xdscreds "google.golang.org/grpc/credentials/xds"
+	// Registers the xds:/// resolver and the xDS balancers.
+	_ "google.golang.org/grpc/xds"
+)
+
+// XdsConfig takes the endpoints, load balancing and optionally the TLS
+// config of a client from an xDS control plane. Pools keep working as
+// before, each pooled connection balancing over the xDS endpoints.
+type XdsConfig struct {
+	// Target to dial. Defaults to "xds:///<svc_name>".
+	Target		string	`json:"target"`
+	// Bootstrap file naming the control plane. Defaults to the
+	// GRPC_XDS_BOOTSTRAP environment variable. grpc reads it once per
+	// process, so all the clients must use the same file.
+	BootstrapFile	string	`json:"bootstrap_file"`
+	// Use the security config from the control plane. The client's own
+	// TLS settings are used if it sends none.
+	UseXdsCreds	bool	`json:"use_xds_creds"`
+}
+
+func (x *XdsConfig) target(svc_name string) string {
+	if len(x.Target) > 0 {
+		return x.Target
+	}
+	return "xds:///" + svc_name
+}
+
+var (
+	xds_bootstrap_mtx	sync.Mutex
+	xds_bootstrap		string
+)
+
+// The bootstrap is read from the environment by grpc once per process, so
+// the first file set is used by every xDS client. Dialing with a different
+// one fails rather than silently using the first.
+func (x *XdsConfig) setBootstrap() error {
+	if len(x.BootstrapFile) == 0 {
+		return nil
+	}
+	xds_bootstrap_mtx.Lock()
+	defer xds_bootstrap_mtx.Unlock()
+	if len(xds_bootstrap) == 0 {
+		xds_bootstrap = x.BootstrapFile
+		return os.Setenv("GRPC_XDS_BOOTSTRAP", x.BootstrapFile)
+	}
+	if xds_bootstrap != x.BootstrapFile {
+		return fmt.Errorf("xDS bootstrap file %s conflicts with %s already in use.",
+			x.BootstrapFile, xds_bootstrap)
+	}
+	return nil
+}
+
+// xdsCredsOpt wraps the client's TLS config, or plaintext, as fallback of
+// the xDS credentials.
+func (c *GrpcClientConfig) xdsCredsOpt() (grpc.DialOption, error) {
+	fallback := insecure.NewCredentials()
+	if c.UseTls || c.Spiffe != nil {
+		conf, err := c.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		fallback = credentials.NewTLS(conf)
+	}
+	creds, err := xdscreds.NewClientCredentials(xdscreds.ClientOptions{FallbackCreds: fallback})
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(creds), nil
+}